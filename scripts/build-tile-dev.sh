@@ -1,6 +1,8 @@
 #!/usr/bin/env bash
 set -euo pipefail
 
+"$(dirname "$0")/write-build-info.sh"
+
 echo "==> Creating BOSH dev release (offline)..."
 bosh create-release --force --tarball=openclaw-release.tgz
 
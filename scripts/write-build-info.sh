@@ -0,0 +1,16 @@
+#!/usr/bin/env bash
+# Records the broker build info that the openclaw-broker package links in.
+# Usage: write-build-info.sh [version]   (defaults to `git describe`)
+set -euo pipefail
+
+cd "$(dirname "$0")/.."
+VERSION="${1:-$(git describe --tags --always --dirty 2>/dev/null || echo dev)}"
+COMMIT="$(git rev-parse --short HEAD 2>/dev/null || echo unknown)"
+BUILD_DATE="$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+
+cat > src/openclaw-broker/build-info.env <<INFO
+VERSION=${VERSION}
+COMMIT=${COMMIT}
+BUILD_DATE=${BUILD_DATE}
+INFO
+echo "==> Broker build info: ${VERSION} (${COMMIT}, ${BUILD_DATE})"
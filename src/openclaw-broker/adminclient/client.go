@@ -0,0 +1,327 @@
+// Package adminclient is a Go client for the broker's /admin API. Responses
+// decode into the broker package's own types, so the client can't drift from
+// the handlers.
+package adminclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/bosh"
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/broker"
+)
+
+// Error is a non-2xx admin API response. Code and Description come from the
+// {"error", "description"} body the handlers write; for other bodies (e.g.
+// the plain-text 401 from basic auth) Code holds the body text.
+type Error struct {
+	StatusCode  int
+	Code        string
+	Description string
+	Body        []byte
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("admin API returned %d", e.StatusCode)
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Description != "" {
+		msg += ": " + e.Description
+	}
+	return msg
+}
+
+// StatusCode returns the HTTP status of err if it is an *Error, or 0.
+func StatusCode(err error) int {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+// Client calls the admin API of one broker.
+type Client struct {
+	baseURL    string
+	username   string
+	password   string
+	httpClient *http.Client
+}
+
+// New returns a Client for the broker at baseURL (e.g.
+// https://openclaw-broker.sys.example.com), authenticating with the admin
+// credentials. A nil httpClient uses http.DefaultClient.
+func New(baseURL, username, password string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		username:   username,
+		password:   password,
+		httpClient: httpClient,
+	}
+}
+
+// ListInstances returns every instance not being deprovisioned.
+func (c *Client) ListInstances(ctx context.Context) ([]broker.AdminInstance, error) {
+	var list []broker.AdminInstance
+	if err := c.do(ctx, "GET", "/admin/instances", nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// SearchInstances returns the instances matching every non-empty filter:
+// owner (case-insensitive), route (hostname, with or without the apps domain)
+// and org GUID.
+func (c *Client) SearchInstances(ctx context.Context, owner, route, org string) ([]broker.AdminInstance, error) {
+	query := url.Values{}
+	for key, value := range map[string]string{"owner": owner, "route": route, "org": org} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	var list []broker.AdminInstance
+	if err := c.do(ctx, "GET", "/admin/instances/search", query, nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetInstance returns the full detail of one instance.
+func (c *Client) GetInstance(ctx context.Context, instanceID string) (*broker.AdminInstanceDetail, error) {
+	var detail broker.AdminInstanceDetail
+	if err := c.do(ctx, "GET", "/admin/instances/"+url.PathEscape(instanceID), nil, nil, &detail); err != nil {
+		return nil, err
+	}
+	return &detail, nil
+}
+
+// DeleteInstance deletes an instance's deployment and broker record. When the
+// Director refuses the delete the summary is returned along with the error.
+func (c *Client) DeleteInstance(ctx context.Context, instanceID string, force bool) (*broker.AdminDeleteSummary, error) {
+	query := url.Values{}
+	if force {
+		query.Set("force", "true")
+	}
+	var summary broker.AdminDeleteSummary
+	err := c.do(ctx, "DELETE", "/admin/instances/"+url.PathEscape(instanceID), query, nil, &summary)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadGateway {
+		if json.Unmarshal(apiErr.Body, &summary) == nil && summary.BoshError != "" {
+			apiErr.Description = summary.BoshError
+			return &summary, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// InstanceVMs returns the BOSH VMs backing an instance.
+func (c *Client) InstanceVMs(ctx context.Context, instanceID string) ([]bosh.VMInfo, error) {
+	var vms []bosh.VMInfo
+	if err := c.do(ctx, "GET", "/admin/instances/"+url.PathEscape(instanceID)+"/vms", nil, nil, &vms); err != nil {
+		return nil, err
+	}
+	return vms, nil
+}
+
+// RecreateInstance recreates an instance's VMs from its current manifest.
+func (c *Client) RecreateInstance(ctx context.Context, instanceID string) (*broker.RecreateResult, error) {
+	var result broker.RecreateResult
+	if err := c.do(ctx, "POST", "/admin/instances/"+url.PathEscape(instanceID)+"/recreate", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// RotateToken replaces an instance's gateway token. The new token is only
+// ever returned here.
+func (c *Client) RotateToken(ctx context.Context, instanceID string) (*broker.RotateTokenResult, error) {
+	var result broker.RotateTokenResult
+	if err := c.do(ctx, "POST", "/admin/instances/"+url.PathEscape(instanceID)+"/rotate-token", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DeprovisionAll deletes every instance matching req.
+func (c *Client) DeprovisionAll(ctx context.Context, req broker.DeprovisionAllRequest) (*broker.DeprovisionAllResult, error) {
+	var result broker.DeprovisionAllResult
+	if err := c.do(ctx, "POST", "/admin/deprovision-all", nil, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Reconcile diffs broker state against the Director's deployments.
+func (c *Client) Reconcile(ctx context.Context, req broker.ReconcileRequest) (*broker.ReconcileReport, error) {
+	var report broker.ReconcileReport
+	if err := c.do(ctx, "POST", "/admin/reconcile", nil, req, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Export returns every instance record, secrets included, keyed by ID.
+func (c *Client) Export(ctx context.Context) (map[string]*broker.Instance, error) {
+	var instances map[string]*broker.Instance
+	if err := c.do(ctx, "GET", "/admin/export", nil, nil, &instances); err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+// Import merges an Export into broker state. Existing instances are only
+// replaced with overwrite; otherwise the import fails with a 409 *Error.
+func (c *Client) Import(ctx context.Context, instances map[string]*broker.Instance, overwrite bool) (*broker.ImportResult, error) {
+	query := url.Values{}
+	if overwrite {
+		query.Set("overwrite", "true")
+	}
+	var result broker.ImportResult
+	if err := c.do(ctx, "POST", "/admin/import", query, instances, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Upgrade redeploys up to req.Count instances running an older version.
+func (c *Client) Upgrade(ctx context.Context, req broker.UpgradeRequest) (*broker.UpgradeResult, error) {
+	var result broker.UpgradeResult
+	if err := c.do(ctx, "POST", "/admin/upgrade", nil, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// UpgradeStatus counts tracked upgrades by the state of their BOSH task.
+func (c *Client) UpgradeStatus(ctx context.Context) (*broker.UpgradeStatus, error) {
+	var status broker.UpgradeStatus
+	if err := c.do(ctx, "GET", "/admin/upgrade/status", nil, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// UpgradeRollback redeploys tracked upgrades at their previous version.
+// Upgrades that succeeded are only rolled back with includeHealthy.
+func (c *Client) UpgradeRollback(ctx context.Context, includeHealthy bool) (*broker.RollbackResult, error) {
+	query := url.Values{}
+	if includeHealthy {
+		query.Set("include_healthy", "true")
+	}
+	var result broker.RollbackResult
+	if err := c.do(ctx, "POST", "/admin/upgrade/rollback", query, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Audit returns the audit trail, limited to one instance when instanceID is
+// not empty.
+func (c *Client) Audit(ctx context.Context, instanceID string) ([]broker.AuditEntry, error) {
+	query := url.Values{}
+	if instanceID != "" {
+		query.Set("instance_id", instanceID)
+	}
+	var entries []broker.AuditEntry
+	if err := c.do(ctx, "GET", "/admin/audit", query, nil, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Maintenance returns the broker's maintenance mode.
+func (c *Client) Maintenance(ctx context.Context) (*broker.Maintenance, error) {
+	var m broker.Maintenance
+	if err := c.do(ctx, "GET", "/admin/maintenance", nil, nil, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// SetMaintenance enables or disables maintenance mode, in which the broker
+// rejects new provisions with message. It returns the mode now in effect.
+func (c *Client) SetMaintenance(ctx context.Context, enabled bool, message string) (*broker.Maintenance, error) {
+	var m broker.Maintenance
+	if err := c.do(ctx, "POST", "/admin/maintenance", nil, broker.Maintenance{Enabled: enabled, Message: message}, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// do sends an admin request with in as the JSON body (when not nil) and
+// decodes a 2xx response into out. Other statuses return an *Error.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("encoding %s %s request: %w", method, path, err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.username, c.password)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s %s response: %w", method, path, err)
+	}
+	return nil
+}
+
+// maxErrorBody bounds how much of an error response is kept.
+const maxErrorBody = 64 << 10
+
+func decodeError(resp *http.Response) *Error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	apiErr := &Error{StatusCode: resp.StatusCode, Body: data}
+	var fields struct {
+		Error       string `json:"error"`
+		Description string `json:"description"`
+	}
+	if json.Unmarshal(data, &fields) == nil {
+		apiErr.Code, apiErr.Description = fields.Error, fields.Description
+	} else {
+		apiErr.Code = strings.TrimSpace(string(data))
+	}
+	if apiErr.Code == "" && apiErr.Description == "" {
+		apiErr.Code = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
@@ -0,0 +1,184 @@
+package adminclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/bosh"
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/broker"
+)
+
+// newTestServer serves the real admin handlers of a broker backed by a fake
+// Director whose deploys all succeed as task 42.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	var director *httptest.Server
+	director = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/deployments":
+			w.Header().Set("Location", director.URL+"/tasks/42")
+			w.WriteHeader(http.StatusFound)
+		case r.Method == "GET" && r.URL.Path == "/tasks/42":
+			json.NewEncoder(w).Encode(map[string]string{"state": "done"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(director.Close)
+
+	b := broker.New(broker.BrokerConfig{
+		OpenClawVersion: "2026.3.1",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		StateDir:        t.TempDir(),
+	}, bosh.NewClient(director.URL, "admin", "admin", "", ""))
+
+	r := mux.NewRouter()
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(broker.BasicAuthMiddleware("admin", "s3cret"))
+	b.RegisterAdminRoutes(admin)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testInstances() map[string]*broker.Instance {
+	return map[string]*broker.Instance{
+		"inst-a": {PlanID: "openclaw-developer-plan", PlanName: "developer", Owner: "a@example.com", State: "ready",
+			DeploymentName: "openclaw-agent-inst-a", OpenClawVersion: "2026.2.21", GatewayToken: "token-a"},
+		"inst-b": {PlanID: "openclaw-developer-plan", PlanName: "developer", Owner: "b@example.com", State: "ready",
+			DeploymentName: "openclaw-agent-inst-b", OpenClawVersion: "2026.3.1", GatewayToken: "token-b"},
+	}
+}
+
+func TestClient_ImportListExport(t *testing.T) {
+	server := newTestServer(t)
+	client := New(server.URL+"/", "admin", "s3cret", nil)
+	ctx := context.Background()
+
+	result, err := client.Import(ctx, testInstances(), false)
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if len(result.Imported) != 2 || len(result.Overwritten) != 0 {
+		t.Errorf("Import = %+v, want two new instances", result)
+	}
+
+	list, err := client.ListInstances(ctx)
+	if err != nil {
+		t.Fatalf("ListInstances: %v", err)
+	}
+	if len(list) != 2 {
+		t.Errorf("ListInstances returned %d instances, want 2", len(list))
+	}
+
+	found, err := client.SearchInstances(ctx, "B@example.com", "", "")
+	if err != nil {
+		t.Fatalf("SearchInstances: %v", err)
+	}
+	if len(found) != 1 || found[0].ID != "inst-b" {
+		t.Errorf("SearchInstances = %+v, want inst-b", found)
+	}
+
+	detail, err := client.GetInstance(ctx, "inst-a")
+	if err != nil {
+		t.Fatalf("GetInstance: %v", err)
+	}
+	if detail.Owner != "a@example.com" || !detail.GatewayTokenPresent {
+		t.Errorf("GetInstance = %+v", detail)
+	}
+
+	exported, err := client.Export(ctx)
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if exported["inst-b"] == nil || exported["inst-b"].GatewayToken != "token-b" {
+		t.Errorf("Export = %v, want inst-b with its secrets", exported)
+	}
+
+	entries, err := client.Audit(ctx, "inst-a")
+	if err != nil {
+		t.Fatalf("Audit: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Operation != "import" {
+		t.Errorf("Audit = %+v, want the import of inst-a", entries)
+	}
+
+	// Importing again without overwrite conflicts
+	_, err = client.Import(ctx, exported, false)
+	apiErr, ok := err.(*Error)
+	if !ok || apiErr.StatusCode != http.StatusConflict || apiErr.Code != "InstancesExist" {
+		t.Errorf("repeat Import error = %v, want a 409 InstancesExist *Error", err)
+	}
+}
+
+func TestClient_UpgradeAndStatus(t *testing.T) {
+	server := newTestServer(t)
+	client := New(server.URL, "admin", "s3cret", nil)
+	ctx := context.Background()
+
+	if _, err := client.Import(ctx, testInstances(), false); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	upgrade, err := client.Upgrade(ctx, broker.UpgradeRequest{Count: 10})
+	if err != nil {
+		t.Fatalf("Upgrade: %v", err)
+	}
+	if upgrade.Upgrading != 1 {
+		t.Errorf("Upgrading = %d, want only the outdated instance", upgrade.Upgrading)
+	}
+
+	status, err := client.UpgradeStatus(ctx)
+	if err != nil {
+		t.Fatalf("UpgradeStatus: %v", err)
+	}
+	if *status != (broker.UpgradeStatus{Healthy: 1, Total: 1}) {
+		t.Errorf("UpgradeStatus = %+v, want one healthy upgrade", status)
+	}
+
+	if _, err := client.Upgrade(ctx, broker.UpgradeRequest{}); StatusCode(err) != http.StatusBadRequest {
+		t.Errorf("Upgrade without a count error = %v, want 400", err)
+	}
+}
+
+func TestClient_Maintenance(t *testing.T) {
+	server := newTestServer(t)
+	client := New(server.URL, "admin", "s3cret", nil)
+	ctx := context.Background()
+
+	if _, err := client.SetMaintenance(ctx, true, "back soon"); err != nil {
+		t.Fatalf("SetMaintenance: %v", err)
+	}
+	m, err := client.Maintenance(ctx)
+	if err != nil {
+		t.Fatalf("Maintenance: %v", err)
+	}
+	if *m != (broker.Maintenance{Enabled: true, Message: "back soon"}) {
+		t.Errorf("Maintenance = %+v, want enabled with the message", m)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	server := newTestServer(t)
+
+	_, err := New(server.URL, "admin", "s3cret", nil).GetInstance(context.Background(), "missing")
+	apiErr, ok := err.(*Error)
+	if !ok || apiErr.StatusCode != http.StatusNotFound || apiErr.Code != "Instance not found" {
+		t.Errorf("GetInstance(missing) error = %v, want a 404 *Error", err)
+	}
+
+	_, err = New(server.URL, "admin", "wrong", nil).ListInstances(context.Background())
+	if StatusCode(err) != http.StatusUnauthorized {
+		t.Errorf("bad credentials error = %v, want 401", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := New(server.URL, "admin", "s3cret", nil).ListInstances(ctx); err == nil || StatusCode(err) != 0 {
+		t.Errorf("cancelled context error = %v, want a transport error", err)
+	}
+}
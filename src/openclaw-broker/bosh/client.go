@@ -1,14 +1,18 @@
 package bosh
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,20 +21,114 @@ import (
 type uaaToken struct {
 	accessToken string
 	expiresAt   time.Time
+	refreshAt   time.Time // when the background refresher renews it
+}
+
+// tokenRefreshLead is how long before expiry the background refresher renews
+// the token. Short-lived tokens are renewed after 80% of their lifetime instead.
+const tokenRefreshLead = 30 * time.Second
+
+// minTokenRefreshInterval bounds how often the background refresher renews.
+const minTokenRefreshInterval = time.Second
+
+// tokenRetryInterval is the background refresher's backoff after a failed renewal.
+const tokenRetryInterval = 10 * time.Second
+
+// DefaultTimeout bounds each Director and UAA request when ClientOptions
+// sets no timeout.
+const DefaultTimeout = 60 * time.Second
+
+// ClientOptions tunes a Client. Zero values use the defaults.
+type ClientOptions struct {
+	// Timeout bounds each request, including task submissions such as Deploy.
+	// Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// TaskStatusTimeout bounds the lightweight task status polls separately,
+	// so they can be given more room on a loaded Director (or less). Defaults
+	// to Timeout.
+	TaskStatusTimeout time.Duration
+	// TLSMinVersion is the oldest TLS version negotiated with the Director
+	// and its UAA. Defaults to DefaultTLSMinVersion.
+	TLSMinVersion uint16
+	// TLSCipherSuites restricts the TLS 1.2 cipher suites offered; empty uses
+	// Go's defaults. TLS 1.3 suites are not configurable.
+	TLSCipherSuites []uint16
+	// MaxIdleConns and MaxIdleConnsPerHost cap the keep-alive connections
+	// kept open for reuse. Default to DefaultMaxIdleConns and
+	// DefaultMaxIdleConnsPerHost.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout closes keep-alive connections left idle this long.
+	// Defaults to DefaultIdleConnTimeout.
+	IdleConnTimeout time.Duration
+	// DisableHTTP2 keeps the client on HTTP/1.1 even when the Director offers HTTP/2.
+	DisableHTTP2 bool
+}
+
+// DefaultTLSMinVersion keeps clients off TLS 1.0 and 1.1.
+const DefaultTLSMinVersion = tls.VersionTLS12
+
+// Keep-alive defaults. Go's default of two idle connections per host is far
+// too few for bursts of concurrent binds, which all talk to one host.
+const (
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 32
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// newTransport returns a pooled, HTTP/2-capable transport for options.
+func newTransport(tlsConfig *tls.Config, options ClientOptions) *http.Transport {
+	if options.MaxIdleConns <= 0 {
+		options.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if options.MaxIdleConnsPerHost <= 0 {
+		options.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	if options.IdleConnTimeout <= 0 {
+		options.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	return &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConns:        options.MaxIdleConns,
+		MaxIdleConnsPerHost: options.MaxIdleConnsPerHost,
+		IdleConnTimeout:     options.IdleConnTimeout,
+		// A custom TLS config turns off Go's automatic HTTP/2
+		ForceAttemptHTTP2: !options.DisableHTTP2,
+	}
 }
 
 type Client struct {
-	directorURL  string
-	clientID     string
-	clientSecret string
-	uaaURL       string
-	httpClient   *http.Client
-	token        *uaaToken
-	tokenMu      sync.Mutex
+	directorURL      string
+	clientID         string
+	clientSecret     string
+	uaaURL           string
+	httpClient       *http.Client
+	taskStatusClient *http.Client
+	token            *uaaToken
+	tokenMu          sync.Mutex
+
+	stopRefresh chan struct{}
+	refreshDone chan struct{}
+	closeOnce   sync.Once
 }
 
-func NewClient(directorURL, clientID, clientSecret, caCert, uaaURL string) *Client {
-	tlsConfig := &tls.Config{}
+// NewClient returns a Director client. At most one ClientOptions may be given.
+func NewClient(directorURL, clientID, clientSecret, caCert, uaaURL string, opts ...ClientOptions) *Client {
+	var options ClientOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.TaskStatusTimeout <= 0 {
+		options.TaskStatusTimeout = options.Timeout
+	}
+	if options.TLSMinVersion == 0 {
+		options.TLSMinVersion = DefaultTLSMinVersion
+	}
+
+	tlsConfig := &tls.Config{MinVersion: options.TLSMinVersion, CipherSuites: options.TLSCipherSuites}
 	if caCert != "" {
 		pool := x509.NewCertPool()
 		if !pool.AppendCertsFromPEM([]byte(caCert)) {
@@ -39,16 +137,14 @@ func NewClient(directorURL, clientID, clientSecret, caCert, uaaURL string) *Clie
 		tlsConfig.RootCAs = pool
 	}
 
-	return &Client{
+	c := &Client{
 		directorURL:  strings.TrimRight(directorURL, "/"),
 		clientID:     clientID,
 		clientSecret: clientSecret,
 		uaaURL:       strings.TrimRight(uaaURL, "/"),
 		httpClient: &http.Client{
-			Timeout: 60 * time.Second,
-			Transport: &http.Transport{
-				TLSClientConfig: tlsConfig,
-			},
+			Timeout:   options.Timeout,
+			Transport: newTransport(tlsConfig, options),
 			// Don't follow redirects — the BOSH Director returns 302 with
 			// Location: /tasks/NNN for async operations. We need to capture
 			// that header rather than following the redirect.
@@ -57,9 +153,60 @@ func NewClient(directorURL, clientID, clientSecret, caCert, uaaURL string) *Clie
 			},
 		},
 	}
+	// Task status polls share the connection pool but not the timeout
+	statusClient := *c.httpClient
+	statusClient.Timeout = options.TaskStatusTimeout
+	c.taskStatusClient = &statusClient
+	// With UAA auth, renew the token in the background so foreground
+	// requests almost always hit the cache.
+	if c.uaaURL != "" {
+		c.stopRefresh = make(chan struct{})
+		c.refreshDone = make(chan struct{})
+		go c.refreshLoop()
+	}
+	return c
 }
 
-func (c *Client) getToken() (string, error) {
+// Close stops the background token refresher. Safe to call more than once.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		if c.stopRefresh != nil {
+			close(c.stopRefresh)
+			<-c.refreshDone
+		}
+	})
+}
+
+// refreshLoop renews the cached token shortly before it expires, fetching the
+// first one immediately. Runs until Close.
+func (c *Client) refreshLoop() {
+	defer close(c.refreshDone)
+	var wait time.Duration
+	for {
+		select {
+		case <-c.stopRefresh:
+			return
+		case <-time.After(wait):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.httpClient.Timeout)
+		token, err := c.fetchToken(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("WARNING: background BOSH token refresh failed, retrying in %s: %v", tokenRetryInterval, err)
+			wait = tokenRetryInterval
+			continue
+		}
+		c.tokenMu.Lock()
+		c.token = token
+		c.tokenMu.Unlock()
+		// Floor the wait so a token UAA issues with almost no lifetime
+		// can't turn the loop into a busy retry.
+		wait = max(time.Until(token.refreshAt), minTokenRefreshInterval)
+	}
+}
+
+func (c *Client) getToken(ctx context.Context) (string, error) {
 	c.tokenMu.Lock()
 	defer c.tokenMu.Unlock()
 
@@ -67,21 +214,39 @@ func (c *Client) getToken() (string, error) {
 		return c.token.accessToken, nil
 	}
 
+	token, err := c.fetchToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.token = token
+	return c.token.accessToken, nil
+}
+
+// fetchToken requests a new client_credentials token from UAA. It does not
+// touch the cache, so the background refresher can call it without blocking
+// foreground requests on tokenMu.
+func (c *Client) fetchToken(ctx context.Context) (*uaaToken, error) {
 	data := url.Values{
 		"grant_type":    {"client_credentials"},
 		"client_id":     {c.clientID},
 		"client_secret": {c.clientSecret},
 	}
 
-	resp, err := c.httpClient.PostForm(c.uaaURL+"/oauth/token", data)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.uaaURL+"/oauth/token", strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("building UAA token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("UAA token request failed: %w", err)
+		return nil, fmt.Errorf("UAA token request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("UAA token request returned %d: %s", resp.StatusCode, body)
+		return nil, fmt.Errorf("UAA token request returned %d: %s", resp.StatusCode, body)
 	}
 
 	var tokenResp struct {
@@ -89,7 +254,7 @@ func (c *Client) getToken() (string, error) {
 		ExpiresIn   int    `json:"expires_in"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		return "", fmt.Errorf("failed to decode UAA token response: %w", err)
+		return nil, fmt.Errorf("failed to decode UAA token response: %w", err)
 	}
 
 	// Cache token with 60s safety margin before expiry.
@@ -98,19 +263,24 @@ func (c *Client) getToken() (string, error) {
 	if margin < 0 {
 		margin = 0
 	}
-	c.token = &uaaToken{
-		accessToken: tokenResp.AccessToken,
-		expiresAt:   time.Now().Add(time.Duration(margin) * time.Second),
+	now := time.Now()
+	lifetime := time.Duration(margin) * time.Second
+	lead := tokenRefreshLead
+	if lead > lifetime/5 {
+		lead = lifetime / 5
 	}
-
-	return c.token.accessToken, nil
+	return &uaaToken{
+		accessToken: tokenResp.AccessToken,
+		expiresAt:   now.Add(lifetime),
+		refreshAt:   now.Add(lifetime - lead),
+	}, nil
 }
 
 // setAuth sets authorization on the request. Uses UAA bearer token if uaaURL is configured,
 // otherwise falls back to basic auth (useful for tests and non-UAA environments).
 func (c *Client) setAuth(req *http.Request) error {
 	if c.uaaURL != "" {
-		token, err := c.getToken()
+		token, err := c.getToken(req.Context())
 		if err != nil {
 			return err
 		}
@@ -121,41 +291,242 @@ func (c *Client) setAuth(req *http.Request) error {
 	return nil
 }
 
-func (c *Client) Deploy(manifest []byte) (int, error) {
-	req, err := http.NewRequest("POST", c.directorURL+"/deployments", strings.NewReader(string(manifest)))
+// Ping checks that the Director is reachable and that the broker can
+// authenticate against it. The whole probe, including any token fetch,
+// is bounded by timeout so it is safe to call from a readiness handler.
+func (c *Client) Ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.directorURL+"/info", nil)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	req.Header.Set("Content-Type", "text/yaml")
 	if err := c.setAuth(req); err != nil {
-		return 0, fmt.Errorf("failed to authenticate: %w", err)
+		return fmt.Errorf("failed to authenticate: %w", err)
 	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("deploy request failed: %w", err)
+		return fmt.Errorf("info request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
-	return c.extractTaskID(resp, "deploy")
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("info request returned %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// Deployment is an entry from the Director's GET /deployments listing.
+type Deployment struct {
+	Name      string        `json:"name"`
+	Releases  []NameVersion `json:"releases"`
+	Stemcells []NameVersion `json:"stemcells"`
+}
+
+// NameVersion is a release or stemcell reference within a Deployment.
+type NameVersion struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// ErrDeploymentNotFound is returned by GetDeploymentManifest when the
+// Director has no deployment of that name.
+var ErrDeploymentNotFound = errors.New("deployment not found")
+
+// DeploymentExists reports whether the Director has a deployment of that name.
+func (c *Client) DeploymentExists(name string) (bool, error) {
+	_, err := c.GetDeploymentManifest(name)
+	if errors.Is(err, ErrDeploymentNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetDeploymentManifest returns the manifest the Director last deployed for
+// name, exactly as it was uploaded.
+func (c *Client) GetDeploymentManifest(name string) ([]byte, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/deployments/%s", c.directorURL, url.PathEscape(name)), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.setAuth(req); err != nil {
+		return nil, fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get deployment request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", name, ErrDeploymentNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("get deployment request returned %d: %s", resp.StatusCode, body)
+	}
+
+	var result struct {
+		Manifest string `json:"manifest"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("parsing deployment %s: %w", name, err)
+	}
+	return []byte(result.Manifest), nil
+}
+
+// ListDeployments returns all deployments visible to the broker's Director client.
+func (c *Client) ListDeployments() ([]Deployment, error) {
+	req, err := http.NewRequest("GET", c.directorURL+"/deployments", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.setAuth(req); err != nil {
+		return nil, fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("list deployments request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("list deployments request returned %d: %s", resp.StatusCode, body)
+	}
+
+	var deployments []Deployment
+	if err := json.NewDecoder(resp.Body).Decode(&deployments); err != nil {
+		return nil, fmt.Errorf("failed to decode deployments: %w", err)
+	}
+	return deployments, nil
+}
+
+func (c *Client) Deploy(manifest []byte) (int, error) {
+	return c.submitTask("deploy", func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", c.directorURL+"/deployments", strings.NewReader(string(manifest)))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "text/yaml")
+		return req, nil
+	})
 }
 
 func (c *Client) DeleteDeployment(name string) (int, error) {
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/deployments/%s", c.directorURL, name), nil)
+	return c.submitTask("delete", func() (*http.Request, error) {
+		return http.NewRequest("DELETE", fmt.Sprintf("%s/deployments/%s", c.directorURL, name), nil)
+	})
+}
+
+// Recreate rebuilds every VM in the deployment from the manifest the Director
+// already has, as `bosh recreate` does, so nothing about the deployment
+// changes. Returns the task ID.
+func (c *Client) Recreate(deploymentName string) (int, error) {
+	manifest, err := c.GetDeploymentManifest(deploymentName)
 	if err != nil {
 		return 0, err
 	}
+	return c.submitTask("recreate", func() (*http.Request, error) {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("%s/deployments/%s/jobs/*?state=recreate", c.directorURL, url.PathEscape(deploymentName)), strings.NewReader(string(manifest)))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "text/yaml")
+		return req, nil
+	})
+}
+
+// A busy Director answers task submissions with 429 and Retry-After.
+const (
+	maxTaskSubmitAttempts = 4
+	defaultRetryAfter     = time.Second
+	maxRetryAfter         = 30 * time.Second
+)
+
+// submitTask sends a request that starts a Director task and returns the task
+// ID. A 429 is retried after the Retry-After delay (capped at maxRetryAfter),
+// up to maxTaskSubmitAttempts in total. newReq is called per attempt so the
+// body can be resent.
+func (c *Client) submitTask(operation string, newReq func() (*http.Request, error)) (int, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return 0, err
+		}
+		if err := c.setAuth(req); err != nil {
+			return 0, fmt.Errorf("failed to authenticate: %w", err)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return 0, requestError(operation+" request", c.httpClient.Timeout, err)
+		}
+		if resp.StatusCode != http.StatusTooManyRequests {
+			defer resp.Body.Close()
+			return c.extractTaskID(resp, operation)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if attempt == maxTaskSubmitAttempts {
+			return 0, fmt.Errorf("%s: Director still rate limiting (429) after %d attempts", operation, attempt)
+		}
+		wait := parseRetryAfter(resp.Header.Get("Retry-After"))
+		log.Printf("BOSH Director rate limited %s (attempt %d/%d), retrying in %s", operation, attempt, maxTaskSubmitAttempts, wait)
+		time.Sleep(wait)
+	}
+}
+
+// requestError wraps a failed request, naming the configured timeout when
+// that is what cut it short.
+func requestError(what string, timeout time.Duration, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%s timed out after %s: %w", what, timeout, err)
+	}
+	return fmt.Errorf("%s failed: %w", what, err)
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP
+// date, falling back to defaultRetryAfter and capping at maxRetryAfter.
+func parseRetryAfter(header string) time.Duration {
+	wait := defaultRetryAfter
+	if secs, err := strconv.Atoi(strings.TrimSpace(header)); err == nil && secs >= 0 {
+		wait = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(header); err == nil {
+		wait = max(time.Until(at), 0)
+	}
+	return min(wait, maxRetryAfter)
+}
+
+// CancelTask asks the Director to cancel a queued or running task.
+// Cancellation is asynchronous: the task moves through "cancelling" to "cancelled".
+func (c *Client) CancelTask(taskID int) error {
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/task/%d", c.directorURL, taskID), nil)
+	if err != nil {
+		return err
+	}
 	if err := c.setAuth(req); err != nil {
-		return 0, fmt.Errorf("failed to authenticate: %w", err)
+		return fmt.Errorf("failed to authenticate: %w", err)
 	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("delete request failed: %w", err)
+		return fmt.Errorf("cancel task request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
-	return c.extractTaskID(resp, "delete")
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("cancel task %d returned %d: %s", taskID, resp.StatusCode, body)
+	}
+	return nil
 }
 
 // extractTaskID gets the BOSH task ID from a Director async response.
@@ -205,9 +576,9 @@ func (c *Client) TaskStatus(taskID int) (string, error) {
 		return "", fmt.Errorf("failed to authenticate: %w", err)
 	}
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.taskStatusClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("task status request failed: %w", err)
+		return "", requestError("task status request", c.taskStatusClient.Timeout, err)
 	}
 	defer resp.Body.Close()
 
@@ -227,3 +598,145 @@ func (c *Client) TaskStatus(taskID int) (string, error) {
 	}
 	return result.State, nil
 }
+
+// VMInfo describes one VM of a deployment as reported by the Director.
+type VMInfo struct {
+	InstanceGroup string   `json:"instance_group"`
+	Index         int      `json:"index"`
+	ID            string   `json:"id"`
+	AZ            string   `json:"az,omitempty"`
+	IPs           []string `json:"ips"`
+	VMCID         string   `json:"vm_cid,omitempty"`
+	ProcessState  string   `json:"process_state"`
+}
+
+// vmListTimeout bounds how long VMInstances waits for the Director's vms task.
+const vmListTimeout = 2 * time.Minute
+
+// VMInstances lists the VMs of a deployment. The Director answers
+// GET /deployments/{name}/vms?format=full with an async task whose result
+// output is newline-delimited JSON, one object per VM.
+func (c *Client) VMInstances(deploymentName string) ([]VMInfo, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/deployments/%s/vms?format=full", c.directorURL, url.PathEscape(deploymentName)), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.setAuth(req); err != nil {
+		return nil, fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vms request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	taskID, err := c.extractTaskID(resp, "vms")
+	if err != nil {
+		return nil, err
+	}
+	if err := c.waitForTask(taskID, vmListTimeout); err != nil {
+		return nil, err
+	}
+
+	output, err := c.TaskResult(taskID)
+	if err != nil {
+		return nil, err
+	}
+	return parseVMOutput(output)
+}
+
+// waitForTask polls a task until it is done. Error and cancelled states,
+// as well as exceeding the timeout, are returned as errors.
+func (c *Client) waitForTask(taskID int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := c.TaskStatus(taskID)
+		if err != nil {
+			return err
+		}
+		switch state {
+		case "done":
+			return nil
+		case "error", "cancelled", "timeout":
+			return fmt.Errorf("BOSH task %d finished in state %q", taskID, state)
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("BOSH task %d did not finish within %s", taskID, timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// TaskResult fetches a task's result output. For failed deploys this usually
+// holds the Director's error message.
+func (c *Client) TaskResult(taskID int) (string, error) {
+	return c.TaskOutput(taskID, "result")
+}
+
+// TaskOutput fetches a task's output of the given type (result, event, debug).
+func (c *Client) TaskOutput(taskID int, outputType string) (string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/tasks/%d/output?type=%s", c.directorURL, taskID, url.QueryEscape(outputType)), nil)
+	if err != nil {
+		return "", err
+	}
+	if err := c.setAuth(req); err != nil {
+		return "", fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("task output request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading task output: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("task output request returned %d: %s", resp.StatusCode, body)
+	}
+	return string(body), nil
+}
+
+// parseVMOutput decodes the NDJSON result of a vms task.
+func parseVMOutput(output string) ([]VMInfo, error) {
+	var vms []VMInfo
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var raw struct {
+			JobName      string   `json:"job_name"`
+			Index        *int     `json:"index"`
+			ID           string   `json:"id"`
+			AZ           string   `json:"az"`
+			IPs          []string `json:"ips"`
+			VMCID        string   `json:"vm_cid"`
+			ProcessState string   `json:"process_state"`
+			JobState     string   `json:"job_state"`
+		}
+		if err := json.Unmarshal([]byte(line), &raw); err != nil {
+			return nil, fmt.Errorf("parsing vm output line: %w", err)
+		}
+		vm := VMInfo{
+			InstanceGroup: raw.JobName,
+			ID:            raw.ID,
+			AZ:            raw.AZ,
+			IPs:           raw.IPs,
+			VMCID:         raw.VMCID,
+			ProcessState:  raw.ProcessState,
+		}
+		if raw.Index != nil {
+			vm.Index = *raw.Index
+		}
+		// Older Directors report job_state instead of process_state
+		if vm.ProcessState == "" {
+			vm.ProcessState = raw.JobState
+		}
+		vms = append(vms, vm)
+	}
+	return vms, nil
+}
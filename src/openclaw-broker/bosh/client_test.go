@@ -0,0 +1,389 @@
+package bosh
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newSlowUAA issues numbered tokens that expire after expiresIn seconds,
+// taking delay to answer each request.
+func newSlowUAA(expiresIn int, delay time.Duration, requests *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth/token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		n := requests.Add(1)
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token-%d", n),
+			"expires_in":   expiresIn,
+		})
+	}))
+}
+
+func TestClient_BackgroundTokenRefresh(t *testing.T) {
+	const uaaDelay = 300 * time.Millisecond
+	var tokenRequests atomic.Int32
+	// 63s minus the 60s safety margin leaves a 3s cached lifetime
+	uaa := newSlowUAA(63, uaaDelay, &tokenRequests)
+	defer uaa.Close()
+
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	director := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] = true
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer director.Close()
+
+	c := NewClient(director.URL, "ops", "secret", "", uaa.URL)
+	defer c.Close()
+
+	// The refresher fetches the first token on its own
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c.tokenMu.Lock()
+		ready := c.token != nil
+		c.tokenMu.Unlock()
+		if ready {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background refresher never fetched a token")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Across a renewal, no foreground request waits on UAA
+	var slowest time.Duration
+	for end := time.Now().Add(3500 * time.Millisecond); time.Now().Before(end); {
+		start := time.Now()
+		if err := c.Ping(5 * time.Second); err != nil {
+			t.Fatalf("Ping: %v", err)
+		}
+		slowest = max(slowest, time.Since(start))
+		time.Sleep(25 * time.Millisecond)
+	}
+	if slowest >= uaaDelay {
+		t.Errorf("slowest Ping took %s, want a cache hit (< %s)", slowest, uaaDelay)
+	}
+	if got := tokenRequests.Load(); got < 2 {
+		t.Errorf("UAA token requests = %d, want the token renewed in the background", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) < 2 {
+		t.Errorf("Director saw tokens %v, want the renewed token in use", seen)
+	}
+}
+
+func TestClient_CloseStopsRefresher(t *testing.T) {
+	var tokenRequests atomic.Int32
+	uaa := newSlowUAA(61, 0, &tokenRequests)
+	defer uaa.Close()
+
+	c := NewClient("http://127.0.0.1:0", "ops", "secret", "", uaa.URL)
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	c.Close()
+
+	after := tokenRequests.Load()
+	time.Sleep(1500 * time.Millisecond)
+	if got := tokenRequests.Load(); got != after {
+		t.Errorf("token requests went from %d to %d after Close", after, got)
+	}
+}
+
+func TestClient_CloseWithoutUAA(t *testing.T) {
+	c := NewClient("http://127.0.0.1:0", "admin", "admin", "", "")
+	c.Close()
+}
+
+// newRateLimitedDirector answers the first `limited` task submissions with
+// 429 and retryAfter, then accepts them.
+func newRateLimitedDirector(limited int, retryAfter string, attempts *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := attempts.Add(1); int(n) <= limited {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Location", "/tasks/42")
+		w.WriteHeader(http.StatusFound)
+	}))
+}
+
+func TestDeploy_RetriesAfter429(t *testing.T) {
+	var attempts atomic.Int32
+	director := newRateLimitedDirector(1, "1", &attempts)
+	defer director.Close()
+	c := NewClient(director.URL, "admin", "admin", "", "")
+
+	start := time.Now()
+	taskID, err := c.Deploy([]byte("name: test"))
+	if err != nil {
+		t.Fatalf("Deploy: %v", err)
+	}
+	if taskID != 42 {
+		t.Errorf("taskID = %d, want 42", taskID)
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("attempts = %d, want 2", attempts.Load())
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want Retry-After of 1s honored", elapsed)
+	}
+}
+
+func TestDeleteDeployment_GivesUpAfterRepeated429(t *testing.T) {
+	var attempts atomic.Int32
+	director := newRateLimitedDirector(100, "0", &attempts)
+	defer director.Close()
+	c := NewClient(director.URL, "admin", "admin", "", "")
+
+	_, err := c.DeleteDeployment("openclaw-agent-x")
+	if err == nil || !strings.Contains(err.Error(), "429") {
+		t.Fatalf("err = %v, want a rate-limit error", err)
+	}
+	if attempts.Load() != maxTaskSubmitAttempts {
+		t.Errorf("attempts = %d, want %d", attempts.Load(), maxTaskSubmitAttempts)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":        defaultRetryAfter,
+		"garbage": defaultRetryAfter,
+		"0":       0,
+		"5":       5 * time.Second,
+		"3600":    maxRetryAfter,
+		time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat): 0,
+	}
+	for header, want := range tests {
+		if got := parseRetryAfter(header); got != want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", header, got, want)
+		}
+	}
+}
+
+// newSlowDirector answers every request after delay.
+func newSlowDirector(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"state": "done"}`))
+	}))
+}
+
+func TestTaskStatus_ConfiguredTimeout(t *testing.T) {
+	director := newSlowDirector(time.Second)
+	defer director.Close()
+
+	c := NewClient(director.URL, "admin", "admin", "", "", ClientOptions{TaskStatusTimeout: 100 * time.Millisecond})
+	start := time.Now()
+	_, err := c.TaskStatus(1)
+	if err == nil || !strings.Contains(err.Error(), "task status request timed out after 100ms") {
+		t.Fatalf("err = %v, want a clear timeout error", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("TaskStatus took %s, want the 100ms timeout to apply", elapsed)
+	}
+	if c.httpClient.Timeout != DefaultTimeout {
+		t.Errorf("request timeout = %s, want the default %s", c.httpClient.Timeout, DefaultTimeout)
+	}
+}
+
+func TestDeploy_ConfiguredTimeout(t *testing.T) {
+	director := newSlowDirector(time.Second)
+	defer director.Close()
+
+	c := NewClient(director.URL, "admin", "admin", "", "", ClientOptions{Timeout: 100 * time.Millisecond, TaskStatusTimeout: 5 * time.Second})
+	if _, err := c.Deploy([]byte("name: test")); err == nil || !strings.Contains(err.Error(), "deploy request timed out after 100ms") {
+		t.Fatalf("err = %v, want a clear timeout error", err)
+	}
+	if state, err := c.TaskStatus(1); err != nil || state != "done" {
+		t.Errorf("TaskStatus = %q, %v; want the longer status timeout to let it finish", state, err)
+	}
+}
+
+func TestNewClient_TLSMinVersion(t *testing.T) {
+	// The Director is capped at TLS 1.2 and trusted via its CA
+	director := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"state": "done"}`))
+	}))
+	director.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	director.StartTLS()
+	defer director.Close()
+	caCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: director.Certificate().Raw}))
+
+	c := NewClient(director.URL, "admin", "admin", caCert, "")
+	if got := c.httpClient.Transport.(*http.Transport).TLSClientConfig.MinVersion; got != tls.VersionTLS12 {
+		t.Errorf("default MinVersion = %x, want TLS 1.2", got)
+	}
+	if _, err := c.TaskStatus(1); err != nil {
+		t.Errorf("TLS 1.2 Director with the default minimum: %v", err)
+	}
+
+	strict := NewClient(director.URL, "admin", "admin", caCert, "", ClientOptions{TLSMinVersion: tls.VersionTLS13})
+	if got := strict.taskStatusClient.Transport.(*http.Transport).TLSClientConfig.MinVersion; got != tls.VersionTLS13 {
+		t.Errorf("task status MinVersion = %x, want TLS 1.3", got)
+	}
+	if _, err := strict.TaskStatus(1); err == nil {
+		t.Error("a TLS 1.3 minimum should refuse a TLS 1.2 Director")
+	}
+}
+
+// newCountingDirector answers task status polls and counts the TCP
+// connections opened to it, recording each request's protocol.
+func newCountingDirector(conns *atomic.Int32, protoMajor *atomic.Int32) *httptest.Server {
+	director := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protoMajor.Store(int32(r.ProtoMajor))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"state": "done"}`))
+	}))
+	director.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	return director
+}
+
+func TestClient_ReusesConnections(t *testing.T) {
+	var conns, proto atomic.Int32
+	director := newCountingDirector(&conns, &proto)
+	director.Start()
+	defer director.Close()
+
+	c := NewClient(director.URL, "admin", "admin", "", "")
+	for i := 0; i < 10; i++ {
+		if _, err := c.TaskStatus(i); err != nil {
+			t.Fatalf("TaskStatus: %v", err)
+		}
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("opened %d connections for 10 sequential requests, want 1", got)
+	}
+	transport := c.httpClient.Transport.(*http.Transport)
+	if transport.MaxIdleConnsPerHost != DefaultMaxIdleConnsPerHost || transport.IdleConnTimeout != DefaultIdleConnTimeout {
+		t.Errorf("transport pool = %d per host, %s idle; want the defaults", transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+	if c.httpClient.CheckRedirect == nil {
+		t.Error("the Director client must not follow task redirects")
+	}
+}
+
+func TestClient_HTTP2(t *testing.T) {
+	var conns, proto atomic.Int32
+	director := newCountingDirector(&conns, &proto)
+	director.EnableHTTP2 = true
+	director.StartTLS()
+	defer director.Close()
+	caCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: director.Certificate().Raw}))
+
+	if _, err := NewClient(director.URL, "admin", "admin", caCert, "").TaskStatus(1); err != nil {
+		t.Fatalf("TaskStatus: %v", err)
+	}
+	if got := proto.Load(); got != 2 {
+		t.Errorf("protocol = HTTP/%d, want HTTP/2", got)
+	}
+
+	if _, err := NewClient(director.URL, "admin", "admin", caCert, "", ClientOptions{DisableHTTP2: true}).TaskStatus(1); err != nil {
+		t.Fatalf("TaskStatus: %v", err)
+	}
+	if got := proto.Load(); got != 1 {
+		t.Errorf("protocol with DisableHTTP2 = HTTP/%d, want HTTP/1.1", got)
+	}
+}
+
+func BenchmarkTaskStatus(b *testing.B) {
+	var conns, proto atomic.Int32
+	director := newCountingDirector(&conns, &proto)
+	director.Start()
+	defer director.Close()
+	c := NewClient(director.URL, "admin", "admin", "", "")
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := c.TaskStatus(1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.ReportMetric(float64(conns.Load()), "conns")
+}
+
+func TestGetDeploymentManifest(t *testing.T) {
+	director := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/deployments/openclaw-agent-a" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"manifest": "name: openclaw-agent-a\n"})
+	}))
+	defer director.Close()
+	c := NewClient(director.URL, "admin", "admin", "", "")
+
+	manifest, err := c.GetDeploymentManifest("openclaw-agent-a")
+	if err != nil || string(manifest) != "name: openclaw-agent-a\n" {
+		t.Errorf("GetDeploymentManifest = %q, %v", manifest, err)
+	}
+	if exists, err := c.DeploymentExists("openclaw-agent-a"); !exists || err != nil {
+		t.Errorf("DeploymentExists(existing) = %v, %v; want true", exists, err)
+	}
+	if exists, err := c.DeploymentExists("openclaw-agent-gone"); exists || err != nil {
+		t.Errorf("DeploymentExists(missing) = %v, %v; want false, nil", exists, err)
+	}
+}
+
+func TestRecreate_ResubmitsDeployedManifest(t *testing.T) {
+	var gotBody, gotQuery, gotType string
+	director := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/deployments/openclaw-agent-a":
+			json.NewEncoder(w).Encode(map[string]string{"manifest": "name: openclaw-agent-a\n"})
+		case r.Method == "PUT" && r.URL.Path == "/deployments/openclaw-agent-a/jobs/*":
+			body, _ := io.ReadAll(r.Body)
+			gotBody, gotQuery, gotType = string(body), r.URL.RawQuery, r.Header.Get("Content-Type")
+			w.Header().Set("Location", "/tasks/77")
+			w.WriteHeader(http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer director.Close()
+	c := NewClient(director.URL, "admin", "admin", "", "")
+
+	taskID, err := c.Recreate("openclaw-agent-a")
+	if err != nil || taskID != 77 {
+		t.Fatalf("Recreate = %d, %v; want task 77", taskID, err)
+	}
+	if gotQuery != "state=recreate" || gotType != "text/yaml" || gotBody != "name: openclaw-agent-a\n" {
+		t.Errorf("recreate request query=%q content-type=%q body=%q", gotQuery, gotType, gotBody)
+	}
+
+	if _, err := c.Recreate("openclaw-agent-gone"); !errors.Is(err, ErrDeploymentNotFound) {
+		t.Errorf("Recreate(missing) err = %v, want ErrDeploymentNotFound", err)
+	}
+}
@@ -3,9 +3,17 @@ package bosh
 import (
 	"bytes"
 	"fmt"
+	"log"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 const agentManifestTemplate = `---
@@ -24,10 +32,22 @@ instance_groups:
           openclaw:
             version: "{{ .OpenClawVersion }}"
             gateway:
-              token: "{{ .GatewayToken }}"
+              port: {{ .GatewayPort }}
+              token: "{{ .Secret "openclaw_gateway_token" .GatewayToken }}"
+{{- if .BindingTokens }}
+              binding_tokens:
+{{- range .BindingTokens }}
+                - "{{ . }}"
+{{- end }}
+{{- end }}
             security:
               sandbox_mode: {{ .SandboxMode }}
-{{- if .BlockedCommands }}
+{{- if eq .CommandPolicy "allowlist" }}
+              allowed_commands:{{ if not .AllowedCommands }} []{{ end }}
+{{- range .AllowedCommands }}
+                - "{{ . }}"
+{{- end }}
+{{- else if .BlockedCommands }}
               blocked_commands:
 {{- range .BlockedCommands }}
                 - "{{ . }}"
@@ -36,7 +56,45 @@ instance_groups:
 {{- if .LLMProvider }}
             llm:
               provider: "{{ .LLMProvider }}"
-{{- if or .LLMEndpoint .LLMAPIEndpoint }}
+{{- if eq .LLMProvider "openai" }}
+              openai:
+{{- if .LLMBaseURL }}
+                base_url: "{{ .LLMBaseURL }}"
+{{- end }}
+{{- if .LLMAPIKey }}
+                api_key: "{{ .Secret "openclaw_llm_api_key" .LLMAPIKey }}"
+{{- end }}
+{{- if .LLMModel }}
+                model: "{{ .LLMModel }}"
+{{- end }}
+{{- range .LLMExtras }}
+                {{ .Key }}: "{{ .Value }}"
+{{- end }}
+{{- else if eq .LLMProvider "anthropic" }}
+              anthropic:
+{{- if .LLMAPIKey }}
+                api_key: "{{ .Secret "openclaw_llm_api_key" .LLMAPIKey }}"
+{{- end }}
+{{- if .LLMModel }}
+                model: "{{ .LLMModel }}"
+{{- end }}
+{{- range .LLMExtras }}
+                {{ .Key }}: "{{ .Value }}"
+{{- end }}
+{{- else if eq .LLMProvider "azure_openai" }}
+              azure:
+{{- if .LLMBaseURL }}
+                api_base: "{{ .LLMBaseURL }}"
+{{- end }}
+{{- if .LLMAPIKey }}
+                api_key: "{{ .Secret "openclaw_llm_api_key" .LLMAPIKey }}"
+{{- end }}
+                deployment_name: "{{ .AzureDeploymentName }}"
+                api_version: "{{ .AzureAPIVersion }}"
+{{- range .LLMExtras }}
+                {{ .Key }}: "{{ .Value }}"
+{{- end }}
+{{- else if or .LLMEndpoint .LLMAPIEndpoint }}
               genai:
 {{- if .LLMEndpoint }}
                 endpoint: "{{ .LLMEndpoint }}"
@@ -44,30 +102,65 @@ instance_groups:
                 endpoint: "{{ .LLMAPIEndpoint }}"
 {{- end }}
 {{- if .LLMAPIKey }}
-                api_key: "{{ .LLMAPIKey }}"
+                api_key: "{{ .Secret "openclaw_llm_api_key" .LLMAPIKey }}"
 {{- end }}
 {{- if .LLMModel }}
                 model: "{{ .LLMModel }}"
 {{- end }}
-{{- end }}
-{{- if not (or .LLMEndpoint .LLMAPIEndpoint) }}
-{{- if .LLMAPIKey }}
+{{- else if .LLMAPIKey }}
               genai:
-                api_key: "{{ .LLMAPIKey }}"
+                api_key: "{{ .Secret "openclaw_llm_api_key" .LLMAPIKey }}"
 {{- if .LLMModel }}
                 model: "{{ .LLMModel }}"
 {{- end }}
 {{- end }}
-{{- end }}
 {{- if .LLMPreferredModel }}
               model_override: "{{ .LLMPreferredModel }}"
 {{- end }}
+{{- if .LLMTemperature }}
+              temperature: {{ float .LLMTemperature }}
+{{- end }}
+{{- if .LLMMaxTokens }}
+              max_tokens: {{ .LLMMaxTokens }}
+{{- end }}
+{{- if .LLMTopP }}
+              top_p: {{ float .LLMTopP }}
 {{- end }}
+{{- end }}
+            webchat:
+              port: {{ .WebchatPort }}
+              sso_port: {{ .WebchatSSOPort }}
             browser:
               enabled: {{ .BrowserEnabled }}
+{{- if or .MaxConcurrentTasks .MaxToolCallsPerMinute }}
+            limits:
+{{- if .MaxConcurrentTasks }}
+              max_concurrent_tasks: {{ .MaxConcurrentTasks }}
+{{- end }}
+{{- if .MaxToolCallsPerMinute }}
+              max_tool_calls_per_minute: {{ .MaxToolCallsPerMinute }}
+{{- end }}
+{{- end }}
+{{- with .AgentSettings }}
+            agent:
+              custom:
+{{- range . }}
+                {{ .Key }}: "{{ .Value }}"
+{{- end }}
+{{- end }}
+{{- with .Channels }}
+            channels:
+{{- range . }}
+              {{ .Name }}:
+                enabled: true
+{{- if .Credential }}
+                {{ .CredentialKey }}: "{{ $.Secret .SecretName .Credential }}"
+{{- end }}
+{{- end }}
+{{- end }}
             node:
               enabled: true
-              seed: "{{ .NodeSeed }}"
+              seed: "{{ .Secret "openclaw_node_seed" .NodeSeed }}"
             instance:
               id: "{{ .ID }}"
               owner: "{{ .Owner }}"
@@ -85,11 +178,11 @@ instance_groups:
         properties:
           openclaw:
             sso_proxy:
-              listen_port: 8080
-              upstream_port: 8081
+              listen_port: {{ .WebchatPort }}
+              upstream_port: {{ .WebchatSSOPort }}
               client_id: "{{ .SSOClientID }}"
-              client_secret: "{{ .SSOClientSecret }}"
-              cookie_secret: "{{ .SSOCookieSecret }}"
+              client_secret: "{{ .Secret "openclaw_sso_client_secret" .SSOClientSecret }}"
+              cookie_secret: "{{ .Secret "openclaw_sso_cookie_secret" .SSOCookieSecret }}"
               redirect_url: "https://{{ .RouteHostname }}.{{ .AppsDomain }}/oauth2/callback"
 {{- if .SSOOIDCIssuerURL }}
               oidc_issuer_url: "{{ .SSOOIDCIssuerURL }}"
@@ -101,13 +194,19 @@ instance_groups:
       - name: route_registrar
         release: routing
         consumes:
+{{- if .NATSTLS }}
           nats-tls:
             from: nats-tls
+{{- else }}
+          nats:
+            from: nats
+{{- end }}
             deployment: {{ .CFDeploymentName }}
         properties:
           nats:
             tls:
-              enabled: true
+              enabled: {{ .NATSTLS }}
+{{- if .NATSTLS }}
 {{- if .NATSTLSClientCert }}
               client_cert: |
 {{ indent 16 .NATSTLSClientCert }}
@@ -119,24 +218,43 @@ instance_groups:
 {{- if .NATSTLSCACert }}
               ca_cert: |
 {{ indent 16 .NATSTLSCACert }}
+{{- end }}
 {{- end }}
           route_registrar:
             routes:
               - name: "openclaw-{{ .ID }}"
-                registration_interval: 20s
-                port: 8080
+                registration_interval: {{ .RouteRegistrationInterval }}
+                port: {{ .WebchatPort }}
                 uris:
                   - "{{ .RouteHostname }}.{{ .AppsDomain }}"
 
+{{- with .VMResources }}
+    vm_resources:
+      cpu: {{ .CPU }}
+      ram: {{ .RAM }}
+      ephemeral_disk_size: {{ .EphemeralDiskSize }}
+{{- else }}
     vm_type: {{ .VMType }}
-    stemcell: default
+{{- end }}
+{{- if .VMExtensions }}
+    vm_extensions: [{{ range $i, $ext := .VMExtensions }}{{ if $i }}, {{ end }}"{{ $ext }}"{{ end }}]
+{{- end }}
+    stemcell: {{ .StemcellAlias }}
     azs: [{{ .AZsYAML }}]
     persistent_disk_type: {{ .DiskType }}
     networks:
-      - name: {{ .Network }}
+{{- range .NetworkList }}
+      - name: {{ .Name }}
+{{- if .Default }}
+        default: [{{ join .Default }}]
+{{- end }}
+{{- if .StaticIPs }}
+        static_ips: [{{ join .StaticIPs }}]
+{{- end }}
+{{- end }}
 
 stemcells:
-  - alias: default
+  - alias: {{ .StemcellAlias }}
     os: {{ .StemcellOS }}
     version: "{{ .StemcellVersion }}"
 
@@ -149,29 +267,85 @@ releases:
     version: "{{ .RoutingReleaseVersion }}"
 
 update:
-  canaries: 1
-  max_in_flight: 1
-  canary_watch_time: 30000-120000
-  update_watch_time: 30000-120000
+  canaries: {{ .Update.Canaries }}
+  max_in_flight: {{ .Update.MaxInFlight }}
+  canary_watch_time: {{ .Update.CanaryWatchTime }}
+  update_watch_time: {{ .Update.UpdateWatchTime }}
+{{- with .TagList }}
+
+tags:
+{{- range . }}
+  "{{ .Key }}": "{{ .Value }}"
+{{- end }}
+{{- end }}
+{{- with .ConfigServerVariables }}
+
+variables:
+{{- range . }}
+  - name: {{ .Name }}
+    type: password
+{{- end }}
+{{- end }}
 `
 
+// NetworkConfig is one entry in the agent instance group's networks list.
+// Default lists the properties (dns, gateway) this network provides when
+// the VM is attached to more than one network.
+type NetworkConfig struct {
+	Name      string   `json:"name" yaml:"name"`
+	Default   []string `json:"default,omitempty" yaml:"default,omitempty"`
+	StaticIPs []string `json:"static_ips,omitempty" yaml:"static_ips,omitempty"`
+}
+
+// UpdateConfig controls the BOSH update block of an agent deployment.
+// Zero values are replaced with defaults by RenderAgentManifest.
+type UpdateConfig struct {
+	Canaries        int    `json:"canaries,omitempty" yaml:"canaries,omitempty"`
+	MaxInFlight     int    `json:"max_in_flight,omitempty" yaml:"max_in_flight,omitempty"`
+	CanaryWatchTime string `json:"canary_watch_time,omitempty" yaml:"canary_watch_time,omitempty"`
+	UpdateWatchTime string `json:"update_watch_time,omitempty" yaml:"update_watch_time,omitempty"`
+}
+
+// withDefaults fills zero-valued fields with the conservative one-at-a-time
+// rollout the agent manifest has always used.
+func (u UpdateConfig) withDefaults() UpdateConfig {
+	if u.Canaries <= 0 {
+		u.Canaries = 1
+	}
+	if u.MaxInFlight <= 0 {
+		u.MaxInFlight = 1
+	}
+	if u.CanaryWatchTime == "" {
+		u.CanaryWatchTime = "30000-120000"
+	}
+	if u.UpdateWatchTime == "" {
+		u.UpdateWatchTime = "30000-120000"
+	}
+	return u
+}
+
 type ManifestParams struct {
 	DeploymentName        string
 	ID                    string
 	Owner                 string
 	PlanName              string
 	GatewayToken          string
+	BindingTokens         []string
 	NodeSeed              string
 	RouteHostname         string
 	VMType                string
+	VMResources           *VMResources // sized by the CPI instead of a cloud-config vm_type when set
+	VMExtensions          []string
 	DiskType              string
 	SSOEnabled            bool
 	OpenClawVersion       string
 	SandboxMode           string
-	Network               string
+	Network               string // convenience for a single network; ignored when Networks is set
+	Networks              []NetworkConfig
 	AZs                   []string
 	StemcellOS            string
 	StemcellVersion       string
+	StemcellAlias         string // names the stemcell entry; empty uses "default"
 	CFDeploymentName      string
 	OpenClawReleaseVersion string
 	BPMReleaseVersion      string
@@ -187,13 +361,169 @@ type ManifestParams struct {
 	LLMModel               string
 	LLMPreferredModel      string
 	LLMAPIEndpoint         string
+	LLMExtraParams         map[string]string
+	LLMTemperature         *float64
+	LLMMaxTokens           int
+	LLMTopP                *float64
 	BrowserEnabled         bool
+	MaxConcurrentTasks     int // caps tasks the agent runs at once; 0 renders no limit
+	MaxToolCallsPerMinute  int // caps the agent's tool call rate; 0 renders no limit
+	AgentCustom            map[string]string // openclaw.agent.custom settings; keys outside AgentCustomKeys are dropped
+	ChannelsEnabled        map[string]bool   // messaging channels by name; see MessagingChannels
+	ChannelCredentials     map[string]string // credential for each enabled channel, by channel name
+	CommandPolicy          string // "allowlist" renders AllowedCommands; anything else renders BlockedCommands
 	BlockedCommands        []string
+	AllowedCommands        []string
 	NATSTLSClientCert      string
 	NATSTLSClientKey       string
 	NATSTLSCACert          string
+	NATSTLSEnabled         *bool  // route_registrar talks to NATS over TLS; nil enables it
+	RouteRegistrationInterval string // how often route_registrar re-announces the route; empty uses DefaultRouteRegistrationInterval
 	SSOAllowedEmailDomains string
 	SSOSessionTimeoutHours int
+	Update                 UpdateConfig
+	TemplatePath           string // optional operator-supplied template; empty uses the built-in
+	UseConfigServer        bool   // reference secrets as ((variables)) stored in CredHub instead of inlining them
+	GatewayPort            int    // gateway WebSocket port; 0 uses DefaultGatewayPort
+	WebchatPort            int    // routed WebChat port, served by the SSO proxy when SSO is on; 0 uses DefaultWebchatPort
+	WebchatSSOPort         int    // WebChat port behind the SSO proxy; 0 uses DefaultWebchatSSOPort
+	Tags                   map[string]string // deployment tags BOSH applies to the VM and disk for IaaS cost allocation
+}
+
+// Default agent ports, matching the openclaw-agent job spec.
+const (
+	DefaultGatewayPort    = 18789
+	DefaultWebchatPort    = 8080
+	DefaultWebchatSSOPort = 8081
+)
+
+// VMResources sizes the agent VM directly. The CPI picks a matching instance
+// type, so plans don't need a vm_type in the Director's cloud config.
+type VMResources struct {
+	CPU               int
+	RAM               int // MB
+	EphemeralDiskSize int // MB
+}
+
+// DefaultEphemeralDiskMB is the ephemeral disk given to vm_resources VMs that
+// don't set one.
+const DefaultEphemeralDiskMB = 10240
+
+// DefaultRouteRegistrationInterval matches the routing release's default.
+const DefaultRouteRegistrationInterval = "20s"
+
+// ConfigServerVariable is a secret held in the Director's config server
+// (CredHub) and referenced from the manifest as ((Name)).
+type ConfigServerVariable struct {
+	Name  string
+	Value string
+}
+
+// Secret returns value for inlining, or a ((name)) reference when secrets
+// live in the config server.
+func (p ManifestParams) Secret(name, value string) string {
+	if p.UseConfigServer {
+		return "((" + name + "))"
+	}
+	return value
+}
+
+// ConfigServerVariables lists the secrets the manifest references when
+// UseConfigServer is set, in render order. Their values must be stored in the
+// config server before deploying. Returns nil when secrets are inlined.
+func (p ManifestParams) ConfigServerVariables() []ConfigServerVariable {
+	if !p.UseConfigServer {
+		return nil
+	}
+	vars := []ConfigServerVariable{{"openclaw_gateway_token", p.GatewayToken}}
+	if p.LLMProvider != "" && p.LLMAPIKey != "" {
+		vars = append(vars, ConfigServerVariable{"openclaw_llm_api_key", p.LLMAPIKey})
+	}
+	vars = append(vars, ConfigServerVariable{"openclaw_node_seed", p.NodeSeed})
+	if p.SSOEnabled {
+		vars = append(vars,
+			ConfigServerVariable{"openclaw_sso_client_secret", p.SSOClientSecret},
+			ConfigServerVariable{"openclaw_sso_cookie_secret", p.SSOCookieSecret},
+		)
+	}
+	for _, c := range p.Channels() {
+		if c.Credential != "" {
+			vars = append(vars, ConfigServerVariable{c.SecretName(), c.Credential})
+		}
+	}
+	return vars
+}
+
+// MessagingChannels maps each messaging channel a plan can enable through its
+// features to the name of the credential the channel needs.
+var MessagingChannels = map[string]string{
+	"slack":   "bot_token",
+	"teams":   "webhook_url",
+	"discord": "bot_token",
+}
+
+// AgentCustomKeys are the agent settings a provision may pass through to
+// openclaw.agent.custom, with the longest value (in characters) each accepts.
+// Keys are rendered unquoted, so anything added here must be a plain YAML
+// identifier.
+var AgentCustomKeys = map[string]int{
+	"system_prompt":  8000,
+	"assistant_name": 64,
+	"greeting":       1000,
+	"language":       35,
+	"timezone":       64,
+}
+
+// AgentSetting is one entry of the openclaw.agent.custom block.
+type AgentSetting struct {
+	Key   string
+	Value string
+}
+
+// AgentSettings returns AgentCustom sorted by key.
+func (p ManifestParams) AgentSettings() []AgentSetting {
+	settings := make([]AgentSetting, 0, len(p.AgentCustom))
+	for k, v := range p.AgentCustom {
+		settings = append(settings, AgentSetting{Key: k, Value: v})
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Key < settings[j].Key })
+	return settings
+}
+
+// Channel is an enabled messaging channel rendered into the channels block.
+type Channel struct {
+	Name          string
+	CredentialKey string
+	Credential    string
+}
+
+// SecretName is the config server variable holding the channel credential.
+func (c Channel) SecretName() string {
+	return "openclaw_" + c.Name + "_" + c.CredentialKey
+}
+
+// Channels returns the enabled messaging channels sorted by name. Unknown
+// channel names are skipped.
+func (p ManifestParams) Channels() []Channel {
+	var channels []Channel
+	for name, enabled := range p.ChannelsEnabled {
+		key, known := MessagingChannels[name]
+		if !enabled || !known {
+			continue
+		}
+		channels = append(channels, Channel{Name: name, CredentialKey: key, Credential: p.ChannelCredentials[name]})
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	return channels
+}
+
+// NetworkList returns the networks to render, falling back to the single
+// Network field for callers that only configure one.
+func (p ManifestParams) NetworkList() []NetworkConfig {
+	if len(p.Networks) > 0 {
+		return p.Networks
+	}
+	return []NetworkConfig{{Name: p.Network}}
 }
 
 // AZsYAML returns the AZs formatted for inline YAML: "az1, az2"
@@ -201,11 +531,105 @@ func (p ManifestParams) AZsYAML() string {
 	return strings.Join(p.AZs, ", ")
 }
 
+// azureDefaultAPIVersion is used when azure_openai is configured without an
+// explicit api_version extra param.
+const azureDefaultAPIVersion = "2024-06-01"
+
+// LLMParam is a single provider-specific setting rendered into the llm block.
+type LLMParam struct {
+	Key   string
+	Value string
+}
+
+// Tag is one entry of the deployment's tags block.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// TagList returns Tags sorted by key.
+func (p ManifestParams) TagList() []Tag {
+	tags := make([]Tag, 0, len(p.Tags))
+	for k, v := range p.Tags {
+		tags = append(tags, Tag{Key: k, Value: v})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+	return tags
+}
+
+// NATSTLS reports whether route_registrar connects to NATS over TLS.
+func (p ManifestParams) NATSTLS() bool {
+	return p.NATSTLSEnabled == nil || *p.NATSTLSEnabled
+}
+
+// LLMBaseURL returns the configured endpoint for providers that take a base
+// URL, preferring LLMEndpoint over the external LLMAPIEndpoint.
+func (p ManifestParams) LLMBaseURL() string {
+	if p.LLMEndpoint != "" {
+		return p.LLMEndpoint
+	}
+	return p.LLMAPIEndpoint
+}
+
+// AzureDeploymentName returns the Azure OpenAI deployment, falling back to
+// the model name since Azure deployments are commonly named after the model.
+func (p ManifestParams) AzureDeploymentName() string {
+	if v := p.LLMExtraParams["deployment_name"]; v != "" {
+		return v
+	}
+	return p.LLMModel
+}
+
+// AzureAPIVersion returns the Azure OpenAI REST API version to target.
+func (p ManifestParams) AzureAPIVersion() string {
+	if v := p.LLMExtraParams["api_version"]; v != "" {
+		return v
+	}
+	return azureDefaultAPIVersion
+}
+
+// LLMExtras returns LLMExtraParams sorted by key, minus the keys the template
+// already renders explicitly for the configured provider.
+func (p ManifestParams) LLMExtras() []LLMParam {
+	reserved := map[string]bool{"api_key": true, "model": true, "base_url": true, "api_base": true}
+	if p.LLMProvider == "azure_openai" {
+		reserved["deployment_name"] = true
+		reserved["api_version"] = true
+	}
+	var extras []LLMParam
+	for k, v := range p.LLMExtraParams {
+		if reserved[k] {
+			continue
+		}
+		extras = append(extras, LLMParam{Key: k, Value: v})
+	}
+	sort.Slice(extras, func(i, j int) bool { return extras[i].Key < extras[j].Key })
+	return extras
+}
+
 // yamlSafeControlChars strips control characters and escapes double quotes and
 // backslashes in strings that will be placed inside YAML double-quoted values.
 // This prevents YAML injection via user-supplied fields like Owner.
 var unsafeYAMLChars = regexp.MustCompile(`[^\x20-\x7E]`)
 
+// validTagKey restricts deployment tag keys to names every IaaS accepts.
+var validTagKey = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// validLLMParamKey restricts extra param keys to plain YAML identifiers, since
+// keys are rendered unquoted.
+var validLLMParamKey = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// sanitizeMultilineForYAML is sanitizeForYAML for free text such as a system
+// prompt, keeping newlines and tabs as YAML escape sequences.
+func sanitizeMultilineForYAML(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	s = strings.ReplaceAll(s, "\t", `\t`)
+	s = unsafeYAMLChars.ReplaceAllString(s, "")
+	return s
+}
+
 func sanitizeForYAML(s string) string {
 	s = strings.ReplaceAll(s, `\`, `\\`)
 	s = strings.ReplaceAll(s, `"`, `\"`)
@@ -213,6 +637,20 @@ func sanitizeForYAML(s string) string {
 	return s
 }
 
+// formatFloat renders an optional generation parameter without exponent
+// notation or trailing zeros (e.g. 0.7, not 7e-01).
+func formatFloat(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+// joinYAMLFlow renders values as the body of a YAML flow sequence: "a, b".
+func joinYAMLFlow(values []string) string {
+	return strings.Join(values, ", ")
+}
+
 // indent returns s with each line prefixed by the given number of spaces.
 // Used in the manifest template to indent PEM certificates inside YAML block scalars.
 func indentPEM(spaces int, s string) string {
@@ -227,6 +665,81 @@ func indentPEM(spaces int, s string) string {
 	return strings.Join(lines, "\n")
 }
 
+// manifestTemplates caches parsed templates by path; "" is the built-in template.
+var (
+	manifestTemplatesMu sync.Mutex
+	manifestTemplates   = map[string]*template.Template{}
+)
+
+// loadManifestTemplate returns the parsed template at path, or the built-in
+// agentManifestTemplate when path is empty or the file does not exist. Custom
+// templates are read once and cached for the life of the process.
+func loadManifestTemplate(path string) (*template.Template, error) {
+	manifestTemplatesMu.Lock()
+	defer manifestTemplatesMu.Unlock()
+
+	if path != "" {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if _, warned := manifestTemplates[path]; !warned {
+				log.Printf("WARNING: manifest template %s not found, using built-in template", path)
+				manifestTemplates[path] = nil
+			}
+			path = ""
+		}
+	}
+	if tmpl := manifestTemplates[path]; tmpl != nil {
+		return tmpl, nil
+	}
+
+	text := agentManifestTemplate
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest template %s: %w", path, err)
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("manifest").Funcs(template.FuncMap{
+		"indent": indentPEM,
+		"float":  formatFloat,
+		"join":   joinYAMLFlow,
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest template: %w", err)
+	}
+	manifestTemplates[path] = tmpl
+	return tmpl, nil
+}
+
+// ManifestInstanceID returns the openclaw.instance.id property recorded in an
+// agent deployment manifest, or "" if the manifest has none.
+func ManifestInstanceID(manifest []byte) string {
+	var parsed struct {
+		InstanceGroups []struct {
+			Jobs []struct {
+				Properties struct {
+					OpenClaw struct {
+						Instance struct {
+							ID string `yaml:"id"`
+						} `yaml:"instance"`
+					} `yaml:"openclaw"`
+				} `yaml:"properties"`
+			} `yaml:"jobs"`
+		} `yaml:"instance_groups"`
+	}
+	if err := yaml.Unmarshal(manifest, &parsed); err != nil {
+		return ""
+	}
+	for _, group := range parsed.InstanceGroups {
+		for _, job := range group.Jobs {
+			if id := job.Properties.OpenClaw.Instance.ID; id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
 func RenderAgentManifest(params ManifestParams) ([]byte, error) {
 	// Sanitize strings that go into YAML double-quoted values.
 	// PEM certs (NATSTLSClientCert/Key) are NOT sanitized because they go
@@ -243,20 +756,108 @@ func RenderAgentManifest(params ManifestParams) ([]byte, error) {
 	params.LLMModel = sanitizeForYAML(params.LLMModel)
 	params.LLMPreferredModel = sanitizeForYAML(params.LLMPreferredModel)
 	params.LLMAPIEndpoint = sanitizeForYAML(params.LLMAPIEndpoint)
+	if len(params.LLMExtraParams) > 0 {
+		extras := make(map[string]string, len(params.LLMExtraParams))
+		for k, v := range params.LLMExtraParams {
+			if !validLLMParamKey.MatchString(k) {
+				continue
+			}
+			extras[k] = sanitizeForYAML(v)
+		}
+		params.LLMExtraParams = extras
+	}
+	if len(params.Tags) > 0 {
+		tags := make(map[string]string, len(params.Tags))
+		for k, v := range params.Tags {
+			if !validTagKey.MatchString(k) {
+				continue
+			}
+			tags[k] = sanitizeForYAML(v)
+		}
+		params.Tags = tags
+	}
+	if len(params.ChannelCredentials) > 0 {
+		creds := make(map[string]string, len(params.ChannelCredentials))
+		for k, v := range params.ChannelCredentials {
+			creds[k] = sanitizeForYAML(v)
+		}
+		params.ChannelCredentials = creds
+	}
+	if len(params.AgentCustom) > 0 {
+		custom := make(map[string]string, len(params.AgentCustom))
+		for k, v := range params.AgentCustom {
+			if _, ok := AgentCustomKeys[k]; !ok {
+				continue
+			}
+			custom[k] = sanitizeMultilineForYAML(v)
+		}
+		params.AgentCustom = custom
+	}
+	for i := range params.BindingTokens {
+		params.BindingTokens[i] = sanitizeForYAML(params.BindingTokens[i])
+	}
+	networks := make([]NetworkConfig, len(params.Networks))
+	for i, n := range params.Networks {
+		networks[i] = NetworkConfig{Name: sanitizeForYAML(n.Name)}
+		for _, d := range n.Default {
+			networks[i].Default = append(networks[i].Default, sanitizeForYAML(d))
+		}
+		for _, ip := range n.StaticIPs {
+			networks[i].StaticIPs = append(networks[i].StaticIPs, sanitizeForYAML(ip))
+		}
+	}
+	params.Networks = networks
+	for i := range params.VMExtensions {
+		params.VMExtensions[i] = sanitizeForYAML(params.VMExtensions[i])
+	}
 	for i := range params.BlockedCommands {
 		params.BlockedCommands[i] = sanitizeForYAML(params.BlockedCommands[i])
 	}
+	for i := range params.AllowedCommands {
+		params.AllowedCommands[i] = sanitizeForYAML(params.AllowedCommands[i])
+	}
+	params.Update = params.Update.withDefaults()
+	if params.StemcellAlias == "" {
+		params.StemcellAlias = "default"
+	}
+	if params.GatewayPort <= 0 {
+		params.GatewayPort = DefaultGatewayPort
+	}
+	if params.WebchatPort <= 0 {
+		params.WebchatPort = DefaultWebchatPort
+	}
+	if params.WebchatSSOPort <= 0 {
+		params.WebchatSSOPort = DefaultWebchatSSOPort
+	}
+	if params.VMResources != nil && params.VMResources.EphemeralDiskSize <= 0 {
+		resources := *params.VMResources
+		resources.EphemeralDiskSize = DefaultEphemeralDiskMB
+		params.VMResources = &resources
+	}
+	if params.RouteRegistrationInterval == "" {
+		params.RouteRegistrationInterval = DefaultRouteRegistrationInterval
+	}
+	if d, err := time.ParseDuration(params.RouteRegistrationInterval); err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid route registration interval %q", params.RouteRegistrationInterval)
+	}
+	params.Update.CanaryWatchTime = sanitizeForYAML(params.Update.CanaryWatchTime)
+	params.Update.UpdateWatchTime = sanitizeForYAML(params.Update.UpdateWatchTime)
 
-	tmpl, err := template.New("manifest").Funcs(template.FuncMap{
-		"indent": indentPEM,
-	}).Parse(agentManifestTemplate)
+	tmpl, err := loadManifestTemplate(params.TemplatePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse manifest template: %w", err)
+		return nil, err
 	}
 
 	var buf bytes.Buffer
 	if err := tmpl.Execute(&buf, params); err != nil {
 		return nil, fmt.Errorf("failed to render manifest: %w", err)
 	}
+
+	// Catch malformed output here rather than as an opaque Director error.
+	// Unquoted fields (vm_type, network, AZs) are not sanitized above.
+	var parsed map[string]interface{}
+	if err := yaml.Unmarshal(buf.Bytes(), &parsed); err != nil {
+		return nil, fmt.Errorf("rendered manifest is not valid YAML: %w", err)
+	}
 	return buf.Bytes(), nil
 }
@@ -1,55 +1,683 @@
 package broker
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/bosh"
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/security"
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/uaa"
 )
 
-// AdminListInstances returns all known instances as a JSON array.
-// The errand's json_array_len counts "id" fields, so each entry must include "id".
+// RegisterAdminRoutes adds the admin API handlers to r, which is expected to
+// be mounted at /admin behind BasicAuthMiddleware.
+func (b *Broker) RegisterAdminRoutes(r *mux.Router) {
+	r.HandleFunc("/instances", b.AdminListInstances).Methods("GET")
+	r.HandleFunc("/instances/search", b.AdminSearchInstances).Methods("GET")
+	r.HandleFunc("/instances/{id}", b.AdminGetInstance).Methods("GET")
+	r.HandleFunc("/instances/{id}", b.AdminDeleteInstance).Methods("DELETE")
+	r.HandleFunc("/instances/{id}/vms", b.AdminInstanceVMs).Methods("GET")
+	r.HandleFunc("/instances/{id}/recreate", b.AdminRecreateInstance).Methods("POST")
+	r.HandleFunc("/instances/{id}/rotate-token", b.AdminRotateToken).Methods("POST")
+	r.HandleFunc("/deprovision-all", b.AdminDeprovisionAll).Methods("POST")
+	r.HandleFunc("/reconcile", b.AdminReconcile).Methods("POST")
+	r.HandleFunc("/export", b.AdminExport).Methods("GET")
+	r.HandleFunc("/import", b.AdminImport).Methods("POST")
+	r.HandleFunc("/upgrade", b.AdminUpgrade).Methods("POST")
+	r.HandleFunc("/upgrade/status", b.AdminUpgradeStatus).Methods("GET")
+	r.HandleFunc("/upgrade/rollback", b.AdminUpgradeRollback).Methods("POST")
+	r.HandleFunc("/audit", b.AdminAudit).Methods("GET")
+	r.HandleFunc("/maintenance", b.AdminGetMaintenance).Methods("GET")
+	r.HandleFunc("/maintenance", b.AdminSetMaintenance).Methods("POST")
+}
+
+// instanceListMediaType selects the {"count", "instances"} envelope from
+// AdminListInstances, as does ?envelope=true.
+const instanceListMediaType = "application/vnd.openclaw.instance-list+json"
+
+// wantsInstanceEnvelope reports whether the caller asked for the counted
+// envelope instead of the plain array.
+func wantsInstanceEnvelope(r *http.Request) bool {
+	if v, err := strconv.ParseBool(r.URL.Query().Get("envelope")); err == nil && v {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), instanceListMediaType)
+}
+
+// AdminInstance is one entry of AdminListInstances.
+type AdminInstance struct {
+	ID              string            `json:"id"`
+	DeploymentName  string            `json:"deployment_name"`
+	State           string            `json:"state"`
+	OpenClawVersion string            `json:"openclaw_version"`
+	PlanName        string            `json:"plan_name"`
+	Owner           string            `json:"owner"`
+	Tags            []string          `json:"tags,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// AdminInstanceList is the counted envelope AdminListInstances returns when
+// asked for instanceListMediaType.
+type AdminInstanceList struct {
+	Count     int             `json:"count"`
+	Instances []AdminInstance `json:"instances"`
+}
+
+// AdminListInstances returns all known instances, excluding those being
+// deprovisioned, as a JSON array ordered by ID. X-Total-Count always carries the number
+// returned; callers that need it in the body (the upgrade-agents errand)
+// request the {"count": N, "instances": [...]} envelope.
 func (b *Broker) AdminListInstances(w http.ResponseWriter, r *http.Request) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	type instanceInfo struct {
-		ID              string `json:"id"`
-		DeploymentName  string `json:"deployment_name"`
-		State           string `json:"state"`
-		OpenClawVersion string `json:"openclaw_version"`
-		PlanName        string `json:"plan_name"`
-		Owner           string `json:"owner"`
+	list := make([]AdminInstance, 0, len(b.instances))
+	for _, inst := range b.sortedInstances() {
+		if inst.State == "deprovisioning" {
+			continue
+		}
+		list = append(list, adminInstance(inst))
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(list)))
+	if wantsInstanceEnvelope(r) {
+		writeJSON(w, http.StatusOK, AdminInstanceList{Count: len(list), Instances: list})
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func adminInstance(inst *Instance) AdminInstance {
+	return AdminInstance{
+		ID:              inst.ID,
+		DeploymentName:  inst.DeploymentName,
+		State:           inst.State,
+		OpenClawVersion: inst.OpenClawVersion,
+		PlanName:        inst.PlanName,
+		Owner:           inst.Owner,
+		Tags:            inst.Tags,
+		Labels:          inst.Labels,
+	}
+}
+
+// AdminSearchInstances returns the instances matching every given filter of
+// ?owner=&route=&org=, sorted by ID, for finding the instance behind a
+// support request. owner matches case-insensitively; route matches the route
+// hostname alone or with its apps domain, and may be a full URL; org matches
+// the org GUID. At least one filter is required.
+func (b *Broker) AdminSearchInstances(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	owner, route, org := strings.TrimSpace(query.Get("owner")), routeHost(query.Get("route")), strings.TrimSpace(query.Get("org"))
+	if owner == "" && route == "" && org == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "At least one of owner, route or org is required"})
+		return
+	}
+
+	b.mu.RLock()
+	list := []AdminInstance{}
+	for _, inst := range b.sortedInstances() {
+		if inst.State == "deprovisioning" {
+			continue
+		}
+		if owner != "" && !strings.EqualFold(inst.Owner, owner) {
+			continue
+		}
+		if route != "" && route != inst.RouteHostname && route != inst.RouteHostname+"."+inst.AppsDomain {
+			continue
+		}
+		if org != "" && org != inst.OrgGUID {
+			continue
+		}
+		list = append(list, adminInstance(inst))
+	}
+	b.mu.RUnlock()
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(list)))
+	writeJSON(w, http.StatusOK, list)
+}
+
+// routeHost reduces a reported route to its hostname, accepting a bare
+// hostname or a URL such as https://host.apps.example.com/chat.
+func routeHost(route string) string {
+	route = strings.TrimSpace(route)
+	if strings.Contains(route, "://") {
+		if u, err := url.Parse(route); err == nil {
+			return u.Hostname()
+		}
+	}
+	return route
+}
+
+// AdminBinding describes a binding without exposing its gateway token.
+type AdminBinding struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AdminInstanceDetail is everything the broker knows about an instance, with
+// secrets reduced to whether they are present.
+type AdminInstanceDetail struct {
+	ID                     string               `json:"id"`
+	PlanID                 string               `json:"plan_id"`
+	PlanName               string               `json:"plan_name"`
+	Owner                  string               `json:"owner"`
+	OrgGUID                string               `json:"org_guid"`
+	SpaceGUID              string               `json:"space_guid"`
+	DeploymentName         string               `json:"deployment_name"`
+	RouteHostname          string               `json:"route_hostname"`
+	AppsDomain             string               `json:"apps_domain"`
+	VMType                 string               `json:"vm_type"`
+	DiskType               string               `json:"disk_type"`
+	AZ                     string               `json:"az,omitempty"`
+	State                  string               `json:"state"`
+	OpenClawVersion        string               `json:"openclaw_version"`
+	BoshTaskID             int                  `json:"bosh_task_id"`
+	BoshTaskState          string               `json:"bosh_task_state,omitempty"`
+	BoshTaskError          string               `json:"bosh_task_error,omitempty"`
+	LastError              string               `json:"last_error,omitempty"`
+	CreatedBy              *OriginatingIdentity `json:"created_by,omitempty"`
+	LastModifiedBy         *OriginatingIdentity `json:"last_modified_by,omitempty"`
+	CreatedAt              time.Time            `json:"created_at,omitzero"`
+	SSOEnabled             bool                 `json:"sso_enabled"`
+	SSOClientID            string               `json:"sso_client_id,omitempty"`
+	SSOClientSecretPresent bool                 `json:"sso_client_secret_present"`
+	SSOCookieSecretPresent bool                 `json:"sso_cookie_secret_present"`
+	GatewayTokenPresent    bool                 `json:"gateway_token_present"`
+	NodeSeedPresent        bool                 `json:"node_seed_present"`
+	Tags                   []string             `json:"tags,omitempty"`
+	Labels                 map[string]string    `json:"labels,omitempty"`
+	Bindings               []AdminBinding       `json:"bindings"`
+}
+
+// AdminGetInstance returns the full detail of a single instance plus the live
+// state of its most recent BOSH task.
+func (b *Broker) AdminGetInstance(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["id"]
+
+	b.mu.RLock()
+	inst, exists := b.instances[instanceID]
+	if !exists {
+		b.mu.RUnlock()
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Instance not found"})
+		return
+	}
+	detail := AdminInstanceDetail{
+		ID:                     inst.ID,
+		PlanID:                 inst.PlanID,
+		PlanName:               inst.PlanName,
+		Owner:                  inst.Owner,
+		OrgGUID:                inst.OrgGUID,
+		SpaceGUID:              inst.SpaceGUID,
+		DeploymentName:         inst.DeploymentName,
+		RouteHostname:          inst.RouteHostname,
+		AppsDomain:             inst.AppsDomain,
+		VMType:                 inst.VMType,
+		DiskType:               inst.DiskType,
+		AZ:                     inst.AZ,
+		State:                  inst.State,
+		OpenClawVersion:        inst.OpenClawVersion,
+		BoshTaskID:             inst.BoshTaskID,
+		LastError:              inst.LastError,
+		CreatedBy:              inst.CreatedBy,
+		LastModifiedBy:         inst.LastModifiedBy,
+		CreatedAt:              inst.CreatedAt,
+		SSOEnabled:             inst.SSOEnabled,
+		SSOClientID:            inst.SSOClientID,
+		SSOClientSecretPresent: inst.SSOClientSecret != "",
+		SSOCookieSecretPresent: inst.SSOCookieSecret != "",
+		GatewayTokenPresent:    inst.GatewayToken != "",
+		NodeSeedPresent:        inst.NodeSeed != "",
+		Tags:                   inst.Tags,
+		Labels:                 inst.Labels,
+		Bindings:               make([]AdminBinding, 0, len(inst.Bindings)),
+	}
+	for _, binding := range inst.Bindings {
+		detail.Bindings = append(detail.Bindings, AdminBinding{ID: binding.ID, CreatedAt: binding.CreatedAt})
+	}
+	b.mu.RUnlock()
+	sort.Slice(detail.Bindings, func(i, j int) bool { return detail.Bindings[i].ID < detail.Bindings[j].ID })
+
+	// Fetch live task state outside the lock; a Director error is reported
+	// in the response rather than failing the whole request.
+	if detail.BoshTaskID != 0 {
+		state, err := b.taskStatus(r.Context(), instanceID, detail.BoshTaskID)
+		if err != nil {
+			detail.BoshTaskError = err.Error()
+		} else {
+			detail.BoshTaskState = state
+		}
+	}
+	writeJSON(w, http.StatusOK, detail)
+}
+
+// AdminDeleteSummary reports what AdminDeleteInstance cleaned up.
+type AdminDeleteSummary struct {
+	InstanceID       string `json:"instance_id"`
+	DeploymentName   string `json:"deployment_name"`
+	BoshTaskID       int    `json:"bosh_task_id,omitempty"`
+	BoshError        string `json:"bosh_error,omitempty"`
+	UAAClientDeleted bool   `json:"uaa_client_deleted"`
+	UAAError         string `json:"uaa_error,omitempty"`
+	StateRemoved     bool   `json:"state_removed"`
+}
+
+// AdminDeleteInstance deletes an instance's BOSH deployment and purges it
+// from broker state. Without force=true a Director error leaves the instance
+// untouched; with force=true the record and SSO client are removed regardless,
+// which also covers deployments the broker has no record of.
+func (b *Broker) AdminDeleteInstance(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["id"]
+	force := r.URL.Query().Get("force") == "true"
+	ctx := r.Context()
+
+	b.mu.RLock()
+	inst, exists := b.instances[instanceID]
+	var deploymentName, ssoClientID string
+	if exists {
+		deploymentName = inst.DeploymentName
+		ssoClientID = inst.SSOClientID
+	}
+	b.mu.RUnlock()
+
+	if !exists {
+		if !force || !validInstanceID.MatchString(instanceID) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "Instance not found"})
+			return
+		}
+		deploymentName = b.deploymentName(instanceID)
+		ssoClientID = uaa.ClientIDForInstance(instanceID)
+	}
+
+	summary := b.adminDelete(ctx, instanceID, deploymentName, ssoClientID, force)
+	if summary.BoshError != "" && !force {
+		writeJSON(w, http.StatusBadGateway, summary)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// adminDelete deletes an instance's BOSH deployment and SSO client and drops
+// it from broker state. A Director error stops there unless force is set.
+func (b *Broker) adminDelete(ctx context.Context, instanceID, deploymentName, ssoClientID string, force bool) AdminDeleteSummary {
+	// Wait out any Update still submitting its deploy, so the delete is
+	// issued after it and no deployment is left behind
+	unlock := b.ops.lock(instanceID)
+	defer unlock()
+
+	done := b.beginBOSHWrite()
+	defer done()
+
+	summary := AdminDeleteSummary{InstanceID: instanceID, DeploymentName: deploymentName}
+	taskID, err := b.deleteDeployment(ctx, instanceID, deploymentName)
+	if err != nil {
+		summary.BoshError = err.Error()
+		b.logger.WarnContext(ctx, "admin delete: BOSH delete failed", "operation", "admin_delete",
+			"instance_id", instanceID, "deployment", deploymentName, "force", force, "error", err)
+		if !force {
+			return summary
+		}
+	} else {
+		summary.BoshTaskID = taskID
+	}
+
+	if ssoClientID != "" && b.uaaClient != nil {
+		if err := b.traceUAA(ctx, "uaa.delete_client", instanceID, ssoClientID, func() error { return b.uaaClient.DeleteClient(ssoClientID) }); err != nil {
+			summary.UAAError = err.Error()
+		} else {
+			summary.UAAClientDeleted = true
+		}
 	}
 
-	list := make([]instanceInfo, 0, len(b.instances))
+	b.mu.Lock()
+	_, summary.StateRemoved = b.instances[instanceID]
+	b.removeInstance(instanceID)
+	b.mu.Unlock()
+	b.saveInstance(instanceID)
+
+	b.logger.InfoContext(ctx, "admin delete completed", "operation", "admin_delete", "instance_id", instanceID,
+		"deployment", deploymentName, "bosh_task_id", summary.BoshTaskID, "force", force,
+		"uaa_client_deleted", summary.UAAClientDeleted, "state_removed", summary.StateRemoved)
+	return summary
+}
+
+// BulkDeleteCandidate is an instance AdminDeprovisionAll matched.
+type BulkDeleteCandidate struct {
+	InstanceID     string `json:"instance_id"`
+	DeploymentName string `json:"deployment_name"`
+	PlanName       string `json:"plan_name"`
+	OrgGUID        string `json:"org_guid"`
+	ssoClientID    string
+}
+
+// DeprovisionAllRequest is the AdminDeprovisionAll body.
+type DeprovisionAllRequest struct {
+	OrgGUID     string `json:"org_guid,omitempty"`
+	Plan        string `json:"plan,omitempty"`
+	DryRun      bool   `json:"dry_run,omitempty"`
+	MaxParallel int    `json:"max_parallel,omitempty"`
+}
+
+// DeprovisionAllResult reports what AdminDeprovisionAll matched and, unless
+// it was a dry run, how each delete went.
+type DeprovisionAllResult struct {
+	DryRun    bool                  `json:"dry_run"`
+	Matched   int                   `json:"matched"`
+	Instances []BulkDeleteCandidate `json:"instances,omitempty"` // dry run only
+	Submitted int                   `json:"submitted"`
+	Failed    int                   `json:"failed"`
+	Results   []AdminDeleteSummary  `json:"results,omitempty"`
+}
+
+// AdminDeprovisionAll deletes every instance matching an optional
+// {"org_guid", "plan"} filter (plan matches the plan name or ID), as when
+// tearing down a foundation. Each match is deleted as AdminDeleteInstance
+// would, at most max_parallel at a time. With dry_run the matches are listed
+// and nothing is touched. Returns {"matched", "submitted", "failed", ...}.
+func (b *Broker) AdminDeprovisionAll(w http.ResponseWriter, r *http.Request) {
+	var req DeprovisionAllRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Bad request"})
+		return
+	}
+	ctx := r.Context()
+
+	b.mu.RLock()
+	var matched []BulkDeleteCandidate
 	for _, inst := range b.instances {
 		if inst.State == "deprovisioning" {
 			continue
 		}
-		list = append(list, instanceInfo{
-			ID:              inst.ID,
-			DeploymentName:  inst.DeploymentName,
-			State:           inst.State,
-			OpenClawVersion: inst.OpenClawVersion,
-			PlanName:        inst.PlanName,
-			Owner:           inst.Owner,
+		if req.OrgGUID != "" && inst.OrgGUID != req.OrgGUID {
+			continue
+		}
+		if req.Plan != "" && inst.PlanName != req.Plan && inst.PlanID != req.Plan {
+			continue
+		}
+		matched = append(matched, BulkDeleteCandidate{
+			InstanceID:     inst.ID,
+			DeploymentName: inst.DeploymentName,
+			PlanName:       inst.PlanName,
+			OrgGUID:        inst.OrgGUID,
+			ssoClientID:    inst.SSOClientID,
 		})
 	}
+	b.mu.RUnlock()
+	sort.Slice(matched, func(i, j int) bool { return matched[i].InstanceID < matched[j].InstanceID })
 
-	writeJSON(w, http.StatusOK, list)
+	if req.DryRun {
+		writeJSON(w, http.StatusOK, DeprovisionAllResult{DryRun: true, Matched: len(matched), Instances: matched})
+		return
+	}
+
+	b.logger.WarnContext(ctx, "bulk deprovision started", "operation", "admin_deprovision_all",
+		"org_guid", req.OrgGUID, "plan", req.Plan, "matched", len(matched))
+	maxParallel := req.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = 1
+	}
+	results := make([]AdminDeleteSummary, len(matched))
+	sem := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+	for i, c := range matched {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, c BulkDeleteCandidate) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = b.adminDelete(ctx, c.InstanceID, c.DeploymentName, c.ssoClientID, false)
+		}(i, c)
+	}
+	wg.Wait()
+
+	submitted, failed := 0, 0
+	for _, res := range results {
+		if res.BoshError != "" {
+			failed++
+		} else {
+			submitted++
+		}
+	}
+	b.logger.WarnContext(ctx, "bulk deprovision finished", "operation", "admin_deprovision_all",
+		"matched", len(matched), "submitted", submitted, "failed", failed)
+	writeJSON(w, http.StatusOK, DeprovisionAllResult{Matched: len(matched), Submitted: submitted, Failed: failed, Results: results})
+}
+
+// RecreateResult is the AdminRecreateInstance response.
+type RecreateResult struct {
+	InstanceID string `json:"instance_id"`
+	BoshTaskID int    `json:"bosh_task_id"`
+}
+
+// AdminRecreateInstance recreates an instance's VMs from the manifest BOSH
+// already has, replacing an unhealthy VM without changing its version. The
+// task is tracked like an upgrade, so /admin/upgrade/status reports it.
+func (b *Broker) AdminRecreateInstance(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["id"]
+	ctx := r.Context()
+
+	// Hold the operation lock until the new task is recorded, so a concurrent
+	// Deprovision can't be overwritten with "provisioning"
+	unlock := b.ops.lock(instanceID)
+	defer unlock()
+
+	done := b.beginBOSHWrite()
+	defer done()
+
+	b.mu.Lock()
+	inst, exists := b.instances[instanceID]
+	if !exists {
+		b.mu.Unlock()
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Instance not found"})
+		return
+	}
+	if inst.State != "ready" && inst.State != "failed" {
+		state := inst.State
+		b.mu.Unlock()
+		writeJSON(w, http.StatusConflict, map[string]string{
+			"error":       "OperationInProgress",
+			"description": fmt.Sprintf("Instance is %s; wait for it to finish before recreating", state),
+		})
+		return
+	}
+	deploymentName := inst.DeploymentName
+	b.mu.Unlock()
+
+	taskID, err := b.recreate(ctx, instanceID, deploymentName)
+	if err != nil {
+		b.logger.ErrorContext(ctx, "BOSH recreate failed", "operation", "recreate", "instance_id", instanceID,
+			"deployment", deploymentName, "error", err)
+		status := http.StatusBadGateway
+		if errors.Is(err, bosh.ErrDeploymentNotFound) {
+			status = http.StatusNotFound
+		}
+		writeJSON(w, status, map[string]string{"error": "Recreate failed", "description": err.Error()})
+		return
+	}
+
+	b.mu.Lock()
+	b.setInstanceState(inst, "provisioning")
+	inst.BoshTaskID = taskID
+	b.mu.Unlock()
+	b.upgrades.trackOperation(instanceID, taskID, "recreate")
+	b.saveInstance(instanceID)
+
+	b.logger.InfoContext(ctx, "recreate started", "operation", "recreate", "instance_id", instanceID, "bosh_task_id", taskID)
+	b.audit(ctx, "recreate", instanceID, "", nil)
+	writeJSON(w, http.StatusAccepted, RecreateResult{InstanceID: instanceID, BoshTaskID: taskID})
+}
+
+// RotateTokenResult is the AdminRotateToken response.
+type RotateTokenResult struct {
+	InstanceID          string   `json:"instance_id"`
+	GatewayToken        string   `json:"gateway_token"`
+	BoshTaskID          int      `json:"bosh_task_id"`
+	InvalidatedBindings []string `json:"invalidated_bindings"`
+}
+
+// AdminRotateToken replaces a ready or failed instance's gateway token and
+// redeploys so the agent stops accepting the old one. Bindings carry
+// credentials derived from the instance, so they are invalidated and listed in
+// the response for the app owners to rebind. The new token is only ever
+// returned here.
+func (b *Broker) AdminRotateToken(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["id"]
+	ctx := r.Context()
+
+	// Hold the operation lock until the new task is recorded, so a concurrent
+	// Deprovision can't be overwritten with "provisioning"
+	unlock := b.ops.lock(instanceID)
+	defer unlock()
+
+	done := b.beginBOSHWrite()
+	defer done()
+
+	b.mu.Lock()
+	inst, exists := b.instances[instanceID]
+	if !exists {
+		b.mu.Unlock()
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Instance not found"})
+		return
+	}
+	if inst.State != "ready" && inst.State != "failed" {
+		state := inst.State
+		b.mu.Unlock()
+		writeJSON(w, http.StatusConflict, map[string]string{
+			"error":       "OperationInProgress",
+			"description": fmt.Sprintf("Instance is %s; wait for it to finish before rotating its token", state),
+		})
+		return
+	}
+	oldToken, oldBindings := inst.GatewayToken, inst.Bindings
+	invalidated := make([]string, 0, len(oldBindings))
+	for id := range oldBindings {
+		invalidated = append(invalidated, id)
+	}
+	sort.Strings(invalidated)
+	inst.GatewayToken = security.GenerateGatewayToken()
+	inst.Bindings = nil
+	newToken := inst.GatewayToken
+	params := b.buildManifestParams(inst)
+	b.mu.Unlock()
+
+	// Until the deploy is submitted the agent still runs the old token, so a
+	// failure puts back what the rotation took. Bind and Unbind wait on the
+	// operation lock, so none of the old bindings can have been revoked.
+	restore := func() {
+		b.mu.Lock()
+		if inst.GatewayToken == newToken {
+			inst.GatewayToken = oldToken
+		}
+		for id, binding := range oldBindings {
+			if _, exists := inst.Bindings[id]; exists {
+				continue
+			}
+			if inst.Bindings == nil {
+				inst.Bindings = make(map[string]*Binding)
+			}
+			inst.Bindings[id] = binding
+		}
+		b.mu.Unlock()
+	}
+	manifest, err := b.renderManifest(params)
+	if err != nil {
+		restore()
+		b.logger.ErrorContext(ctx, "manifest render failed", "operation", "rotate_token", "instance_id", instanceID, "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to render deployment manifest"})
+		return
+	}
+	taskID, err := b.deploy(ctx, instanceID, manifest)
+	if err != nil {
+		restore()
+		b.logger.ErrorContext(ctx, "BOSH deploy failed", "operation", "rotate_token", "instance_id", instanceID, "error", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "Token rotation deployment failed", "description": err.Error()})
+		return
+	}
+
+	b.mu.Lock()
+	b.setInstanceState(inst, "provisioning")
+	inst.BoshTaskID = taskID
+	b.mu.Unlock()
+	b.upgrades.trackOperation(instanceID, taskID, "rotate-token")
+	b.saveInstance(instanceID)
+
+	b.logger.InfoContext(ctx, "gateway token rotated, redeploying", "operation", "rotate_token", "instance_id", instanceID,
+		"bosh_task_id", taskID, "invalidated_bindings", len(invalidated))
+	b.audit(ctx, "rotate-token", instanceID, "", nil)
+	writeJSON(w, http.StatusAccepted, RotateTokenResult{
+		InstanceID:          instanceID,
+		GatewayToken:        newToken,
+		BoshTaskID:          taskID,
+		InvalidatedBindings: invalidated,
+	})
+}
+
+// AdminInstanceVMs returns the BOSH VMs (instance group, index, IPs, process
+// state) backing a single instance.
+func (b *Broker) AdminInstanceVMs(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["id"]
+
+	b.mu.RLock()
+	inst, exists := b.instances[instanceID]
+	var deploymentName string
+	if exists {
+		deploymentName = inst.DeploymentName
+	}
+	b.mu.RUnlock()
+	if !exists {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Instance not found"})
+		return
+	}
+
+	vms, err := b.director.VMInstances(deploymentName)
+	if err != nil {
+		b.logger.ErrorContext(r.Context(), "VM listing failed", "operation", "admin_vms", "instance_id", instanceID,
+			"deployment", deploymentName, "error", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{
+			"error":       "Failed to list VMs from BOSH",
+			"description": err.Error(),
+		})
+		return
+	}
+	if vms == nil {
+		vms = []bosh.VMInfo{}
+	}
+	writeJSON(w, http.StatusOK, vms)
+}
+
+// UpgradeRequest is the AdminUpgrade body.
+type UpgradeRequest struct {
+	TargetVersion string `json:"target_version,omitempty"`
+	Count         int    `json:"count"`
+	MaxParallel   int    `json:"max_parallel,omitempty"`
+}
+
+// UpgradeResult is the AdminUpgrade response. SSOSkipped lists instances left
+// at their old version because their UAA client couldn't be refreshed.
+type UpgradeResult struct {
+	Upgrading  int      `json:"upgrading"`
+	SSOSkipped []string `json:"sso_skipped,omitempty"`
 }
 
 // AdminUpgrade triggers BOSH redeploys for instances that need upgrading.
 // Accepts {"target_version": "...", "count": N, "max_parallel": N}.
-// Picks up to count instances whose version differs from the broker's configured version.
+// Picks up to count instances, in ID order, whose version differs from the broker's configured version
+// and deploys them with at most max_parallel (default 1) in flight at once.
+// SSO instances whose UAA client redirect URI can't be refreshed are skipped
+// and listed in sso_skipped rather than redeployed with broken login.
 func (b *Broker) AdminUpgrade(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		TargetVersion string `json:"target_version"`
-		Count         int    `json:"count"`
-		MaxParallel   int    `json:"max_parallel"`
-	}
+	var req UpgradeRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Bad request"})
 		return
@@ -59,17 +687,19 @@ func (b *Broker) AdminUpgrade(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	configVersion := b.config.OpenClawVersion
-
-	// Collect instances that need upgrading
+	// Collect instances behind the version their plan deploys; pinned plans
+	// upgrade only to their pin.
 	b.mu.Lock()
 	var candidates []*Instance
-	for _, inst := range b.instances {
+	targets := make(map[string]string)
+	for _, inst := range b.sortedInstances() {
 		if inst.State == "deprovisioning" {
 			continue
 		}
-		if inst.OpenClawVersion != configVersion {
+		target := b.planVersion(b.findPlan(inst.PlanID))
+		if needsUpgrade(inst.OpenClawVersion, target) {
 			candidates = append(candidates, inst)
+			targets[inst.ID] = target
 		}
 		if len(candidates) >= req.Count {
 			break
@@ -77,42 +707,239 @@ func (b *Broker) AdminUpgrade(w http.ResponseWriter, r *http.Request) {
 	}
 	b.mu.Unlock()
 
-	upgraded := 0
+	// Deploy at most max_parallel candidates at once so a large upgrade
+	// doesn't flood the Director with concurrent deployments.
+	maxParallel := req.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = 1
+	}
+	sem := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+	var upgraded atomic.Int32
+	var skippedMu sync.Mutex
+	var ssoSkipped []string
 	for _, inst := range candidates {
-		b.mu.RLock()
-		params := b.buildManifestParams(inst)
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(inst *Instance) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := b.upgradeInstance(r.Context(), inst, targets[inst.ID])
+			switch {
+			case err == nil:
+				upgraded.Add(1)
+			case errors.Is(err, errSSORefresh):
+				skippedMu.Lock()
+				ssoSkipped = append(ssoSkipped, inst.ID)
+				skippedMu.Unlock()
+			}
+		}(inst)
+	}
+	wg.Wait()
+	sort.Strings(ssoSkipped)
+
+	writeJSON(w, http.StatusOK, UpgradeResult{Upgrading: int(upgraded.Load()), SSOSkipped: ssoSkipped})
+}
+
+// needsUpgrade reports whether an instance at current is older than target,
+// including hotfix builds of the same day. Versions that don't parse (e.g.
+// instances recorded before versions were tracked) upgrade if they differ.
+func needsUpgrade(current, target string) bool {
+	cmp, err := security.CompareVersions(current, target)
+	if err != nil {
+		return current != target
+	}
+	return cmp < 0
+}
+
+// errSSORefresh marks an upgrade skipped because the instance's UAA client
+// couldn't be brought in line with its route.
+var errSSORefresh = errors.New("refreshing SSO client failed")
+
+// upgradeInstance redeploys a single instance at version and records the
+// task in the upgrade tracker. Returns an error if the deploy wasn't
+// submitted, wrapping errSSORefresh when the SSO client refresh failed.
+func (b *Broker) upgradeInstance(ctx context.Context, inst *Instance, version string) error {
+	unlock := b.ops.lock(inst.ID)
+	defer unlock()
+
+	done := b.beginBOSHWrite()
+	defer done()
+
+	// The candidate was picked without the operation lock; a Deprovision may
+	// have claimed it since
+	b.mu.RLock()
+	if b.instances[inst.ID] != inst || inst.State == "deprovisioning" {
 		b.mu.RUnlock()
+		return fmt.Errorf("instance %s is being deprovisioned", inst.ID)
+	}
+	params := b.buildManifestParams(inst)
+	previousVersion := inst.OpenClawVersion
+	ssoClientID := inst.SSOClientID
+	b.mu.RUnlock()
+	params.OpenClawVersion = version
 
-		manifest, err := bosh.RenderAgentManifest(params)
-		if err != nil {
-			log.Printf("Upgrade manifest render failed for %s: %v", inst.ID, err)
+	// The redeployed SSO proxy redirects to the instance's current route, so
+	// UAA must accept it there first; deploying otherwise breaks login
+	if ssoClientID != "" && b.uaaClient != nil {
+		if err := b.traceUAA(ctx, "uaa.update_client", inst.ID, ssoClientID, func() error {
+			return b.uaaClient.UpdateClient(ssoOAuthClient(inst.ID, ssoClientID, "", params.RouteHostname, params.AppsDomain))
+		}); err != nil {
+			b.logger.ErrorContext(ctx, "upgrade skipped: UAA client redirect URI refresh failed", "operation", "upgrade",
+				"instance_id", inst.ID, "client_id", ssoClientID, "error", err)
+			return fmt.Errorf("%w: %v", errSSORefresh, err)
+		}
+	}
+
+	manifest, err := b.renderManifest(params)
+	if err != nil {
+		b.logger.ErrorContext(ctx, "upgrade manifest render failed", "operation", "upgrade", "instance_id", inst.ID, "error", err)
+		return err
+	}
+	taskID, err := b.deploy(ctx, inst.ID, manifest)
+	if err != nil {
+		b.logger.ErrorContext(ctx, "upgrade deploy failed", "operation", "upgrade", "instance_id", inst.ID, "error", err)
+		return err
+	}
+
+	b.mu.Lock()
+	b.setInstanceState(inst, "provisioning")
+	inst.BoshTaskID = taskID
+	inst.OpenClawVersion = version
+	b.mu.Unlock()
+
+	b.upgrades.track(inst.ID, taskID, previousVersion)
+	b.saveInstance(inst.ID)
+
+	b.logger.InfoContext(ctx, "upgrade started", "operation", "upgrade", "instance_id", inst.ID,
+		"bosh_task_id", taskID, "openclaw_version", version)
+	return nil
+}
+
+// RollbackResult is the AdminUpgradeRollback response.
+type RollbackResult struct {
+	RolledBack int `json:"rolled_back"`
+	Skipped    int `json:"skipped"`
+	Failed     int `json:"failed"`
+}
+
+// AdminUpgradeRollback redeploys tracked upgrades back to the version each
+// instance ran before the upgrade, then clears the tracker. Upgrades whose
+// task completed successfully are left alone unless include_healthy=true, and
+// other tracked operations such as recreates are not counted.
+// Returns {"rolled_back": N, "skipped": N, "failed": N}.
+func (b *Broker) AdminUpgradeRollback(w http.ResponseWriter, r *http.Request) {
+	includeHealthy := r.URL.Query().Get("include_healthy") == "true"
+	ctx := r.Context()
+
+	done := b.beginBOSHWrite()
+	defer done()
+
+	b.upgrades.mu.Lock()
+	tasks := b.upgrades.tasks
+	operations := b.upgrades.operations
+	previous := b.upgrades.previousVersions
+	b.upgrades.tasks = nil
+	b.upgrades.operations = nil
+	b.upgrades.previousVersions = nil
+	b.upgrades.mu.Unlock()
+
+	rolledBack, skipped, failed := 0, 0, 0
+	for instID, taskID := range tasks {
+		if operations[instID] != trackedUpgrade {
 			continue
 		}
-		taskID, err := b.director.Deploy(manifest)
-		if err != nil {
-			log.Printf("Upgrade deploy failed for %s: %v", inst.ID, err)
+		prevVersion, ok := previous[instID]
+		if !ok || prevVersion == "" {
+			skipped++
 			continue
 		}
+		if !includeHealthy {
+			if state, err := b.taskStatus(ctx, instID, taskID); err == nil && state == "done" {
+				skipped++
+				continue
+			}
+		}
 
-		b.mu.Lock()
-		inst.State = "provisioning"
-		inst.BoshTaskID = taskID
-		inst.OpenClawVersion = configVersion
-		b.mu.Unlock()
-
-		b.upgrades.mu.Lock()
-		if b.upgrades.tasks == nil {
-			b.upgrades.tasks = make(map[string]int)
+		started, err := b.rollbackInstance(ctx, instID, prevVersion)
+		switch {
+		case err != nil:
+			failed++
+		case !started:
+			skipped++
+		default:
+			rolledBack++
 		}
-		b.upgrades.tasks[inst.ID] = taskID
-		b.upgrades.mu.Unlock()
+	}
+
+	writeJSON(w, http.StatusOK, RollbackResult{RolledBack: rolledBack, Skipped: skipped, Failed: failed})
+}
+
+// rollbackInstance redeploys one instance at version under its operation
+// lock. It reports false without an error when the instance is gone or being
+// deprovisioned.
+func (b *Broker) rollbackInstance(ctx context.Context, instanceID, version string) (bool, error) {
+	unlock := b.ops.lock(instanceID)
+	defer unlock()
 
-		upgraded++
-		log.Printf("Upgrade started for %s: task=%d", inst.ID, taskID)
+	b.mu.RLock()
+	inst, exists := b.instances[instanceID]
+	if !exists || inst.State == "deprovisioning" {
+		b.mu.RUnlock()
+		return false, nil
 	}
+	params := b.buildManifestParams(inst)
+	b.mu.RUnlock()
+	params.OpenClawVersion = version
 
-	b.saveState()
-	writeJSON(w, http.StatusOK, map[string]int{"upgrading": upgraded})
+	manifest, err := b.renderManifest(params)
+	if err != nil {
+		b.logger.ErrorContext(ctx, "rollback manifest render failed", "operation", "rollback", "instance_id", instanceID, "error", err)
+		return false, err
+	}
+	taskID, err := b.deploy(ctx, instanceID, manifest)
+	if err != nil {
+		b.logger.ErrorContext(ctx, "rollback deploy failed", "operation", "rollback", "instance_id", instanceID, "error", err)
+		return false, err
+	}
+
+	b.mu.Lock()
+	b.setInstanceState(inst, "provisioning")
+	inst.BoshTaskID = taskID
+	inst.OpenClawVersion = version
+	b.mu.Unlock()
+	b.saveInstance(instanceID)
+
+	b.logger.InfoContext(ctx, "rollback started", "operation", "rollback", "instance_id", instanceID,
+		"bosh_task_id", taskID, "openclaw_version", version)
+	return true, nil
+}
+
+// setUpgradeResult records the outcome of an upgrade task. Status is polled
+// repeatedly, so changed reports whether this call moved the instance into
+// state, i.e. whether the transition is new. An instance being deprovisioned,
+// or one whose task has since been replaced, is left alone.
+func (b *Broker) setUpgradeResult(instanceID string, taskID int, state string) (plan string, changed bool) {
+	b.mu.Lock()
+	inst, ok := b.instances[instanceID]
+	if !ok || inst.State == "deprovisioning" || inst.BoshTaskID != taskID {
+		b.mu.Unlock()
+		return "", false
+	}
+	changed = inst.State != state
+	b.setInstanceState(inst, state)
+	plan = inst.PlanName
+	b.mu.Unlock()
+	b.saveInstance(instanceID)
+	return plan, changed
+}
+
+// UpgradeStatus counts tracked upgrades by the state of their BOSH task.
+type UpgradeStatus struct {
+	Healthy    int `json:"healthy"`
+	Total      int `json:"total"`
+	Failed     int `json:"failed"`
+	InProgress int `json:"in_progress"`
 }
 
 // AdminUpgradeStatus polls BOSH task status for tracked upgrades and returns counts.
@@ -132,9 +959,10 @@ func (b *Broker) AdminUpgradeStatus(w http.ResponseWriter, r *http.Request) {
 	inProgress := 0
 
 	for instID, taskID := range tasks {
-		state, err := b.director.TaskStatus(taskID)
+		state, err := b.taskStatus(r.Context(), instID, taskID)
 		if err != nil {
-			log.Printf("Upgrade status check failed for %s (task %d): %v", instID, taskID, err)
+			b.logger.WarnContext(r.Context(), "upgrade status check failed", "operation", "upgrade", "instance_id", instID,
+				"bosh_task_id", taskID, "error", err)
 			failed++
 			continue
 		}
@@ -142,28 +970,18 @@ func (b *Broker) AdminUpgradeStatus(w http.ResponseWriter, r *http.Request) {
 		switch state {
 		case "done":
 			healthy++
-			b.mu.Lock()
-			if inst, ok := b.instances[instID]; ok {
-				inst.State = "ready"
+			if plan, changed := b.setUpgradeResult(instID, taskID, "ready"); changed {
+				b.notify(r.Context(), EventUpgradeSucceeded, instID, plan, "ready")
 			}
-			b.mu.Unlock()
 		case "error", "cancelled":
 			failed++
-			b.mu.Lock()
-			if inst, ok := b.instances[instID]; ok {
-				inst.State = "failed"
+			if plan, changed := b.setUpgradeResult(instID, taskID, "failed"); changed {
+				b.notify(r.Context(), EventUpgradeFailed, instID, plan, "failed")
 			}
-			b.mu.Unlock()
 		default:
 			inProgress++
 		}
 	}
 
-	b.saveState()
-	writeJSON(w, http.StatusOK, map[string]int{
-		"healthy":     healthy,
-		"total":       total,
-		"failed":      failed,
-		"in_progress": inProgress,
-	})
+	writeJSON(w, http.StatusOK, UpgradeStatus{Healthy: healthy, Total: total, Failed: failed, InProgress: inProgress})
 }
@@ -5,18 +5,23 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/bosh"
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/uaa"
 )
 
 // newTestBrokerWithAdminRoutes is like newTestBroker but also registers admin routes.
 func newTestBrokerWithAdminRoutes(taskState string, deployFail bool) (*Broker, *httptest.Server, *mux.Router) {
 	b, fakeBOSH, r := newTestBroker(taskState, deployFail)
-	r.HandleFunc("/admin/instances", b.AdminListInstances).Methods("GET")
-	r.HandleFunc("/admin/upgrade", b.AdminUpgrade).Methods("POST")
-	r.HandleFunc("/admin/upgrade/status", b.AdminUpgradeStatus).Methods("GET")
+	b.RegisterAdminRoutes(r.PathPrefix("/admin").Subrouter())
 	return b, fakeBOSH, r
 }
 
@@ -123,6 +128,121 @@ func TestAdminListInstances_ExcludesDeprovisioning(t *testing.T) {
 	}
 }
 
+func TestAdminListInstances_OrderedByID(t *testing.T) {
+	_, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+
+	for _, id := range []string{"inst-c", "inst-a", "inst-d", "inst-b"} {
+		provisionInstance(t, router, id, "openclaw-developer-plan")
+	}
+	for i := 0; i < 5; i++ {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/instances", nil))
+		var list []AdminInstance
+		json.Unmarshal(rr.Body.Bytes(), &list)
+		var ids []string
+		for _, inst := range list {
+			ids = append(ids, inst.ID)
+		}
+		if !reflect.DeepEqual(ids, []string{"inst-a", "inst-b", "inst-c", "inst-d"}) {
+			t.Fatalf("call %d: list order = %v, want sorted by ID", i, ids)
+		}
+	}
+}
+
+func TestAdminListInstances_TotalCountAndEnvelope(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-a", "openclaw-developer-plan")
+	provisionInstance(t, router, "inst-b", "openclaw-developer-plan")
+	provisionInstance(t, router, "inst-dying", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-dying"].State = "deprovisioning"
+	b.mu.Unlock()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/instances", nil))
+	var list []map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatalf("default response should be a plain array: %v", err)
+	}
+	if got := rr.Header().Get("X-Total-Count"); got != "2" || len(list) != 2 {
+		t.Errorf("X-Total-Count = %q with %d entries, want 2 non-deprovisioning instances", got, len(list))
+	}
+
+	envelopeRequests := []*http.Request{httptest.NewRequest("GET", "/admin/instances?envelope=true", nil)}
+	byAccept := httptest.NewRequest("GET", "/admin/instances", nil)
+	byAccept.Header.Set("Accept", instanceListMediaType)
+	envelopeRequests = append(envelopeRequests, byAccept)
+	for _, req := range envelopeRequests {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var envelope struct {
+			Count     int                      `json:"count"`
+			Instances []map[string]interface{} `json:"instances"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &envelope); err != nil {
+			t.Fatalf("envelope response is not an object: %v: %s", err, rr.Body.String())
+		}
+		if envelope.Count != 2 || len(envelope.Instances) != 2 || rr.Header().Get("X-Total-Count") != "2" {
+			t.Errorf("envelope = %s, header %q, want count 2", rr.Body.String(), rr.Header().Get("X-Total-Count"))
+		}
+	}
+}
+
+func TestAdminSearchInstances(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+
+	b.mu.Lock()
+	b.putInstance(&Instance{ID: "inst-alice", Owner: "Alice@Example.com", OrgGUID: "org-1", State: "ready",
+		RouteHostname: "openclaw-alice", AppsDomain: "apps.example.com"})
+	b.putInstance(&Instance{ID: "inst-alice-2", Owner: "alice@example.com", OrgGUID: "org-2", State: "ready",
+		RouteHostname: "openclaw-alice-2", AppsDomain: "apps.example.com"})
+	b.putInstance(&Instance{ID: "inst-bob", Owner: "bob@example.com", OrgGUID: "org-1", State: "ready",
+		RouteHostname: "openclaw-bob", AppsDomain: "apps.example.com"})
+	b.putInstance(&Instance{ID: "inst-dying", Owner: "alice@example.com", OrgGUID: "org-1", State: "deprovisioning",
+		RouteHostname: "openclaw-dying", AppsDomain: "apps.example.com"})
+	b.mu.Unlock()
+
+	search := func(query string) (int, []string) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/instances/search?"+query, nil))
+		var list []AdminInstance
+		json.Unmarshal(rr.Body.Bytes(), &list)
+		ids := []string{}
+		for _, inst := range list {
+			ids = append(ids, inst.ID)
+		}
+		return rr.Code, ids
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"owner=ALICE@example.com", []string{"inst-alice", "inst-alice-2"}},
+		{"owner=alice@example.com&org=org-2", []string{"inst-alice-2"}},
+		{"route=openclaw-bob", []string{"inst-bob"}},
+		{"route=openclaw-bob.apps.example.com", []string{"inst-bob"}},
+		{"route=" + url.QueryEscape("https://openclaw-alice.apps.example.com/chat"), []string{"inst-alice"}},
+		{"route=openclaw-bob.other.example.com", []string{}},
+		{"route=openclaw-dying", []string{}},
+		{"owner=carol@example.com", []string{}},
+	}
+	for _, tt := range tests {
+		code, ids := search(tt.query)
+		if code != http.StatusOK || !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("search %q = %d %v, want 200 %v", tt.query, code, ids, tt.want)
+		}
+	}
+
+	if code, _ := search(""); code != http.StatusBadRequest {
+		t.Errorf("search without filters = %d, want 400", code)
+	}
+}
+
 func TestAdminUpgrade_UpgradesOutdatedInstances(t *testing.T) {
 	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
 	defer fakeBOSH.Close()
@@ -179,6 +299,55 @@ func TestAdminUpgrade_UpgradesOutdatedInstances(t *testing.T) {
 	b.upgrades.mu.Unlock()
 }
 
+func TestAdminUpgrade_RefreshesSSOClients(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+	fakeUAA := newFakeUAA()
+	defer fakeUAA.Close()
+	b.config.SSOEnabled = true
+	b.uaaClient = uaa.NewClient(fakeUAA.URL, "admin", "secret", "", false)
+
+	provisionInstance(t, router, "inst-sso-moved", "openclaw-developer-plan")
+	provisionInstance(t, router, "inst-sso-gone", "openclaw-developer-plan")
+	b.mu.Lock()
+	for _, inst := range b.instances {
+		inst.State = "ready"
+		inst.OpenClawVersion = "2026.2.17"
+	}
+	// The route moved since the client was registered
+	moved := b.instances["inst-sso-moved"]
+	moved.AppsDomain = "apps.new.example.com"
+	b.mu.Unlock()
+	// UAA lost this one's client, so its redirect URI can't be refreshed
+	if err := b.uaaClient.DeleteClient(uaa.ClientIDForInstance("inst-sso-gone")); err != nil {
+		t.Fatalf("deleting UAA client: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/upgrade", strings.NewReader(`{"count": 10}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200. Body: %s", rr.Code, rr.Body.String())
+	}
+	var resp UpgradeResult
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.Upgrading != 1 || !reflect.DeepEqual(resp.SSOSkipped, []string{"inst-sso-gone"}) {
+		t.Errorf("response = %+v, want inst-sso-moved upgraded and inst-sso-gone skipped", resp)
+	}
+
+	want := "https://" + moved.RouteHostname + ".apps.new.example.com/oauth2/callback"
+	if got := fakeUAA.redirectURIs(uaa.ClientIDForInstance("inst-sso-moved")); !reflect.DeepEqual(got, []string{want}) {
+		t.Errorf("redirect URIs = %v, want [%s] before redeploying", got, want)
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if moved.OpenClawVersion == "2026.2.17" {
+		t.Error("inst-sso-moved should have been upgraded")
+	}
+	if gone := b.instances["inst-sso-gone"]; gone.State != "ready" || gone.OpenClawVersion != "2026.2.17" {
+		t.Errorf("skipped instance = %s at %s, want it left ready at its old version", gone.State, gone.OpenClawVersion)
+	}
+}
+
 func TestAdminUpgrade_SkipsCurrentVersion(t *testing.T) {
 	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
 	defer fakeBOSH.Close()
@@ -211,6 +380,37 @@ func TestAdminUpgrade_SkipsCurrentVersion(t *testing.T) {
 	}
 }
 
+func TestAdminUpgrade_ComparesHotfixBuilds(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+
+	// Broker is configured for 2026.2.21-2: build 1 is older, build 10 is newer
+	provisionInstance(t, router, "inst-build-1", "openclaw-developer-plan")
+	provisionInstance(t, router, "inst-build-10", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-build-1"].State = "ready"
+	b.instances["inst-build-1"].OpenClawVersion = "2026.2.21-1"
+	b.instances["inst-build-10"].State = "ready"
+	b.instances["inst-build-10"].OpenClawVersion = "2026.2.21-10"
+	b.mu.Unlock()
+
+	body, _ := json.Marshal(map[string]interface{}{"count": 2, "max_parallel": 2})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/upgrade", bytes.NewReader(body)))
+
+	var resp map[string]int
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["upgrading"] != 1 {
+		t.Errorf("upgrading = %d, want 1", resp["upgrading"])
+	}
+	if v := b.instances["inst-build-1"].OpenClawVersion; v != "2026.2.21-2" {
+		t.Errorf("inst-build-1 version = %q, want 2026.2.21-2", v)
+	}
+	if v := b.instances["inst-build-10"].OpenClawVersion; v != "2026.2.21-10" {
+		t.Errorf("inst-build-10 version = %q, want it left at 2026.2.21-10", v)
+	}
+}
+
 func TestAdminUpgrade_RespectsCount(t *testing.T) {
 	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
 	defer fakeBOSH.Close()
@@ -243,6 +443,100 @@ func TestAdminUpgrade_RespectsCount(t *testing.T) {
 	}
 }
 
+func TestAdminUpgrade_PicksInstancesInIDOrder(t *testing.T) {
+	for run := 0; run < 3; run++ {
+		b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+		b.mu.Lock()
+		for _, id := range []string{"inst-d", "inst-b", "inst-e", "inst-a", "inst-c"} {
+			b.putInstance(&Instance{ID: id, PlanID: "openclaw-developer-plan", PlanName: "developer", State: "ready",
+				DeploymentName: "openclaw-agent-" + id, OpenClawVersion: "2026.2.17", AppsDomain: "apps.example.com"})
+		}
+		b.mu.Unlock()
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/upgrade", strings.NewReader(`{"count": 2}`)))
+		fakeBOSH.Close()
+
+		b.mu.RLock()
+		var upgraded []string
+		for _, inst := range b.sortedInstances() {
+			if inst.OpenClawVersion != "2026.2.17" {
+				upgraded = append(upgraded, inst.ID)
+			}
+		}
+		b.mu.RUnlock()
+		if !reflect.DeepEqual(upgraded, []string{"inst-a", "inst-b"}) {
+			t.Fatalf("run %d: upgraded %v, want the first two IDs", run, upgraded)
+		}
+	}
+}
+
+func TestAdminUpgrade_BoundsParallelDeploys(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+
+	for i := 1; i <= 5; i++ {
+		id := "inst-par-" + string(rune('0'+i))
+		provisionInstance(t, router, id, "openclaw-developer-plan")
+		b.mu.Lock()
+		b.instances[id].State = "ready"
+		b.instances[id].OpenClawVersion = "2026.2.17"
+		b.mu.Unlock()
+	}
+
+	// Director that holds each deploy briefly and records peak concurrency
+	var mu sync.Mutex
+	inFlight, peak, deploys := 0, 0, 0
+	slowBOSH := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/deployments" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		inFlight++
+		deploys++
+		if inFlight > peak {
+			peak = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.Header().Set("Location", "/tasks/42")
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer slowBOSH.Close()
+	b.director = bosh.NewClient(slowBOSH.URL, "admin", "admin", "", "")
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"target_version": "2026.2.21-2",
+		"count":          5,
+		"max_parallel":   2,
+	})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/upgrade", bytes.NewReader(body)))
+
+	var resp map[string]int
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["upgrading"] != 5 {
+		t.Errorf("upgrading = %d, want 5", resp["upgrading"])
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if deploys != 5 {
+		t.Errorf("deploys submitted = %d, want 5", deploys)
+	}
+	if peak > 2 {
+		t.Errorf("peak concurrent deploys = %d, want <= 2", peak)
+	}
+	b.upgrades.mu.Lock()
+	defer b.upgrades.mu.Unlock()
+	if len(b.upgrades.tasks) != 5 {
+		t.Errorf("upgrade tracker has %d entries, want 5", len(b.upgrades.tasks))
+	}
+}
+
 func TestAdminUpgrade_InvalidRequest(t *testing.T) {
 	_, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
 	defer fakeBOSH.Close()
@@ -499,3 +793,1030 @@ func TestAdminUpgrade_EndToEnd(t *testing.T) {
 		t.Errorf("final total = %d, want 3", statusResp["total"])
 	}
 }
+
+func TestAdminInstanceVMs_ReturnsVMs(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{taskOutput: map[string]string{"result": `{"job_name":"agent","index":0,"id":"abc-123","az":"z1","ips":["10.0.16.5"],"vm_cid":"vm-1","process_state":"running"}` + "\n" +
+		`{"job_name":"agent","index":1,"id":"def-456","az":"z2","ips":["10.0.16.6"],"vm_cid":"vm-2","job_state":"failing"}` + "\n"}})
+	defer fakeBOSH.Close()
+
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	b := New(BrokerConfig{}, director)
+	b.instances["inst-vms"] = &Instance{ID: "inst-vms", DeploymentName: "openclaw-agent-inst-vms", State: "ready"}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/instances/{id}/vms", b.AdminInstanceVMs).Methods("GET")
+
+	req := httptest.NewRequest("GET", "/admin/instances/inst-vms/vms", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var vms []bosh.VMInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &vms); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if len(vms) != 2 {
+		t.Fatalf("Got %d VMs, want 2", len(vms))
+	}
+	if vms[0].InstanceGroup != "agent" || vms[0].IPs[0] != "10.0.16.5" || vms[0].ProcessState != "running" {
+		t.Errorf("vms[0] = %+v", vms[0])
+	}
+	if vms[1].Index != 1 || vms[1].ProcessState != "failing" {
+		t.Errorf("vms[1] = %+v, want index 1 with job_state fallback", vms[1])
+	}
+}
+
+func TestAdminInstanceVMs_UnknownInstance(t *testing.T) {
+	_, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+
+	req := httptest.NewRequest("GET", "/admin/instances/nope/vms", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+// --- AdminGetInstance tests ---
+
+func TestAdminGetInstance_ReturnsDetailWithLiveTaskState(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("processing", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-detail", "openclaw-developer-plan")
+
+	req := httptest.NewRequest("GET", "/admin/instances/inst-detail", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var detail map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &detail); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if detail["id"] != "inst-detail" || detail["state"] != "provisioning" {
+		t.Errorf("id/state = %v/%v, want inst-detail/provisioning", detail["id"], detail["state"])
+	}
+	if detail["bosh_task_id"] != float64(42) {
+		t.Errorf("bosh_task_id = %v, want 42", detail["bosh_task_id"])
+	}
+	if detail["bosh_task_state"] != "processing" {
+		t.Errorf("bosh_task_state = %v, want processing", detail["bosh_task_state"])
+	}
+	if detail["route_hostname"] != b.instances["inst-detail"].RouteHostname {
+		t.Errorf("route_hostname = %v, want %q", detail["route_hostname"], b.instances["inst-detail"].RouteHostname)
+	}
+}
+
+func TestAdminGetInstance_RedactsSecrets(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+
+	b.instances["inst-secret"] = &Instance{
+		ID:              "inst-secret",
+		State:           "ready",
+		GatewayToken:    "gw-secret-token",
+		NodeSeed:        "node-seed-secret",
+		SSOClientID:     "openclaw-inst-secret",
+		SSOClientSecret: "sso-client-secret",
+		SSOCookieSecret: "sso-cookie-secret",
+		Bindings: map[string]*Binding{
+			"bind-1": {ID: "bind-1", GatewayToken: "binding-secret-token"},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/admin/instances/inst-secret", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	body := rr.Body.String()
+	for _, secret := range []string{"gw-secret-token", "node-seed-secret", "sso-client-secret", "sso-cookie-secret", "binding-secret-token"} {
+		if bytes.Contains(rr.Body.Bytes(), []byte(secret)) {
+			t.Errorf("response leaks secret %q: %s", secret, body)
+		}
+	}
+	var detail map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &detail)
+	for _, key := range []string{"gateway_token_present", "node_seed_present", "sso_client_secret_present", "sso_cookie_secret_present"} {
+		if detail[key] != true {
+			t.Errorf("%s = %v, want true", key, detail[key])
+		}
+	}
+	if detail["sso_client_id"] != "openclaw-inst-secret" {
+		t.Errorf("sso_client_id = %v, want openclaw-inst-secret", detail["sso_client_id"])
+	}
+}
+
+func TestAdminGetInstance_NotFound(t *testing.T) {
+	_, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+
+	req := httptest.NewRequest("GET", "/admin/instances/inst-missing", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+// --- AdminDeleteInstance tests ---
+
+func TestAdminDeleteInstance_HappyPath(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("error", false)
+	defer fakeBOSH.Close()
+	b.config.StateDir = t.TempDir()
+
+	provisionInstance(t, router, "inst-stuck", "openclaw-developer-plan")
+	b.instances["inst-stuck"].State = "failed"
+	b.saveInstance("inst-stuck")
+
+	req := httptest.NewRequest("DELETE", "/admin/instances/inst-stuck", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var summary AdminDeleteSummary
+	json.Unmarshal(rr.Body.Bytes(), &summary)
+	if summary.BoshTaskID != 99 || summary.BoshError != "" {
+		t.Errorf("bosh_task_id/bosh_error = %d/%q, want 99/\"\"", summary.BoshTaskID, summary.BoshError)
+	}
+	if !summary.StateRemoved {
+		t.Error("state_removed should be true")
+	}
+	if _, exists := b.instances["inst-stuck"]; exists {
+		t.Error("instance should be removed from memory")
+	}
+	if _, err := os.Stat(b.instanceStatePath("inst-stuck")); !os.IsNotExist(err) {
+		t.Errorf("state file should be removed, stat err = %v", err)
+	}
+}
+
+func TestAdminDeleteInstance_DirectorErrorWithoutForceKeepsInstance(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{deleteFail: true})
+	defer fakeBOSH.Close()
+	b := New(BrokerConfig{}, bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", ""))
+	b.instances["inst-wedged"] = &Instance{ID: "inst-wedged", DeploymentName: "openclaw-agent-inst-wedged", State: "failed"}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/instances/{id}", b.AdminDeleteInstance).Methods("DELETE")
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("DELETE", "/admin/instances/inst-wedged", nil))
+
+	if rr.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusBadGateway)
+	}
+	if _, exists := b.instances["inst-wedged"]; !exists {
+		t.Error("instance should be kept when the delete fails without force")
+	}
+}
+
+func TestAdminDeleteInstance_ForceCleansUpOnDirectorError(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{deleteFail: true})
+	defer fakeBOSH.Close()
+	b := New(BrokerConfig{}, bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", ""))
+	b.instances["inst-wedged"] = &Instance{ID: "inst-wedged", DeploymentName: "openclaw-agent-inst-wedged", State: "failed"}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/instances/{id}", b.AdminDeleteInstance).Methods("DELETE")
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("DELETE", "/admin/instances/inst-wedged?force=true", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var summary AdminDeleteSummary
+	json.Unmarshal(rr.Body.Bytes(), &summary)
+	if summary.BoshError == "" {
+		t.Error("bosh_error should report the Director failure")
+	}
+	if !summary.StateRemoved {
+		t.Error("state_removed should be true")
+	}
+	if _, exists := b.instances["inst-wedged"]; exists {
+		t.Error("instance should be purged with force=true")
+	}
+}
+
+func TestAdminDeleteInstance_UnknownWithoutForce(t *testing.T) {
+	_, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/admin/instances/inst-missing", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+// --- AdminUpgradeRollback tests ---
+
+// upgradeOutdated marks instances ready at oldVersion, provisioning any that
+// don't exist yet, and upgrades them to the broker's configured version.
+func upgradeOutdated(t *testing.T, b *Broker, router *mux.Router, oldVersion string, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if _, exists := b.instances[id]; !exists {
+			provisionInstance(t, router, id, "openclaw-developer-plan")
+		}
+		b.mu.Lock()
+		b.instances[id].State = "ready"
+		b.instances[id].OpenClawVersion = oldVersion
+		b.mu.Unlock()
+	}
+	body, _ := json.Marshal(map[string]interface{}{"count": len(ids), "max_parallel": 1})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/upgrade", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("upgrade status = %d, want %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestAdminUpgradeRollback_IgnoresRecreates(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("error", false)
+	defer fakeBOSH.Close()
+
+	upgradeOutdated(t, b, router, "2026.2.17", "inst-canary")
+	provisionInstance(t, router, "inst-sick", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-sick"].State = "ready"
+	version := b.instances["inst-sick"].OpenClawVersion
+	b.mu.Unlock()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/instances/inst-sick/recreate", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("recreate status = %d, want 202. Body: %s", rr.Code, rr.Body.String())
+	}
+
+	// Both tasks fail, but only the upgrade changed a version to roll back
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/upgrade/rollback", nil))
+	var resp RollbackResult
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp != (RollbackResult{RolledBack: 1}) {
+		t.Errorf("rollback = %+v, want only the upgrade rolled back", resp)
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if inst := b.instances["inst-sick"]; inst.BoshTaskID != 77 || inst.OpenClawVersion != version {
+		t.Errorf("recreated instance = task %d version %q, want it left on task 77 at %q", inst.BoshTaskID, inst.OpenClawVersion, version)
+	}
+}
+
+func TestAdminUpgradeRollback_IgnoresTokenRotations(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("error", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-rotated", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-rotated"].State = "ready"
+	b.mu.Unlock()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/instances/inst-rotated/rotate-token", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("rotate status = %d, want 202. Body: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/upgrade/rollback", nil))
+	var resp RollbackResult
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp != (RollbackResult{}) {
+		t.Errorf("rollback = %+v, want the failed rotation left out", resp)
+	}
+}
+
+func TestAdminUpgradeRollback_RestoresFailedCanary(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("error", false)
+	defer fakeBOSH.Close()
+
+	upgradeOutdated(t, b, router, "2026.2.17", "inst-canary")
+	if v := b.instances["inst-canary"].OpenClawVersion; v != "2026.2.21-2" {
+		t.Fatalf("version after upgrade = %q, want 2026.2.21-2", v)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/upgrade/rollback", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("rollback status = %d, want %d. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var resp map[string]int
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["rolled_back"] != 1 {
+		t.Errorf("rolled_back = %d, want 1", resp["rolled_back"])
+	}
+
+	inst := b.instances["inst-canary"]
+	if inst.OpenClawVersion != "2026.2.17" {
+		t.Errorf("version after rollback = %q, want 2026.2.17", inst.OpenClawVersion)
+	}
+	if inst.State != "provisioning" {
+		t.Errorf("state = %q, want provisioning", inst.State)
+	}
+	b.upgrades.mu.Lock()
+	defer b.upgrades.mu.Unlock()
+	if len(b.upgrades.tasks) != 0 || len(b.upgrades.previousVersions) != 0 {
+		t.Errorf("tracker should be cleared, got tasks=%v previous=%v", b.upgrades.tasks, b.upgrades.previousVersions)
+	}
+}
+
+func TestAdminUpgradeRollback_SkipsHealthyUnlessIncluded(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+
+	upgradeOutdated(t, b, router, "2026.2.17", "inst-healthy")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/upgrade/rollback", nil))
+	var resp map[string]int
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["rolled_back"] != 0 || resp["skipped"] != 1 {
+		t.Errorf("rolled_back/skipped = %d/%d, want 0/1", resp["rolled_back"], resp["skipped"])
+	}
+	if v := b.instances["inst-healthy"].OpenClawVersion; v != "2026.2.21-2" {
+		t.Errorf("healthy instance version = %q, want it left at 2026.2.21-2", v)
+	}
+
+	// Upgrade again and roll back including healthy instances
+	upgradeOutdated(t, b, router, "2026.2.17", "inst-healthy")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/upgrade/rollback?include_healthy=true", nil))
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["rolled_back"] != 1 {
+		t.Errorf("rolled_back with include_healthy = %d, want 1", resp["rolled_back"])
+	}
+	if v := b.instances["inst-healthy"].OpenClawVersion; v != "2026.2.17" {
+		t.Errorf("version after rollback = %q, want 2026.2.17", v)
+	}
+}
+
+func TestAdminUpgrade_PlanAwareTargets(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+	b.config.Plans = []Plan{
+		{ID: "stable-plan", Name: "stable", VMType: "small", OpenClawVersion: "2026.2.17"},
+		{ID: "beta-plan", Name: "beta", VMType: "small"},
+	}
+	provisionInstance(t, router, "inst-stable", "stable-plan")
+	provisionInstance(t, router, "inst-stable-old", "stable-plan")
+	provisionInstance(t, router, "inst-beta", "beta-plan")
+
+	b.mu.Lock()
+	for _, inst := range b.instances {
+		inst.State = "ready"
+	}
+	b.instances["inst-stable-old"].OpenClawVersion = "2026.2.1"
+	b.instances["inst-beta"].OpenClawVersion = "2026.2.17"
+	b.mu.Unlock()
+
+	body, _ := json.Marshal(map[string]interface{}{"count": 10, "max_parallel": 5})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/upgrade", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp map[string]int
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["upgrading"] != 2 {
+		t.Errorf("upgrading = %d, want the old stable and the beta instance", resp["upgrading"])
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	want := map[string]string{"inst-stable": "2026.2.17", "inst-stable-old": "2026.2.17", "inst-beta": "2026.2.21-2"}
+	for id, version := range want {
+		if got := b.instances[id].OpenClawVersion; got != version {
+			t.Errorf("%s version = %q, want %q", id, got, version)
+		}
+	}
+	if b.instances["inst-stable"].State != "ready" {
+		t.Error("an instance at its plan's pin should not be redeployed")
+	}
+}
+
+func TestAdminRecreateInstance(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+	provisionInstance(t, router, "inst-sick", "openclaw-developer-plan")
+
+	// Still provisioning: recreating now would race the deploy
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/instances/inst-sick/recreate", nil))
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("recreate while provisioning: status = %d, want 409", rr.Code)
+	}
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/service_instances/inst-sick/last_operation", nil))
+	b.mu.RLock()
+	version := b.instances["inst-sick"].OpenClawVersion
+	b.mu.RUnlock()
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/instances/inst-sick/recreate", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202. Body: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		InstanceID string `json:"instance_id"`
+		BoshTaskID int    `json:"bosh_task_id"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.InstanceID != "inst-sick" || resp.BoshTaskID != 77 {
+		t.Errorf("response = %+v, want task 77", resp)
+	}
+
+	b.mu.RLock()
+	inst := b.instances["inst-sick"]
+	if inst.State != "provisioning" || inst.BoshTaskID != 77 || inst.OpenClawVersion != version {
+		t.Errorf("instance = state %q task %d version %q, want provisioning on task 77 at %q", inst.State, inst.BoshTaskID, inst.OpenClawVersion, version)
+	}
+	b.mu.RUnlock()
+
+	// Tracked with upgrades, so the status endpoint finalizes it
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/upgrade/status", nil))
+	var status map[string]int
+	json.Unmarshal(rr.Body.Bytes(), &status)
+	if status["total"] != 1 || status["healthy"] != 1 {
+		t.Errorf("upgrade status = %v, want the recreate reported healthy", status)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/instances/inst-missing/recreate", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown instance: status = %d, want 404", rr.Code)
+	}
+}
+
+func TestAdminRecreateAndDeprovision_ConcurrentDeprovisionWins(t *testing.T) {
+	// Hold the recreate at the Director so the Deprovision lands mid-call
+	arrived, release := make(chan struct{}), make(chan struct{})
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{onRequest: func(r *http.Request) {
+		if r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/jobs/*") {
+			close(arrived)
+			<-release
+		}
+	}})
+	defer fakeBOSH.Close()
+	b := New(BrokerConfig{OpenClawVersion: "2026.2.21-2", AZs: []string{"z1"}, AppsDomain: "apps.example.com"},
+		bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", ""))
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Deprovision).Methods("DELETE")
+	r.HandleFunc("/admin/instances/{id}/recreate", b.AdminRecreateInstance).Methods("POST")
+	b.putInstance(&Instance{
+		ID: "inst-race", PlanID: "openclaw-developer-plan", DeploymentName: "openclaw-agent-inst-race", State: "ready",
+	})
+
+	recreated := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/instances/inst-race/recreate", nil))
+		recreated <- rr.Code
+	}()
+	<-arrived
+
+	deprovisioned := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("DELETE", "/v2/service_instances/inst-race?accepts_incomplete=true", nil))
+		deprovisioned <- rr.Code
+	}()
+
+	// The Deprovision must wait for the recreate to record its task; give
+	// it a chance to run ahead before letting the recreate finish
+	var deprovisionCode int
+	select {
+	case deprovisionCode = <-deprovisioned:
+		close(release)
+	case <-time.After(100 * time.Millisecond):
+		close(release)
+		deprovisionCode = <-deprovisioned
+	}
+	if code := <-recreated; code != http.StatusAccepted {
+		t.Errorf("recreate status = %d, want 202", code)
+	}
+	if deprovisionCode != http.StatusAccepted {
+		t.Fatalf("deprovision status = %d, want 202", deprovisionCode)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if inst := b.instances["inst-race"]; inst == nil || inst.State != "deprovisioning" || inst.BoshTaskID != 99 {
+		t.Errorf("final instance = %+v, want deprovisioning on delete task 99", inst)
+	}
+}
+
+func TestAdminRotateToken(t *testing.T) {
+	var manifests, deletes []string
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{manifests: &manifests, deletes: &deletes})
+	defer fakeBOSH.Close()
+	stateDir := t.TempDir()
+	b := New(BrokerConfig{OpenClawVersion: "2026.2.21-2", AZs: []string{"z1"}, AppsDomain: "apps.example.com", StateDir: stateDir},
+		bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", ""))
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/instances/{id}/rotate-token", b.AdminRotateToken).Methods("POST")
+
+	b.putInstance(&Instance{
+		ID: "inst-leak", PlanID: "openclaw-developer-plan", DeploymentName: "openclaw-agent-inst-leak",
+		State: "ready", GatewayToken: "leaked-token", VMType: "small", DiskType: "10GB", AppsDomain: "apps.example.com",
+		Bindings: map[string]*Binding{"bind-1": {ID: "bind-1", GatewayToken: "binding-token"}},
+	})
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/instances/inst-leak/rotate-token", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202. Body: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		GatewayToken        string   `json:"gateway_token"`
+		BoshTaskID          int      `json:"bosh_task_id"`
+		InvalidatedBindings []string `json:"invalidated_bindings"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.GatewayToken == "" || resp.GatewayToken == "leaked-token" {
+		t.Fatalf("gateway_token = %q, want a fresh token", resp.GatewayToken)
+	}
+	if resp.BoshTaskID != 42 || len(resp.InvalidatedBindings) != 1 || resp.InvalidatedBindings[0] != "bind-1" {
+		t.Errorf("response = %+v, want task 42 invalidating bind-1", resp)
+	}
+
+	// Redeployed with the new token, and the old and binding tokens dropped
+	if len(manifests) != 1 {
+		t.Fatalf("got %d deploys, want 1", len(manifests))
+	}
+	if !strings.Contains(manifests[0], resp.GatewayToken) {
+		t.Error("redeployed manifest should carry the new token")
+	}
+	for _, old := range []string{"leaked-token", "binding-token"} {
+		if strings.Contains(manifests[0], old) {
+			t.Errorf("redeployed manifest still accepts %q", old)
+		}
+	}
+
+	b.mu.RLock()
+	inst := b.instances["inst-leak"]
+	if inst.GatewayToken != resp.GatewayToken || len(inst.Bindings) != 0 || inst.State != "provisioning" || inst.BoshTaskID != 42 {
+		t.Errorf("instance = %+v, want the new token, no bindings, provisioning on task 42", inst)
+	}
+	b.mu.RUnlock()
+
+	data, err := os.ReadFile(b.instanceStatePath("inst-leak"))
+	if err != nil {
+		t.Fatalf("reading state: %v", err)
+	}
+	var persisted Instance
+	json.Unmarshal(data, &persisted)
+	if persisted.GatewayToken != resp.GatewayToken {
+		t.Error("rotated token should be persisted")
+	}
+
+	// Mid-deploy now, so a second rotation must wait
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/instances/inst-leak/rotate-token", nil))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("rotate while provisioning: status = %d, want 409", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/instances/inst-missing/rotate-token", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown instance: status = %d, want 404", rr.Code)
+	}
+}
+
+func TestAdminRotateToken_DeployFailureKeepsOldToken(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", true)
+	defer fakeBOSH.Close()
+	b.putInstance(&Instance{
+		ID: "inst-keep", PlanID: "openclaw-developer-plan", DeploymentName: "openclaw-agent-inst-keep",
+		State: "ready", GatewayToken: "current-token",
+		Bindings: map[string]*Binding{"bind-1": {ID: "bind-1", GatewayToken: "binding-token"}},
+	})
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/instances/inst-keep/rotate-token", nil))
+	if rr.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502. Body: %s", rr.Code, rr.Body.String())
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if inst := b.instances["inst-keep"]; inst.GatewayToken != "current-token" || len(inst.Bindings) != 1 || inst.State != "ready" {
+		t.Errorf("instance = %+v, want the old token and bindings restored", inst)
+	}
+}
+
+func TestAdminRotateToken_DeployFailureThenConcurrentUnbind(t *testing.T) {
+	var b *Broker
+	var r *mux.Router
+	var once sync.Once
+	unbound := make(chan int, 1)
+	// While the rotation's deploy is at the Director, start unbinding an old app
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{deployFail: true, onRequest: func(req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/deployments" {
+			return
+		}
+		once.Do(func() {
+			go func() {
+				rr := httptest.NewRecorder()
+				r.ServeHTTP(rr, httptest.NewRequest("DELETE", "/v2/service_instances/inst-keep/service_bindings/bind-1", nil))
+				unbound <- rr.Code
+			}()
+		})
+	}})
+	defer fakeBOSH.Close()
+	b = New(BrokerConfig{OpenClawVersion: "2026.2.21-2", AZs: []string{"z1"}, AppsDomain: "apps.example.com"},
+		bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", ""))
+	r = mux.NewRouter()
+	r.HandleFunc("/admin/instances/{id}/rotate-token", b.AdminRotateToken).Methods("POST")
+	r.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Unbind).Methods("DELETE")
+	b.putInstance(&Instance{
+		ID: "inst-keep", PlanID: "openclaw-developer-plan", DeploymentName: "openclaw-agent-inst-keep",
+		State: "ready", GatewayToken: "current-token", AppsDomain: "apps.example.com",
+		Bindings: map[string]*Binding{"bind-1": {ID: "bind-1", GatewayToken: "binding-token"}},
+	})
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/instances/inst-keep/rotate-token", nil))
+	if rr.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502. Body: %s", rr.Code, rr.Body.String())
+	}
+	// The unbind waited for the rotation, so it removes the restored binding
+	// instead of finding it already gone
+	if code := <-unbound; code != http.StatusOK {
+		t.Errorf("unbind status = %d, want 200", code)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	inst := b.instances["inst-keep"]
+	if inst.GatewayToken != "current-token" {
+		t.Errorf("GatewayToken = %q, want the old token restored", inst.GatewayToken)
+	}
+	if _, ok := inst.Bindings["bind-1"]; ok {
+		t.Error("an unbound binding should not be resurrected")
+	}
+}
+
+// --- AdminDeprovisionAll tests ---
+
+func TestAdminDeprovisionAll_DryRunListsMatches(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+	provisionInSpace(t, router, "inst-a1", "org-a", "space-1")
+	provisionInSpace(t, router, "inst-a2", "org-a", "space-2")
+	provisionInSpace(t, router, "inst-b1", "org-b", "space-3")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/deprovision-all", strings.NewReader(`{"org_guid": "org-a", "dry_run": true}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200. Body: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		DryRun    bool                  `json:"dry_run"`
+		Matched   int                   `json:"matched"`
+		Instances []BulkDeleteCandidate `json:"instances"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if !resp.DryRun || resp.Matched != 2 || len(resp.Instances) != 2 ||
+		resp.Instances[0].InstanceID != "inst-a1" || resp.Instances[1].InstanceID != "inst-a2" {
+		t.Errorf("dry run = %+v, want inst-a1 and inst-a2", resp)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.instances) != 3 {
+		t.Errorf("dry run removed instances: %d left, want 3", len(b.instances))
+	}
+}
+
+func TestAdminDeprovisionAll_DeletesMatchingInstances(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+	fakeUAA := newFakeUAA()
+	defer fakeUAA.Close()
+	b.config.SSOEnabled = true
+	b.uaaClient = uaa.NewClient(fakeUAA.URL, "admin", "secret", "", false)
+
+	for _, id := range []string{"inst-1", "inst-2", "inst-3"} {
+		provisionInstance(t, router, id, "openclaw-developer-plan")
+	}
+	provisionInstance(t, router, "inst-team", "openclaw-team-plan")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/deprovision-all", strings.NewReader(`{"plan": "developer", "max_parallel": 2}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200. Body: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		Matched   int                  `json:"matched"`
+		Submitted int                  `json:"submitted"`
+		Failed    int                  `json:"failed"`
+		Results   []AdminDeleteSummary `json:"results"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.Matched != 3 || resp.Submitted != 3 || resp.Failed != 0 || len(resp.Results) != 3 {
+		t.Fatalf("summary = %+v, want 3 submitted", resp)
+	}
+	for _, res := range resp.Results {
+		if res.BoshTaskID != 99 || !res.StateRemoved || !res.UAAClientDeleted {
+			t.Errorf("result = %+v, want a delete task, removed state and deleted SSO client", res)
+		}
+		if fakeUAA.hasClient(uaa.ClientIDForInstance(res.InstanceID)) {
+			t.Errorf("SSO client for %s should be deleted", res.InstanceID)
+		}
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if _, ok := b.instances["inst-team"]; !ok || len(b.instances) != 1 {
+		t.Errorf("only the team instance should remain, have %d instances", len(b.instances))
+	}
+}
+
+func TestAdminReconcile(t *testing.T) {
+	// The Director knows "kept" and an orphaned "stray"; broker memory also
+	// holds "gone" and "gone-failed" whose deployments were deleted out of
+	// band, plus an in-flight provision that must be left alone.
+	setup := func(t *testing.T) (*Broker, *mux.Router) {
+		fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{
+			deployments: []string{"cf", "openclaw-agent-kept", "openclaw-agent-stray"},
+			instanceIDs: map[string]string{"openclaw-agent-kept": "kept", "openclaw-agent-stray": "stray"},
+		})
+		t.Cleanup(fakeBOSH.Close)
+		b := New(BrokerConfig{AppsDomain: "apps.example.com", StateDir: t.TempDir()},
+			bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", ""))
+		for id, state := range map[string]string{"kept": "ready", "gone": "ready", "gone-failed": "failed", "pending": "provisioning"} {
+			b.putInstance(&Instance{ID: id, DeploymentName: "openclaw-agent-" + id, State: state})
+		}
+		r := mux.NewRouter()
+		r.HandleFunc("/admin/reconcile", b.AdminReconcile).Methods("POST")
+		return b, r
+	}
+	reconcile := func(t *testing.T, r *mux.Router, body string) ReconcileReport {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/admin/reconcile", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var report ReconcileReport
+		json.NewDecoder(rr.Body).Decode(&report)
+		return report
+	}
+
+	t.Run("dry run reports drift in both directions", func(t *testing.T) {
+		b, r := setup(t)
+		report := reconcile(t, r, `{"dry_run":true,"adopt":true}`)
+		if strings.Join(report.Missing, ",") != "gone,gone-failed" {
+			t.Errorf("missing = %v, want [gone gone-failed]", report.Missing)
+		}
+		if strings.Join(report.Orphaned, ",") != "stray" {
+			t.Errorf("orphaned = %v, want [stray]", report.Orphaned)
+		}
+		if len(report.MarkedFailed)+len(report.Removed)+len(report.Adopted) != 0 {
+			t.Errorf("dry run should change nothing: %+v", report)
+		}
+		if b.instances["gone"].State != "ready" || b.instances["stray"] != nil {
+			t.Error("dry run should leave broker state untouched")
+		}
+	})
+
+	t.Run("marks missing failed by default", func(t *testing.T) {
+		b, r := setup(t)
+		report := reconcile(t, r, "")
+		if strings.Join(report.MarkedFailed, ",") != "gone" {
+			t.Errorf("marked_failed = %v, want [gone]", report.MarkedFailed)
+		}
+		if inst := b.instances["gone"]; inst.State != "failed" || !strings.Contains(inst.LastError, "openclaw-agent-gone") {
+			t.Errorf("gone = %+v, want failed with a LastError naming the deployment", inst)
+		}
+		if b.instances["kept"].State != "ready" || b.instances["pending"].State != "provisioning" {
+			t.Error("instances with a deployment or in flight should not be touched")
+		}
+		if b.instances["stray"] != nil {
+			t.Error("orphans should only be adopted when asked")
+		}
+	})
+
+	t.Run("removes missing and adopts orphans", func(t *testing.T) {
+		b, r := setup(t)
+		report := reconcile(t, r, `{"remove_missing":true,"adopt":true}`)
+		if strings.Join(report.Removed, ",") != "gone,gone-failed" {
+			t.Errorf("removed = %v, want [gone gone-failed]", report.Removed)
+		}
+		if strings.Join(report.Adopted, ",") != "stray" {
+			t.Errorf("adopted = %v, want [stray]", report.Adopted)
+		}
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		if _, ok := b.instances["gone"]; ok {
+			t.Error("gone should have been removed")
+		}
+		if inst := b.instances["stray"]; inst == nil || inst.State != "ready" || inst.DeploymentName != "openclaw-agent-stray" {
+			t.Errorf("stray = %+v, want an adopted ready instance", inst)
+		}
+	})
+}
+
+func TestAdminReconcile_DirectorError(t *testing.T) {
+	_, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/reconcile", nil))
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 when the Director listing fails, got %d", rr.Code)
+	}
+}
+
+func TestAdminExportImport_RoundTrip(t *testing.T) {
+	src, srcBOSH, srcRouter := newTestBrokerWithAdminRoutes("done", false)
+	defer srcBOSH.Close()
+	provisionInstance(t, srcRouter, "inst-move-1", "openclaw-developer-plan")
+	provisionInstance(t, srcRouter, "inst-move-2", "openclaw-developer-plan")
+
+	rr := httptest.NewRecorder()
+	srcRouter.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/export", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("export status = %d, want 200. Body: %s", rr.Code, rr.Body.String())
+	}
+	export := rr.Body.String()
+	if !strings.Contains(export, src.instances["inst-move-1"].GatewayToken) {
+		t.Error("export should include secrets")
+	}
+
+	dst, dstBOSH, dstRouter := newTestBrokerWithAdminRoutes("done", false)
+	defer dstBOSH.Close()
+	dst.config.StateDir = t.TempDir()
+	provisionInstance(t, dstRouter, "inst-local", "openclaw-developer-plan")
+
+	importExport := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		dstRouter.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/import"+query, strings.NewReader(export)))
+		return rr
+	}
+	if rr := importExport(""); rr.Code != http.StatusOK {
+		t.Fatalf("import status = %d, want 200. Body: %s", rr.Code, rr.Body.String())
+	}
+
+	dst.mu.RLock()
+	for _, id := range []string{"inst-move-1", "inst-move-2"} {
+		got, want := dst.instances[id], src.instances[id]
+		if got == nil || got.GatewayToken != want.GatewayToken || got.NodeSeed != want.NodeSeed || got.DeploymentName != want.DeploymentName {
+			t.Errorf("%s = %+v, want the exported record", id, got)
+		}
+	}
+	if _, ok := dst.instances["inst-local"]; !ok || len(dst.instances) != 3 {
+		t.Errorf("import should merge with existing state, have %d instances", len(dst.instances))
+	}
+	dst.mu.RUnlock()
+	if _, err := os.Stat(dst.instanceStatePath("inst-move-1")); err != nil {
+		t.Errorf("imported instance should be persisted: %v", err)
+	}
+}
+
+func TestAdminImport_OverwriteGuard(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+	provisionInstance(t, router, "inst-dup", "openclaw-developer-plan")
+	original := b.instances["inst-dup"].GatewayToken
+
+	body := `{"inst-dup": {"id": "inst-dup", "gateway_token": "imported-token", "state": "ready"}, "inst-new": {"state": "ready"}}`
+	post := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/import"+query, strings.NewReader(body)))
+		return rr
+	}
+
+	rr := post("")
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("import over an existing ID: status = %d, want 409", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), `"existing":["inst-dup"]`) {
+		t.Errorf("conflict should list the existing IDs: %s", rr.Body.String())
+	}
+	if b.instances["inst-dup"].GatewayToken != original || b.instances["inst-new"] != nil {
+		t.Error("a refused import should change nothing")
+	}
+
+	rr = post("?overwrite=true")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("overwrite import: status = %d, want 200. Body: %s", rr.Code, rr.Body.String())
+	}
+	if b.instances["inst-dup"].GatewayToken != "imported-token" || b.instances["inst-new"].ID != "inst-new" {
+		t.Error("overwrite import should replace the existing record and add the new one")
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/import", strings.NewReader(`{"../etc": {}}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid instance ID: status = %d, want 400", rr.Code)
+	}
+}
+
+func setMaintenance(t *testing.T, router *mux.Router, body string) Maintenance {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/maintenance", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("POST /admin/maintenance status = %d, want 200. Body: %s", rr.Code, rr.Body.String())
+	}
+	var m Maintenance
+	json.Unmarshal(rr.Body.Bytes(), &m)
+	return m
+}
+
+func TestMaintenance_RejectsProvisionOnly(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+	b.config.StateDir = t.TempDir()
+
+	provisionInstance(t, router, "inst-existing", "openclaw-developer-plan")
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/service_instances/inst-existing/last_operation", nil))
+	waitForState(t, b, "inst-existing", "ready")
+
+	m := setMaintenance(t, router, `{"enabled": true, "message": "Upgrading the foundation until 18:00 UTC"}`)
+	if !m.Enabled || m.Message != "Upgrading the foundation until 18:00 UTC" {
+		t.Errorf("maintenance = %+v, want enabled with the message", m)
+	}
+
+	rr := provisionInstance(t, router, "inst-new", "openclaw-developer-plan")
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Provision status = %d, want 503. Body: %s", rr.Code, rr.Body.String())
+	}
+	var osbErr map[string]string
+	json.Unmarshal(rr.Body.Bytes(), &osbErr)
+	if osbErr["error"] != "MaintenanceMode" || osbErr["description"] != "Upgrading the foundation until 18:00 UTC" {
+		t.Errorf("Provision error = %v, want MaintenanceMode with the message", osbErr)
+	}
+	if _, exists := b.instances["inst-new"]; exists {
+		t.Error("no instance should be created in maintenance mode")
+	}
+
+	// Existing instances can still be bound, updated, polled and deleted
+	bindInstance(t, router, "inst-existing", "bind-1")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PATCH", "/v2/service_instances/inst-existing?accepts_incomplete=true",
+		strings.NewReader(`{"service_id":"openclaw-service","parameters":{"owner":"dev@example.com"}}`)))
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("Update status = %d, want 202. Body: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/service_instances/inst-existing/last_operation", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("LastOperation status = %d, want 200. Body: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/v2/service_instances/inst-existing?accepts_incomplete=true", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("Deprovision status = %d, want 202. Body: %s", rr.Code, rr.Body.String())
+	}
+
+	// Leaving maintenance mode accepts provisions again
+	if m := setMaintenance(t, router, `{"enabled": false}`); m.Enabled || m.Message != "" {
+		t.Errorf("maintenance = %+v, want disabled", m)
+	}
+	if rr := provisionInstance(t, router, "inst-new", "openclaw-developer-plan"); rr.Code != http.StatusAccepted {
+		t.Errorf("Provision after maintenance status = %d, want 202. Body: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestMaintenance_SurvivesRestart(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+	b.config.StateDir = t.TempDir()
+
+	setMaintenance(t, router, `{"enabled": true}`)
+
+	restarted := New(b.config, b.director)
+	if m := restarted.maintenanceMode(); !m.Enabled || m.Message != defaultMaintenanceMessage {
+		t.Errorf("maintenance after restart = %+v, want enabled with the default message", m)
+	}
+}
+
+func TestMaintenance_MalformedBody(t *testing.T) {
+	_, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/maintenance", strings.NewReader(`{"enabled": "yes"`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rr.Code)
+	}
+}
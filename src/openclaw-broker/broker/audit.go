@@ -0,0 +1,155 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// originatingIdentityHeader carries the platform user behind an OSB request:
+// "<platform> <base64-encoded JSON>".
+const originatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+// auditLogFile is the StateDir file holding one JSON audit entry per line.
+const auditLogFile = "audit.log"
+
+// OriginatingIdentity is the decoded X-Broker-API-Originating-Identity header.
+type OriginatingIdentity struct {
+	Platform string `json:"platform"`
+	UserID   string `json:"user_id,omitempty"`
+	UserName string `json:"user_name,omitempty"`
+}
+
+// AuditEntry records who performed an OSB operation against an instance.
+type AuditEntry struct {
+	Timestamp  time.Time            `json:"timestamp"`
+	Operation  string               `json:"operation"`
+	InstanceID string               `json:"instance_id"`
+	BindingID  string               `json:"binding_id,omitempty"`
+	User       *OriginatingIdentity `json:"user,omitempty"`
+}
+
+// parseOriginatingIdentity decodes the originating identity header. CF sends
+// {"user_id": "..."}; other platforms may add more fields, which are ignored.
+func parseOriginatingIdentity(header string) (*OriginatingIdentity, error) {
+	platform, value, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || platform == "" || value == "" {
+		return nil, errors.New("expected \"<platform> <base64 JSON>\"")
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("decoding value: %w", err)
+	}
+	var fields struct {
+		UserID   string `json:"user_id"`
+		UserName string `json:"user_name"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("parsing value: %w", err)
+	}
+	return &OriginatingIdentity{Platform: platform, UserID: fields.UserID, UserName: fields.UserName}, nil
+}
+
+// originatingIdentity returns the caller identity of an OSB request, or nil
+// when the platform sent none or it can't be parsed.
+func (b *Broker) originatingIdentity(ctx context.Context, r *http.Request) *OriginatingIdentity {
+	header := r.Header.Get(originatingIdentityHeader)
+	if header == "" {
+		return nil
+	}
+	identity, err := parseOriginatingIdentity(header)
+	if err != nil {
+		b.logger.WarnContext(ctx, "ignoring malformed originating identity", "error", err)
+		return nil
+	}
+	return identity
+}
+
+// audit appends an entry to StateDir/audit.log. Best-effort: a failed write
+// is logged but never fails the operation being audited.
+func (b *Broker) audit(ctx context.Context, operation, instanceID, bindingID string, user *OriginatingIdentity) {
+	if b.config.StateDir == "" {
+		return
+	}
+	entry := AuditEntry{
+		Timestamp:  time.Now().UTC(),
+		Operation:  operation,
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		User:       user,
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		b.logger.ErrorContext(ctx, "failed to marshal audit entry", "operation", operation, "instance_id", instanceID, "error", err)
+		return
+	}
+
+	b.auditMu.Lock()
+	defer b.auditMu.Unlock()
+	f, err := os.OpenFile(filepath.Join(b.config.StateDir, auditLogFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		b.logger.ErrorContext(ctx, "failed to open audit log", "operation", operation, "instance_id", instanceID, "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		b.logger.ErrorContext(ctx, "failed to write audit entry", "operation", operation, "instance_id", instanceID, "error", err)
+	}
+}
+
+// readAuditLog returns every entry in the audit log, oldest first. A missing
+// log reads as empty.
+func (b *Broker) readAuditLog() ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	if b.config.StateDir == "" {
+		return entries, nil
+	}
+	b.auditMu.Lock()
+	defer b.auditMu.Unlock()
+	f, err := os.Open(filepath.Join(b.config.StateDir, auditLogFile))
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("parsing audit log: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// AdminAudit returns the audit trail, optionally filtered by ?instance_id=.
+func (b *Broker) AdminAudit(w http.ResponseWriter, r *http.Request) {
+	entries, err := b.readAuditLog()
+	if err != nil {
+		b.logger.ErrorContext(r.Context(), "failed to read audit log", "operation", "admin_audit", "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to read audit log"})
+		return
+	}
+	if instanceID := r.URL.Query().Get("instance_id"); instanceID != "" {
+		filtered := []AuditEntry{}
+		for _, e := range entries {
+			if e.InstanceID == instanceID {
+				filtered = append(filtered, e)
+			}
+		}
+		entries = filtered
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sampleOriginatingIdentity is the example header from the OSB spec.
+const sampleOriginatingIdentity = "cloudfoundry eyJ1c2VyX2lkIjoiNjgzZWE3NDgtMzA5Mi00ZmY0LWI2NTYtMzljYWNjNGQ1MzYwIn0="
+
+func TestParseOriginatingIdentity(t *testing.T) {
+	identity, err := parseOriginatingIdentity(sampleOriginatingIdentity)
+	if err != nil {
+		t.Fatalf("parseOriginatingIdentity: %v", err)
+	}
+	if identity.Platform != "cloudfoundry" {
+		t.Errorf("Platform = %q, want cloudfoundry", identity.Platform)
+	}
+	if identity.UserID != "683ea748-3092-4ff4-b656-39cacc4d5360" {
+		t.Errorf("UserID = %q, want the decoded user_id", identity.UserID)
+	}
+
+	for _, bad := range []string{"cloudfoundry", "cloudfoundry not-base64!", "cloudfoundry bm90LWpzb24="} {
+		if _, err := parseOriginatingIdentity(bad); err == nil {
+			t.Errorf("parseOriginatingIdentity(%q) should fail", bad)
+		}
+	}
+}
+
+func TestAudit_ProvisionWritesEntry(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+	b.config.StateDir = t.TempDir()
+
+	body, _ := json.Marshal(ProvisionRequest{
+		ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan",
+		OrganizationGUID: "org-123", SpaceGUID: "space-456",
+		Parameters: map[string]interface{}{"owner": "dev@example.com"},
+	})
+	req := httptest.NewRequest("PUT", "/v2/service_instances/inst-audit?accepts_incomplete=true", bytes.NewReader(body))
+	req.Header.Set(originatingIdentityHeader, sampleOriginatingIdentity)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Provision failed: %d %s", rr.Code, rr.Body.String())
+	}
+
+	if user := b.instances["inst-audit"].CreatedBy; user == nil || user.UserID != "683ea748-3092-4ff4-b656-39cacc4d5360" {
+		t.Errorf("CreatedBy = %+v, want the originating user", user)
+	}
+
+	data, err := os.ReadFile(filepath.Join(b.config.StateDir, auditLogFile))
+	if err != nil {
+		t.Fatalf("reading audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("audit log has %d lines, want 1:\n%s", len(lines), data)
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("audit entry is not JSON: %v", err)
+	}
+	if entry.Operation != "provision" || entry.InstanceID != "inst-audit" || entry.Timestamp.IsZero() {
+		t.Errorf("entry = %+v, want a timestamped provision of inst-audit", entry)
+	}
+	if entry.User == nil || entry.User.Platform != "cloudfoundry" {
+		t.Errorf("entry user = %+v, want the cloudfoundry identity", entry.User)
+	}
+}
+
+func TestAudit_AdminEndpointListsAndFilters(t *testing.T) {
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+	b.config.StateDir = t.TempDir()
+
+	provisionInstance(t, router, "inst-a", "openclaw-developer-plan")
+	provisionInstance(t, router, "inst-b", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-a"].State = "ready"
+	b.mu.Unlock()
+
+	req := httptest.NewRequest("PUT", "/v2/service_instances/inst-a/service_bindings/bind-1", nil)
+	req.Header.Set(originatingIdentityHeader, sampleOriginatingIdentity)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/audit", nil))
+	var all []AuditEntry
+	json.Unmarshal(rr.Body.Bytes(), &all)
+	if len(all) != 3 {
+		t.Fatalf("got %d audit entries, want 3: %s", len(all), rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/audit?instance_id=inst-a", nil))
+	var filtered []AuditEntry
+	json.Unmarshal(rr.Body.Bytes(), &filtered)
+	if len(filtered) != 2 {
+		t.Fatalf("got %d entries for inst-a, want 2", len(filtered))
+	}
+	bind := filtered[1]
+	if bind.Operation != "bind" || bind.BindingID != "bind-1" || bind.User == nil {
+		t.Errorf("bind entry = %+v, want bind-1 with the originating user", bind)
+	}
+	if filtered[0].User != nil {
+		t.Errorf("provision without the header should have no user, got %+v", filtered[0].User)
+	}
+}
+
+func TestAudit_AdminEndpointEmptyWithoutLog(t *testing.T) {
+	_, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/audit", nil))
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Errorf("got %d %q, want 200 []", rr.Code, rr.Body.String())
+	}
+}
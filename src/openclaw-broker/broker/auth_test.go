@@ -0,0 +1,63 @@
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// newAuthRouter mirrors main.go: an /admin subrouter with its own credentials
+// registered ahead of the catch-all OSB subrouter.
+func newAuthRouter(b *Broker) *mux.Router {
+	r := mux.NewRouter()
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(BasicAuthMiddleware("ops", "ops-secret"))
+	admin.HandleFunc("/instances", b.AdminListInstances).Methods("GET")
+
+	api := r.PathPrefix("/").Subrouter()
+	api.Use(BasicAuthMiddleware("broker", "broker-secret"))
+	api.HandleFunc("/v2/catalog", b.Catalog).Methods("GET")
+	return r
+}
+
+func TestBasicAuth_SeparateAdminCredentials(t *testing.T) {
+	b, fakeBOSH, _ := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	r := newAuthRouter(b)
+
+	tests := []struct {
+		path, user, pass string
+		want             int
+	}{
+		{"/admin/instances", "broker", "broker-secret", http.StatusUnauthorized},
+		{"/admin/instances", "ops", "ops-secret", http.StatusOK},
+		{"/v2/catalog", "broker", "broker-secret", http.StatusOK},
+		{"/v2/catalog", "ops", "ops-secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.SetBasicAuth(tt.user, tt.pass)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("GET %s as %s: status = %d, want %d", tt.path, tt.user, rr.Code, tt.want)
+		}
+	}
+}
+
+func TestBasicAuth_MissingCredentials(t *testing.T) {
+	b, fakeBOSH, _ := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	r := newAuthRouter(b)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/instances", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+	if rr.Header().Get("WWW-Authenticate") == "" {
+		t.Error("401 response should carry a WWW-Authenticate challenge")
+	}
+}
@@ -1,64 +1,572 @@
 package broker
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/security"
 )
 
 type BindRequest struct {
-	ServiceID  string                 `json:"service_id"`
-	PlanID     string                 `json:"plan_id"`
-	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	ServiceID    string                 `json:"service_id"`
+	PlanID       string                 `json:"plan_id"`
+	BindResource *BindResource          `json:"bind_resource,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// BindResource identifies what a binding is for. CF sets app_guid for app
+// bindings and omits it (or the whole block) for service keys.
+type BindResource struct {
+	AppGUID string `json:"app_guid,omitempty"`
+	Route   string `json:"route,omitempty"`
+}
+
+// isAppBinding reports whether the request binds an app rather than
+// creating a service key.
+func (req BindRequest) isAppBinding() bool {
+	return req.BindResource != nil && req.BindResource.AppGUID != ""
 }
 
 type BindResponse struct {
 	Credentials map[string]interface{} `json:"credentials"`
 }
 
+// BindAsyncResponse is returned with 202 when a binding is set up asynchronously.
+type BindAsyncResponse struct {
+	Operation string `json:"operation"`
+}
+
+// Binding records the credentials issued to a single service binding.
+type Binding struct {
+	ID           string    `json:"id"`
+	GatewayToken string    `json:"gateway_token"`
+	CreatedAt    time.Time `json:"created_at"`
+	RequestHash  string    `json:"request_hash,omitempty"` // fingerprint of the bind request, for idempotent repeats
+	AppBinding   bool      `json:"app_binding,omitempty"`
+	State        string    `json:"state,omitempty"`  // bindingInProgress or bindingFailed while async setup is unfinished; empty once usable
+	Format       string    `json:"format,omitempty"` // bindFormatBundle adds connection files to the credentials
+	LastError    string    `json:"last_error,omitempty"`
+	BoshTaskID   int       `json:"bosh_task_id,omitempty"` // deploy that adds GatewayToken to the agent's accepted set
+}
+
+// Async binding states. A binding with neither state is complete.
+const (
+	bindingInProgress = "in progress"
+	bindingFailed     = "failed"
+)
+
+// bindFormatBundle is the "format" bind parameter that adds base64-encoded
+// connection files to the credentials, for automation that wants one bundle
+// rather than individual fields.
+const bindFormatBundle = "bundle"
+
+// bindFormat returns the "format" bind parameter, which is empty or
+// bindFormatBundle.
+func (req BindRequest) bindFormat() (string, error) {
+	raw, ok := req.Parameters["format"]
+	if !ok {
+		return "", nil
+	}
+	format, _ := raw.(string)
+	if format != bindFormatBundle {
+		return "", fmt.Errorf("parameter format must be %q, got %v", bindFormatBundle, raw)
+	}
+	return format, nil
+}
+
+// bindOperation is the operation string returned for async binds.
+const bindOperation = "bind"
+
+// fingerprint hashes the parts of a bind request that define the binding, so
+// a repeated PUT can be told apart from a conflicting one. encoding/json sorts
+// map keys, so equal parameters always hash the same.
+func (req BindRequest) fingerprint() string {
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 func (b *Broker) Bind(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	instanceID := vars["instance_id"]
+	bindingID := vars["binding_id"]
+	ctx := r.Context()
 
-	b.mu.RLock()
+	// Bindings are synchronous unless the platform accepts an async response.
+	async, ok := acceptsIncomplete(w, r)
+	if !ok {
+		return
+	}
+
+	var req BindRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		osbError(w, http.StatusBadRequest, "BadRequest", "Malformed request body: "+err.Error())
+		return
+	}
+	format, err := req.bindFormat()
+	if err != nil {
+		osbError(w, http.StatusBadRequest, "InvalidParameters", err.Error())
+		return
+	}
+	user := b.originatingIdentity(ctx, r)
+
+	// A new binding redeploys the agent, so it must not race an Update or
+	// Deprovision of the same instance
+	unlock := b.ops.lock(instanceID)
+	defer unlock()
+	b.settleOperation(ctx, instanceID)
+
+	b.mu.Lock()
 	instance, exists := b.instances[instanceID]
 	if !exists {
-		b.mu.RUnlock()
-		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Instance not found"})
+		b.mu.Unlock()
+		osbError(w, http.StatusNotFound, "InstanceNotFound", fmt.Sprintf("Instance %s does not exist", instanceID))
 		return
 	}
 
+	// A repeated PUT for an existing binding returns the credentials already
+	// issued, provided the request is identical (OSB requires 409 otherwise).
+	// Bindings stored before request fingerprints were recorded match any request.
+	// A failed async binding is replaced by the retry.
+	fingerprint := req.fingerprint()
+	if existing, ok := instance.Bindings[bindingID]; ok && existing.State != bindingFailed {
+		if existing.RequestHash != "" && existing.RequestHash != fingerprint {
+			b.mu.Unlock()
+			osbError(w, http.StatusConflict, "BindingAlreadyExists", fmt.Sprintf("Binding %s already exists with different parameters", bindingID))
+			return
+		}
+		if existing.State == bindingInProgress {
+			b.mu.Unlock()
+			if async {
+				writeJSON(w, http.StatusAccepted, BindAsyncResponse{Operation: bindOperation})
+			} else {
+				osbError(w, http.StatusUnprocessableEntity, errConcurrency, fmt.Sprintf("Binding %s is still being set up", bindingID))
+			}
+			return
+		}
+		resp := b.bindResponse(instance, existing, req.isAppBinding())
+		b.mu.Unlock()
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	if instance.State == stateDeployingRoute {
+		b.mu.Unlock()
+		osbError(w, http.StatusUnprocessableEntity, errConcurrency, "The agent is deployed but its route is not registered yet; retry shortly")
+		return
+	}
+	if instance.State == "provisioning" || instance.State == "deprovisioning" {
+		state := instance.State
+		b.mu.Unlock()
+		osbError(w, http.StatusUnprocessableEntity, errConcurrency, fmt.Sprintf("Instance %s is %s; retry once it finishes", instanceID, state))
+		return
+	}
 	if instance.State != "ready" {
-		b.mu.RUnlock()
-		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "Instance not ready"})
+		state := instance.State
+		b.mu.Unlock()
+		osbError(w, http.StatusUnprocessableEntity, "InstanceNotReady", fmt.Sprintf("Instance %s is %s", instanceID, state))
+		return
+	}
+
+	// Each binding gets its own gateway token so it can be revoked on unbind
+	// without affecting other bindings of the same instance.
+	binding := &Binding{
+		ID:          bindingID,
+		CreatedAt:   time.Now().UTC(),
+		RequestHash: fingerprint,
+		AppBinding:  req.isAppBinding(),
+		Format:      format,
+	}
+	if async {
+		binding.State = bindingInProgress
+	} else {
+		binding.GatewayToken = security.GenerateGatewayToken()
+	}
+	if instance.Bindings == nil {
+		instance.Bindings = make(map[string]*Binding)
+	}
+	instance.Bindings[bindingID] = binding
+	if user != nil {
+		instance.LastModifiedBy = user
+	}
+
+	if async {
+		b.mu.Unlock()
+		b.saveInstance(instanceID)
+		b.audit(ctx, "bind", instanceID, bindingID, user)
+		go b.completeBinding(context.WithoutCancel(ctx), instanceID, binding)
+		writeJSON(w, http.StatusAccepted, BindAsyncResponse{Operation: bindOperation})
+		return
+	}
+
+	b.mu.Unlock()
+
+	// The agent only accepts the tokens its manifest lists, so the new
+	// credentials work once this deploy finishes
+	taskID, err := b.redeployBindings(ctx, instanceID, "bind")
+	if err != nil {
+		b.mu.Lock()
+		if instance.Bindings[bindingID] == binding {
+			delete(instance.Bindings, bindingID)
+		}
+		b.mu.Unlock()
+		b.saveInstance(instanceID)
+		b.logger.ErrorContext(ctx, "BOSH deploy failed", "operation", "bind", "instance_id", instanceID, "binding_id", bindingID, "error", err)
+		osbError(w, http.StatusInternalServerError, "DeploymentFailed", "The BOSH Director rejected the deployment")
 		return
 	}
 
 	// Copy values under lock to avoid race with concurrent state mutations
+	b.mu.Lock()
+	binding.BoshTaskID = taskID
+	resp := b.bindResponse(instance, binding, req.isAppBinding())
+	b.mu.Unlock()
+	b.saveInstance(instanceID)
+	b.audit(ctx, "bind", instanceID, bindingID, user)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// completeBinding issues the credentials for a binding accepted asynchronously
+// and redeploys the agent so it accepts them, unless the binding was unbound
+// in the meantime. The binding stays in progress until advanceBinding sees
+// the deploy finish.
+func (b *Broker) completeBinding(ctx context.Context, instanceID string, binding *Binding) {
+	unlock := b.ops.lock(instanceID)
+	defer unlock()
+	b.settleOperation(ctx, instanceID)
+
+	b.mu.Lock()
+	instance, exists := b.instances[instanceID]
+	if !exists || instance.Bindings[binding.ID] != binding {
+		b.mu.Unlock()
+		b.logger.InfoContext(ctx, "binding removed before setup finished", "operation", "bind",
+			"instance_id", instanceID, "binding_id", binding.ID)
+		return
+	}
+	// Another operation may have taken the instance since Bind accepted
+	if instance.State != "ready" {
+		failBinding(binding, fmt.Sprintf("Instance %s is %s; retry the bind once it finishes", instanceID, instance.State))
+		b.mu.Unlock()
+		b.saveInstance(instanceID)
+		b.logger.WarnContext(ctx, "binding setup abandoned, instance busy", "operation", "bind",
+			"instance_id", instanceID, "binding_id", binding.ID)
+		return
+	}
+	binding.GatewayToken = security.GenerateGatewayToken()
+	b.mu.Unlock()
+
+	taskID, err := b.redeployBindings(ctx, instanceID, "bind")
+	b.mu.Lock()
+	if err != nil {
+		failBinding(binding, "The BOSH Director rejected the deployment of the binding credentials")
+	} else {
+		binding.BoshTaskID = taskID
+	}
+	b.mu.Unlock()
+	b.saveInstance(instanceID)
+	if err != nil {
+		b.logger.ErrorContext(ctx, "BOSH deploy failed", "operation", "bind", "instance_id", instanceID, "binding_id", binding.ID, "error", err)
+	}
+}
+
+// advanceBinding settles an async binding once the deploy carrying its token
+// finishes. While that deploy is still the instance's operation it is followed
+// the way LastOperation would; if a later operation replaced it, e.g. a
+// deprovision cancelled it, the task is asked about directly.
+func (b *Broker) advanceBinding(ctx context.Context, instance *Instance, binding *Binding) {
+	b.mu.RLock()
+	taskID := binding.BoshTaskID
+	pending := binding.State == bindingInProgress && taskID != 0
+	current := instance.BoshTaskID == taskID
+	b.mu.RUnlock()
+	if !pending {
+		return
+	}
+
+	succeeded, failure := false, ""
+	if current {
+		var resp LastOperationResponse
+		if b.watching.Load() {
+			resp = b.cachedOperation(instance)
+		} else {
+			resp = b.advanceOperation(ctx, instance)
+		}
+		switch resp.State {
+		case "succeeded":
+			succeeded = true
+		case "failed":
+			failure = resp.Description
+		}
+	} else {
+		taskState, err := b.taskStatus(ctx, instance.ID, taskID)
+		if err != nil {
+			b.logger.WarnContext(ctx, "BOSH task status check failed", "operation", "bind",
+				"instance_id", instance.ID, "binding_id", binding.ID, "bosh_task_id", taskID, "error", err)
+		}
+		switch taskState {
+		case "done":
+			succeeded = true
+		case "error", "cancelled":
+			failure = b.describeTaskFailure(ctx, "BOSH deployment failed", taskID)
+		}
+	}
+	if !succeeded && failure == "" {
+		return
+	}
+
+	b.mu.Lock()
+	if instance.Bindings[binding.ID] != binding || binding.State != bindingInProgress {
+		b.mu.Unlock()
+		return
+	}
+	if succeeded {
+		binding.State = ""
+	} else {
+		failBinding(binding, failure)
+	}
+	b.mu.Unlock()
+	b.saveInstance(instance.ID)
+	if succeeded {
+		b.logger.InfoContext(ctx, "binding ready", "operation", "bind", "instance_id", instance.ID, "binding_id", binding.ID)
+	} else {
+		b.logger.ErrorContext(ctx, "binding failed", "operation", "bind", "instance_id", instance.ID,
+			"binding_id", binding.ID, "bosh_task_id", taskID, "description", failure)
+	}
+}
+
+// failBinding marks an async binding failed. Its token was never accepted,
+// so it is dropped from later manifests. Must be called with b.mu held.
+func failBinding(binding *Binding, reason string) {
+	binding.State = bindingFailed
+	binding.GatewayToken = ""
+	binding.LastError = reason
+}
+
+// GetBinding serves a completed binding's credentials. OSB requires 404 while
+// an async binding is still being set up.
+func (b *Broker) GetBinding(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	instanceID := vars["instance_id"]
+	bindingID := vars["binding_id"]
+
+	b.mu.RLock()
+	instance, exists := b.instances[instanceID]
+	var binding *Binding
+	if exists {
+		binding = instance.Bindings[bindingID]
+	}
+	if binding == nil || binding.State != "" {
+		b.mu.RUnlock()
+		osbError(w, http.StatusNotFound, "BindingNotFound", fmt.Sprintf("Binding %s does not exist", bindingID))
+		return
+	}
+	resp := b.bindResponse(instance, binding, binding.AppBinding)
+	b.mu.RUnlock()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// BindingLastOperation reports the progress of an async bind, which succeeds
+// once the deploy adding its token to the agent is done.
+func (b *Broker) BindingLastOperation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	instanceID := vars["instance_id"]
+	bindingID := vars["binding_id"]
+
+	b.mu.RLock()
+	instance, exists := b.instances[instanceID]
+	var binding *Binding
+	if exists {
+		binding = instance.Bindings[bindingID]
+	}
+	b.mu.RUnlock()
+	if binding == nil {
+		osbError(w, http.StatusNotFound, "BindingNotFound", fmt.Sprintf("Binding %s does not exist", bindingID))
+		return
+	}
+	b.advanceBinding(r.Context(), instance, binding)
+
+	b.mu.RLock()
+	var resp LastOperationResponse
+	switch {
+	case binding.State == bindingInProgress && binding.BoshTaskID != 0:
+		resp = LastOperationResponse{State: "in progress", Description: "Deploying binding credentials to the agent..."}
+	case binding.State == bindingInProgress:
+		resp = LastOperationResponse{State: "in progress", Description: "Setting up binding credentials..."}
+	case binding.State == bindingFailed:
+		resp = LastOperationResponse{State: "failed", Description: binding.LastError}
+	default:
+		resp = LastOperationResponse{State: "succeeded", Description: "Binding ready"}
+	}
+	b.mu.RUnlock()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// failInterruptedBindings fails async bindings whose setup was cut short by a
+// broker restart before their deploy was submitted, so the platform stops
+// polling and can retry the bind. Bindings with a deploy in flight are left
+// for BindingLastOperation to finish.
+func failInterruptedBindings(instance *Instance) {
+	for _, binding := range instance.Bindings {
+		if binding.State == bindingInProgress && binding.BoshTaskID == 0 {
+			failBinding(binding, "Broker restarted before binding setup finished; retry the bind")
+		}
+	}
+}
+
+// bindResponse builds the credentials for a binding, plus the env_file and
+// shell_snippet connection files for bindFormatBundle. Must be called with b.mu held.
+func (b *Broker) bindResponse(instance *Instance, binding *Binding, appBinding bool) BindResponse {
 	resp := BindResponse{
 		Credentials: map[string]interface{}{
-			"dashboard_url":    fmt.Sprintf("https://%s.%s?token=%s", instance.RouteHostname, instance.AppsDomain, instance.GatewayToken),
+			"dashboard_url":    withToken(b.dashboardURL(instance), binding.GatewayToken),
 			"api_endpoint":     fmt.Sprintf("https://%s.%s/api", instance.RouteHostname, instance.AppsDomain),
-			"api_token":        instance.GatewayToken,
+			"api_token":        binding.GatewayToken,
 			"instance_id":      instance.ID,
 			"owner":            instance.Owner,
 			"plan":             instance.PlanName,
 			"openclaw_version": instance.OpenClawVersion,
-			"node_seed":        instance.NodeSeed,
 			"sso_enabled":      instance.SSOEnabled,
 		},
 	}
-	b.mu.RUnlock()
+	// Apps only need the API; node pairing and the Control UI are for
+	// humans holding a service key.
+	if !appBinding {
+		resp.Credentials["node_seed"] = instance.NodeSeed
+		resp.Credentials["control_ui_url"] = fmt.Sprintf("https://%s.%s", instance.RouteHostname, instance.AppsDomain)
+	}
+	if binding.Format == bindFormatBundle {
+		env := [][2]string{
+			{"OPENCLAW_GATEWAY_URL", fmt.Sprintf("https://%s.%s", instance.RouteHostname, instance.AppsDomain)},
+			{"OPENCLAW_API_ENDPOINT", resp.Credentials["api_endpoint"].(string)},
+			{"OPENCLAW_TOKEN", binding.GatewayToken},
+			{"OPENCLAW_INSTANCE_ID", instance.ID},
+		}
+		var envFile, shell strings.Builder
+		for _, kv := range env {
+			fmt.Fprintf(&envFile, "%s=%s\n", kv[0], kv[1])
+			fmt.Fprintf(&shell, "export %s=%s\n", kv[0], shellQuote(kv[1]))
+		}
+		resp.Credentials["env_file"] = base64.StdEncoding.EncodeToString([]byte(envFile.String()))
+		resp.Credentials["shell_snippet"] = base64.StdEncoding.EncodeToString([]byte(shell.String()))
+	}
+	return resp
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(resp)
+// shellQuote single-quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
 
 func (b *Broker) Unbind(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{})
+	vars := mux.Vars(r)
+	instanceID := vars["instance_id"]
+	bindingID := vars["binding_id"]
+
+	// Wait out a token rotation, which may still put this binding back
+	unlock := b.ops.lock(instanceID)
+	defer unlock()
+	b.settleOperation(r.Context(), instanceID)
+
+	b.mu.Lock()
+	instance, exists := b.instances[instanceID]
+	if !exists {
+		b.mu.Unlock()
+		writeJSON(w, http.StatusGone, map[string]string{})
+		return
+	}
+	if _, ok := instance.Bindings[bindingID]; !ok {
+		// Already unbound (or never bound) — OSB expects 410 Gone
+		b.mu.Unlock()
+		writeJSON(w, http.StatusGone, map[string]string{})
+		return
+	}
+	delete(instance.Bindings, bindingID)
+
+	// Redeploy so the agent drops the revoked token from its accepted set.
+	// Only ready instances are redeployed; any in-flight operation will
+	// render the manifest from the updated binding set anyway.
+	redeploy := instance.State == "ready" || instance.State == stateDeployingRoute
+	b.mu.Unlock()
+	b.saveInstance(instanceID)
+
+	if redeploy {
+		b.redeployForRevocation(r.Context(), instanceID)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{})
+}
+
+// redeployForRevocation pushes a manifest without the revoked binding token,
+// tracked as the instance's operation so nothing deploys over it.
+// Best-effort: the binding is already gone from broker state, so a failure here
+// only delays revocation until the next redeploy. Caller holds the operation lock.
+func (b *Broker) redeployForRevocation(ctx context.Context, instanceID string) {
+	if _, err := b.redeployBindings(ctx, instanceID, "unbind"); err != nil {
+		b.logger.WarnContext(ctx, "redeploy to revoke binding token failed, token stays accepted until next redeploy",
+			"operation", "unbind", "instance_id", instanceID, "error", err)
+	}
+}
+
+// redeployBindings deploys the instance's current binding tokens and records
+// the task as the instance's operation, as Update does, so nothing else
+// deploys over it before it finishes. Caller holds the operation lock.
+func (b *Broker) redeployBindings(ctx context.Context, instanceID, operation string) (int, error) {
+	done := b.beginBOSHWrite()
+	defer done()
+
+	b.mu.RLock()
+	instance, exists := b.instances[instanceID]
+	if !exists {
+		b.mu.RUnlock()
+		return 0, fmt.Errorf("instance %s does not exist", instanceID)
+	}
+	params := b.buildManifestParams(instance)
+	b.mu.RUnlock()
+
+	manifest, err := b.renderManifest(params)
+	if err != nil {
+		return 0, fmt.Errorf("rendering manifest: %w", err)
+	}
+	taskID, err := b.deploy(ctx, instanceID, manifest)
+	if err != nil {
+		return 0, err
+	}
+
+	b.mu.Lock()
+	b.setInstanceState(instance, "provisioning")
+	instance.BoshTaskID = taskID
+	b.mu.Unlock()
+	b.saveInstance(instanceID)
+	b.logger.InfoContext(ctx, "BOSH deploy started", "operation", operation, "instance_id", instanceID, "bosh_task_id", taskID)
+	return taskID, nil
+}
+
+// bindingTokens returns the gateway tokens of all live bindings, sorted so the
+// rendered manifest is stable across redeploys. Bindings whose async setup
+// hasn't issued a token yet are skipped. Must be called with b.mu held.
+func bindingTokens(instance *Instance) []string {
+	if len(instance.Bindings) == 0 {
+		return nil
+	}
+	tokens := make([]string, 0, len(instance.Bindings))
+	for _, binding := range instance.Bindings {
+		if binding.GatewayToken != "" {
+			tokens = append(tokens, binding.GatewayToken)
+		}
+	}
+	sort.Strings(tokens)
+	return tokens
 }
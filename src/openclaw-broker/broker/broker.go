@@ -1,15 +1,23 @@
 package broker
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/bosh"
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/tracing"
 	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/uaa"
 )
 
@@ -21,13 +29,59 @@ func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	json.NewEncoder(w).Encode(v)
 }
 
+// Error codes defined by the OSB spec; platforms act on these rather than on
+// the description, e.g. retrying a ConcurrencyError later.
+const (
+	errAsyncRequired           = "AsyncRequired"
+	errConcurrency             = "ConcurrencyError"
+	errMaintenanceInfoConflict = "MaintenanceInfoConflict"
+)
+
+// osbError writes an OSB error body: a single CamelCase code in "error" and a
+// human-readable "description" the platform shows to the user.
+func osbError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]string{"error": code, "description": description})
+}
+
+// acceptsIncomplete parses the OSB accepts_incomplete query parameter; absent
+// means false. A malformed value gets a 400 and ok=false.
+func acceptsIncomplete(w http.ResponseWriter, r *http.Request) (async, ok bool) {
+	v := r.URL.Query().Get("accepts_incomplete")
+	if v == "" {
+		return false, true
+	}
+	async, err := strconv.ParseBool(v)
+	if err != nil {
+		osbError(w, http.StatusBadRequest, "BadRequest", fmt.Sprintf("accepts_incomplete must be true or false, got %q", v))
+		return false, false
+	}
+	return async, true
+}
+
+// requireAsync enforces accepts_incomplete=true for operations that only run
+// asynchronously, answering 422 AsyncRequired per the OSB spec when the
+// platform can't poll. Returns false once a response has been written.
+func requireAsync(w http.ResponseWriter, r *http.Request) bool {
+	async, ok := acceptsIncomplete(w, r)
+	if !ok {
+		return false
+	}
+	if !async {
+		osbError(w, http.StatusUnprocessableEntity, errAsyncRequired, "This service plan requires client support for asynchronous service operations.")
+		return false
+	}
+	return true
+}
+
 type BrokerConfig struct {
 	MinOpenClawVersion     string   `json:"min_openclaw_version"`
 	SandboxMode            string   `json:"sandbox_mode"`
 	OpenClawVersion        string   `json:"openclaw_version"`
 	Plans                  []Plan   `json:"plans"`
 	AppsDomain             string   `json:"apps_domain"`
+	DashboardURLTemplate   string   `json:"dashboard_url_template"` // text/template over DashboardURLFields; empty uses DefaultDashboardURLTemplate
 	Network                string   `json:"network"`
+	DeploymentPrefix       string   `json:"deployment_prefix"`
 	AZs                    []string `json:"azs"`
 	StemcellOS             string   `json:"stemcell_os"`
 	StemcellVersion        string   `json:"stemcell_version"`
@@ -39,30 +93,106 @@ type BrokerConfig struct {
 	SSOOIDCIssuerURL        string `json:"sso_oidc_issuer_url"`
 	SSOAllowedEmailDomains  string `json:"sso_allowed_email_domains"`
 	SSOSessionTimeoutHours  int    `json:"sso_session_timeout_hours"`
+	// With SSOExternalClientManagement the broker never creates, updates or
+	// deletes UAA clients: each instance's client (uaa.ClientIDForInstance)
+	// must already exist, with its secret in a file of that name under
+	// SSOExternalClientSecretsDir.
+	SSOExternalClientManagement bool   `json:"sso_external_client_management,omitempty"`
+	SSOExternalClientSecretsDir string `json:"sso_external_client_secrets_dir,omitempty"`
 	CFUaaURL                string `json:"cf_uaa_url"`
 	CFUaaAdminClientID      string `json:"cf_uaa_admin_client_id"`
 	CFUaaAdminClientSecret  string `json:"cf_uaa_admin_client_secret"`
+	CFUaaCACert             string `json:"cf_uaa_ca_cert"`
+	// Outbound TLS for the UAA client; parsed from config by main
+	OutboundTLSMinVersion   uint16   `json:"-"`
+	OutboundTLSCipherSuites []uint16 `json:"-"`
 	MaxInstances           int      `json:"max_instances"`
 	MaxInstancesPerOrg     int      `json:"max_instances_per_org"`
+	MaxInstancesPerSpace   int      `json:"max_instances_per_space"`
+	MaxTotalMemoryMB       int      `json:"max_total_memory_mb"`
+	CatalogQuotas          bool     `json:"catalog_quotas,omitempty"` // report remaining capacity in catalog plan metadata
 	LLMProvider            string   `json:"llm_provider"`
 	LLMEndpoint            string   `json:"llm_endpoint"`
 	LLMAPIKey              string   `json:"llm_api_key"`
 	LLMModel               string   `json:"llm_model"`
 	LLMPreferredModel      string   `json:"llm_preferred_model"`
 	LLMAPIEndpoint         string   `json:"llm_api_endpoint"`
+	LLMExtraParams         map[string]string `json:"llm_extra_params,omitempty"`
+	LLMTemperature         *float64 `json:"llm_temperature,omitempty"`
+	LLMMaxTokens           int      `json:"llm_max_tokens,omitempty"`
+	LLMTopP                *float64 `json:"llm_top_p,omitempty"`
 	GenAIOfferingName      string   `json:"genai_offering_name"`
 	GenAIPlanName          string   `json:"genai_plan_name"`
 	BlockedCommands        string   `json:"blocked_commands"`
+	CommandPolicyMode      string   `json:"command_policy_mode"` // "blocklist" (default) or "allowlist"
+	AllowedCommands        string   `json:"allowed_commands"`
 	NATSTLSEnabled         bool     `json:"nats_tls_enabled"`
 	NATSTLSClientCert      string   `json:"nats_tls_client_cert"`
 	NATSTLSClientKey       string   `json:"nats_tls_client_key"`
 	NATSTLSCACert          string   `json:"nats_tls_ca_cert"`
 	StateDir               string   `json:"state_dir"`
+	SyncProvision          bool     `json:"sync_provision"`
+	SyncProvisionTimeout   int      `json:"sync_provision_timeout_seconds"`
+	RouteReadyTimeout      int      `json:"route_ready_timeout_seconds"` // 0 marks instances ready without probing their route
+	ManifestTemplatePath   string   `json:"manifest_template_path,omitempty"`
+	UseConfigServer        bool     `json:"use_config_server"`
+	GatewayPort            int      `json:"gateway_port,omitempty"`
+	WebchatPort            int      `json:"webchat_port,omitempty"`
+	WebchatSSOPort         int      `json:"webchat_sso_port,omitempty"`
+	RouteRegistrationInterval string `json:"route_registration_interval,omitempty"` // e.g. "20s"; empty uses bosh.DefaultRouteRegistrationInterval
+	LogFormat              string   `json:"log_format,omitempty"` // "json" or "text" (default)
+	WebhookURL             string   `json:"webhook_url,omitempty"`    // receives lifecycle events; empty disables
+	WebhookSecret          string   `json:"webhook_secret,omitempty"` // signs webhook bodies with HMAC-SHA256
+	InstanceTTLHours       int      `json:"instance_ttl_hours,omitempty"`        // deprovision instances older than this; 0 disables
+	InstanceTTLExemptLabel string   `json:"instance_ttl_exempt_label,omitempty"` // label key that exempts an instance; empty uses DefaultTTLExemptLabel
+	UseVMResources         bool     `json:"use_vm_resources,omitempty"` // size VMs from plan cpu/memory instead of vm_type
+	TaskWatchInterval      int      `json:"task_watch_interval_seconds,omitempty"` // polls in-flight BOSH tasks in the background; 0 leaves it to LastOperation
+	OTLPEndpoint           string   `json:"otlp_endpoint,omitempty"`  // OTLP/HTTP collector for traces, e.g. http://collector:4318; empty disables
 }
 
 type upgradeTracker struct {
-	mu    sync.Mutex
-	tasks map[string]int // instanceID -> BOSH task ID
+	mu               sync.Mutex
+	tasks            map[string]int    // instanceID -> BOSH task ID
+	operations       map[string]string // instanceID -> admin operation that submitted the task
+	previousVersions map[string]string // instanceID -> OpenClaw version before the upgrade
+}
+
+// trackedUpgrade is the tracker operation of an upgrade, the only kind
+// AdminUpgradeRollback redeploys.
+const trackedUpgrade = "upgrade"
+
+// track records an upgrade deploy. The first previous version seen for an
+// instance is kept, so repeated upgrades still roll back to the original.
+func (t *upgradeTracker) track(instanceID string, taskID int, previousVersion string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.record(instanceID, taskID, trackedUpgrade)
+	if t.previousVersions == nil {
+		t.previousVersions = make(map[string]string)
+	}
+	if _, ok := t.previousVersions[instanceID]; !ok {
+		t.previousVersions[instanceID] = previousVersion
+	}
+}
+
+// trackOperation records a task that isn't an upgrade, such as a recreate, so
+// /admin/upgrade/status reports it. Rollback leaves it alone.
+func (t *upgradeTracker) trackOperation(instanceID string, taskID int, operation string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.record(instanceID, taskID, operation)
+}
+
+// record stores an instance's latest tracked task. Caller holds t.mu.
+func (t *upgradeTracker) record(instanceID string, taskID int, operation string) {
+	if t.tasks == nil {
+		t.tasks = make(map[string]int)
+	}
+	if t.operations == nil {
+		t.operations = make(map[string]string)
+	}
+	t.tasks[instanceID] = taskID
+	t.operations[instanceID] = operation
 }
 
 type Broker struct {
@@ -71,9 +201,103 @@ type Broker struct {
 	uaaClient *uaa.Client
 	mu        sync.RWMutex
 	instances map[string]*Instance
+	counts    instanceCounts // active instances in b.instances; guarded by mu
 	upgrades  upgradeTracker
+	ops       instanceLocks // serializes update and deprovision of an instance
+	logger    *slog.Logger
+	secrets   SecretStore
+
+	auditMu  sync.Mutex // serializes audit.log appends
+	llmMu    sync.RWMutex // guards the LLM endpoint, API key and model in config
+
+	// inflight counts handlers between submitting a BOSH change and
+	// persisting its task ID, so Shutdown can wait for them.
+	inflight sync.WaitGroup
+
+	// syncTimeout bounds synchronous provisioning; taskPollInterval is the
+	// delay between BOSH task status checks whenever the broker waits on a task.
+	syncTimeout      time.Duration
+	taskPollInterval time.Duration
+
+	// routeProbe checks whether an agent's route is being served; see
+	// RouteReadyTimeout.
+	routeProbe RouteProbe
+
+	// webhookRetryDelay is the pause between webhook delivery attempts.
+	webhookRetryDelay time.Duration
+
+	// now is the clock the TTL reaper ages instances by; reaperInterval is
+	// how often it runs. See BrokerConfig.InstanceTTLHours.
+	now            func() time.Time
+	reaperInterval time.Duration
+
+	// watchInterval is the mean delay between task watcher runs; watching is
+	// set while the watcher runs. See BrokerConfig.TaskWatchInterval.
+	watchInterval time.Duration
+	watching      atomic.Bool
+
+	// catalogCache holds the serialized catalog; see Catalog.
+	catalogCache catalogCache
+
+	// dashboardTmpl renders instance dashboard URLs; see
+	// BrokerConfig.DashboardURLTemplate.
+	dashboardTmpl *template.Template
+
+	// tracer records a span per OSB request and its BOSH and UAA calls; a
+	// no-op unless BrokerConfig.OTLPEndpoint is set.
+	tracer *tracing.Tracer
+
+	// maintenance rejects new provisions while enabled; guarded by mu. See
+	// AdminSetMaintenance.
+	maintenance Maintenance
+}
+
+// SecretStore sets values in the Director's config server (CredHub) so agent
+// manifests can reference them as ((variables)) instead of inlining secrets.
+type SecretStore interface {
+	// SetSecret stores value as the named variable of the given deployment.
+	SetSecret(deploymentName, name, value string) error
+}
+
+// SetSecretStore enables config-server secrets for manifests rendered from
+// now on, provided BrokerConfig.UseConfigServer is also set.
+func (b *Broker) SetSecretStore(s SecretStore) {
+	b.secrets = s
+}
+
+// beginBOSHWrite marks the start of a BOSH-mutating section. The returned
+// func ends it and is safe to call more than once.
+func (b *Broker) beginBOSHWrite() func() {
+	b.inflight.Add(1)
+	return sync.OnceFunc(b.inflight.Done)
+}
+
+// Shutdown waits, until ctx is done, for in-flight BOSH operations to record
+// their task IDs, then flushes state to disk one final time.
+func (b *Broker) Shutdown(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		b.inflight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("waiting for in-flight BOSH operations: %w", ctx.Err())
+	}
+	b.saveState()
+	if terr := b.tracer.Shutdown(ctx); err == nil {
+		err = terr
+	}
+	return err
 }
 
+// defaultSyncProvisionTimeout is used when sync provisioning is enabled
+// without an explicit timeout.
+const defaultSyncProvisionTimeout = 10 * time.Minute
+
 type Instance struct {
 	ID             string `json:"id"`
 	PlanID         string `json:"plan_id"`
@@ -88,88 +312,277 @@ type Instance struct {
 	AppsDomain     string `json:"apps_domain"`
 	VMType         string `json:"vm_type"`
 	DiskType       string `json:"disk_type"`
-	State            string `json:"state"` // provisioning, ready, deprovisioning, failed
+	State            string `json:"state"` // provisioning, deploying-route, ready, deprovisioning, failed
 	BoshTaskID       int    `json:"bosh_task_id"`
 	SSOEnabled       bool   `json:"sso_enabled"`
 	SSOClientID      string `json:"sso_client_id,omitempty"`
 	SSOClientSecret  string `json:"sso_client_secret,omitempty"`
 	SSOCookieSecret  string `json:"sso_cookie_secret,omitempty"`
 	OpenClawVersion  string `json:"openclaw_version"`
+	CancelledTaskID  int    `json:"cancelled_task_id,omitempty"`
+	LastError        string `json:"last_error,omitempty"`
+	StaticIP         string `json:"static_ip,omitempty"`
+	AZ               string `json:"az,omitempty"` // AZ pinned at provision time; empty uses all of the plan's AZs
+	RouteWaitSince   time.Time `json:"route_wait_since,omitzero"` // when the instance entered deploying-route
+	CreatedAt        time.Time `json:"created_at,omitzero"`       // zero for instances recovered from BOSH, which the TTL reaper skips
+	ReapedAt         time.Time `json:"reaped_at,omitzero"`        // when the TTL reaper started deleting the instance
+	ChannelCredentials map[string]string `json:"channel_credentials,omitempty"` // by channel name
+	Tags             []string          `json:"tags,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	AgentConfig      map[string]string `json:"agent_config,omitempty"` // rendered into openclaw.agent.custom
+	CreatedBy        *OriginatingIdentity `json:"created_by,omitempty"`
+	LastModifiedBy   *OriginatingIdentity `json:"last_modified_by,omitempty"`
+	Bindings         map[string]*Binding `json:"bindings,omitempty"`
 }
 
 type Plan struct {
-	Name            string                 `json:"name"`
-	ID              string                 `json:"id"`
-	Description     string                 `json:"description"`
-	PlanDescription string                 `json:"plan_description"` // OpsMan service_plan_forms field
-	VMType          string                 `json:"vm_type"`
-	DiskType        string                 `json:"disk_type"`
-	Memory          int                    `json:"memory"`
-	AZs             []string               `json:"azs,omitempty"`
-	Features        map[string]bool        `json:"features,omitempty"`
-	Metadata        map[string]interface{} `json:"metadata,omitempty"`
+	Name            string                 `json:"name" yaml:"name"`
+	ID              string                 `json:"id" yaml:"id"`
+	Description     string                 `json:"description" yaml:"description"`
+	PlanDescription string                 `json:"plan_description" yaml:"plan_description"` // OpsMan service_plan_forms field
+	VMType          string                 `json:"vm_type" yaml:"vm_type"`
+	DiskType        string                 `json:"disk_type" yaml:"disk_type"`
+	VMExtensions    []string               `json:"vm_extensions,omitempty" yaml:"vm_extensions,omitempty"`
+	Networks        []bosh.NetworkConfig   `json:"networks,omitempty" yaml:"networks,omitempty"`
+	StaticIPs       []string               `json:"static_ips,omitempty" yaml:"static_ips,omitempty"` // pool handed out one IP per instance
+	Memory          int                    `json:"memory" yaml:"memory"`
+	CPU             int                    `json:"cpu,omitempty" yaml:"cpu,omitempty"`                             // with Memory, sizes the VM when BrokerConfig.UseVMResources is set
+	EphemeralDiskMB int                    `json:"ephemeral_disk_mb,omitempty" yaml:"ephemeral_disk_mb,omitempty"` // vm_resources only; 0 uses bosh.DefaultEphemeralDiskMB
+	AZs             []string               `json:"azs,omitempty" yaml:"azs,omitempty"`
+	Features        map[string]bool        `json:"features,omitempty" yaml:"features,omitempty"`
+	Metadata        map[string]interface{} `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+	Update          bosh.UpdateConfig      `json:"update,omitempty" yaml:"update,omitempty"`
+	LLMTemperature  *float64               `json:"llm_temperature,omitempty" yaml:"llm_temperature,omitempty"`
+	LLMMaxTokens    int                    `json:"llm_max_tokens,omitempty" yaml:"llm_max_tokens,omitempty"`
+	LLMTopP         *float64               `json:"llm_top_p,omitempty" yaml:"llm_top_p,omitempty"`
+	OpenClawVersion string                 `json:"openclaw_version,omitempty" yaml:"openclaw_version,omitempty"` // pins the plan; empty tracks BrokerConfig.OpenClawVersion
+	StemcellOS      string                 `json:"stemcell_os,omitempty" yaml:"stemcell_os,omitempty"`           // overrides BrokerConfig.StemcellOS
+	StemcellVersion string                 `json:"stemcell_version,omitempty" yaml:"stemcell_version,omitempty"` // overrides BrokerConfig.StemcellVersion; "latest" when only the OS is overridden
+	Deprecated         bool   `json:"deprecated,omitempty" yaml:"deprecated,omitempty"`                   // still listed, but rejects new provisions
+	MaxConcurrentTasks    int `json:"max_concurrent_tasks,omitempty" yaml:"max_concurrent_tasks,omitempty"`           // 0 leaves the agent unlimited
+	MaxToolCallsPerMinute int `json:"max_tool_calls_per_minute,omitempty" yaml:"max_tool_calls_per_minute,omitempty"` // 0 leaves the agent unlimited
+	DeprecationMessage string `json:"deprecation_message,omitempty" yaml:"deprecation_message,omitempty"` // tells users what to use instead
+	AllowedUpdates     []string `json:"allowed_updates,omitempty" yaml:"allowed_updates,omitempty"`       // plan names or IDs instances may move to; empty allows any
 }
 
 func New(config BrokerConfig, director *bosh.Client) *Broker {
 	normalizePlans(config.Plans)
+	if config.DeploymentPrefix == "" {
+		config.DeploymentPrefix = defaultDeploymentPrefix
+	}
 	b := &Broker{
-		config:    config,
-		director:  director,
-		instances: make(map[string]*Instance),
+		config:            config,
+		director:          director,
+		instances:         make(map[string]*Instance),
+		syncTimeout:       defaultSyncProvisionTimeout,
+		taskPollInterval:  5 * time.Second,
+		logger:            NewLogger(config.LogFormat, os.Stderr),
+		routeProbe:        probeRoute,
+		webhookRetryDelay: 2 * time.Second,
+		now:               time.Now,
+		reaperInterval:    defaultReaperInterval,
+		watchInterval:     time.Duration(config.TaskWatchInterval) * time.Second,
+	}
+	// main rejects duplicates at startup; keep the first of any that get here
+	if kept, dropped := uniquePlans(config.Plans); len(dropped) > 0 {
+		for _, p := range dropped {
+			b.logger.Error("ignoring plan with a duplicate name or id", "plan", p.Name, "plan_id", p.ID)
+		}
+		b.config.Plans = kept
+	}
+	if config.OTLPEndpoint != "" {
+		b.tracer = tracing.NewTracer(tracing.NewOTLPExporter(config.OTLPEndpoint, "openclaw-broker"))
+	}
+	if config.SyncProvisionTimeout > 0 {
+		b.syncTimeout = time.Duration(config.SyncProvisionTimeout) * time.Second
+	}
+	// main validates the template at startup; a bad one here falls back to the route
+	if tmpl, err := ParseDashboardURLTemplate(config.DashboardURLTemplate); err != nil {
+		b.logger.Error("invalid dashboard URL template, using the agent route", "error", err)
+	} else {
+		b.dashboardTmpl = tmpl
 	}
-	// Create UAA client for dynamic OAuth2 client management when SSO is enabled
-	if config.SSOEnabled && config.CFUaaURL != "" && config.CFUaaAdminClientSecret != "" {
-		b.uaaClient = uaa.NewClient(config.CFUaaURL, config.CFUaaAdminClientID, config.CFUaaAdminClientSecret, true)
+	// Create UAA client for dynamic OAuth2 client management when SSO is enabled.
+	// Without one, nothing calls UAA, which is what external client management needs.
+	if config.SSOEnabled && !config.SSOExternalClientManagement && config.CFUaaURL != "" && config.CFUaaAdminClientSecret != "" {
+		// Without a CA bundle, keep skipping verification as before
+		b.uaaClient = uaa.NewClient(config.CFUaaURL, config.CFUaaAdminClientID, config.CFUaaAdminClientSecret,
+			config.CFUaaCACert, config.CFUaaCACert == "", uaa.ClientOptions{
+				TLSMinVersion:   config.OutboundTLSMinVersion,
+				TLSCipherSuites: config.OutboundTLSCipherSuites,
+			})
 	}
 	b.loadState()
+	b.loadMaintenance()
 	return b
 }
 
-// saveState writes the instance map to disk for persistence across broker restarts.
+// defaultDeploymentPrefix is the BOSH deployment name prefix for on-demand
+// agents when the operator doesn't set one.
+const defaultDeploymentPrefix = "openclaw-agent"
+
+// deploymentName returns the BOSH deployment name for an instance. Operators
+// sharing a Director across foundations set DeploymentPrefix to keep them apart.
+func (b *Broker) deploymentName(instanceID string) string {
+	return b.config.DeploymentPrefix + "-" + instanceID
+}
+
+// instancesDirName is the StateDir subdirectory holding one JSON file per instance.
+const instancesDirName = "instances"
+
+// legacyStateFile is the single-file state format used before per-instance files.
+// It is imported once on startup and then renamed so it is never re-applied.
+const legacyStateFile = "instances.json"
+
+func (b *Broker) instanceStatePath(instanceID string) string {
+	return filepath.Join(b.config.StateDir, instancesDirName, instanceID+".json")
+}
+
+// saveInstance persists a single instance to StateDir/instances/{id}.json using
+// an atomic temp+rename. If the instance is no longer in the map, its file is removed.
 // Acquires its own read lock; callers must NOT hold the lock.
-func (b *Broker) saveState() {
+func (b *Broker) saveInstance(instanceID string) {
 	if b.config.StateDir == "" {
 		return
 	}
 	b.mu.RLock()
-	data, err := json.MarshalIndent(b.instances, "", "  ")
+	inst, exists := b.instances[instanceID]
+	var data []byte
+	var err error
+	if exists {
+		data, err = json.MarshalIndent(inst, "", "  ")
+	}
 	b.mu.RUnlock()
+
+	path := b.instanceStatePath(instanceID)
+	if !exists {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			b.logger.Error("failed to remove state file", "instance_id", instanceID, "error", err)
+		}
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to marshal state: %v", err)
+		b.logger.Error("failed to marshal state", "instance_id", instanceID, "error", err)
 		return
 	}
-	path := filepath.Join(b.config.StateDir, "instances.json")
-	tmp := path + ".tmp"
-	if err := os.WriteFile(tmp, data, 0644); err != nil {
-		log.Printf("Failed to write state file: %v", err)
+	if err := writeFileAtomic(path, data); err != nil {
+		b.logger.Error("failed to write state file", "instance_id", instanceID, "error", err)
+	}
+}
+
+// saveState persists every instance in the map. Prefer saveInstance when only
+// one instance changed. Acquires its own read lock; callers must NOT hold the lock.
+func (b *Broker) saveState() {
+	if b.config.StateDir == "" {
 		return
 	}
-	if err := os.Rename(tmp, path); err != nil {
-		log.Printf("Failed to rename state file: %v", err)
+	b.mu.RLock()
+	ids := make([]string, 0, len(b.instances))
+	for id := range b.instances {
+		ids = append(ids, id)
+	}
+	b.mu.RUnlock()
+	for _, id := range ids {
+		b.saveInstance(id)
+	}
+}
+
+// writeFileAtomic writes data to a uniquely named temp file in the target
+// directory and renames it into place, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
 	}
+	return nil
 }
 
-// loadState reads instance state from disk on startup.
+// loadState reads per-instance state files on startup. A legacy instances.json
+// is imported for instances that don't already have their own file, written out
+// in the per-instance format, and renamed so deleted instances aren't resurrected.
 func (b *Broker) loadState() {
 	if b.config.StateDir == "" {
 		return
 	}
-	path := filepath.Join(b.config.StateDir, "instances.json")
-	data, err := os.ReadFile(path)
+	files, err := filepath.Glob(filepath.Join(b.config.StateDir, instancesDirName, "*.json"))
 	if err != nil {
-		if os.IsNotExist(err) {
-			return
+		b.logger.Error("failed to list state files", "error", err)
+		return
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			b.logger.Error("failed to read state file", "path", f, "error", err)
+			continue
+		}
+		var inst Instance
+		if err := json.Unmarshal(data, &inst); err != nil {
+			b.logger.Error("failed to unmarshal state file", "path", f, "error", err)
+			continue
+		}
+		if inst.ID == "" {
+			inst.ID = strings.TrimSuffix(filepath.Base(f), ".json")
+		}
+		failInterruptedBindings(&inst)
+		b.instances[inst.ID] = &inst
+	}
+
+	b.migrateLegacyState()
+	b.counts = scanInstanceCounts(b.instances)
+	if len(b.instances) > 0 {
+		b.logger.Info("loaded instances from state directory", "count", len(b.instances))
+	}
+}
+
+// migrateLegacyState imports the pre-per-instance-file instances.json, if present.
+func (b *Broker) migrateLegacyState() {
+	legacyPath := filepath.Join(b.config.StateDir, legacyStateFile)
+	data, err := os.ReadFile(legacyPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			b.logger.Error("failed to read legacy state file", "error", err)
 		}
-		log.Printf("Failed to read state file: %v", err)
 		return
 	}
-	var instances map[string]*Instance
-	if err := json.Unmarshal(data, &instances); err != nil {
-		log.Printf("Failed to unmarshal state file: %v", err)
+	var legacy map[string]*Instance
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		b.logger.Error("failed to unmarshal legacy state file", "error", err)
 		return
 	}
-	b.instances = instances
-	log.Printf("Loaded %d instances from state file", len(instances))
+	imported := 0
+	for id, inst := range legacy {
+		if _, exists := b.instances[id]; exists || inst == nil {
+			continue
+		}
+		b.instances[id] = inst
+		b.saveInstance(id)
+		imported++
+	}
+	if err := os.Rename(legacyPath, legacyPath+".migrated"); err != nil {
+		b.logger.Error("failed to rename legacy state file", "error", err)
+	}
+	b.logger.Info("imported instances from legacy state file", "count", imported, "path", legacyStateFile)
 }
 
 // normalizePlans fills in missing ID and Description fields for plans coming
@@ -189,28 +602,89 @@ func normalizePlans(plans []Plan) {
 	}
 }
 
-// countInstances returns the total number of active (non-deprovisioning) instances.
+// uniquePlans splits normalized plans into those kept and the later ones
+// whose ID or name repeats a kept plan's. findPlan would only ever see the
+// first, and OSB requires plan IDs and names to be unique.
+func uniquePlans(plans []Plan) (kept, dropped []Plan) {
+	ids := make(map[string]bool, len(plans))
+	names := make(map[string]bool, len(plans))
+	for _, p := range plans {
+		if ids[p.ID] || names[p.Name] {
+			dropped = append(dropped, p)
+			continue
+		}
+		ids[p.ID], names[p.Name] = true, true
+		kept = append(kept, p)
+	}
+	return kept, dropped
+}
+
+// CheckUniquePlans reports each plan whose ID or name, once normalized as
+// New does, repeats an earlier plan's.
+func CheckUniquePlans(plans []Plan) []error {
+	normalized := append([]Plan(nil), plans...)
+	normalizePlans(normalized)
+	_, dropped := uniquePlans(normalized)
+	var errs []error
+	for _, p := range dropped {
+		errs = append(errs, fmt.Errorf("plan %q (id %q) duplicates the name or id of an earlier plan", p.Name, p.ID))
+	}
+	return errs
+}
+
+// sortedInstances returns every instance ordered by ID, so listings and
+// anything that picks the first N instances are stable between calls. Must
+// be called with b.mu held.
+func (b *Broker) sortedInstances() []*Instance {
+	list := make([]*Instance, 0, len(b.instances))
+	for _, inst := range b.instances {
+		list = append(list, inst)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// totalMemoryMB returns the plan memory committed across all active instances.
+// Instances whose plan is no longer in the catalog count as zero.
 // Must be called with b.mu held.
-func (b *Broker) countInstances() int {
-	count := 0
+func (b *Broker) totalMemoryMB() int {
+	total := 0
 	for _, inst := range b.instances {
-		if inst.State != "deprovisioning" {
-			count++
+		if inst.State == "deprovisioning" {
+			continue
+		}
+		if plan := b.findPlan(inst.PlanID); plan != nil {
+			total += plan.Memory
 		}
 	}
-	return count
+	return total
 }
 
-// countInstancesByOrg returns the number of active instances for a given org.
-// Must be called with b.mu held.
-func (b *Broker) countInstancesByOrg(orgGUID string) int {
-	count := 0
+// nextStaticIP returns the first IP in the plan's static pool not held by any
+// instance. An IP returns to the pool when its instance is removed from state
+// after deprovisioning. Must be called with b.mu held.
+func (b *Broker) nextStaticIP(plan *Plan) (string, bool) {
+	used := make(map[string]bool)
 	for _, inst := range b.instances {
-		if inst.OrgGUID == orgGUID && inst.State != "deprovisioning" {
-			count++
+		if inst.StaticIP != "" {
+			used[inst.StaticIP] = true
+		}
+	}
+	for _, ip := range plan.StaticIPs {
+		if !used[ip] {
+			return ip, true
 		}
 	}
-	return count
+	return "", false
+}
+
+// memoryQuotaExceeded reports whether committing additionalMB more memory
+// would exceed MaxTotalMemoryMB. Must be called with b.mu held.
+func (b *Broker) memoryQuotaExceeded(additionalMB int) bool {
+	if b.config.MaxTotalMemoryMB <= 0 || additionalMB <= 0 {
+		return false
+	}
+	return b.totalMemoryMB()+additionalMB > b.config.MaxTotalMemoryMB
 }
 
 // findPlan searches config plans by ID, falling back to hardcoded defaults.
@@ -227,6 +701,15 @@ func (b *Broker) findPlan(planID string) *Plan {
 	return nil
 }
 
+// planVersion returns the OpenClaw version new deployments of plan get: its
+// pinned version, or the broker-wide version when unpinned or plan is nil.
+func (b *Broker) planVersion(plan *Plan) string {
+	if plan != nil && plan.OpenClawVersion != "" {
+		return plan.OpenClawVersion
+	}
+	return b.config.OpenClawVersion
+}
+
 func defaultPlans() []Plan {
 	return []Plan{
 		{
@@ -236,6 +719,11 @@ func defaultPlans() []Plan {
 			VMType:      "small",
 			DiskType:    "10GB",
 			Memory:      2048,
+			Metadata: map[string]interface{}{
+				"displayName":  "Developer",
+				"displayOrder": 1,
+				"bullets":      []string{"Dedicated VM with isolated WebChat UI", "2GB RAM, 10GB persistent disk", "Cloud LLM integration", "Per-instance SSO"},
+			},
 		},
 		{
 			ID:          "openclaw-developer-plus-plan",
@@ -244,6 +732,12 @@ func defaultPlans() []Plan {
 			VMType:      "medium",
 			DiskType:    "20GB",
 			Memory:      4096,
+			Features:    map[string]bool{"browser": true},
+			Metadata: map[string]interface{}{
+				"displayName":  "Developer Plus",
+				"displayOrder": 2,
+				"bullets":      []string{"Dedicated VM with isolated WebChat UI", "4GB RAM, 20GB persistent disk", "Browser automation enabled", "All messaging channels"},
+			},
 		},
 		{
 			ID:          "openclaw-team-plan",
@@ -252,6 +746,12 @@ func defaultPlans() []Plan {
 			VMType:      "large",
 			DiskType:    "50GB",
 			Memory:      8192,
+			Features:    map[string]bool{"browser": true},
+			Metadata: map[string]interface{}{
+				"displayName":  "Team",
+				"displayOrder": 3,
+				"bullets":      []string{"Dedicated VM with isolated WebChat UI", "8GB RAM, 50GB persistent disk", "Multi-user with Slack/Teams", "Full browser automation"},
+			},
 		},
 	}
 }
@@ -2,15 +2,26 @@ package broker
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/bosh"
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/uaa"
 )
 
 // --- helpers ---
@@ -20,29 +31,156 @@ import (
 // Deploy and DeleteDeployment return 302 Found with a full-URL Location header
 // (e.g., https://host:port/tasks/NNN) matching real BOSH Director behavior.
 func newFakeBOSHDirector(taskState string, deployFail bool) *httptest.Server {
+	return newFakeBOSHDirectorWith(fakeDirector{taskState: taskState, deployFail: deployFail})
+}
+
+// fakeDirector configures newFakeBOSHDirectorWith. The zero value serves the
+// same Director as newFakeBOSHDirector("done", false): deploys run as task 42,
+// deletes as task 99 and recreates and VM listings as task 77.
+type fakeDirector struct {
+	// taskState is what every task reports, "done" when empty. taskStates,
+	// when set, is called on each status poll instead.
+	taskState  string
+	taskStates func() string
+
+	deployFail bool
+	deleteFail bool
+
+	// manifests and deletes, when set, record deployed manifests and the
+	// paths of deployment deletes. With serveManifest the latest manifest is
+	// returned from GET /deployments/{name}, as the real Director does.
+	manifests     *[]string
+	deletes       *[]string
+	serveManifest bool
+
+	// deployments are listed by GET /deployments, which fails when nil.
+	// instanceIDs gives the openclaw.instance.id recorded in the manifest
+	// GET /deployments/{name} serves for each of them.
+	deployments []string
+	instanceIDs map[string]string
+
+	// taskOutput is served from GET /tasks/{id}/output, keyed by output type.
+	taskOutput map[string]string
+
+	// cancels, when set, counts DELETE /task/{id} calls.
+	cancels *int
+
+	// onRequest, when set, runs before each request is served, e.g. to hold
+	// a call in flight.
+	onRequest func(r *http.Request)
+}
+
+// newFakeBOSHDirectorWith creates a fake Director configured by f. taskStates
+// runs under the fake's lock, so it may read state the fake mutates.
+func newFakeBOSHDirectorWith(f fakeDirector) *httptest.Server {
+	var mu sync.Mutex
+	var deployed string
 	var server *httptest.Server
+	redirect := func(w http.ResponseWriter, taskID int) {
+		// Real BOSH Director returns full URL in Location header
+		w.Header().Set("Location", fmt.Sprintf("%s/tasks/%d", server.URL, taskID))
+		w.WriteHeader(http.StatusFound)
+	}
 	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.onRequest != nil {
+			f.onRequest(r)
+		}
+		mu.Lock()
+		defer mu.Unlock()
 		switch {
 		// POST /deployments -> Deploy
 		case r.Method == "POST" && r.URL.Path == "/deployments":
-			if deployFail {
+			if f.deployFail {
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte("deploy error"))
 				return
 			}
-			// Real BOSH Director returns full URL in Location header
-			w.Header().Set("Location", server.URL+"/tasks/42")
-			w.WriteHeader(http.StatusFound)
+			body, _ := io.ReadAll(r.Body)
+			deployed = string(body)
+			if f.manifests != nil {
+				*f.manifests = append(*f.manifests, deployed)
+			}
+			redirect(w, 42)
+
+		// GET /deployments -> ListDeployments
+		case r.Method == "GET" && r.URL.Path == "/deployments":
+			if f.deployments == nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			list := make([]bosh.Deployment, 0, len(f.deployments))
+			for _, n := range f.deployments {
+				list = append(list, bosh.Deployment{
+					Name:      n,
+					Releases:  []bosh.NameVersion{{Name: "openclaw", Version: "1.0.0"}},
+					Stemcells: []bosh.NameVersion{{Name: "bosh-stemcell", Version: "1.200"}},
+				})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
 
 		// DELETE /deployments/{name} -> DeleteDeployment
-		case r.Method == "DELETE" && len(r.URL.Path) > len("/deployments/"):
-			w.Header().Set("Location", server.URL+"/tasks/99")
-			w.WriteHeader(http.StatusFound)
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/deployments/"):
+			if f.deleteFail {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("director unavailable"))
+				return
+			}
+			if f.deletes != nil {
+				*f.deletes = append(*f.deletes, r.URL.Path)
+			}
+			redirect(w, 99)
+
+		// DELETE /task/{id} -> CancelTask
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/task/"):
+			if f.cancels != nil {
+				*f.cancels++
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		// PUT /deployments/{name}/jobs/* -> Recreate
+		case r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/jobs/*"):
+			redirect(w, 77)
+
+		// GET /deployments/{name}/vms -> VMs
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/vms"):
+			if r.URL.Query().Get("format") != "full" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			redirect(w, 77)
+
+		// GET /deployments/{name} -> GetDeploymentManifest
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/deployments/"):
+			w.Header().Set("Content-Type", "application/json")
+			if id, ok := f.instanceIDs[strings.TrimPrefix(r.URL.Path, "/deployments/")]; ok {
+				manifest := "instance_groups:\n- name: agent\n  jobs:\n  - name: openclaw-agent\n    properties:\n      openclaw:\n        instance:\n          id: " + id + "\n"
+				json.NewEncoder(w).Encode(map[string]string{"manifest": manifest})
+			} else if f.serveManifest {
+				json.NewEncoder(w).Encode(map[string]string{"manifest": deployed})
+			} else {
+				w.Write([]byte("{}"))
+			}
+
+		// GET /tasks/{id}/output -> TaskOutput
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/tasks/") && strings.HasSuffix(r.URL.Path, "/output"):
+			w.Write([]byte(f.taskOutput[r.URL.Query().Get("type")]))
 
 		// GET /tasks/{id} -> TaskStatus
-		case r.Method == "GET" && len(r.URL.Path) > len("/tasks/"):
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/tasks/"):
+			state := f.taskState
+			if f.taskStates != nil {
+				state = f.taskStates()
+			} else if state == "" {
+				state = "done"
+			}
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"state": taskState})
+			json.NewEncoder(w).Encode(map[string]string{"state": state})
+
+		// GET /info -> Ping
+		case r.Method == "GET" && r.URL.Path == "/info":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"name": "fake-director"})
 
 		default:
 			w.WriteHeader(http.StatusNotFound)
@@ -51,6 +189,68 @@ func newFakeBOSHDirector(taskState string, deployFail bool) *httptest.Server {
 	return server
 }
 
+// fakeUAA simulates the UAA client-management API and records registered
+// clients with their redirect URIs.
+type fakeUAA struct {
+	*httptest.Server
+	mu      sync.Mutex
+	clients map[string][]string
+}
+
+func newFakeUAA() *fakeUAA {
+	f := &fakeUAA{clients: make(map[string][]string)}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/oauth/token":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "fake-admin-token", "expires_in": 3600})
+		case r.Method == "POST" && r.URL.Path == "/oauth/clients":
+			var client uaa.OAuthClient
+			json.NewDecoder(r.Body).Decode(&client)
+			f.clients[client.ClientID] = client.RedirectURI
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/oauth/clients/"):
+			id := strings.TrimPrefix(r.URL.Path, "/oauth/clients/")
+			if _, ok := f.clients[id]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var client uaa.OAuthClient
+			json.NewDecoder(r.Body).Decode(&client)
+			f.clients[id] = client.RedirectURI
+			w.WriteHeader(http.StatusOK)
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/oauth/clients/"):
+			id := strings.TrimPrefix(r.URL.Path, "/oauth/clients/")
+			if _, ok := f.clients[id]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(f.clients, id)
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return f
+}
+
+// hasClient reports whether clientID is currently registered.
+func (f *fakeUAA) hasClient(clientID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.clients[clientID]
+	return ok
+}
+
+// redirectURIs returns the redirect URIs registered for clientID.
+func (f *fakeUAA) redirectURIs(clientID string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.clients[clientID]
+}
+
 // newTestBroker creates a Broker backed by a fake BOSH director.
 // Returns the broker, the fake BOSH server (caller should defer Close()), and a mux.Router wired up the same as main.go.
 func newTestBroker(taskState string, deployFail bool) (*Broker, *httptest.Server, *mux.Router) {
@@ -73,6 +273,8 @@ func newTestBroker(taskState string, deployFail bool) (*Broker, *httptest.Server
 	r.HandleFunc("/v2/service_instances/{instance_id}", b.Update).Methods("PATCH")
 	r.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Bind).Methods("PUT")
 	r.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Unbind).Methods("DELETE")
+	r.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.GetBinding).Methods("GET")
+	r.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}/last_operation", b.BindingLastOperation).Methods("GET")
 	r.HandleFunc("/v2/service_instances/{instance_id}/last_operation", b.LastOperation).Methods("GET")
 
 	return b, fakeBOSH, r
@@ -116,6 +318,49 @@ func TestCatalog_ReturnsJSON(t *testing.T) {
 	}
 }
 
+func TestCatalog_ETag(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v2/catalog", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := get("")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Catalog() = %d with ETag %q, want 200 with an ETag", first.Code, etag)
+	}
+	if rr := get(etag); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("conditional Catalog() = %d with %d byte body, want an empty 304", rr.Code, rr.Body.Len())
+	}
+	if rr := get(`"stale", W/` + etag); rr.Code != http.StatusNotModified {
+		t.Errorf("Catalog() with a weak match in a list = %d, want 304", rr.Code)
+	}
+	if rr := get(`"stale"`); rr.Code != http.StatusOK || rr.Body.String() != first.Body.String() {
+		t.Errorf("Catalog() with a stale ETag = %d, want 200 with the full catalog", rr.Code)
+	}
+
+	b.config.Plans = append(defaultPlans(), Plan{ID: "openclaw-xl-plan", Name: "xl", VMType: "2xlarge", DiskType: "100GB"})
+	b.invalidateCatalog()
+	rr := get(etag)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Catalog() after a plan change = %d, want 200", rr.Code)
+	}
+	if newETag := rr.Header().Get("ETag"); newETag == etag {
+		t.Errorf("ETag %s did not change with the plans", etag)
+	}
+	if !strings.Contains(rr.Body.String(), "openclaw-xl-plan") {
+		t.Error("catalog should list the added plan")
+	}
+}
+
 func TestCatalog_HasOneService(t *testing.T) {
 	_, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
@@ -254,7 +499,8 @@ func TestCatalog_UsesConfigPlans(t *testing.T) {
 	cfg := BrokerConfig{
 		OpenClawVersion: "2026.2.21-2",
 		Plans: []Plan{
-			{ID: "custom-plan-1", Name: "custom", Description: "Custom plan", VMType: "tiny", DiskType: "5GB"},
+			{ID: "custom-plan-1", Name: "custom", Description: "Custom plan", VMType: "tiny", DiskType: "5GB",
+				Metadata: map[string]interface{}{"displayName": "Custom"}},
 			{ID: "custom-plan-2", Name: "custom-big", Description: "Big custom plan", VMType: "huge", DiskType: "100GB"},
 		},
 	}
@@ -280,6 +526,168 @@ func TestCatalog_UsesConfigPlans(t *testing.T) {
 	if plans[1].ID != "custom-plan-2" {
 		t.Errorf("Plan[1].ID = %q, want %q", plans[1].ID, "custom-plan-2")
 	}
+	if plans[0].Metadata["displayName"] != "Custom" {
+		t.Errorf("Plan[0] metadata = %v, want the configured metadata passed through", plans[0].Metadata)
+	}
+}
+
+// catalogQuotas fetches the catalog and returns each plan's metadata.quota by plan ID.
+func catalogQuotas(t *testing.T, b *Broker, identity string) map[string]*PlanQuota {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/v2/catalog", nil)
+	if identity != "" {
+		req.Header.Set(originatingIdentityHeader, identity)
+	}
+	rr := httptest.NewRecorder()
+	b.Catalog(rr, req)
+	var catalog struct {
+		Services []struct {
+			Plans []struct {
+				ID       string `json:"id"`
+				Metadata struct {
+					Quota *PlanQuota `json:"quota"`
+				} `json:"metadata"`
+			} `json:"plans"`
+		} `json:"services"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &catalog); err != nil {
+		t.Fatal(err)
+	}
+	quotas := make(map[string]*PlanQuota)
+	for _, p := range catalog.Services[0].Plans {
+		quotas[p.ID] = p.Metadata.Quota
+	}
+	return quotas
+}
+
+func TestCatalog_QuotaMetadata(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	if q := catalogQuotas(t, b, ""); q["openclaw-developer-plan"] != nil {
+		t.Errorf("quota = %+v, want none unless enabled", q["openclaw-developer-plan"])
+	}
+
+	b.config.CatalogQuotas = true
+	b.config.MaxInstances = 5
+	b.config.MaxInstancesPerOrg = 3
+	b.config.MaxTotalMemoryMB = 8192
+	provisionInstance(t, router, "inst-quota-1", "openclaw-developer-plan")
+	provisionInstance(t, router, "inst-quota-2", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-quota-1"].CreatedBy = &OriginatingIdentity{Platform: "cloudfoundry", UserID: "user-1"}
+	b.mu.Unlock()
+
+	quotas := catalogQuotas(t, b, "")
+	dev, team := quotas["openclaw-developer-plan"], quotas["openclaw-team-plan"]
+	if dev == nil || dev.UsedInstances != 2 || dev.MaxInstances != 5 || dev.RemainingInstances == nil || *dev.RemainingInstances != 2 || dev.Full {
+		t.Errorf("developer quota = %+v, want 2 used and room for 2 more in the remaining 4096 MB", dev)
+	}
+	if team == nil || team.RemainingInstances == nil || *team.RemainingInstances != 0 || !team.Full {
+		t.Errorf("team quota = %+v, want full: 8192 MB doesn't fit in 4096 MB", team)
+	}
+	if dev.Orgs != nil {
+		t.Errorf("orgs = %v, want none without an originating identity", dev.Orgs)
+	}
+
+	identity := "cloudfoundry " + base64.StdEncoding.EncodeToString([]byte(`{"user_id":"user-1"}`))
+	quotas = catalogQuotas(t, b, identity)
+	org := quotas["openclaw-developer-plan"].Orgs["org-123"]
+	if org.UsedInstances != 2 || org.MaxInstances != 3 || org.RemainingInstances != 1 {
+		t.Errorf("org quota = %+v, want 2 of 3 used in the user's org", org)
+	}
+
+	// Deprovisioning frees capacity straight away
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/v2/service_instances/inst-quota-2?accepts_incomplete=true", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Deprovision status = %d", rr.Code)
+	}
+	if dev := catalogQuotas(t, b, "")["openclaw-developer-plan"]; dev.UsedInstances != 1 || *dev.RemainingInstances != 3 {
+		t.Errorf("developer quota after deprovision = %+v, want 1 used and 3 remaining", dev)
+	}
+}
+
+func TestCatalog_PlanCostsAndDisplayOrder(t *testing.T) {
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		Plans: []Plan{
+			{ID: "cheap-plan", Name: "cheap", VMType: "small", Metadata: map[string]interface{}{
+				"displayName": "Cheap",
+				"costs": []interface{}{map[string]interface{}{
+					"amount": map[string]interface{}{"usd": 49.0},
+					"unit":   "MONTHLY",
+				}},
+			}},
+			{ID: "pinned-plan", Name: "pinned", VMType: "large", Metadata: map[string]interface{}{"displayOrder": 10}},
+		},
+	}, nil)
+
+	rr := httptest.NewRecorder()
+	b.Catalog(rr, httptest.NewRequest("GET", "/v2/catalog", nil))
+	var catalog struct {
+		Services []struct {
+			Plans []struct {
+				Metadata struct {
+					DisplayName  string `json:"displayName"`
+					DisplayOrder int    `json:"displayOrder"`
+					Costs        []struct {
+						Amount map[string]float64 `json:"amount"`
+						Unit   string             `json:"unit"`
+					} `json:"costs"`
+				} `json:"metadata"`
+			} `json:"plans"`
+		} `json:"services"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &catalog); err != nil {
+		t.Fatal(err)
+	}
+	plans := catalog.Services[0].Plans
+	cheap := plans[0].Metadata
+	if cheap.DisplayName != "Cheap" || cheap.DisplayOrder != 1 {
+		t.Errorf("cheap metadata = %+v, want displayName Cheap and displayOrder 1", cheap)
+	}
+	if len(cheap.Costs) != 1 || cheap.Costs[0].Amount["usd"] != 49.0 || cheap.Costs[0].Unit != "MONTHLY" {
+		t.Errorf("cheap costs = %+v, want 49 usd MONTHLY", cheap.Costs)
+	}
+	if plans[1].Metadata.DisplayOrder != 10 {
+		t.Errorf("pinned displayOrder = %d, want the configured 10", plans[1].Metadata.DisplayOrder)
+	}
+	if _, ok := b.config.Plans[0].Metadata["displayOrder"]; ok {
+		t.Error("catalog rendering should not mutate the plan config")
+	}
+
+	// Default plans carry their own display metadata
+	rr = httptest.NewRecorder()
+	New(BrokerConfig{}, nil).Catalog(rr, httptest.NewRequest("GET", "/v2/catalog", nil))
+	json.Unmarshal(rr.Body.Bytes(), &catalog)
+	for i, p := range catalog.Services[0].Plans {
+		if p.Metadata.DisplayOrder != i+1 || p.Metadata.DisplayName == "" {
+			t.Errorf("default plan %d metadata = %+v, want displayName and displayOrder %d", i, p.Metadata, i+1)
+		}
+	}
+}
+
+func TestCatalog_PlanOrderIsDeterministic(t *testing.T) {
+	// JSON config decodes displayOrder as float64; "alpha" ties with the
+	// positional order of "zulu" and sorts by name
+	plans := []Plan{
+		{ID: "zulu-plan", Name: "zulu", VMType: "small"},
+		{ID: "late-plan", Name: "late", VMType: "small", Metadata: map[string]interface{}{"displayOrder": 5.0}},
+		{ID: "alpha-plan", Name: "alpha", VMType: "small", Metadata: map[string]interface{}{"displayOrder": 1}},
+		{ID: "first-plan", Name: "first", VMType: "small", Metadata: map[string]interface{}{"displayOrder": 0}},
+	}
+	want := []string{"first", "alpha", "zulu", "late"}
+	for i := 0; i < 5; i++ {
+		b := New(BrokerConfig{OpenClawVersion: "2026.2.21-2", Plans: plans}, nil)
+		var names []string
+		for _, p := range b.buildServicePlans() {
+			names = append(names, p.Name)
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Fatalf("call %d: plan order = %v, want %v", i, names, want)
+		}
+	}
 }
 
 // --- Provision tests ---
@@ -529,6 +937,52 @@ func TestProvision_SetsOwnerFromParameters(t *testing.T) {
 	}
 }
 
+func TestProvision_NormalizesOwner(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	provision := func(id, owner string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(ProvisionRequest{
+			ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan",
+			OrganizationGUID: "org-123", SpaceGUID: "space-456",
+			Parameters: map[string]interface{}{"owner": owner},
+		})
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v2/service_instances/"+id+"?accepts_incomplete=true", bytes.NewReader(body)))
+		return rr
+	}
+
+	if rr := provision("inst-upper", "Dev.Ops@Example.COM"); rr.Code != http.StatusAccepted {
+		t.Fatalf("valid owner: status = %d: %s", rr.Code, rr.Body.String())
+	}
+	b.mu.RLock()
+	inst := b.instances["inst-upper"]
+	b.mu.RUnlock()
+	if inst.Owner != "dev.ops@example.com" {
+		t.Errorf("Owner = %q, want the lowercased address", inst.Owner)
+	}
+	if inst.RouteHostname != "oc-dev-ops-inst-upper" {
+		t.Errorf("RouteHostname = %q, want oc-dev-ops-inst-upper", inst.RouteHostname)
+	}
+
+	for name, owner := range map[string]string{
+		"control characters": "dev\x00\"\nroot: true@example.com",
+		"escape sequence":    "dev\x1b[31m@example.com",
+		"over-length":        strings.Repeat("a", 250) + "@example.com",
+	} {
+		rr := provision("inst-bad", owner)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", name, rr.Code)
+		}
+	}
+	b.mu.RLock()
+	_, exists := b.instances["inst-bad"]
+	b.mu.RUnlock()
+	if exists {
+		t.Error("rejected owners should not create an instance")
+	}
+}
+
 func TestProvision_SetsVMTypeAndDiskTypeFromPlan(t *testing.T) {
 	b, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
@@ -576,1274 +1030,4774 @@ func TestProvision_UsesConfigVersionWhenNotInParams(t *testing.T) {
 	}
 }
 
-// --- Deprovision tests ---
-
-func TestDeprovision_ExistingInstance(t *testing.T) {
-	_, fakeBOSH, router := newTestBroker("done", false)
-	defer fakeBOSH.Close()
+// transitioningTaskStates reports "processing" for the first pollsUntilDone
+// status checks and then finalState. A negative pollsUntilDone keeps the task
+// processing forever.
+func transitioningTaskStates(pollsUntilDone int, finalState string) func() string {
+	polls := 0
+	return func() string {
+		polls++
+		if pollsUntilDone >= 0 && polls > pollsUntilDone {
+			return finalState
+		}
+		return "processing"
+	}
+}
 
-	// First provision
-	provisionInstance(t, router, "inst-deprov", "openclaw-developer-plan")
+func TestAcceptsIncomplete_AllAsyncOperations(t *testing.T) {
+	tests := []struct {
+		query    string
+		wantCode int
+		wantErr  string
+	}{
+		{"", http.StatusUnprocessableEntity, "AsyncRequired"},
+		{"?accepts_incomplete=false", http.StatusUnprocessableEntity, "AsyncRequired"},
+		{"?accepts_incomplete=yes", http.StatusBadRequest, "BadRequest"},
+		{"?accepts_incomplete=true", http.StatusAccepted, ""},
+	}
+	for _, tt := range tests {
+		b, fakeBOSH, r := newTestBroker("done", false)
+		defer fakeBOSH.Close()
+
+		body, _ := json.Marshal(ProvisionRequest{
+			ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan",
+			OrganizationGUID: "org-1", SpaceGUID: "space-1",
+			Parameters: map[string]interface{}{"owner": "alice@example.com"},
+		})
+		provision := httptest.NewRequest("PUT", "/v2/service_instances/inst-async"+tt.query, bytes.NewReader(body))
+		b.instances["inst-ready"] = &Instance{ID: "inst-ready", PlanID: "openclaw-developer-plan", State: "ready", DeploymentName: "openclaw-agent-inst-ready"}
+		b.instances["inst-gone"] = &Instance{ID: "inst-gone", PlanID: "openclaw-developer-plan", State: "ready", DeploymentName: "openclaw-agent-inst-gone"}
+
+		requests := map[string]*http.Request{
+			"provision":   provision,
+			"update":      httptest.NewRequest("PATCH", "/v2/service_instances/inst-ready"+tt.query, bytes.NewReader([]byte(`{"service_id":"openclaw-service"}`))),
+			"deprovision": httptest.NewRequest("DELETE", "/v2/service_instances/inst-gone"+tt.query, nil),
+		}
+		for op, req := range requests {
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Errorf("%s%s: status = %d, want %d (%s)", op, tt.query, rr.Code, tt.wantCode, rr.Body.String())
+				continue
+			}
+			if tt.wantErr == "" {
+				continue
+			}
+			var resp map[string]string
+			json.Unmarshal(rr.Body.Bytes(), &resp)
+			if resp["error"] != tt.wantErr || resp["description"] == "" {
+				t.Errorf("%s%s: body = %v, want error %q with a description", op, tt.query, resp, tt.wantErr)
+			}
+		}
+	}
+}
 
-	// Then deprovision
-	req := httptest.NewRequest("DELETE", "/v2/service_instances/inst-deprov?accepts_incomplete=true&service_id=openclaw-service&plan_id=openclaw-developer-plan", nil)
+// provisionSync issues a provision request without accepts_incomplete.
+func provisionSync(t *testing.T, router *mux.Router, instanceID string) *httptest.ResponseRecorder {
+	t.Helper()
+	bodyBytes, _ := json.Marshal(ProvisionRequest{
+		ServiceID:        "openclaw-service",
+		PlanID:           "openclaw-developer-plan",
+		OrganizationGUID: "org-123",
+		SpaceGUID:        "space-456",
+	})
+	req := httptest.NewRequest("PUT", "/v2/service_instances/"+instanceID, bytes.NewReader(bodyBytes))
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
+	return rr
+}
 
-	if rr.Code != http.StatusAccepted {
-		t.Errorf("Deprovision status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
-	}
+func TestProvision_RequiresAsyncByDefault(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
 
-	var resp DeprovisionResponse
-	json.Unmarshal(rr.Body.Bytes(), &resp)
-	if resp.Operation == "" {
-		t.Error("Deprovision operation is empty")
+	rr := provisionSync(t, router, "inst-no-async")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusUnprocessableEntity)
 	}
 }
 
-func TestDeprovision_NonExistentInstance_AttemptsBOSHDelete(t *testing.T) {
-	_, fakeBOSH, router := newTestBroker("done", false)
+func TestProvision_SyncSuccess(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{taskStates: transitioningTaskStates(2, "done")})
 	defer fakeBOSH.Close()
 
-	// When instance is not in broker memory, broker should attempt BOSH delete
-	// using the naming convention openclaw-agent-{instanceID} and return 202
-	req := httptest.NewRequest("DELETE", "/v2/service_instances/inst-ghost?accepts_incomplete=true&service_id=openclaw-service&plan_id=openclaw-developer-plan", nil)
-	rr := httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		SyncProvision:   true,
+	}, director)
+	b.taskPollInterval = 5 * time.Millisecond
 
-	if rr.Code != http.StatusAccepted {
-		t.Errorf("Deprovision orphaned instance status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
-	}
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
 
-	var resp DeprovisionResponse
+	rr := provisionSync(t, r, "inst-sync")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d. Body: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+	var resp ProvisionResponse
 	json.Unmarshal(rr.Body.Bytes(), &resp)
-	if resp.Operation != "deprovision-inst-ghost" {
-		t.Errorf("Operation = %q, want %q", resp.Operation, "deprovision-inst-ghost")
+	if !strings.HasPrefix(resp.DashboardURL, "https://") {
+		t.Errorf("DashboardURL = %q, want https URL", resp.DashboardURL)
+	}
+	if resp.Operation != "" {
+		t.Errorf("Operation = %q, want empty for synchronous provision", resp.Operation)
+	}
+	if state := b.instances["inst-sync"].State; state != "ready" {
+		t.Errorf("State = %q, want %q", state, "ready")
 	}
 }
 
-func TestDeprovision_SetsStateToDeprovisioning(t *testing.T) {
-	b, fakeBOSH, router := newTestBroker("done", false)
+func TestProvision_SyncTaskTimeout(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{taskStates: transitioningTaskStates(-1, "done")})
 	defer fakeBOSH.Close()
 
-	provisionInstance(t, router, "inst-deprov-state", "openclaw-developer-plan")
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		SyncProvision:   true,
+	}, director)
+	b.syncTimeout = 50 * time.Millisecond
+	b.taskPollInterval = 5 * time.Millisecond
 
-	req := httptest.NewRequest("DELETE", "/v2/service_instances/inst-deprov-state?accepts_incomplete=true&service_id=openclaw-service&plan_id=openclaw-developer-plan", nil)
-	rr := httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
 
-	if rr.Code != http.StatusAccepted {
-		t.Fatalf("Deprovision failed: %d", rr.Code)
+	rr := provisionSync(t, r, "inst-sync-slow")
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d. Body: %s", rr.Code, http.StatusInternalServerError, rr.Body.String())
 	}
+	// The task is still running, so the instance stays trackable
+	if state := b.instances["inst-sync-slow"].State; state != "provisioning" {
+		t.Errorf("State = %q, want %q", state, "provisioning")
+	}
+}
 
-	b.mu.RLock()
-	inst := b.instances["inst-deprov-state"]
-	b.mu.RUnlock()
+func TestProvision_SyncWaitsForRouteAndNotifies(t *testing.T) {
+	receiver, events := newWebhookReceiver(t, "", 0)
+	defer receiver.Close()
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
 
-	if inst.State != "deprovisioning" {
-		t.Errorf("State = %q, want %q", inst.State, "deprovisioning")
+	b := New(BrokerConfig{
+		OpenClawVersion:   "2026.2.21-2",
+		AZs:               []string{"z1"},
+		AppsDomain:        "apps.example.com",
+		SyncProvision:     true,
+		RouteReadyTimeout: 120,
+		WebhookURL:        receiver.URL,
+	}, bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", ""))
+	b.taskPollInterval = 5 * time.Millisecond
+	var probes atomic.Int32
+	b.SetRouteProbe(func(ctx context.Context, url string) error {
+		if probes.Add(1) < 3 {
+			return errors.New("unknown_route")
+		}
+		return nil
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+
+	rr := provisionSync(t, r, "inst-sync-route")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d. Body: %s", rr.Code, http.StatusCreated, rr.Body.String())
 	}
-	if inst.BoshTaskID != 99 {
-		t.Errorf("BoshTaskID = %d, want 99", inst.BoshTaskID)
+	if got := probes.Load(); got != 3 {
+		t.Errorf("route probed %d times, want the response held until the third probe", got)
+	}
+	if event := waitForEvent(t, events); event.Event != EventProvisionSucceeded || event.InstanceID != "inst-sync-route" {
+		t.Errorf("event = %+v, want provision.succeeded", event)
 	}
 }
 
-// --- Bind tests ---
-
-func TestBind_ReadyInstance(t *testing.T) {
-	b, fakeBOSH, router := newTestBroker("done", false)
+func TestProvision_SyncStopsWhenClientGoesAway(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{taskStates: transitioningTaskStates(-1, "done")})
 	defer fakeBOSH.Close()
 
-	provisionInstance(t, router, "inst-bind", "openclaw-developer-plan")
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		SyncProvision:   true,
+	}, bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", ""))
+	b.taskPollInterval = time.Hour
 
-	// Manually set state to "ready"
-	b.mu.Lock()
-	b.instances["inst-bind"].State = "ready"
-	b.instances["inst-bind"].AppsDomain = "apps.example.com"
-	b.mu.Unlock()
-
-	body := BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"}
-	bodyBytes, _ := json.Marshal(body)
-	req := httptest.NewRequest("PUT", "/v2/service_instances/inst-bind/service_bindings/bind-001", bytes.NewReader(bodyBytes))
-	rr := httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
-
-	if rr.Code != http.StatusCreated {
-		t.Fatalf("Bind status = %d, want %d. Body: %s", rr.Code, http.StatusCreated, rr.Body.String())
-	}
-
-	var resp BindResponse
-	json.Unmarshal(rr.Body.Bytes(), &resp)
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
 
-	creds := resp.Credentials
-	if creds["instance_id"] != "inst-bind" {
-		t.Errorf("instance_id = %v, want %q", creds["instance_id"], "inst-bind")
-	}
-	if creds["api_token"] == nil || creds["api_token"] == "" {
-		t.Error("api_token is missing or empty")
-	}
-	if creds["node_seed"] == nil || creds["node_seed"] == "" {
-		t.Error("node_seed is missing or empty")
-	}
-	if creds["dashboard_url"] == nil {
-		t.Error("dashboard_url is missing")
-	}
-	dashURL, _ := creds["dashboard_url"].(string)
-	if !strings.Contains(dashURL, "?token=") {
-		t.Errorf("dashboard_url should contain ?token= for auth, got %q", dashURL)
-	}
-	if creds["api_endpoint"] == nil {
-		t.Error("api_endpoint is missing")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	bodyBytes, _ := json.Marshal(ProvisionRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"})
+	req := httptest.NewRequest("PUT", "/v2/service_instances/inst-sync-gone", bytes.NewReader(bodyBytes)).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("synchronous provision kept polling after the request context ended")
 	}
-	if creds["plan"] != "developer" {
-		t.Errorf("plan = %v, want %q", creds["plan"], "developer")
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if state := b.instances["inst-sync-gone"].State; state != "provisioning" {
+		t.Errorf("State = %q, want %q", state, "provisioning")
 	}
 }
 
-func TestBind_InstanceNotFound(t *testing.T) {
-	_, fakeBOSH, router := newTestBroker("done", false)
+func TestProvision_SyncEnabledStillHonorsAsync(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{taskStates: transitioningTaskStates(-1, "done")})
 	defer fakeBOSH.Close()
 
-	body := BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"}
-	bodyBytes, _ := json.Marshal(body)
-	req := httptest.NewRequest("PUT", "/v2/service_instances/inst-missing/service_bindings/bind-001", bytes.NewReader(bodyBytes))
-	rr := httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		SyncProvision:   true,
+	}, director)
 
-	if rr.Code != http.StatusNotFound {
-		t.Errorf("Bind missing instance status = %d, want %d", rr.Code, http.StatusNotFound)
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+
+	rr := provisionInstance(t, r, "inst-async", "openclaw-developer-plan")
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusAccepted)
 	}
 }
 
-func TestBind_InstanceNotReady(t *testing.T) {
-	_, fakeBOSH, router := newTestBroker("done", false)
-	defer fakeBOSH.Close()
-
-	// Instance is in "provisioning" state after provision
-	provisionInstance(t, router, "inst-not-ready", "openclaw-developer-plan")
-
-	body := BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"}
-	bodyBytes, _ := json.Marshal(body)
-	req := httptest.NewRequest("PUT", "/v2/service_instances/inst-not-ready/service_bindings/bind-001", bytes.NewReader(bodyBytes))
+// provisionWithOwner provisions instanceID on the developer plan with the given owner parameter.
+func provisionWithOwner(t *testing.T, router *mux.Router, instanceID string, owner interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	params := map[string]interface{}{}
+	if owner != nil {
+		params["owner"] = owner
+	}
+	bodyBytes, _ := json.Marshal(ProvisionRequest{
+		ServiceID:        "openclaw-service",
+		PlanID:           "openclaw-developer-plan",
+		OrganizationGUID: "org-123",
+		SpaceGUID:        "space-456",
+		Parameters:       params,
+	})
+	req := httptest.NewRequest("PUT", "/v2/service_instances/"+instanceID+"?accepts_incomplete=true", bytes.NewReader(bodyBytes))
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
+	return rr
+}
 
-	if rr.Code != http.StatusUnprocessableEntity {
-		t.Errorf("Bind not-ready instance status = %d, want %d", rr.Code, http.StatusUnprocessableEntity)
+func TestProvision_SSOAllowedEmailDomains(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.config.SSOEnabled = true
+	b.config.SSOAllowedEmailDomains = "example.com, @Corp.example.org"
+
+	tests := []struct {
+		name  string
+		owner interface{}
+		want  int
+	}{
+		{"allowed domain", "dev@example.com", http.StatusAccepted},
+		{"allowed domain case-insensitive", "Ops@corp.EXAMPLE.org", http.StatusAccepted},
+		{"disallowed domain", "dev@evil.com", http.StatusUnprocessableEntity},
+		{"subdomain of allowed", "dev@sub.example.com", http.StatusUnprocessableEntity},
+		{"missing owner", nil, http.StatusUnprocessableEntity},
+		// The parameter schema rejects non-email owners before the domain check
+		{"non-email owner", "devuser", http.StatusBadRequest},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := fmt.Sprintf("inst-sso-domain-%d", i)
+			rr := provisionWithOwner(t, router, id, tt.owner)
+			if rr.Code != tt.want {
+				t.Fatalf("status = %d, want %d. Body: %s", rr.Code, tt.want, rr.Body.String())
+			}
+			_, exists := b.instances[id]
+			if tt.want != http.StatusAccepted {
+				if exists {
+					t.Error("rejected instance should not be stored")
+				}
+				if !strings.Contains(rr.Body.String(), "domain") && !strings.Contains(rr.Body.String(), "email") {
+					t.Errorf("error body should explain the email restriction: %s", rr.Body.String())
+				}
+			}
+		})
 	}
 }
 
-func TestBind_CredentialsContainExpectedKeys(t *testing.T) {
+func TestCheckOwnerEmailDomain_RejectsNonEmail(t *testing.T) {
+	for _, owner := range []string{"", "devuser", "@example.com", "dev@", "a@b@example.com"} {
+		if err := checkOwnerEmailDomain(owner, "example.com"); err == nil {
+			t.Errorf("checkOwnerEmailDomain(%q) returned nil, want error", owner)
+		}
+	}
+}
+
+func TestProvision_SSOAllowedEmailDomainsIgnoredWithoutSSO(t *testing.T) {
 	b, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
+	b.config.SSOAllowedEmailDomains = "example.com"
 
-	provisionInstance(t, router, "inst-keys", "openclaw-team-plan")
-	b.mu.Lock()
-	b.instances["inst-keys"].State = "ready"
-	b.mu.Unlock()
+	if rr := provisionWithOwner(t, router, "inst-no-sso", "dev@evil.com"); rr.Code != http.StatusAccepted {
+		t.Errorf("status = %d, want %d when SSO is disabled", rr.Code, http.StatusAccepted)
+	}
+}
 
-	body := BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-team-plan"}
-	bodyBytes, _ := json.Marshal(body)
-	req := httptest.NewRequest("PUT", "/v2/service_instances/inst-keys/service_bindings/bind-keys", bytes.NewReader(bodyBytes))
+// provisionInSpace provisions instanceID on the developer plan in the given org and space.
+func provisionInSpace(t *testing.T, router *mux.Router, instanceID, orgGUID, spaceGUID string) *httptest.ResponseRecorder {
+	t.Helper()
+	bodyBytes, _ := json.Marshal(ProvisionRequest{
+		ServiceID:        "openclaw-service",
+		PlanID:           "openclaw-developer-plan",
+		OrganizationGUID: orgGUID,
+		SpaceGUID:        spaceGUID,
+		Parameters:       map[string]interface{}{"owner": "dev@example.com"},
+	})
+	req := httptest.NewRequest("PUT", "/v2/service_instances/"+instanceID+"?accepts_incomplete=true", bytes.NewReader(bodyBytes))
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
+	return rr
+}
 
-	var resp BindResponse
-	json.Unmarshal(rr.Body.Bytes(), &resp)
+func TestProvision_EnforcesPerSpaceQuota(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.config.MaxInstancesPerSpace = 2
 
-	expectedKeys := []string{
-		"dashboard_url", "api_endpoint", "api_token",
-		"instance_id", "owner", "plan", "openclaw_version", "node_seed", "sso_enabled",
-	}
-	for _, key := range expectedKeys {
-		if _, ok := resp.Credentials[key]; !ok {
-			t.Errorf("Credentials missing key %q", key)
+	for i := 1; i <= 2; i++ {
+		if rr := provisionInSpace(t, router, fmt.Sprintf("inst-space-%d", i), "org-1", "space-a"); rr.Code != http.StatusAccepted {
+			t.Fatalf("provision %d status = %d, want %d", i, rr.Code, http.StatusAccepted)
 		}
 	}
-}
-
-// --- Unbind tests ---
 
-func TestUnbind_ReturnsOK(t *testing.T) {
-	_, fakeBOSH, router := newTestBroker("done", false)
-	defer fakeBOSH.Close()
+	rr := provisionInSpace(t, router, "inst-space-3", "org-1", "space-a")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d. Body: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), "per space") {
+		t.Errorf("error should mention the per-space limit: %s", rr.Body.String())
+	}
 
-	req := httptest.NewRequest("DELETE", "/v2/service_instances/inst-any/service_bindings/bind-any", nil)
-	rr := httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
+	// Another space in the same org still has room
+	if rr := provisionInSpace(t, router, "inst-space-b", "org-1", "space-b"); rr.Code != http.StatusAccepted {
+		t.Errorf("other space status = %d, want %d", rr.Code, http.StatusAccepted)
+	}
 
-	if rr.Code != http.StatusOK {
-		t.Errorf("Unbind status = %d, want %d", rr.Code, http.StatusOK)
+	// Deprovisioning instances don't count against the space
+	b.mu.Lock()
+	b.setInstanceState(b.instances["inst-space-1"], "deprovisioning")
+	b.mu.Unlock()
+	if rr := provisionInSpace(t, router, "inst-space-4", "org-1", "space-a"); rr.Code != http.StatusAccepted {
+		t.Errorf("after deprovision status = %d, want %d", rr.Code, http.StatusAccepted)
 	}
 }
 
-// --- LastOperation tests ---
-
-func TestLastOperation_ProvisioningDone(t *testing.T) {
-	_, fakeBOSH, router := newTestBroker("done", false)
+func TestProvision_EnforcesTotalMemoryQuota(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
+	// developer = 2048 MB, team = 8192 MB
+	b.config.MaxTotalMemoryMB = 12288
+
+	for _, p := range []struct{ id, plan string }{
+		{"inst-mem-dev-1", "openclaw-developer-plan"},
+		{"inst-mem-team", "openclaw-team-plan"},
+		{"inst-mem-dev-2", "openclaw-developer-plan"}, // exactly at the cap
+	} {
+		if rr := provisionInstance(t, router, p.id, p.plan); rr.Code != http.StatusAccepted {
+			t.Fatalf("provision %s status = %d, want %d. Body: %s", p.id, rr.Code, http.StatusAccepted, rr.Body.String())
+		}
+	}
 
-	provisionInstance(t, router, "inst-lo-done", "openclaw-developer-plan")
-
-	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-done/last_operation", nil)
-	rr := httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
+	rr := provisionInstance(t, router, "inst-mem-over", "openclaw-developer-plan")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d. Body: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), "memory") {
+		t.Errorf("error should mention memory: %s", rr.Body.String())
+	}
 
-	if rr.Code != http.StatusOK {
-		t.Fatalf("LastOperation status = %d, want %d", rr.Code, http.StatusOK)
+	// Freeing the team plan's memory makes room again
+	b.mu.Lock()
+	b.instances["inst-mem-team"].State = "deprovisioning"
+	b.mu.Unlock()
+	if rr := provisionInstance(t, router, "inst-mem-after", "openclaw-developer-plan"); rr.Code != http.StatusAccepted {
+		t.Errorf("after deprovision status = %d, want %d", rr.Code, http.StatusAccepted)
 	}
+}
 
-	var resp LastOperationResponse
-	json.Unmarshal(rr.Body.Bytes(), &resp)
+func TestProvision_OrgQuotaCheckedBeforeSpaceQuota(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.config.MaxInstancesPerOrg = 1
+	b.config.MaxInstancesPerSpace = 1
 
-	if resp.State != "succeeded" {
-		t.Errorf("LastOperation state = %q, want %q", resp.State, "succeeded")
+	provisionInSpace(t, router, "inst-q-1", "org-1", "space-a")
+	rr := provisionInSpace(t, router, "inst-q-2", "org-1", "space-a")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if !strings.Contains(rr.Body.String(), "per org") {
+		t.Errorf("org quota should be reported first: %s", rr.Body.String())
 	}
 }
 
-func TestLastOperation_ProvisioningInProgress(t *testing.T) {
-	_, fakeBOSH, router := newTestBroker("processing", false)
+func TestProvision_DeployFailureDeletesUAAClient(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", true)
 	defer fakeBOSH.Close()
+	fakeUAA := newFakeUAA()
+	defer fakeUAA.Close()
+	b.config.SSOEnabled = true
+	b.uaaClient = uaa.NewClient(fakeUAA.URL, "admin", "secret", "", false)
 
-	provisionInstance(t, router, "inst-lo-prog", "openclaw-developer-plan")
-
-	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-prog/last_operation", nil)
-	rr := httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
+	rr := provisionInstance(t, router, "inst-sso-fail", "openclaw-developer-plan")
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+	if _, exists := b.instances["inst-sso-fail"]; exists {
+		t.Error("failed instance should be removed from broker state")
+	}
+	if fakeUAA.hasClient(uaa.ClientIDForInstance("inst-sso-fail")) {
+		t.Error("UAA client should be deleted after deploy failure")
+	}
+}
 
-	var resp LastOperationResponse
-	json.Unmarshal(rr.Body.Bytes(), &resp)
+func TestProvision_SuccessKeepsUAAClient(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	fakeUAA := newFakeUAA()
+	defer fakeUAA.Close()
+	b.config.SSOEnabled = true
+	b.uaaClient = uaa.NewClient(fakeUAA.URL, "admin", "secret", "", false)
 
-	if resp.State != "in progress" {
-		t.Errorf("LastOperation state = %q, want %q", resp.State, "in progress")
+	if rr := provisionInstance(t, router, "inst-sso-ok", "openclaw-developer-plan"); rr.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	if !fakeUAA.hasClient(uaa.ClientIDForInstance("inst-sso-ok")) {
+		t.Error("UAA client should remain registered after successful provision")
 	}
 }
 
-func TestLastOperation_ProvisioningError(t *testing.T) {
-	_, fakeBOSH, router := newTestBroker("error", false)
+func TestProvision_ExternalSSOClientMakesNoUAACalls(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
 	defer fakeBOSH.Close()
+	var uaaRequests atomic.Int32
+	fakeUAA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uaaRequests.Add(1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer fakeUAA.Close()
+	secretsDir := t.TempDir()
+	os.WriteFile(filepath.Join(secretsDir, uaa.ClientIDForInstance("inst-ext")), []byte("pipeline-secret\n"), 0600)
+
+	b := New(BrokerConfig{
+		OpenClawVersion:             "2026.2.21-2",
+		AZs:                         []string{"z1"},
+		AppsDomain:                  "apps.example.com",
+		SSOEnabled:                  true,
+		SSOExternalClientManagement: true,
+		SSOExternalClientSecretsDir: secretsDir,
+		CFUaaURL:                    fakeUAA.URL,
+		CFUaaAdminClientSecret:      "secret",
+	}, bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", ""))
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Deprovision).Methods("DELETE")
+	r.HandleFunc("/v2/service_instances/{instance_id}/last_operation", b.LastOperation).Methods("GET")
 
-	provisionInstance(t, router, "inst-lo-err", "openclaw-developer-plan")
+	if rr := provisionInstance(t, r, "inst-ext", "openclaw-developer-plan"); rr.Code != http.StatusAccepted {
+		t.Fatalf("Provision status = %d: %s", rr.Code, rr.Body.String())
+	}
+	inst := b.instances["inst-ext"]
+	if inst.SSOClientID != "openclaw-inst-ext" || inst.SSOClientSecret != "pipeline-secret" || inst.SSOCookieSecret == "" {
+		t.Errorf("SSO client = %q/%q, want the external client and its secret from the file", inst.SSOClientID, inst.SSOClientSecret)
+	}
+	manifest, err := bosh.RenderAgentManifest(b.buildManifestParams(inst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertManifestContains(t, string(manifest), `client_id: "openclaw-inst-ext"`, `client_secret: "pipeline-secret"`)
 
-	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-err/last_operation", nil)
-	rr := httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
+	// Without a secret file the instance deploys without SSO
+	if rr := provisionInstance(t, r, "inst-no-secret", "openclaw-developer-plan"); rr.Code != http.StatusAccepted {
+		t.Fatalf("Provision status = %d: %s", rr.Code, rr.Body.String())
+	}
+	if inst := b.instances["inst-no-secret"]; inst.SSOEnabled || inst.SSOClientID != "" {
+		t.Errorf("instance without a secret file has SSO %v with client %q, want SSO disabled", inst.SSOEnabled, inst.SSOClientID)
+	}
 
-	var resp LastOperationResponse
-	json.Unmarshal(rr.Body.Bytes(), &resp)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("DELETE", "/v2/service_instances/inst-ext?accepts_incomplete=true&service_id=openclaw-service&plan_id=openclaw-developer-plan", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Deprovision status = %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/service_instances/inst-ext/last_operation", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "succeeded") {
+		t.Fatalf("last_operation = %d: %s", rr.Code, rr.Body.String())
+	}
 
-	if resp.State != "failed" {
-		t.Errorf("LastOperation state = %q, want %q", resp.State, "failed")
+	if n := uaaRequests.Load(); n != 0 {
+		t.Errorf("UAA received %d requests, want none with external client management", n)
 	}
 }
 
-func TestLastOperation_ProvisioningCancelled(t *testing.T) {
-	_, fakeBOSH, router := newTestBroker("cancelled", false)
+// --- Deprovision tests ---
+
+func TestDeprovision_ExistingInstance(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
 
-	provisionInstance(t, router, "inst-lo-cancel", "openclaw-developer-plan")
+	// First provision
+	provisionInstance(t, router, "inst-deprov", "openclaw-developer-plan")
 
-	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-cancel/last_operation", nil)
+	// Then deprovision
+	req := httptest.NewRequest("DELETE", "/v2/service_instances/inst-deprov?accepts_incomplete=true&service_id=openclaw-service&plan_id=openclaw-developer-plan", nil)
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 
-	var resp LastOperationResponse
-	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("Deprovision status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
 
-	if resp.State != "failed" {
-		t.Errorf("LastOperation state = %q, want %q", resp.State, "failed")
+	var resp DeprovisionResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.Operation == "" {
+		t.Error("Deprovision operation is empty")
 	}
 }
 
-func TestLastOperation_InstanceNotFound(t *testing.T) {
+func TestDeprovision_NonExistentInstance_AttemptsBOSHDelete(t *testing.T) {
 	_, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
 
-	req := httptest.NewRequest("GET", "/v2/service_instances/inst-nonexistent/last_operation", nil)
+	// When instance is not in broker memory, broker should attempt BOSH delete
+	// using the naming convention openclaw-agent-{instanceID} and return 202
+	req := httptest.NewRequest("DELETE", "/v2/service_instances/inst-ghost?accepts_incomplete=true&service_id=openclaw-service&plan_id=openclaw-developer-plan", nil)
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 
-	if rr.Code != http.StatusNotFound {
-		t.Errorf("LastOperation missing instance status = %d, want %d", rr.Code, http.StatusNotFound)
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("Deprovision orphaned instance status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+
+	var resp DeprovisionResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.Operation != "deprovision-inst-ghost" {
+		t.Errorf("Operation = %q, want %q", resp.Operation, "deprovision-inst-ghost")
 	}
 }
 
-func TestLastOperation_ReadyState(t *testing.T) {
+func TestDeprovision_SetsStateToDeprovisioning(t *testing.T) {
 	b, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
 
-	provisionInstance(t, router, "inst-lo-ready", "openclaw-developer-plan")
-	b.mu.Lock()
-	b.instances["inst-lo-ready"].State = "ready"
-	b.mu.Unlock()
+	provisionInstance(t, router, "inst-deprov-state", "openclaw-developer-plan")
 
-	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-ready/last_operation", nil)
+	req := httptest.NewRequest("DELETE", "/v2/service_instances/inst-deprov-state?accepts_incomplete=true&service_id=openclaw-service&plan_id=openclaw-developer-plan", nil)
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 
-	var resp LastOperationResponse
-	json.Unmarshal(rr.Body.Bytes(), &resp)
-
-	if resp.State != "succeeded" {
-		t.Errorf("LastOperation state = %q, want %q", resp.State, "succeeded")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Deprovision failed: %d", rr.Code)
+	}
+
+	b.mu.RLock()
+	inst := b.instances["inst-deprov-state"]
+	b.mu.RUnlock()
+
+	if inst.State != "deprovisioning" {
+		t.Errorf("State = %q, want %q", inst.State, "deprovisioning")
+	}
+	if inst.BoshTaskID != 99 {
+		t.Errorf("BoshTaskID = %d, want 99", inst.BoshTaskID)
 	}
 }
 
-func TestLastOperation_FailedState(t *testing.T) {
-	b, fakeBOSH, router := newTestBroker("done", false)
+func TestDeprovision_CancelsInFlightProvisionOnce(t *testing.T) {
+	cancels := 0
+	// The deploy task keeps running until it is cancelled
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{cancels: &cancels, taskStates: func() string {
+		if cancels > 0 {
+			return "cancelled"
+		}
+		return "processing"
+	}})
 	defer fakeBOSH.Close()
 
-	provisionInstance(t, router, "inst-lo-failed", "openclaw-developer-plan")
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+	}, director)
+	b.taskPollInterval = 5 * time.Millisecond
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Deprovision).Methods("DELETE")
+
+	provisionInstance(t, r, "inst-cancel", "openclaw-developer-plan")
+
+	deprovision := func() {
+		req := httptest.NewRequest("DELETE", "/v2/service_instances/inst-cancel?accepts_incomplete=true&service_id=openclaw-service&plan_id=openclaw-developer-plan", nil)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("Deprovision status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+		}
+	}
+	deprovision()
+	if cancels != 1 {
+		t.Fatalf("cancel calls = %d, want 1", cancels)
+	}
+	if got := b.instances["inst-cancel"].BoshTaskID; got != 99 {
+		t.Errorf("BoshTaskID = %d, want delete task 99", got)
+	}
+
+	// A retried deprovision while the provision task is still recorded must
+	// not cancel the same task again.
 	b.mu.Lock()
-	b.instances["inst-lo-failed"].State = "failed"
+	b.instances["inst-cancel"].State = "provisioning"
+	b.instances["inst-cancel"].BoshTaskID = 42
 	b.mu.Unlock()
+	deprovision()
+	if cancels != 1 {
+		t.Errorf("cancel calls after retry = %d, want 1", cancels)
+	}
+}
 
-	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-failed/last_operation", nil)
-	rr := httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
-
-	var resp LastOperationResponse
-	json.Unmarshal(rr.Body.Bytes(), &resp)
+func TestUpdateAndDeprovision_ConcurrentDeprovisionWins(t *testing.T) {
+	b, fakeBOSH, r := newTestBroker("done", false)
+	defer fakeBOSH.Close()
 
-	if resp.State != "failed" {
-		t.Errorf("LastOperation state = %q, want %q", resp.State, "failed")
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("inst-race-%d", i)
+		provisionInstance(t, r, id, "openclaw-developer-plan")
+		b.mu.Lock()
+		b.instances[id].State = "ready"
+		b.mu.Unlock()
+
+		var wg sync.WaitGroup
+		var updateCode, deprovisionCode int
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest("PATCH", "/v2/service_instances/"+id+"?accepts_incomplete=true&force=true",
+				strings.NewReader(`{"service_id":"openclaw-service"}`)))
+			updateCode = rr.Code
+		}()
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest("DELETE", "/v2/service_instances/"+id+"?accepts_incomplete=true", nil))
+			deprovisionCode = rr.Code
+		}()
+		wg.Wait()
+
+		if deprovisionCode != http.StatusAccepted {
+			t.Fatalf("%s: deprovision status = %d, want 202", id, deprovisionCode)
+		}
+		if updateCode != http.StatusAccepted && updateCode != http.StatusUnprocessableEntity {
+			t.Errorf("%s: update status = %d, want 202 or 422", id, updateCode)
+		}
+		b.mu.RLock()
+		inst := b.instances[id]
+		if inst == nil || inst.State != "deprovisioning" || inst.BoshTaskID != 99 {
+			t.Errorf("%s: final instance = %+v, want deprovisioning on delete task 99", id, inst)
+		}
+		b.mu.RUnlock()
 	}
 }
 
-func TestLastOperation_DeprovisioningDone(t *testing.T) {
+// --- Bind tests ---
+
+func TestBind_ReadyInstance(t *testing.T) {
 	b, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
 
-	provisionInstance(t, router, "inst-lo-dep-done", "openclaw-developer-plan")
+	provisionInstance(t, router, "inst-bind", "openclaw-developer-plan")
 
-	// Simulate deprovisioning state
+	// Manually set state to "ready"
 	b.mu.Lock()
-	b.instances["inst-lo-dep-done"].State = "deprovisioning"
-	b.instances["inst-lo-dep-done"].BoshTaskID = 99
+	b.instances["inst-bind"].State = "ready"
+	b.instances["inst-bind"].AppsDomain = "apps.example.com"
 	b.mu.Unlock()
 
-	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-dep-done/last_operation", nil)
+	body := BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"}
+	bodyBytes, _ := json.Marshal(body)
+	req := httptest.NewRequest("PUT", "/v2/service_instances/inst-bind/service_bindings/bind-001", bytes.NewReader(bodyBytes))
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 
-	var resp LastOperationResponse
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Bind status = %d, want %d. Body: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+
+	var resp BindResponse
 	json.Unmarshal(rr.Body.Bytes(), &resp)
 
-	if resp.State != "succeeded" {
-		t.Errorf("LastOperation deprovisioning done state = %q, want %q", resp.State, "succeeded")
+	creds := resp.Credentials
+	if creds["instance_id"] != "inst-bind" {
+		t.Errorf("instance_id = %v, want %q", creds["instance_id"], "inst-bind")
 	}
-
-	// Instance should be deleted
-	b.mu.RLock()
-	_, exists := b.instances["inst-lo-dep-done"]
-	b.mu.RUnlock()
-	if exists {
-		t.Error("Instance should have been deleted after deprovisioning done")
+	if creds["api_token"] == nil || creds["api_token"] == "" {
+		t.Error("api_token is missing or empty")
+	}
+	if creds["node_seed"] == nil || creds["node_seed"] == "" {
+		t.Error("node_seed is missing or empty")
+	}
+	if creds["dashboard_url"] == nil {
+		t.Error("dashboard_url is missing")
+	}
+	dashURL, _ := creds["dashboard_url"].(string)
+	if !strings.Contains(dashURL, "?token=") {
+		t.Errorf("dashboard_url should contain ?token= for auth, got %q", dashURL)
+	}
+	if creds["api_endpoint"] == nil {
+		t.Error("api_endpoint is missing")
+	}
+	if creds["plan"] != "developer" {
+		t.Errorf("plan = %v, want %q", creds["plan"], "developer")
 	}
 }
 
-func TestLastOperation_DeprovisioningInProgress(t *testing.T) {
-	b, fakeBOSH, router := newTestBroker("processing", false)
-	defer fakeBOSH.Close()
-
-	provisionInstance(t, router, "inst-lo-dep-prog", "openclaw-developer-plan")
+// bindReady marks instanceID ready and binds it with the given bind_resource.
+func bindReady(t *testing.T, b *Broker, router *mux.Router, instanceID, bindingID string, resource *BindResource) map[string]interface{} {
+	t.Helper()
 	b.mu.Lock()
-	b.instances["inst-lo-dep-prog"].State = "deprovisioning"
+	b.instances[instanceID].State = "ready"
 	b.mu.Unlock()
 
-	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-dep-prog/last_operation", nil)
+	bodyBytes, _ := json.Marshal(BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan", BindResource: resource})
+	req := httptest.NewRequest("PUT", "/v2/service_instances/"+instanceID+"/service_bindings/"+bindingID, bytes.NewReader(bodyBytes))
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
-
-	var resp LastOperationResponse
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Bind status = %d, want %d. Body: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+	var resp BindResponse
 	json.Unmarshal(rr.Body.Bytes(), &resp)
+	return resp.Credentials
+}
 
-	if resp.State != "in progress" {
-		t.Errorf("LastOperation deprovisioning in progress state = %q, want %q", resp.State, "in progress")
+func TestBind_AppBindingGetsNarrowCredentials(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	provisionInstance(t, router, "inst-app-bind", "openclaw-developer-plan")
+
+	creds := bindReady(t, b, router, "inst-app-bind", "bind-app", &BindResource{AppGUID: "app-guid-123"})
+	for _, key := range []string{"node_seed", "control_ui_url"} {
+		if _, ok := creds[key]; ok {
+			t.Errorf("app binding should not include %s", key)
+		}
+	}
+	for _, key := range []string{"api_endpoint", "api_token", "dashboard_url", "instance_id"} {
+		if _, ok := creds[key]; !ok {
+			t.Errorf("app binding missing %s", key)
+		}
 	}
 }
 
-func TestLastOperation_DeprovisioningError(t *testing.T) {
-	b, fakeBOSH, router := newTestBroker("error", false)
+func TestBind_ServiceKeyGetsFullCredentials(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
+	provisionInstance(t, router, "inst-key-bind", "openclaw-developer-plan")
 
-	provisionInstance(t, router, "inst-lo-dep-err", "openclaw-developer-plan")
-	b.mu.Lock()
-	b.instances["inst-lo-dep-err"].State = "deprovisioning"
-	b.mu.Unlock()
+	// Service keys have no bind_resource, or one without app_guid
+	for i, resource := range []*BindResource{nil, {}} {
+		creds := bindReady(t, b, router, "inst-key-bind", fmt.Sprintf("key-%d", i), resource)
+		if creds["node_seed"] != b.instances["inst-key-bind"].NodeSeed {
+			t.Errorf("service key %d node_seed = %v, want instance seed", i, creds["node_seed"])
+		}
+		wantUI := "https://" + b.instances["inst-key-bind"].RouteHostname + ".apps.example.com"
+		if creds["control_ui_url"] != wantUI {
+			t.Errorf("service key %d control_ui_url = %v, want %q", i, creds["control_ui_url"], wantUI)
+		}
+	}
+}
 
-	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-dep-err/last_operation", nil)
+func TestBind_InstanceNotFound(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	body := BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"}
+	bodyBytes, _ := json.Marshal(body)
+	req := httptest.NewRequest("PUT", "/v2/service_instances/inst-missing/service_bindings/bind-001", bytes.NewReader(bodyBytes))
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 
-	var resp LastOperationResponse
-	json.Unmarshal(rr.Body.Bytes(), &resp)
-
-	if resp.State != "failed" {
-		t.Errorf("LastOperation deprovisioning error state = %q, want %q", resp.State, "failed")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Bind missing instance status = %d, want %d", rr.Code, http.StatusNotFound)
 	}
 }
 
-// --- Update tests ---
-
-func TestUpdate_ChangePlan(t *testing.T) {
-	b, fakeBOSH, router := newTestBroker("done", false)
+func TestBind_InstanceNotReady(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("processing", false)
 	defer fakeBOSH.Close()
 
-	provisionInstance(t, router, "inst-update", "openclaw-developer-plan")
+	// Instance is in "provisioning" state after provision
+	provisionInstance(t, router, "inst-not-ready", "openclaw-developer-plan")
 
-	body := UpdateRequest{
-		ServiceID: "openclaw-service",
-		PlanID:    "openclaw-team-plan",
-	}
+	body := BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"}
 	bodyBytes, _ := json.Marshal(body)
-	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-update?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+	req := httptest.NewRequest("PUT", "/v2/service_instances/inst-not-ready/service_bindings/bind-001", bytes.NewReader(bodyBytes))
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 
-	if rr.Code != http.StatusAccepted {
-		t.Fatalf("Update status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
-	}
-
-	b.mu.RLock()
-	inst := b.instances["inst-update"]
-	b.mu.RUnlock()
-
-	if inst.PlanID != "openclaw-team-plan" {
-		t.Errorf("PlanID = %q, want %q", inst.PlanID, "openclaw-team-plan")
-	}
-	if inst.PlanName != "team" {
-		t.Errorf("PlanName = %q, want %q", inst.PlanName, "team")
-	}
-	if inst.VMType != "large" {
-		t.Errorf("VMType = %q, want %q after plan change", inst.VMType, "large")
-	}
-	if inst.DiskType != "50GB" {
-		t.Errorf("DiskType = %q, want %q after plan change", inst.DiskType, "50GB")
-	}
-	if inst.State != "provisioning" {
-		t.Errorf("State = %q, want %q after re-deploy", inst.State, "provisioning")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Bind not-ready instance status = %d, want %d", rr.Code, http.StatusUnprocessableEntity)
 	}
 }
 
-func TestUpdate_SamePlanRedeploys(t *testing.T) {
+func TestBind_CredentialsContainExpectedKeys(t *testing.T) {
 	b, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
 
-	provisionInstance(t, router, "inst-same-plan", "openclaw-developer-plan")
-
+	provisionInstance(t, router, "inst-keys", "openclaw-team-plan")
 	b.mu.Lock()
-	b.instances["inst-same-plan"].State = "ready"
+	b.instances["inst-keys"].State = "ready"
 	b.mu.Unlock()
 
-	body := UpdateRequest{
-		ServiceID: "openclaw-service",
-		PlanID:    "openclaw-developer-plan", // same plan
-	}
+	body := BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-team-plan"}
 	bodyBytes, _ := json.Marshal(body)
-	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-same-plan?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+	req := httptest.NewRequest("PUT", "/v2/service_instances/inst-keys/service_bindings/bind-keys", bytes.NewReader(bodyBytes))
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 
-	// Same-plan updates now always redeploy to pick up new release versions
-	if rr.Code != http.StatusAccepted {
-		t.Fatalf("Update same plan status = %d, want %d", rr.Code, http.StatusAccepted)
-	}
-
-	b.mu.RLock()
-	inst := b.instances["inst-same-plan"]
-	b.mu.RUnlock()
+	var resp BindResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
 
-	if inst.State != "provisioning" {
-		t.Errorf("State = %q, want %q (redeploy should reset state)", inst.State, "provisioning")
+	expectedKeys := []string{
+		"dashboard_url", "api_endpoint", "api_token",
+		"instance_id", "owner", "plan", "openclaw_version", "node_seed", "sso_enabled",
+	}
+	for _, key := range expectedKeys {
+		if _, ok := resp.Credentials[key]; !ok {
+			t.Errorf("Credentials missing key %q", key)
+		}
 	}
 }
 
-func TestUpdate_OrphanRecovery(t *testing.T) {
+func TestBind_BundleFormat(t *testing.T) {
 	b, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
+	provisionInstance(t, router, "inst-bundle", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-bundle"].State = "ready"
+	route := "https://" + b.instances["inst-bundle"].RouteHostname + ".apps.example.com"
+	b.mu.Unlock()
 
-	// Instance not in broker memory — should trigger orphan recovery and redeploy
-	body := UpdateRequest{
-		ServiceID: "openclaw-service",
-		PlanID:    "openclaw-team-plan",
+	bind := func(bindingID, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v2/service_instances/inst-bundle/service_bindings/"+bindingID, strings.NewReader(body)))
+		return rr
 	}
-	bodyBytes, _ := json.Marshal(body)
-	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-orphan?accepts_incomplete=true", bytes.NewReader(bodyBytes))
-	rr := httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
-
-	if rr.Code != http.StatusAccepted {
-		t.Fatalf("Update orphan recovery status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	rr := bind("bind-bundle", `{"service_id":"openclaw-service","plan_id":"openclaw-developer-plan","parameters":{"format":"bundle"}}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Bind status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp BindResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	creds := resp.Credentials
+	token, _ := creds["api_token"].(string)
+	if token == "" || creds["dashboard_url"] == nil {
+		t.Fatalf("bundle should keep the default credentials: %v", creds)
 	}
 
-	// Verify instance was created with recovery data
-	b.mu.RLock()
-	inst, exists := b.instances["inst-orphan"]
-	b.mu.RUnlock()
-
-	if !exists {
-		t.Fatal("Instance should exist after orphan recovery")
+	decode := func(key string) string {
+		encoded, _ := creds[key].(string)
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(data) == 0 {
+			t.Fatalf("%s = %q does not decode: %v", key, encoded, err)
+		}
+		return string(data)
 	}
-	if inst.DeploymentName != "openclaw-agent-inst-orphan" {
-		t.Errorf("DeploymentName = %q, want %q", inst.DeploymentName, "openclaw-agent-inst-orphan")
+	if got := decode("env_file"); !strings.Contains(got, "OPENCLAW_GATEWAY_URL="+route+"\n") || !strings.Contains(got, "OPENCLAW_TOKEN="+token+"\n") {
+		t.Errorf("env_file = %q, want the gateway URL and token", got)
 	}
-	if inst.Owner != "recovered" {
-		t.Errorf("Owner = %q, want %q", inst.Owner, "recovered")
+	if got := decode("shell_snippet"); !strings.Contains(got, "export OPENCLAW_GATEWAY_URL='"+route+"'\n") || !strings.Contains(got, "export OPENCLAW_TOKEN='"+token+"'\n") {
+		t.Errorf("shell_snippet = %q, want exports of the gateway URL and token", got)
 	}
-	if inst.PlanID != "openclaw-team-plan" {
-		t.Errorf("PlanID = %q, want %q", inst.PlanID, "openclaw-team-plan")
-	}
-	if inst.State != "provisioning" {
-		t.Errorf("State = %q, want %q", inst.State, "provisioning")
+
+	// The default format has no bundle files
+	plain := bindInstance(t, router, "inst-bundle", "bind-plain")
+	for _, key := range []string{"env_file", "shell_snippet"} {
+		if _, ok := plain[key]; ok {
+			t.Errorf("default binding should not include %s", key)
+		}
 	}
-	if inst.GatewayToken == "" {
-		t.Error("GatewayToken should not be empty after recovery")
+
+	if rr := bind("bind-bad", `{"service_id":"openclaw-service","plan_id":"openclaw-developer-plan","parameters":{"format":"yaml"}}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown format status = %d, want 400", rr.Code)
 	}
 }
 
-func TestUpdate_InvalidJSON(t *testing.T) {
-	_, fakeBOSH, router := newTestBroker("done", false)
-	defer fakeBOSH.Close()
+func TestShellQuote(t *testing.T) {
+	if got := shellQuote("it's $HOME"); got != `'it'\''s $HOME'` {
+		t.Errorf("shellQuote = %s", got)
+	}
+}
 
-	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-bad?accepts_incomplete=true", bytes.NewReader([]byte("{bad")))
+// bindInstance issues a bind request and returns the decoded credentials.
+func bindInstance(t *testing.T, router *mux.Router, instanceID, bindingID string) map[string]interface{} {
+	t.Helper()
+	bodyBytes, _ := json.Marshal(BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"})
+	req := httptest.NewRequest("PUT", "/v2/service_instances/"+instanceID+"/service_bindings/"+bindingID, bytes.NewReader(bodyBytes))
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
-
-	if rr.Code != http.StatusBadRequest {
-		t.Errorf("Update bad JSON status = %d, want %d", rr.Code, http.StatusBadRequest)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Bind %s status = %d, want %d. Body: %s", bindingID, rr.Code, http.StatusCreated, rr.Body.String())
 	}
+	var resp BindResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	return resp.Credentials
 }
 
-func TestUpdate_BOSHDeployFailure(t *testing.T) {
-	// Create a BOSH server where deploy succeeds on first call but fails on second
-	callCount := 0
-	boshServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch {
-		case r.Method == "POST" && r.URL.Path == "/deployments":
-			callCount++
-			if callCount > 1 {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte("deploy error"))
-				return
-			}
-			w.Header().Set("Location", "/tasks/42")
-			w.WriteHeader(http.StatusFound)
-		case r.Method == "GET" && len(r.URL.Path) > len("/tasks/"):
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"state": "done"})
-		default:
-			w.WriteHeader(http.StatusNotFound)
-		}
-	}))
-	defer boshServer.Close()
+func TestBind_DistinctTokenPerBinding(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
 
-	director := bosh.NewClient(boshServer.URL, "admin", "admin", "", "")
-	cfg := BrokerConfig{
-		MinOpenClawVersion: "2026.1.29",
-		SandboxMode:        "strict",
-		OpenClawVersion:    "2026.2.21-2",
-		AZs:                []string{"z1"},
-		AppsDomain:         "apps.example.com",
+	provisionInstance(t, router, "inst-multi", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-multi"].State = "ready"
+	instanceToken := b.instances["inst-multi"].GatewayToken
+	b.mu.Unlock()
+
+	tokA := bindInstance(t, router, "inst-multi", "bind-a")["api_token"]
+	tokB := bindInstance(t, router, "inst-multi", "bind-b")["api_token"]
+
+	if tokA == tokB {
+		t.Errorf("Bindings share token %v, want distinct tokens", tokA)
 	}
-	b := New(cfg, director)
+	if tokA == instanceToken || tokB == instanceToken {
+		t.Error("Binding token should not be the shared instance gateway token")
+	}
+	if b.instances["inst-multi"].Bindings["bind-a"].GatewayToken != tokA {
+		t.Error("Binding token should be stored on the instance keyed by binding ID")
+	}
+}
 
+// newBindTestBroker returns a broker on director with a ready instance
+// instanceID and the binding routes registered.
+func newBindTestBroker(director *httptest.Server, instanceID string) (*Broker, *mux.Router) {
+	b := New(BrokerConfig{OpenClawVersion: "2026.2.21-2", AZs: []string{"z1"}, AppsDomain: "apps.example.com"},
+		bosh.NewClient(director.URL, "admin", "admin", "", ""))
+	b.putInstance(&Instance{
+		ID: instanceID, PlanID: "openclaw-developer-plan", PlanName: "developer", DeploymentName: "openclaw-agent-" + instanceID,
+		State: "ready", GatewayToken: "instance-token", AppsDomain: "apps.example.com", OpenClawVersion: "2026.2.21-2",
+	})
 	r := mux.NewRouter()
-	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
-	r.HandleFunc("/v2/service_instances/{instance_id}", b.Update).Methods("PATCH")
+	r.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Bind).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.GetBinding).Methods("GET")
+	r.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}/last_operation", b.BindingLastOperation).Methods("GET")
+	return b, r
+}
 
-	// Provision first (succeeds)
-	provisionInstance(t, r, "inst-upd-fail", "openclaw-developer-plan")
+func TestBind_RedeploysAgentWithBindingToken(t *testing.T) {
+	var manifests []string
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{taskState: "processing", manifests: &manifests})
+	defer fakeBOSH.Close()
+	b, router := newBindTestBroker(fakeBOSH, "inst-accept")
 
-	// Now update (deploy will fail on second call)
-	body := UpdateRequest{
-		ServiceID: "openclaw-service",
-		PlanID:    "openclaw-team-plan",
+	token := bindInstance(t, router, "inst-accept", "bind-a")["api_token"].(string)
+	if len(manifests) != 1 {
+		t.Fatalf("Bind submitted %d deploys, want 1", len(manifests))
 	}
-	bodyBytes, _ := json.Marshal(body)
-	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-upd-fail?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+	if !strings.Contains(manifests[0], "binding_tokens:\n                - \""+token+"\"") {
+		t.Errorf("deployed manifest should accept the new binding token:\n%s", manifests[0])
+	}
+
+	b.mu.RLock()
+	inst := b.instances["inst-accept"]
+	state, taskID, bindingTask := inst.State, inst.BoshTaskID, inst.Bindings["bind-a"].BoshTaskID
+	b.mu.RUnlock()
+	if state != "provisioning" || taskID != 42 || bindingTask != 42 {
+		t.Errorf("instance %s on task %d, binding on task %d; want provisioning on task 42 for both", state, taskID, bindingTask)
+	}
+
+	// The deploy is the instance's operation, so a second bind waits for it
+	bodyBytes, _ := json.Marshal(BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"})
 	rr := httptest.NewRecorder()
-	r.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v2/service_instances/inst-accept/service_bindings/bind-b", bytes.NewReader(bodyBytes)))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Bind during the first binding's deploy = %d, want 422", rr.Code)
+	}
+}
+
+func TestBind_DeployFailureDropsBinding(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", true)
+	defer fakeBOSH.Close()
+	b, router := newBindTestBroker(fakeBOSH, "inst-nodeploy")
 
+	bodyBytes, _ := json.Marshal(BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v2/service_instances/inst-nodeploy/service_bindings/bind-a", bytes.NewReader(bodyBytes)))
 	if rr.Code != http.StatusInternalServerError {
-		t.Errorf("Update BOSH failure status = %d, want %d", rr.Code, http.StatusInternalServerError)
+		t.Fatalf("Bind status = %d, want 500: %s", rr.Code, rr.Body.String())
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if inst := b.instances["inst-nodeploy"]; len(inst.Bindings) != 0 || inst.State != "ready" {
+		t.Errorf("instance = %+v, want ready with no bindings", inst)
 	}
 }
 
-func TestUpdate_EmptyPlanIDStillRedeploys(t *testing.T) {
+func TestBindingTokens_SkipsUnissuedTokens(t *testing.T) {
+	inst := &Instance{Bindings: map[string]*Binding{
+		"live": {ID: "live", GatewayToken: "tok"},
+		"wip":  {ID: "wip", State: bindingInProgress},
+	}}
+	if tokens := bindingTokens(inst); len(tokens) != 1 || tokens[0] != "tok" {
+		t.Errorf("bindingTokens = %q, want only the issued token", tokens)
+	}
+}
+
+func TestBind_RepeatedRequests(t *testing.T) {
 	b, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
 
-	provisionInstance(t, router, "inst-empty-plan", "openclaw-developer-plan")
+	provisionInstance(t, router, "inst-idem", "openclaw-developer-plan")
 	b.mu.Lock()
-	b.instances["inst-empty-plan"].State = "ready"
+	b.instances["inst-idem"].State = "ready"
 	b.mu.Unlock()
 
-	body := UpdateRequest{
-		ServiceID: "openclaw-service",
-		PlanID:    "", // empty plan ID
+	bind := func(req BindRequest) *httptest.ResponseRecorder {
+		bodyBytes, _ := json.Marshal(req)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v2/service_instances/inst-idem/service_bindings/bind-1", bytes.NewReader(bodyBytes)))
+		return rr
 	}
-	bodyBytes, _ := json.Marshal(body)
-	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-empty-plan?accepts_incomplete=true", bytes.NewReader(bodyBytes))
-	rr := httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
-
-	// Empty plan ID still triggers a redeploy to refresh the instance
-	if rr.Code != http.StatusAccepted {
-		t.Fatalf("Update empty plan status = %d, want %d", rr.Code, http.StatusAccepted)
+	original := BindRequest{
+		ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan",
+		BindResource: &BindResource{AppGUID: "app-1"},
+		Parameters:   map[string]interface{}{"scope": "read"},
 	}
 
-	b.mu.RLock()
-	inst := b.instances["inst-empty-plan"]
-	b.mu.RUnlock()
-
-	if inst.State != "provisioning" {
-		t.Errorf("State = %q, want %q (redeploy should reset state)", inst.State, "provisioning")
+	first := bind(original)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first bind status = %d, want 201: %s", first.Code, first.Body.String())
 	}
-}
+	var created BindResponse
+	json.Unmarshal(first.Body.Bytes(), &created)
 
-// --- ManifestParams tests ---
+	repeat := bind(original)
+	if repeat.Code != http.StatusOK {
+		t.Fatalf("identical repeat status = %d, want 200: %s", repeat.Code, repeat.Body.String())
+	}
+	var repeated BindResponse
+	json.Unmarshal(repeat.Body.Bytes(), &repeated)
+	if repeated.Credentials["api_token"] != created.Credentials["api_token"] {
+		t.Errorf("repeat returned token %v, want the original %v", repeated.Credentials["api_token"], created.Credentials["api_token"])
+	}
 
-func TestProvision_LLMConfigFlowsToManifest(t *testing.T) {
-	// Verify that GenAI config is included in manifest params
-	fakeBOSH := newFakeBOSHDirector("done", false)
-	defer fakeBOSH.Close()
+	different := original
+	different.Parameters = map[string]interface{}{"scope": "write"}
+	if rr := bind(different); rr.Code != http.StatusConflict {
+		t.Errorf("conflicting repeat status = %d, want 409: %s", rr.Code, rr.Body.String())
+	}
 
-	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
-	cfg := BrokerConfig{
-		OpenClawVersion: "2026.2.21-2",
-		AZs:             []string{"z1"},
-		AppsDomain:      "apps.example.com",
-		LLMProvider:     "genai",
-		LLMEndpoint:     "https://genai.example.com",
-		LLMAPIKey:       "test-key",
-		LLMModel:        "gpt-4",
-		BlockedCommands: "rm -rf /,dd if=/dev/zero",
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if n := len(b.instances["inst-idem"].Bindings); n != 1 {
+		t.Errorf("instance has %d bindings, want 1", n)
 	}
-	b := New(cfg, director)
+}
 
-	r := mux.NewRouter()
-	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+func TestDashboardURLTemplate(t *testing.T) {
+	tests := []struct {
+		name, template, wantProvision, wantBind string
+	}{
+		{"default", "", "https://{route}.apps.example.com", "https://{route}.apps.example.com?token={token}"},
+		{"custom", "https://agents.example.com/{{.PlanName}}/{{.ID}}?org={{.OrgGUID}}",
+			"https://agents.example.com/developer/inst-dash?org=org-123",
+			"https://agents.example.com/developer/inst-dash?org=org-123&token={token}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeBOSH := newFakeBOSHDirector("done", false)
+			defer fakeBOSH.Close()
+			b := New(BrokerConfig{
+				OpenClawVersion:      "2026.2.21-2",
+				AZs:                  []string{"z1"},
+				AppsDomain:           "apps.example.com",
+				DashboardURLTemplate: tt.template,
+			}, bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", ""))
+			r := mux.NewRouter()
+			r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+			r.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Bind).Methods("PUT")
+
+			rr := provisionInstance(t, r, "inst-dash", "openclaw-developer-plan")
+			var provisioned ProvisionResponse
+			json.Unmarshal(rr.Body.Bytes(), &provisioned)
+			route := b.instances["inst-dash"].RouteHostname
+			if want := strings.ReplaceAll(tt.wantProvision, "{route}", route); provisioned.DashboardURL != want {
+				t.Errorf("provision dashboard_url = %q, want %q", provisioned.DashboardURL, want)
+			}
 
-	rr := provisionInstance(t, r, "inst-llm", "openclaw-developer-plan")
-	if rr.Code != http.StatusAccepted {
-		t.Fatalf("Provision failed: %d, body: %s", rr.Code, rr.Body.String())
+			creds := bindReady(t, b, r, "inst-dash", "bind-dash", nil)
+			want := strings.NewReplacer("{route}", route, "{token}", creds["api_token"].(string)).Replace(tt.wantBind)
+			if creds["dashboard_url"] != want {
+				t.Errorf("bind dashboard_url = %v, want %q", creds["dashboard_url"], want)
+			}
+		})
 	}
 }
 
-func TestProvision_BrowserEnabledFromPlanFeatures(t *testing.T) {
-	fakeBOSH := newFakeBOSHDirector("done", false)
+func TestBind_AsyncPollsToSuccess(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
 
-	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
-	cfg := BrokerConfig{
-		OpenClawVersion: "2026.2.21-2",
-		AZs:             []string{"z1"},
-		AppsDomain:      "apps.example.com",
-		Plans: []Plan{
-			{
-				ID: "browser-plan", Name: "browser-enabled",
-				VMType: "medium", DiskType: "20GB",
-				Features: map[string]bool{"browser": true},
-			},
-		},
-	}
-	b := New(cfg, director)
+	provisionInstance(t, router, "inst-async-bind", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-async-bind"].State = "ready"
+	b.mu.Unlock()
 
-	// Build manifest params and check browser is enabled
-	instance := &Instance{
-		ID: "inst-browser", PlanID: "browser-plan", PlanName: "browser-enabled",
-		VMType: "medium", DiskType: "20GB", AppsDomain: "apps.example.com",
+	const bindingPath = "/v2/service_instances/inst-async-bind/service_bindings/bind-async"
+	bodyBytes, _ := json.Marshal(BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", bindingPath+"?accepts_incomplete=true", bytes.NewReader(bodyBytes)))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("async Bind status = %d, want 202: %s", rr.Code, rr.Body.String())
 	}
-	params := b.buildManifestParams(instance)
-	if !params.BrowserEnabled {
-		t.Error("BrowserEnabled should be true for plan with browser feature")
+	var accepted BindAsyncResponse
+	json.Unmarshal(rr.Body.Bytes(), &accepted)
+	if accepted.Operation != "bind" {
+		t.Errorf("operation = %q, want bind", accepted.Operation)
 	}
 
-	// Also test plan without browser feature
-	cfg2 := BrokerConfig{
-		OpenClawVersion: "2026.2.21-2",
-		AZs:             []string{"z1"},
-		AppsDomain:      "apps.example.com",
-		Plans: []Plan{
-			{ID: "no-browser-plan", Name: "basic", VMType: "small", DiskType: "10GB"},
-		},
-	}
-	b2 := New(cfg2, director)
-	instance2 := &Instance{
-		ID: "inst-no-browser", PlanID: "no-browser-plan", PlanName: "basic",
-		VMType: "small", DiskType: "10GB", AppsDomain: "apps.example.com",
+	var op LastOperationResponse
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", bindingPath+"/last_operation?operation=bind", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("binding last_operation status = %d, want 200: %s", rr.Code, rr.Body.String())
+		}
+		json.Unmarshal(rr.Body.Bytes(), &op)
+		if op.State != "in progress" || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	params2 := b2.buildManifestParams(instance2)
-	if params2.BrowserEnabled {
-		t.Error("BrowserEnabled should be false for plan without browser feature")
+	if op.State != "succeeded" {
+		t.Fatalf("binding last_operation state = %q, want succeeded", op.State)
 	}
-}
-
-// --- sanitizeHostname tests ---
 
-func TestSanitizeHostname_BasicEmail(t *testing.T) {
-	result := sanitizeHostname("dev@example.com")
-	if result != "dev" {
-		t.Errorf("sanitizeHostname(%q) = %q, want %q", "dev@example.com", result, "dev")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", bindingPath, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET binding status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+	var fetched BindResponse
+	json.Unmarshal(rr.Body.Bytes(), &fetched)
+	if token, _ := fetched.Credentials["api_token"].(string); token == "" {
+		t.Error("fetched binding should carry an api_token")
 	}
-}
 
-func TestSanitizeHostname_DotsReplacedWithHyphens(t *testing.T) {
-	result := sanitizeHostname("first.last")
-	if result != "first-last" {
-		t.Errorf("sanitizeHostname(%q) = %q, want %q", "first.last", result, "first-last")
+	// A synchronous repeat of the finished binding returns the same credentials
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", bindingPath, bytes.NewReader(bodyBytes)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("repeat Bind status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+	var repeated BindResponse
+	json.Unmarshal(rr.Body.Bytes(), &repeated)
+	if repeated.Credentials["api_token"] != fetched.Credentials["api_token"] {
+		t.Error("repeat bind should return the token issued asynchronously")
 	}
 }
 
-func TestSanitizeHostname_UnderscoresReplacedWithHyphens(t *testing.T) {
-	result := sanitizeHostname("first_last")
-	if result != "first-last" {
-		t.Errorf("sanitizeHostname(%q) = %q, want %q", "first_last", result, "first-last")
+func TestBind_AsyncInProgressBinding(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-async-wip", "openclaw-developer-plan")
+	bodyBytes, _ := json.Marshal(BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"})
+	b.mu.Lock()
+	b.instances["inst-async-wip"].State = "ready"
+	b.instances["inst-async-wip"].Bindings = map[string]*Binding{
+		"bind-wip": {ID: "bind-wip", State: bindingInProgress, RequestHash: BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"}.fingerprint()},
 	}
-}
+	b.mu.Unlock()
 
-func TestSanitizeHostname_UppercaseToLowercase(t *testing.T) {
-	result := sanitizeHostname("DevUser")
-	if result != "devuser" {
-		t.Errorf("sanitizeHostname(%q) = %q, want %q", "DevUser", result, "devuser")
+	const bindingPath = "/v2/service_instances/inst-async-wip/service_bindings/bind-wip"
+	for _, tc := range []struct {
+		query string
+		want  int
+	}{
+		{"?accepts_incomplete=true", http.StatusAccepted},
+		{"", http.StatusUnprocessableEntity},
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PUT", bindingPath+tc.query, bytes.NewReader(bodyBytes)))
+		if rr.Code != tc.want {
+			t.Errorf("repeat Bind%s status = %d, want %d", tc.query, rr.Code, tc.want)
+		}
 	}
-}
 
-func TestSanitizeHostname_EmailWithDotsAndUnderscores(t *testing.T) {
-	result := sanitizeHostname("first.last_name@company.io")
-	if result != "first-last-name" {
-		t.Errorf("sanitizeHostname(%q) = %q, want %q", "first.last_name@company.io", result, "first-last-name")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", bindingPath, nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("GET of an in-progress binding = %d, want 404", rr.Code)
 	}
 }
 
-func TestSanitizeHostname_PlainString(t *testing.T) {
-	result := sanitizeHostname("simple")
-	if result != "simple" {
-		t.Errorf("sanitizeHostname(%q) = %q, want %q", "simple", result, "simple")
+// asyncBind starts an async bind and waits for its deploy to be submitted.
+func asyncBind(t *testing.T, b *Broker, router *mux.Router, instanceID, bindingID string) *Binding {
+	t.Helper()
+	bodyBytes, _ := json.Marshal(BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v2/service_instances/"+instanceID+"/service_bindings/"+bindingID+"?accepts_incomplete=true", bytes.NewReader(bodyBytes)))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("async Bind status = %d, want 202: %s", rr.Code, rr.Body.String())
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b.mu.RLock()
+		binding := b.instances[instanceID].Bindings[bindingID]
+		submitted := binding.BoshTaskID != 0 || binding.State == bindingFailed
+		b.mu.RUnlock()
+		if submitted {
+			return binding
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("async bind never submitted its deploy")
+		}
+		time.Sleep(5 * time.Millisecond)
 	}
 }
 
-func TestSanitizeHostname_EmptyString(t *testing.T) {
-	result := sanitizeHostname("")
-	if result != "" {
-		t.Errorf("sanitizeHostname(%q) = %q, want %q", "", result, "")
+// bindingOperation polls a binding's last_operation once.
+func bindingOperation(t *testing.T, router *mux.Router, instanceID, bindingID string) LastOperationResponse {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/service_instances/"+instanceID+"/service_bindings/"+bindingID+"/last_operation?operation=bind", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("binding last_operation status = %d, want 200: %s", rr.Code, rr.Body.String())
 	}
+	var op LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &op)
+	return op
 }
 
-// --- findPlan tests ---
-
-func TestFindPlan_DeveloperPlan(t *testing.T) {
-	b, fakeBOSH, _ := newTestBroker("done", false)
+func TestBind_AsyncSucceedsOnlyAfterDeploy(t *testing.T) {
+	var taskState atomic.Value
+	taskState.Store("processing")
+	var manifests []string
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{manifests: &manifests, taskStates: func() string { return taskState.Load().(string) }})
 	defer fakeBOSH.Close()
+	b, router := newBindTestBroker(fakeBOSH, "inst-async-deploy")
 
-	plan := b.findPlan("openclaw-developer-plan")
-	if plan == nil {
-		t.Fatal("findPlan returned nil for developer plan")
+	binding := asyncBind(t, b, router, "inst-async-deploy", "bind-async")
+	b.mu.RLock()
+	token := binding.GatewayToken
+	b.mu.RUnlock()
+	if len(manifests) != 1 || !strings.Contains(manifests[0], "- \""+token+"\"") {
+		t.Fatalf("async bind should deploy its token, got %d manifests", len(manifests))
 	}
-	if plan.Name != "developer" {
-		t.Errorf("plan.Name = %q, want %q", plan.Name, "developer")
+
+	if op := bindingOperation(t, router, "inst-async-deploy", "bind-async"); op.State != "in progress" {
+		t.Errorf("binding last_operation while deploying = %q, want in progress", op.State)
 	}
-	if plan.VMType != "small" {
-		t.Errorf("plan.VMType = %q, want %q", plan.VMType, "small")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/service_instances/inst-async-deploy/service_bindings/bind-async", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("GET binding while deploying = %d, want 404", rr.Code)
 	}
-}
-
-func TestFindPlan_DeveloperPlusPlan(t *testing.T) {
-	b, fakeBOSH, _ := newTestBroker("done", false)
-	defer fakeBOSH.Close()
 
-	plan := b.findPlan("openclaw-developer-plus-plan")
-	if plan == nil {
-		t.Fatal("findPlan returned nil for developer-plus plan")
+	taskState.Store("done")
+	if op := bindingOperation(t, router, "inst-async-deploy", "bind-async"); op.State != "succeeded" {
+		t.Fatalf("binding last_operation after deploy = %q, want succeeded", op.State)
 	}
-	if plan.Name != "developer-plus" {
-		t.Errorf("plan.Name = %q, want %q", plan.Name, "developer-plus")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/service_instances/inst-async-deploy/service_bindings/bind-async", nil))
+	var fetched BindResponse
+	json.Unmarshal(rr.Body.Bytes(), &fetched)
+	if rr.Code != http.StatusOK || fetched.Credentials["api_token"] != token {
+		t.Errorf("GET binding = %d with token %v, want 200 with the deployed token", rr.Code, fetched.Credentials["api_token"])
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if state := b.instances["inst-async-deploy"].State; state != "ready" {
+		t.Errorf("instance state = %q, want ready", state)
 	}
 }
 
-func TestFindPlan_TeamPlan(t *testing.T) {
-	b, fakeBOSH, _ := newTestBroker("done", false)
+func TestBind_AsyncDeployFailureFailsBinding(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("error", false)
 	defer fakeBOSH.Close()
+	b, router := newBindTestBroker(fakeBOSH, "inst-async-fail")
 
-	plan := b.findPlan("openclaw-team-plan")
-	if plan == nil {
-		t.Fatal("findPlan returned nil for team plan")
+	asyncBind(t, b, router, "inst-async-fail", "bind-async")
+	if op := bindingOperation(t, router, "inst-async-fail", "bind-async"); op.State != "failed" {
+		t.Fatalf("binding last_operation = %q, want failed", op.State)
 	}
-	if plan.Name != "team" {
-		t.Errorf("plan.Name = %q, want %q", plan.Name, "team")
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if tokens := bindingTokens(b.instances["inst-async-fail"]); len(tokens) != 0 {
+		t.Errorf("a failed binding's token should not be deployed again, got %q", tokens)
 	}
 }
 
-func TestFindPlan_UnknownPlan(t *testing.T) {
-	b, fakeBOSH, _ := newTestBroker("done", false)
-	defer fakeBOSH.Close()
-
-	plan := b.findPlan("unknown-plan")
-	if plan != nil {
-		t.Errorf("findPlan returned non-nil for unknown plan: %+v", plan)
+func TestFailInterruptedBindings(t *testing.T) {
+	inst := &Instance{ID: "inst-restart", Bindings: map[string]*Binding{
+		"done":      {ID: "done", GatewayToken: "tok"},
+		"wip":       {ID: "wip", State: bindingInProgress},
+		"deploying": {ID: "deploying", State: bindingInProgress, GatewayToken: "tok2", BoshTaskID: 42},
+	}}
+	failInterruptedBindings(inst)
+	if inst.Bindings["done"].State != "" {
+		t.Error("completed bindings should be left alone")
+	}
+	if inst.Bindings["deploying"].State != bindingInProgress {
+		t.Error("bindings with a deploy in flight should be left for last_operation to finish")
+	}
+	if wip := inst.Bindings["wip"]; wip.State != bindingFailed || wip.LastError == "" {
+		t.Errorf("interrupted binding = %+v, want failed with an error", wip)
 	}
 }
 
-func TestFindPlan_UsesConfigPlans(t *testing.T) {
-	fakeBOSH := newFakeBOSHDirector("done", false)
+func TestUnbind_RemovesOnlyThatBinding(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
 
-	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
-	cfg := BrokerConfig{
-		Plans: []Plan{
-			{ID: "custom-plan", Name: "custom", VMType: "micro", DiskType: "1GB"},
-		},
+	provisionInstance(t, router, "inst-unbind", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-unbind"].State = "ready"
+	b.mu.Unlock()
+
+	bindInstance(t, router, "inst-unbind", "bind-keep")
+	bindInstance(t, router, "inst-unbind", "bind-drop")
+
+	req := httptest.NewRequest("DELETE", "/v2/service_instances/inst-unbind/service_bindings/bind-drop", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Unbind status = %d, want %d", rr.Code, http.StatusOK)
 	}
-	b := New(cfg, director)
 
-	plan := b.findPlan("custom-plan")
-	if plan == nil {
-		t.Fatal("findPlan returned nil for custom config plan")
+	bindings := b.instances["inst-unbind"].Bindings
+	if _, ok := bindings["bind-drop"]; ok {
+		t.Error("bind-drop should be removed")
 	}
-	if plan.Name != "custom" {
-		t.Errorf("plan.Name = %q, want %q", plan.Name, "custom")
+	if _, ok := bindings["bind-keep"]; !ok {
+		t.Error("bind-keep should remain")
 	}
 
-	// Default plans should not be found when config plans are set
-	defaultPlan := b.findPlan("openclaw-developer-plan")
-	if defaultPlan != nil {
-		t.Error("findPlan should not return default plan when config plans are set")
+	// The manifest only carries live binding tokens
+	params := b.buildManifestParams(b.instances["inst-unbind"])
+	if len(params.BindingTokens) != 1 || params.BindingTokens[0] != bindings["bind-keep"].GatewayToken {
+		t.Errorf("BindingTokens = %v, want only bind-keep's token", params.BindingTokens)
 	}
 }
 
-// --- normalizePlans tests ---
+// --- Unbind tests ---
 
-func TestNormalizePlans_GeneratesIDFromName(t *testing.T) {
-	fakeBOSH := newFakeBOSHDirector("done", false)
+func TestUnbind_UnknownBindingReturnsGone(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
-	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
 
-	cfg := BrokerConfig{
-		Plans: []Plan{
-			{Name: "dedicated-agent", PlanDescription: "A dedicated agent", VMType: "small", DiskType: "10240"},
-		},
-	}
-	b := New(cfg, director)
+	req := httptest.NewRequest("DELETE", "/v2/service_instances/inst-any/service_bindings/bind-any", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
 
-	plan := b.findPlan("openclaw-dedicated-agent-plan")
-	if plan == nil {
-		t.Fatal("findPlan returned nil for auto-generated plan ID")
-	}
-	if plan.ID != "openclaw-dedicated-agent-plan" {
-		t.Errorf("plan.ID = %q, want %q", plan.ID, "openclaw-dedicated-agent-plan")
-	}
-	if plan.Description != "A dedicated agent" {
-		t.Errorf("plan.Description = %q, want %q", plan.Description, "A dedicated agent")
+	if rr.Code != http.StatusGone {
+		t.Errorf("Unbind status = %d, want %d", rr.Code, http.StatusGone)
 	}
 }
 
-func TestNormalizePlans_FallbackDescription(t *testing.T) {
-	plans := []Plan{
-		{Name: "test-plan"},
-	}
-	normalizePlans(plans)
-	if plans[0].Description != "OpenClaw test-plan plan" {
-		t.Errorf("Description = %q, want %q", plans[0].Description, "OpenClaw test-plan plan")
-	}
-}
+func TestUnbind_TracksRevocationDeploy(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("processing", false)
+	defer fakeBOSH.Close()
+	b, router := newBindTestBroker(fakeBOSH, "inst-revoking")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Unbind).Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{instance_id}/last_operation", b.LastOperation).Methods("GET")
+	b.mu.Lock()
+	inst := b.instances["inst-revoking"]
+	inst.BoshTaskID = 7
+	inst.Bindings = map[string]*Binding{"bind-old": {ID: "bind-old", GatewayToken: "old-token"}}
+	b.mu.Unlock()
 
-func TestNormalizePlans_PreservesExistingIDAndDescription(t *testing.T) {
-	plans := []Plan{
-		{Name: "custom", ID: "my-custom-id", Description: "My description"},
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/v2/service_instances/inst-revoking/service_bindings/bind-old", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Unbind status = %d, want 200", rr.Code)
 	}
-	normalizePlans(plans)
-	if plans[0].ID != "my-custom-id" {
-		t.Errorf("ID = %q, want %q (should not be overwritten)", plans[0].ID, "my-custom-id")
+	b.mu.RLock()
+	state, taskID := inst.State, inst.BoshTaskID
+	b.mu.RUnlock()
+	if state != "provisioning" || taskID != 42 {
+		t.Errorf("instance %s on task %d, want provisioning on the revocation task 42", state, taskID)
 	}
-	if plans[0].Description != "My description" {
-		t.Errorf("Description = %q, want %q (should not be overwritten)", plans[0].Description, "My description")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/service_instances/inst-revoking/last_operation", nil))
+	var op LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &op)
+	if op.State != "in progress" {
+		t.Errorf("last_operation during revocation = %q, want in progress", op.State)
 	}
 }
 
-// --- New() constructor tests ---
+func TestUnbind_RevokesAndIsIdempotent(t *testing.T) {
+	var manifests []string
+	boshServer := newFakeBOSHDirectorWith(fakeDirector{taskState: "done", manifests: &manifests})
+	defer boshServer.Close()
 
-func TestNew_ReturnsNonNil(t *testing.T) {
-	fakeBOSH := newFakeBOSHDirector("done", false)
-	defer fakeBOSH.Close()
-	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	director := bosh.NewClient(boshServer.URL, "admin", "admin", "", "")
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		StateDir:        t.TempDir(),
+	}, director)
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Bind).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Unbind).Methods("DELETE")
 
-	b := New(BrokerConfig{}, director)
-	if b == nil {
-		t.Fatal("New() returned nil")
+	provisionInstance(t, router, "inst-revoke", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-revoke"].State = "ready"
+	b.mu.Unlock()
+	revoked := bindInstance(t, router, "inst-revoke", "bind-leaked")["api_token"].(string)
+	deploysBefore := len(manifests)
+
+	req := httptest.NewRequest("DELETE", "/v2/service_instances/inst-revoke/service_bindings/bind-leaked", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("First unbind status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if _, ok := b.instances["inst-revoke"].Bindings["bind-leaked"]; ok {
+		t.Error("Binding should be removed after unbind")
 	}
-}
 
-func TestNew_InitializesInstancesMap(t *testing.T) {
-	fakeBOSH := newFakeBOSHDirector("done", false)
-	defer fakeBOSH.Close()
-	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	if len(manifests) != deploysBefore+1 {
+		t.Fatalf("Unbind should trigger one redeploy, got %d", len(manifests)-deploysBefore)
+	}
+	if strings.Contains(manifests[len(manifests)-1], revoked) {
+		t.Error("Redeployed manifest should not contain the revoked token")
+	}
 
-	b := New(BrokerConfig{}, director)
-	if b.instances == nil {
-		t.Error("instances map is nil")
+	// Removal is persisted
+	b2 := New(BrokerConfig{StateDir: b.config.StateDir}, director)
+	if _, ok := b2.instances["inst-revoke"].Bindings["bind-leaked"]; ok {
+		t.Error("Binding removal should be persisted")
 	}
-	if len(b.instances) != 0 {
-		t.Errorf("instances map length = %d, want 0", len(b.instances))
+
+	req = httptest.NewRequest("DELETE", "/v2/service_instances/inst-revoke/service_bindings/bind-leaked", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusGone {
+		t.Errorf("Second unbind status = %d, want %d", rr.Code, http.StatusGone)
 	}
 }
 
-// --- State persistence tests ---
+// --- LastOperation tests ---
 
-func TestStatePersistence_SaveAndLoad(t *testing.T) {
-	fakeBOSH := newFakeBOSHDirector("done", false)
+func TestLastOperation_ProvisioningDone(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
-	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
 
-	stateDir := t.TempDir()
-	cfg := BrokerConfig{
-		OpenClawVersion: "2026.2.21-2",
-		AZs:             []string{"z1"},
-		AppsDomain:      "apps.example.com",
-		StateDir:        stateDir,
+	provisionInstance(t, router, "inst-lo-done", "openclaw-developer-plan")
+
+	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-done/last_operation", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("LastOperation status = %d, want %d", rr.Code, http.StatusOK)
 	}
 
-	// Create broker and provision an instance
-	b1 := New(cfg, director)
-	b1.mu.Lock()
-	b1.instances["persist-001"] = &Instance{
-		ID:             "persist-001",
-		PlanID:         "openclaw-developer-plan",
-		PlanName:       "developer",
-		Owner:          "testuser",
-		DeploymentName: "openclaw-agent-persist-001",
-		GatewayToken:   "tok-abc",
-		NodeSeed:       "seed-xyz",
-		RouteHostname:  "oc-testuser-persist-001",
-		AppsDomain:     "apps.example.com",
-		VMType:         "small",
-		DiskType:       "10GB",
-		State:          "ready",
-		BoshTaskID:     42,
-		SSOEnabled:     true,
+	var resp LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+
+	if resp.State != "succeeded" {
+		t.Errorf("LastOperation state = %q, want %q", resp.State, "succeeded")
 	}
-	b1.mu.Unlock()
-	b1.saveState()
+}
 
-	// Create a new broker that loads state from disk
-	b2 := New(cfg, director)
+func TestLastOperation_WaitsForRouteBeforeReady(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.config.RouteReadyTimeout = 120
+	var routeServed atomic.Bool
+	var probed []string
+	b.SetRouteProbe(func(ctx context.Context, url string) error {
+		probed = append(probed, url)
+		if !routeServed.Load() {
+			return errors.New("unknown_route")
+		}
+		return nil
+	})
 
-	b2.mu.RLock()
-	inst, exists := b2.instances["persist-001"]
-	b2.mu.RUnlock()
+	provisionInstance(t, router, "inst-route", "openclaw-developer-plan")
+	lastOperation := func() LastOperationResponse {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/service_instances/inst-route/last_operation", nil))
+		var resp LastOperationResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp
+	}
 
-	if !exists {
-		t.Fatal("Instance should exist after loading state from disk")
+	if resp := lastOperation(); resp.State != "in progress" {
+		t.Fatalf("state = %q before the route is served, want in progress", resp.State)
 	}
-	if inst.Owner != "testuser" {
-		t.Errorf("Owner = %q, want %q", inst.Owner, "testuser")
+	if state := b.instances["inst-route"].State; state != stateDeployingRoute {
+		t.Errorf("instance state = %q, want %q", state, stateDeployingRoute)
 	}
-	if inst.GatewayToken != "tok-abc" {
-		t.Errorf("GatewayToken = %q, want %q", inst.GatewayToken, "tok-abc")
+	if len(probed) == 0 || !strings.HasPrefix(probed[0], "https://oc-dev-inst-route.apps.example.com") {
+		t.Errorf("probed %v, want the instance route", probed)
 	}
-	if inst.State != "ready" {
-		t.Errorf("State = %q, want %q", inst.State, "ready")
+
+	bodyBytes, _ := json.Marshal(BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v2/service_instances/inst-route/service_bindings/bind-early", bytes.NewReader(bodyBytes)))
+	if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "route is not registered") {
+		t.Errorf("bind before route registration = %d %s, want 422 naming the route", rr.Code, rr.Body.String())
 	}
-	if inst.SSOEnabled != true {
-		t.Error("SSOEnabled should be true")
+
+	routeServed.Store(true)
+	if resp := lastOperation(); resp.State != "succeeded" {
+		t.Fatalf("state = %q once the route is served, want succeeded", resp.State)
 	}
-	if inst.BoshTaskID != 42 {
-		t.Errorf("BoshTaskID = %d, want 42", inst.BoshTaskID)
+	if state := b.instances["inst-route"].State; state != "ready" {
+		t.Errorf("instance state = %q, want ready", state)
 	}
 }
 
-func TestStatePersistence_EmptyStateDir(t *testing.T) {
-	fakeBOSH := newFakeBOSHDirector("done", false)
+func TestLastOperation_RouteWaitTimesOut(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
-	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	b.config.RouteReadyTimeout = 60
+	b.SetRouteProbe(func(ctx context.Context, url string) error { return errors.New("unknown_route") })
 
-	// No StateDir set — persistence is disabled, should work fine
-	cfg := BrokerConfig{}
-	b := New(cfg, director)
-	if len(b.instances) != 0 {
-		t.Errorf("instances should be empty, got %d", len(b.instances))
+	provisionInstance(t, router, "inst-route-slow", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-route-slow"].State = stateDeployingRoute
+	b.instances["inst-route-slow"].RouteWaitSince = time.Now().Add(-2 * time.Minute)
+	b.mu.Unlock()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/service_instances/inst-route-slow/last_operation", nil))
+	var resp LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.State != "succeeded" || b.instances["inst-route-slow"].State != "ready" {
+		t.Errorf("state = %q (%s), want ready once the route wait times out", resp.State, b.instances["inst-route-slow"].State)
 	}
-	// saveState should be a no-op
-	b.saveState()
 }
 
-func TestStatePersistence_MissingFileOnLoad(t *testing.T) {
-	fakeBOSH := newFakeBOSHDirector("done", false)
-	defer fakeBOSH.Close()
-	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+func TestProbeRoute_UnknownRoute(t *testing.T) {
+	registered := false
+	gorouter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !registered {
+			w.Header().Set("X-Cf-Routererror", "unknown_route")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer gorouter.Close()
 
-	// StateDir exists but no instances.json yet — fresh start
-	cfg := BrokerConfig{StateDir: t.TempDir()}
-	b := New(cfg, director)
+	if err := probeRoute(context.Background(), gorouter.URL); err == nil {
+		t.Error("probeRoute should fail while the gorouter reports unknown_route")
+	}
+	registered = true
+	if err := probeRoute(context.Background(), gorouter.URL); err != nil {
+		t.Errorf("probeRoute = %v, want nil once the route is served", err)
+	}
+}
+
+func TestLastOperation_ProvisioningInProgress(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("processing", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-lo-prog", "openclaw-developer-plan")
+
+	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-prog/last_operation", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var resp LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+
+	if resp.State != "in progress" {
+		t.Errorf("LastOperation state = %q, want %q", resp.State, "in progress")
+	}
+}
+
+func TestLastOperation_ProvisioningError(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("error", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-lo-err", "openclaw-developer-plan")
+
+	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-err/last_operation", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var resp LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+
+	if resp.State != "failed" {
+		t.Errorf("LastOperation state = %q, want %q", resp.State, "failed")
+	}
+}
+
+func TestLastOperation_ProvisioningCancelled(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("cancelled", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-lo-cancel", "openclaw-developer-plan")
+
+	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-cancel/last_operation", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var resp LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+
+	if resp.State != "failed" {
+		t.Errorf("LastOperation state = %q, want %q", resp.State, "failed")
+	}
+}
+
+func TestLastOperation_InstanceNotFound(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	req := httptest.NewRequest("GET", "/v2/service_instances/inst-nonexistent/last_operation", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("LastOperation missing instance status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestLastOperation_ReadyState(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-lo-ready", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-lo-ready"].State = "ready"
+	b.mu.Unlock()
+
+	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-ready/last_operation", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var resp LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+
+	if resp.State != "succeeded" {
+		t.Errorf("LastOperation state = %q, want %q", resp.State, "succeeded")
+	}
+}
+
+func TestLastOperation_FailedState(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-lo-failed", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-lo-failed"].State = "failed"
+	b.mu.Unlock()
+
+	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-failed/last_operation", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var resp LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+
+	if resp.State != "failed" {
+		t.Errorf("LastOperation state = %q, want %q", resp.State, "failed")
+	}
+}
+
+func TestLastOperation_DeprovisioningDone(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-lo-dep-done", "openclaw-developer-plan")
+
+	// Simulate deprovisioning state
+	b.mu.Lock()
+	b.instances["inst-lo-dep-done"].State = "deprovisioning"
+	b.instances["inst-lo-dep-done"].BoshTaskID = 99
+	b.mu.Unlock()
+
+	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-dep-done/last_operation", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var resp LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+
+	if resp.State != "succeeded" {
+		t.Errorf("LastOperation deprovisioning done state = %q, want %q", resp.State, "succeeded")
+	}
+
+	// Instance should be deleted
+	b.mu.RLock()
+	_, exists := b.instances["inst-lo-dep-done"]
+	b.mu.RUnlock()
+	if exists {
+		t.Error("Instance should have been deleted after deprovisioning done")
+	}
+}
+
+func TestLastOperation_DeprovisioningDoneDeletesSSOClient(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	fakeUAA := newFakeUAA()
+	defer fakeUAA.Close()
+	b.config.SSOEnabled = true
+	b.config.StateDir = t.TempDir()
+	uaaClient := uaa.NewClient(fakeUAA.URL, "admin", "secret", "", false)
+	b.uaaClient = uaaClient
+
+	provisionInstance(t, router, "inst-lo-sso", "openclaw-developer-plan")
+	clientID := uaa.ClientIDForInstance("inst-lo-sso")
+	if !fakeUAA.hasClient(clientID) {
+		t.Fatal("provision should have registered the UAA client")
+	}
+
+	// UAA is unreachable when Deprovision runs, so its cleanup is skipped
+	b.uaaClient = nil
+	req := httptest.NewRequest("DELETE", "/v2/service_instances/inst-lo-sso?accepts_incomplete=true", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	b.uaaClient = uaaClient
+
+	req = httptest.NewRequest("GET", "/v2/service_instances/inst-lo-sso/last_operation", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var resp LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.State != "succeeded" {
+		t.Fatalf("state = %q, want succeeded", resp.State)
+	}
+	if _, exists := b.instances["inst-lo-sso"]; exists {
+		t.Error("instance should be deleted after deprovisioning done")
+	}
+	if fakeUAA.hasClient(clientID) {
+		t.Error("UAA client should be deleted after deprovisioning done")
+	}
+	if _, err := os.Stat(b.instanceStatePath("inst-lo-sso")); !os.IsNotExist(err) {
+		t.Errorf("state file should be removed, stat err = %v", err)
+	}
+}
+
+func TestLastOperation_DeprovisioningDoneWithoutUAAClient(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	// SSO client recorded on the instance but no UAA configured: must not panic
+	b.instances["inst-lo-nouaa"] = &Instance{
+		ID:          "inst-lo-nouaa",
+		State:       "deprovisioning",
+		BoshTaskID:  99,
+		SSOClientID: uaa.ClientIDForInstance("inst-lo-nouaa"),
+	}
+	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-nouaa/last_operation", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if _, exists := b.instances["inst-lo-nouaa"]; exists {
+		t.Error("instance should be deleted after deprovisioning done")
+	}
+}
+
+func TestLastOperation_DeprovisioningInProgress(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("processing", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-lo-dep-prog", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-lo-dep-prog"].State = "deprovisioning"
+	b.mu.Unlock()
+
+	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-dep-prog/last_operation", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var resp LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+
+	if resp.State != "in progress" {
+		t.Errorf("LastOperation deprovisioning in progress state = %q, want %q", resp.State, "in progress")
+	}
+}
+
+func TestLastOperation_DeprovisioningError(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("error", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-lo-dep-err", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-lo-dep-err"].State = "deprovisioning"
+	b.mu.Unlock()
+
+	req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-dep-err/last_operation", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var resp LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+
+	if resp.State != "failed" {
+		t.Errorf("LastOperation deprovisioning error state = %q, want %q", resp.State, "failed")
+	}
+}
+
+// --- Update tests ---
+
+func TestUpdate_ChangePlan(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-update", "openclaw-developer-plan")
+
+	body := UpdateRequest{
+		ServiceID: "openclaw-service",
+		PlanID:    "openclaw-team-plan",
+	}
+	bodyBytes, _ := json.Marshal(body)
+	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-update?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Update status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+
+	b.mu.RLock()
+	inst := b.instances["inst-update"]
+	b.mu.RUnlock()
+
+	if inst.PlanID != "openclaw-team-plan" {
+		t.Errorf("PlanID = %q, want %q", inst.PlanID, "openclaw-team-plan")
+	}
+	if inst.PlanName != "team" {
+		t.Errorf("PlanName = %q, want %q", inst.PlanName, "team")
+	}
+	if inst.VMType != "large" {
+		t.Errorf("VMType = %q, want %q after plan change", inst.VMType, "large")
+	}
+	if inst.DiskType != "50GB" {
+		t.Errorf("DiskType = %q, want %q after plan change", inst.DiskType, "50GB")
+	}
+	if inst.State != "provisioning" {
+		t.Errorf("State = %q, want %q after re-deploy", inst.State, "provisioning")
+	}
+}
+
+func TestUpdate_PlanChangeRespectsTotalMemoryQuota(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.config.MaxTotalMemoryMB = 12288
+
+	provisionInstance(t, router, "inst-mem-dev", "openclaw-developer-plan")
+	provisionInstance(t, router, "inst-mem-team", "openclaw-team-plan")
+	provisionInstance(t, router, "inst-mem-dev-2", "openclaw-developer-plan")
+
+	update := func(id, planID string) *httptest.ResponseRecorder {
+		bodyBytes, _ := json.Marshal(UpdateRequest{ServiceID: "openclaw-service", PlanID: planID})
+		req := httptest.NewRequest("PATCH", "/v2/service_instances/"+id+"?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// developer -> developer-plus adds 2048 MB past the cap
+	if rr := update("inst-mem-dev", "openclaw-developer-plus-plan"); rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("upsize status = %d, want %d. Body: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body.String())
+	}
+	if plan := b.instances["inst-mem-dev"].PlanID; plan != "openclaw-developer-plan" {
+		t.Errorf("rejected update changed PlanID to %q", plan)
+	}
+
+	// team -> developer frees memory and is always allowed
+	if rr := update("inst-mem-team", "openclaw-developer-plan"); rr.Code != http.StatusAccepted {
+		t.Fatalf("downsize status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+
+	// Now the upsize fits: 2048*3 + 2048 <= 12288
+	if rr := update("inst-mem-dev", "openclaw-developer-plus-plan"); rr.Code != http.StatusAccepted {
+		t.Errorf("upsize after downsize status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+}
+
+func TestUpdate_PlanChangeRespectsAllowedUpdates(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.config.Plans = defaultPlans()
+	b.config.Plans[0].AllowedUpdates = []string{"developer-plus", "openclaw-team-plan"} // developer
+	b.config.Plans[2].AllowedUpdates = []string{"developer-plus"}                       // team
+
+	provisionInstance(t, router, "inst-up", "openclaw-developer-plan")
+	provisionInstance(t, router, "inst-down", "openclaw-team-plan")
+
+	update := func(id, planID string) *httptest.ResponseRecorder {
+		bodyBytes, _ := json.Marshal(UpdateRequest{ServiceID: "openclaw-service", PlanID: planID})
+		req := httptest.NewRequest("PATCH", "/v2/service_instances/"+id+"?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Allowed by ID
+	if rr := update("inst-up", "openclaw-team-plan"); rr.Code != http.StatusAccepted {
+		t.Fatalf("developer -> team status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+
+	rr := update("inst-down", "openclaw-developer-plan")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("team -> developer status = %d, want %d. Body: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body.String())
+	}
+	var resp map[string]string
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["error"] != "PlanChangeNotAllowed" || !strings.Contains(resp["description"], "allowed plans: developer-plus") {
+		t.Errorf("body = %v, want PlanChangeNotAllowed listing the allowed plans", resp)
+	}
+	if plan := b.instances["inst-down"].PlanID; plan != "openclaw-team-plan" {
+		t.Errorf("rejected update changed PlanID to %q", plan)
+	}
+
+	// Allowed by name
+	if rr := update("inst-down", "openclaw-developer-plus-plan"); rr.Code != http.StatusAccepted {
+		t.Errorf("team -> developer-plus status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+}
+
+func TestUpdate_AppsDomainChangeRotatesSSORedirect(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	fakeUAA := newFakeUAA()
+	defer fakeUAA.Close()
+	b.config.SSOEnabled = true
+	b.uaaClient = uaa.NewClient(fakeUAA.URL, "admin", "secret", "", false)
+
+	provisionInstance(t, router, "inst-domain", "openclaw-developer-plan")
+	clientID := uaa.ClientIDForInstance("inst-domain")
+	route := b.instances["inst-domain"].RouteHostname
+
+	update := func() {
+		bodyBytes, _ := json.Marshal(UpdateRequest{ServiceID: "openclaw-service"})
+		req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-domain?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("Update status = %d, want %d", rr.Code, http.StatusAccepted)
+		}
+	}
+
+	// Domain migration: the broker now serves a new apps domain
+	b.config.AppsDomain = "apps.new.example.com"
+	update()
+
+	if got := b.instances["inst-domain"].AppsDomain; got != "apps.new.example.com" {
+		t.Errorf("AppsDomain = %q, want apps.new.example.com", got)
+	}
+	want := "https://" + route + ".apps.new.example.com/oauth2/callback"
+	if got := fakeUAA.redirectURIs(clientID); len(got) != 1 || got[0] != want {
+		t.Errorf("redirect_uri = %v, want [%s]", got, want)
+	}
+
+	// A second update with no domain change leaves the registration alone
+	update()
+	if got := fakeUAA.redirectURIs(clientID); len(got) != 1 || got[0] != want {
+		t.Errorf("redirect_uri after no-op = %v, want [%s]", got, want)
+	}
+}
+
+func TestUpdate_SamePlanRedeploys(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-same-plan", "openclaw-developer-plan")
+
+	b.mu.Lock()
+	b.instances["inst-same-plan"].State = "ready"
+	b.mu.Unlock()
+
+	body := UpdateRequest{
+		ServiceID: "openclaw-service",
+		PlanID:    "openclaw-developer-plan", // same plan
+	}
+	bodyBytes, _ := json.Marshal(body)
+	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-same-plan?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	// The fake Director reports no deployed manifest, so there is nothing to
+	// compare against and the update redeploys
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Update same plan status = %d, want %d", rr.Code, http.StatusAccepted)
+	}
+
+	b.mu.RLock()
+	inst := b.instances["inst-same-plan"]
+	b.mu.RUnlock()
+
+	if inst.State != "provisioning" {
+		t.Errorf("State = %q, want %q (redeploy should reset state)", inst.State, "provisioning")
+	}
+}
+
+func TestUpdate_SkipsRedeployWhenManifestUnchanged(t *testing.T) {
+	var manifests []string
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{manifests: &manifests, serveManifest: true})
+	defer fakeBOSH.Close()
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+	}, bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", ""))
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", b.Update).Methods("PATCH")
+
+	provisionInstance(t, router, "inst-nochange", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-nochange"].State = "ready"
+	b.mu.Unlock()
+
+	update := func(query, planID string) *httptest.ResponseRecorder {
+		bodyBytes, _ := json.Marshal(UpdateRequest{ServiceID: "openclaw-service", PlanID: planID})
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PATCH", "/v2/service_instances/inst-nochange?accepts_incomplete=true"+query, bytes.NewReader(bodyBytes)))
+		return rr
+	}
+
+	if rr := update("", "openclaw-developer-plan"); rr.Code != http.StatusOK {
+		t.Fatalf("unchanged update status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+	if got := len(manifests); got != 1 {
+		t.Errorf("deploys = %d, want only the provision deploy", got)
+	}
+	if state := b.instances["inst-nochange"].State; state != "ready" {
+		t.Errorf("State = %q, want ready after a skipped redeploy", state)
+	}
+
+	if rr := update("&force=true", "openclaw-developer-plan"); rr.Code != http.StatusAccepted {
+		t.Fatalf("forced update status = %d, want 202: %s", rr.Code, rr.Body.String())
+	}
+	if got := len(manifests); got != 2 {
+		t.Errorf("deploys = %d, want force=true to redeploy", got)
+	}
+}
+
+func TestUpdate_RedeploysWhenManifestChanged(t *testing.T) {
+	var manifests []string
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{manifests: &manifests, serveManifest: true})
+	defer fakeBOSH.Close()
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+	}, bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", ""))
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", b.Update).Methods("PATCH")
+
+	provisionInstance(t, router, "inst-changed", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-changed"].State = "ready"
+	b.mu.Unlock()
+
+	bodyBytes, _ := json.Marshal(UpdateRequest{ServiceID: "openclaw-service", PlanID: "openclaw-team-plan"})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PATCH", "/v2/service_instances/inst-changed?accepts_incomplete=true", bytes.NewReader(bodyBytes)))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("plan change status = %d, want 202: %s", rr.Code, rr.Body.String())
+	}
+	if got := len(manifests); got != 2 {
+		t.Errorf("deploys = %d, want the changed manifest redeployed", got)
+	}
+}
+
+func TestUpdate_OrphanRecovery(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	// Instance not in broker memory — should trigger orphan recovery and redeploy
+	body := UpdateRequest{
+		ServiceID: "openclaw-service",
+		PlanID:    "openclaw-team-plan",
+	}
+	bodyBytes, _ := json.Marshal(body)
+	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-orphan?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Update orphan recovery status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+
+	// Verify instance was created with recovery data
+	b.mu.RLock()
+	inst, exists := b.instances["inst-orphan"]
+	b.mu.RUnlock()
+
+	if !exists {
+		t.Fatal("Instance should exist after orphan recovery")
+	}
+	if inst.DeploymentName != "openclaw-agent-inst-orphan" {
+		t.Errorf("DeploymentName = %q, want %q", inst.DeploymentName, "openclaw-agent-inst-orphan")
+	}
+	if inst.Owner != "recovered" {
+		t.Errorf("Owner = %q, want %q", inst.Owner, "recovered")
+	}
+	if inst.PlanID != "openclaw-team-plan" {
+		t.Errorf("PlanID = %q, want %q", inst.PlanID, "openclaw-team-plan")
+	}
+	if inst.State != "provisioning" {
+		t.Errorf("State = %q, want %q", inst.State, "provisioning")
+	}
+	if inst.GatewayToken == "" {
+		t.Error("GatewayToken should not be empty after recovery")
+	}
+}
+
+func TestUpdate_InvalidJSON(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-bad?accepts_incomplete=true", bytes.NewReader([]byte("{bad")))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Update bad JSON status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestUpdate_BOSHDeployFailure(t *testing.T) {
+	// Create a BOSH server where deploy succeeds on first call but fails on second
+	callCount := 0
+	boshServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/deployments":
+			callCount++
+			if callCount > 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("deploy error"))
+				return
+			}
+			w.Header().Set("Location", "/tasks/42")
+			w.WriteHeader(http.StatusFound)
+		case r.Method == "GET" && len(r.URL.Path) > len("/tasks/"):
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"state": "done"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer boshServer.Close()
+
+	director := bosh.NewClient(boshServer.URL, "admin", "admin", "", "")
+	cfg := BrokerConfig{
+		MinOpenClawVersion: "2026.1.29",
+		SandboxMode:        "strict",
+		OpenClawVersion:    "2026.2.21-2",
+		AZs:                []string{"z1"},
+		AppsDomain:         "apps.example.com",
+	}
+	b := New(cfg, director)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Update).Methods("PATCH")
+
+	// Provision first (succeeds)
+	provisionInstance(t, r, "inst-upd-fail", "openclaw-developer-plan")
+
+	// Now update (deploy will fail on second call)
+	body := UpdateRequest{
+		ServiceID: "openclaw-service",
+		PlanID:    "openclaw-team-plan",
+	}
+	bodyBytes, _ := json.Marshal(body)
+	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-upd-fail?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("Update BOSH failure status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestUpdate_EmptyPlanIDStillRedeploys(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-empty-plan", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-empty-plan"].State = "ready"
+	b.mu.Unlock()
+
+	body := UpdateRequest{
+		ServiceID: "openclaw-service",
+		PlanID:    "", // empty plan ID
+	}
+	bodyBytes, _ := json.Marshal(body)
+	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-empty-plan?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	// Empty plan ID still triggers a redeploy to refresh the instance
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Update empty plan status = %d, want %d", rr.Code, http.StatusAccepted)
+	}
+
+	b.mu.RLock()
+	inst := b.instances["inst-empty-plan"]
+	b.mu.RUnlock()
+
+	if inst.State != "provisioning" {
+		t.Errorf("State = %q, want %q (redeploy should reset state)", inst.State, "provisioning")
+	}
+}
+
+// --- ManifestParams tests ---
+
+func TestProvision_LLMConfigFlowsToManifest(t *testing.T) {
+	// Verify that GenAI config is included in manifest params
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	cfg := BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		LLMProvider:     "genai",
+		LLMEndpoint:     "https://genai.example.com",
+		LLMAPIKey:       "test-key",
+		LLMModel:        "gpt-4",
+		BlockedCommands: "rm -rf /,dd if=/dev/zero",
+	}
+	b := New(cfg, director)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+
+	rr := provisionInstance(t, r, "inst-llm", "openclaw-developer-plan")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Provision failed: %d, body: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestManifest_BlockedCommandsMergeWithSandboxDefaults(t *testing.T) {
+	manifest := renderLLMManifest(t, BrokerConfig{
+		SandboxMode:     "moderate",
+		BlockedCommands: "curl\nrm -rf / , wget,curl",
+	})
+	assertManifestContains(t, manifest,
+		"              blocked_commands:\n"+
+			"                - \"rm -rf /\"\n"+
+			"                - \"rm -rf /*\"\n"+
+			"                - \":(){ :|:& };:\"\n"+
+			"                - \"dd if=/dev/zero\"\n"+
+			"                - \"mkfs\"\n"+
+			"                - \"curl\"\n"+
+			"                - \"wget\"\n"+
+			"            webchat:",
+	)
+	if strings.Contains(manifest, "allowed_commands") {
+		t.Error("blocklist mode should not render allowed_commands")
+	}
+}
+
+func TestManifest_BlockedCommandsDefaultWithoutOperatorList(t *testing.T) {
+	manifest := renderLLMManifest(t, BrokerConfig{})
+	assertManifestContains(t, manifest, "              blocked_commands:\n", `- "shutdown"`)
+}
+
+func TestManifest_AllowlistMode(t *testing.T) {
+	manifest := renderLLMManifest(t, BrokerConfig{
+		CommandPolicyMode: CommandPolicyAllowlist,
+		AllowedCommands:   "git, ls\nls\ncat",
+		BlockedCommands:   "curl",
+	})
+	assertManifestContains(t, manifest,
+		"              allowed_commands:\n                - \"git\"\n                - \"ls\"\n                - \"cat\"\n",
+	)
+	if strings.Contains(manifest, "blocked_commands") {
+		t.Error("allowlist mode should not render blocked_commands")
+	}
+
+	// An empty allowlist still renders, allowing nothing
+	manifest = renderLLMManifest(t, BrokerConfig{CommandPolicyMode: CommandPolicyAllowlist})
+	assertManifestContains(t, manifest, "              allowed_commands: []\n")
+}
+
+func TestManifest_SandboxMode(t *testing.T) {
+	for mode, want := range map[string]string{
+		"":         "strict",
+		"strict":   "strict",
+		"moderate": "moderate",
+		"loose":    "loose",
+		"strct":    "strict",
+	} {
+		manifest := renderLLMManifest(t, BrokerConfig{SandboxMode: mode})
+		if !strings.Contains(manifest, "              sandbox_mode: "+want+"\n") {
+			t.Errorf("sandbox mode %q: manifest should render sandbox_mode %s", mode, want)
+		}
+	}
+}
+
+func TestManifest_VMResources(t *testing.T) {
+	plans := []Plan{{Name: "developer", ID: "openclaw-developer-plan", VMType: "small", DiskType: "10GB", CPU: 2, Memory: 2048}}
+	manifest := renderLLMManifest(t, BrokerConfig{Plans: plans, UseVMResources: true})
+	assertManifestContains(t, manifest,
+		"    vm_resources:\n      cpu: 2\n      ram: 2048\n      ephemeral_disk_size: 10240\n    stemcell:",
+	)
+	if strings.Contains(manifest, "vm_type:") {
+		t.Error("vm_resources manifest should not render vm_type")
+	}
+
+	plans[0].EphemeralDiskMB = 20480
+	manifest = renderLLMManifest(t, BrokerConfig{Plans: plans, UseVMResources: true})
+	assertManifestContains(t, manifest, "      ephemeral_disk_size: 20480\n")
+}
+
+func TestManifest_VMTypeByDefault(t *testing.T) {
+	plans := []Plan{{Name: "developer", ID: "openclaw-developer-plan", VMType: "small", DiskType: "10GB", CPU: 2, Memory: 2048}}
+	for name, cfg := range map[string]BrokerConfig{
+		"vm_resources disabled": {Plans: plans},
+		"plan without cpu":      {UseVMResources: true},
+	} {
+		manifest := renderLLMManifest(t, cfg)
+		if !strings.Contains(manifest, "    vm_type: small\n") || strings.Contains(manifest, "vm_resources") {
+			t.Errorf("%s: manifest should render vm_type small without vm_resources:\n%s", name, manifest)
+		}
+	}
+}
+
+// renderLLMManifest renders the manifest for a ready instance under cfg's LLM settings.
+func renderLLMManifest(t *testing.T, cfg BrokerConfig) string {
+	t.Helper()
+	cfg.OpenClawVersion = "2026.2.21-2"
+	cfg.AZs = []string{"z1"}
+	cfg.AppsDomain = "apps.example.com"
+	b := New(cfg, nil)
+	instance := &Instance{
+		ID: "inst-llm", PlanID: "openclaw-developer-plan", PlanName: "developer",
+		DeploymentName: "openclaw-agent-inst-llm", VMType: "small", DiskType: "10GB",
+		AppsDomain: "apps.example.com",
+	}
+	manifest, err := bosh.RenderAgentManifest(b.buildManifestParams(instance))
+	if err != nil {
+		t.Fatalf("RenderAgentManifest: %v", err)
+	}
+	return string(manifest)
+}
+
+func assertManifestContains(t *testing.T, manifest string, wants ...string) {
+	t.Helper()
+	for _, want := range wants {
+		if !strings.Contains(manifest, want) {
+			t.Errorf("manifest missing %q:\n%s", want, manifest)
+		}
+	}
+}
+
+func TestManifest_OpenAIProvider(t *testing.T) {
+	manifest := renderLLMManifest(t, BrokerConfig{
+		LLMProvider:    "openai",
+		LLMAPIKey:      "sk-openai",
+		LLMModel:       "gpt-4o",
+		LLMExtraParams: map[string]string{"organization": "org-123"},
+	})
+	assertManifestContains(t, manifest,
+		"              openai:\n",
+		`                api_key: "sk-openai"`,
+		`                model: "gpt-4o"`,
+		`                organization: "org-123"`,
+	)
+	if strings.Contains(manifest, "genai:") {
+		t.Error("openai provider should not render a genai block")
+	}
+}
+
+func TestManifest_AnthropicProvider(t *testing.T) {
+	manifest := renderLLMManifest(t, BrokerConfig{
+		LLMProvider: "anthropic",
+		LLMAPIKey:   "sk-ant",
+		LLMModel:    "claude-sonnet-4-5",
+	})
+	assertManifestContains(t, manifest,
+		"              anthropic:\n",
+		`                api_key: "sk-ant"`,
+		`                model: "claude-sonnet-4-5"`,
+	)
+}
+
+func TestManifest_AzureOpenAIProvider(t *testing.T) {
+	manifest := renderLLMManifest(t, BrokerConfig{
+		LLMProvider: "azure_openai",
+		LLMEndpoint: "https://example.openai.azure.com",
+		LLMAPIKey:   "azure-key",
+		LLMExtraParams: map[string]string{
+			"deployment_name": "gpt4o-prod",
+			"api_version":     "2024-10-21",
+			"Bad Key":         "dropped",
+		},
+	})
+	assertManifestContains(t, manifest,
+		"              azure:\n",
+		`                api_base: "https://example.openai.azure.com"`,
+		`                api_key: "azure-key"`,
+		`                deployment_name: "gpt4o-prod"`,
+		`                api_version: "2024-10-21"`,
+	)
+	if strings.Contains(manifest, "Bad Key") {
+		t.Error("extra params with invalid keys should be dropped")
+	}
+}
+
+func TestManifest_GenAIProviderUnchanged(t *testing.T) {
+	manifest := renderLLMManifest(t, BrokerConfig{
+		LLMProvider:    "tanzu_genai",
+		LLMEndpoint:    "https://genai.example.com",
+		LLMAPIKey:      "genai-key",
+		LLMModel:       "auto",
+		LLMExtraParams: map[string]string{"organization": "ignored"},
+	})
+	assertManifestContains(t, manifest,
+		"              genai:\n",
+		`                endpoint: "https://genai.example.com"`,
+		`                api_key: "genai-key"`,
+		`                model: "auto"`,
+	)
+	if strings.Contains(manifest, "organization") {
+		t.Error("genai provider should not render extra params")
+	}
+}
+
+func TestManifest_GenerationParamsAllSet(t *testing.T) {
+	temp, topP := 0.0, 3.5 // zero temperature is meaningful; top_p is out of range
+	planTemp := 0.2
+	manifest := renderLLMManifest(t, BrokerConfig{
+		LLMProvider:    "openai",
+		LLMAPIKey:      "sk-openai",
+		LLMTemperature: &temp,
+		LLMMaxTokens:   4096,
+		LLMTopP:        &topP,
+		Plans: []Plan{{
+			ID: "openclaw-developer-plan", Name: "developer", VMType: "small", DiskType: "10GB",
+			LLMTemperature: &planTemp,
+		}},
+	})
+	assertManifestContains(t, manifest,
+		"              temperature: 0.2\n",
+		"              max_tokens: 4096\n",
+		"              top_p: 1\n",
+	)
+}
+
+func TestManifest_GenerationParamsNoneSet(t *testing.T) {
+	manifest := renderLLMManifest(t, BrokerConfig{
+		LLMProvider: "openai",
+		LLMAPIKey:   "sk-openai",
+	})
+	for _, key := range []string{"temperature:", "max_tokens:", "top_p:"} {
+		if strings.Contains(manifest, key) {
+			t.Errorf("manifest should not contain %q when unset", key)
+		}
+	}
+}
+
+func TestProvision_InvalidManifestYAMLFailsBeforeDeploy(t *testing.T) {
+	deploys := 0
+	fakeBOSH := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && r.URL.Path == "/deployments" {
+			deploys++
+			w.Header().Set("Location", "/tasks/42")
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer fakeBOSH.Close()
+
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		Plans: []Plan{{
+			// vm_type is rendered unquoted, so an embedded newline breaks the document
+			ID: "broken-plan", Name: "broken", VMType: "small\n  oops: [", DiskType: "10GB",
+		}},
+	}, director)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+
+	rr := provisionInstance(t, r, "inst-bad-yaml", "broken-plan")
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d. Body: %s", rr.Code, http.StatusInternalServerError, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), "Failed to render deployment manifest") {
+		t.Errorf("body = %s, want render failure", rr.Body.String())
+	}
+	if deploys != 0 {
+		t.Errorf("Director received %d deploys, want 0", deploys)
+	}
+	if _, exists := b.instances["inst-bad-yaml"]; exists {
+		t.Error("instance should not be recorded after a render failure")
+	}
+}
+
+func TestManifest_CustomTemplateFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent-manifest.yml")
+	custom := "---\nname: {{ .DeploymentName }}\n# custom-template-marker\nowner: \"{{ .Owner }}\"\n"
+	if err := os.WriteFile(path, []byte(custom), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := New(BrokerConfig{OpenClawVersion: "2026.2.21-2", ManifestTemplatePath: path}, nil)
+	instance := &Instance{ID: "inst-custom", DeploymentName: "openclaw-agent-inst-custom", Owner: `dev"@example.com`}
+
+	manifest, err := bosh.RenderAgentManifest(b.buildManifestParams(instance))
+	if err != nil {
+		t.Fatalf("RenderAgentManifest: %v", err)
+	}
+	assertManifestContains(t, string(manifest),
+		"# custom-template-marker",
+		"name: openclaw-agent-inst-custom",
+		`owner: "dev\"@example.com"`, // still sanitized
+	)
+}
+
+func TestManifest_MissingTemplateFileFallsBackToBuiltIn(t *testing.T) {
+	manifest := renderLLMManifest(t, BrokerConfig{
+		ManifestTemplatePath: filepath.Join(t.TempDir(), "does-not-exist.yml"),
+	})
+	assertManifestContains(t, manifest,
+		"name: openclaw-agent-inst-llm",
+		"instance_groups:",
+	)
+}
+
+func TestManifest_VMExtensions(t *testing.T) {
+	manifest := renderLLMManifest(t, BrokerConfig{
+		Plans: []Plan{{
+			ID: "openclaw-developer-plan", Name: "developer", VMType: "small", DiskType: "10GB",
+			VMExtensions: []string{"agent-lb", "agent-sg"},
+		}},
+	})
+	assertManifestContains(t, manifest, "    vm_type: small\n    vm_extensions: [\"agent-lb\", \"agent-sg\"]\n")
+
+	manifest = renderLLMManifest(t, BrokerConfig{})
+	if strings.Contains(manifest, "vm_extensions") {
+		t.Error("vm_extensions should be omitted when the plan has none")
+	}
+}
+
+func TestManifest_SingleNetworkBackwardCompatible(t *testing.T) {
+	manifest := renderLLMManifest(t, BrokerConfig{Network: "openclaw-agents"})
+	assertManifestContains(t, manifest, "    networks:\n      - name: openclaw-agents\n\n")
+}
+
+func TestManifest_MultipleNetworksFromPlan(t *testing.T) {
+	manifest := renderLLMManifest(t, BrokerConfig{
+		Network: "openclaw-agents",
+		Plans: []Plan{{
+			ID: "openclaw-developer-plan", Name: "developer", VMType: "small", DiskType: "10GB",
+			Networks: []bosh.NetworkConfig{
+				{Name: "openclaw-agents", Default: []string{"dns", "gateway"}},
+				{Name: "egress", StaticIPs: []string{"10.0.8.10"}},
+			},
+		}},
+	})
+	assertManifestContains(t, manifest,
+		"      - name: openclaw-agents\n        default: [dns, gateway]\n",
+		"      - name: egress\n        static_ips: [10.0.8.10]\n",
+	)
+}
+
+func TestManifest_DefaultPorts(t *testing.T) {
+	manifest := renderLLMManifest(t, BrokerConfig{})
+	assertManifestContains(t, manifest,
+		"            gateway:\n              port: 18789\n",
+		"            webchat:\n              port: 8080\n              sso_port: 8081\n",
+		"                port: 8080\n                uris:\n",
+	)
+}
+
+func TestManifest_CustomPorts(t *testing.T) {
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		GatewayPort:     28789,
+		WebchatPort:     9080,
+		WebchatSSOPort:  9081,
+	}, nil)
+	instance := &Instance{
+		ID: "inst-ports", PlanID: "openclaw-developer-plan", PlanName: "developer",
+		DeploymentName: "openclaw-agent-inst-ports", VMType: "small", DiskType: "10GB",
+		AppsDomain: "apps.example.com", SSOEnabled: true, SSOClientID: "openclaw-inst-ports",
+	}
+	manifest, err := bosh.RenderAgentManifest(b.buildManifestParams(instance))
+	if err != nil {
+		t.Fatalf("RenderAgentManifest: %v", err)
+	}
+	assertManifestContains(t, string(manifest),
+		"            gateway:\n              port: 28789\n",
+		"            webchat:\n              port: 9080\n              sso_port: 9081\n",
+		"              listen_port: 9080\n              upstream_port: 9081\n",
+		"                port: 9080\n                uris:\n",
+	)
+	for _, old := range []string{"18789", "8080", "8081"} {
+		if strings.Contains(string(manifest), old) {
+			t.Errorf("manifest still contains default port %s", old)
+		}
+	}
+}
+
+func newStaticIPTestBroker(t *testing.T, fakeBOSH *httptest.Server, pool ...string) (*Broker, *mux.Router) {
+	t.Helper()
+	t.Cleanup(fakeBOSH.Close)
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		Network:         "openclaw-agents",
+		Plans: []Plan{{
+			ID: "openclaw-developer-plan", Name: "developer", VMType: "small", DiskType: "10GB",
+			StaticIPs: pool,
+		}},
+	}, director)
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Deprovision).Methods("DELETE")
+	r.HandleFunc("/v2/service_instances/{instance_id}/last_operation", b.LastOperation).Methods("GET")
+	return b, r
+}
+
+func TestProvision_AssignsStaticIPFromPlanPool(t *testing.T) {
+	var manifests, deletes []string
+	b, r := newStaticIPTestBroker(t, newFakeBOSHDirectorWith(fakeDirector{manifests: &manifests, deletes: &deletes}), "10.0.8.10", "10.0.8.11")
+
+	for _, id := range []string{"inst-ip-1", "inst-ip-2"} {
+		if rr := provisionInstance(t, r, id, "openclaw-developer-plan"); rr.Code != http.StatusAccepted {
+			t.Fatalf("Provision %s failed: %d %s", id, rr.Code, rr.Body.String())
+		}
+	}
+	if got := b.instances["inst-ip-1"].StaticIP; got != "10.0.8.10" {
+		t.Errorf("inst-ip-1 StaticIP = %q, want 10.0.8.10", got)
+	}
+	if got := b.instances["inst-ip-2"].StaticIP; got != "10.0.8.11" {
+		t.Errorf("inst-ip-2 StaticIP = %q, want 10.0.8.11", got)
+	}
+	assertManifestContains(t, manifests[1], "      - name: openclaw-agents\n        static_ips: [10.0.8.11]\n")
+
+	// Plan config is copied, not mutated, when rendering the reserved IP
+	if len(b.config.Plans[0].Networks) != 0 {
+		t.Errorf("plan networks mutated: %+v", b.config.Plans[0].Networks)
+	}
+}
+
+func TestOSBErrorBodies(t *testing.T) {
+	b, fakeBOSH, r := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.instances["inst-ready"] = &Instance{ID: "inst-ready", PlanID: "openclaw-developer-plan", State: "ready", DeploymentName: "openclaw-agent-inst-ready",
+		OpenClawVersion: b.config.OpenClawVersion, Bindings: map[string]*Binding{"bind-1": {ID: "bind-1", RequestHash: "other"}}}
+	b.instances["inst-busy"] = &Instance{ID: "inst-busy", PlanID: "openclaw-developer-plan", State: "provisioning", DeploymentName: "openclaw-agent-inst-busy"}
+	b.instances["inst-failed"] = &Instance{ID: "inst-failed", PlanID: "openclaw-developer-plan", State: "failed", DeploymentName: "openclaw-agent-inst-failed"}
+	b.instances["inst-binding"] = &Instance{ID: "inst-binding", PlanID: "openclaw-developer-plan", State: "ready", DeploymentName: "openclaw-agent-inst-binding",
+		Bindings: map[string]*Binding{"bind-1": {ID: "bind-1", State: bindingInProgress}}}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"provision sync", "PUT", "/v2/service_instances/inst-new", `{}`, http.StatusUnprocessableEntity, "AsyncRequired"},
+		{"provision malformed body", "PUT", "/v2/service_instances/inst-new?accepts_incomplete=true", `{`, http.StatusBadRequest, "BadRequest"},
+		{"provision bad ID", "PUT", "/v2/service_instances/bad$id?accepts_incomplete=true", `{}`, http.StatusBadRequest, "BadRequest"},
+		{"provision unknown plan", "PUT", "/v2/service_instances/inst-new?accepts_incomplete=true", `{"plan_id":"nope"}`, http.StatusBadRequest, "UnknownPlan"},
+		{"provision existing", "PUT", "/v2/service_instances/inst-ready?accepts_incomplete=true", `{"plan_id":"openclaw-developer-plan"}`, http.StatusConflict, "InstanceAlreadyExists"},
+		{"provision invalid parameters", "PUT", "/v2/service_instances/inst-new?accepts_incomplete=true", `{"plan_id":"openclaw-developer-plan","parameters":{"bogus":1}}`, http.StatusBadRequest, "InvalidParameters"},
+		{"update maintenance_info", "PATCH", "/v2/service_instances/inst-ready?accepts_incomplete=true", `{"maintenance_info":{"version":"2099.1.1"}}`, http.StatusUnprocessableEntity, "MaintenanceInfoConflict"},
+		{"update unknown plan", "PATCH", "/v2/service_instances/inst-ready?accepts_incomplete=true", `{"plan_id":"nope"}`, http.StatusBadRequest, "UnknownPlan"},
+		{"deprovision sync", "DELETE", "/v2/service_instances/inst-ready", ``, http.StatusUnprocessableEntity, "AsyncRequired"},
+		{"bind missing instance", "PUT", "/v2/service_instances/inst-none/service_bindings/bind-1", `{}`, http.StatusNotFound, "InstanceNotFound"},
+		{"bind while provisioning", "PUT", "/v2/service_instances/inst-busy/service_bindings/bind-1", `{}`, http.StatusUnprocessableEntity, "ConcurrencyError"},
+		{"bind in progress", "PUT", "/v2/service_instances/inst-binding/service_bindings/bind-1", `{}`, http.StatusUnprocessableEntity, "ConcurrencyError"},
+		{"bind failed instance", "PUT", "/v2/service_instances/inst-failed/service_bindings/bind-1", `{}`, http.StatusUnprocessableEntity, "InstanceNotReady"},
+		{"bind conflict", "PUT", "/v2/service_instances/inst-ready/service_bindings/bind-1", `{}`, http.StatusConflict, "BindingAlreadyExists"},
+		{"get missing binding", "GET", "/v2/service_instances/inst-ready/service_bindings/bind-2", ``, http.StatusNotFound, "BindingNotFound"},
+		{"last operation missing instance", "GET", "/v2/service_instances/inst-none/last_operation", ``, http.StatusNotFound, "InstanceNotFound"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			var resp map[string]string
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("body is not a JSON object of strings: %s", rr.Body.String())
+			}
+			if resp["error"] != tt.wantCode || resp["description"] == "" || len(resp) != 2 {
+				t.Errorf("body = %v, want error %q with a description", resp, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestProvision_QuotaVersusMisconfiguration(t *testing.T) {
+	tests := []struct {
+		name       string
+		configure  func(*BrokerConfig)
+		wantStatus int
+		wantCode   string
+	}{
+		{"total quota", func(c *BrokerConfig) { c.MaxInstances = 1 }, http.StatusUnprocessableEntity, "QuotaExceeded"},
+		{"org quota", func(c *BrokerConfig) { c.MaxInstancesPerOrg = 1 }, http.StatusUnprocessableEntity, "QuotaExceeded"},
+		{"memory quota", func(c *BrokerConfig) { c.MaxTotalMemoryMB = 3000 }, http.StatusUnprocessableEntity, "QuotaExceeded"},
+		{"no AZs", func(c *BrokerConfig) { c.AZs = nil }, http.StatusInternalServerError, "BrokerMisconfigured"},
+		{"no apps domain", func(c *BrokerConfig) { c.AppsDomain = "" }, http.StatusInternalServerError, "BrokerMisconfigured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, fakeBOSH, router := newTestBroker("done", false)
+			defer fakeBOSH.Close()
+			b.mu.Lock()
+			b.putInstance(&Instance{ID: "inst-existing", PlanID: "openclaw-developer-plan", State: "ready", OrgGUID: "org-123", SpaceGUID: "space-456"})
+			b.mu.Unlock()
+			tt.configure(&b.config)
+
+			rr := provisionInstance(t, router, "inst-new", "openclaw-developer-plan")
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			var resp map[string]string
+			json.Unmarshal(rr.Body.Bytes(), &resp)
+			if resp["error"] != tt.wantCode || resp["description"] == "" {
+				t.Errorf("body = %v, want error %q with a description", resp, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestProvision_StaticIPPoolExhausted(t *testing.T) {
+	var manifests, deletes []string
+	b, r := newStaticIPTestBroker(t, newFakeBOSHDirectorWith(fakeDirector{manifests: &manifests, deletes: &deletes}), "10.0.8.10")
+
+	provisionInstance(t, r, "inst-ip-1", "openclaw-developer-plan")
+	rr := provisionInstance(t, r, "inst-ip-2", "openclaw-developer-plan")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if !strings.Contains(rr.Body.String(), `"error":"StaticIPPoolExhausted"`) {
+		t.Errorf("body = %s, want pool exhaustion error", rr.Body.String())
+	}
+	if _, exists := b.instances["inst-ip-2"]; exists {
+		t.Error("rejected instance should not be reserved")
+	}
+	if len(manifests) != 1 {
+		t.Errorf("got %d deploys, want 1", len(manifests))
+	}
+}
+
+func TestDeprovision_ReleasesStaticIP(t *testing.T) {
+	b, r := newStaticIPTestBroker(t, newFakeBOSHDirector("done", false), "10.0.8.10")
+
+	provisionInstance(t, r, "inst-ip-1", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-ip-1"].State = "ready"
+	b.mu.Unlock()
+
+	// The IP stays held while the VM is being deleted
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/v2/service_instances/inst-ip-1?accepts_incomplete=true", nil))
+	if rr := provisionInstance(t, r, "inst-ip-2", "openclaw-developer-plan"); rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status during deprovision = %d, want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+
+	// Once the delete task completes the IP returns to the pool
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/service_instances/inst-ip-1/last_operation", nil))
+	if rr := provisionInstance(t, r, "inst-ip-2", "openclaw-developer-plan"); rr.Code != http.StatusAccepted {
+		t.Fatalf("status after deprovision = %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	if got := b.instances["inst-ip-2"].StaticIP; got != "10.0.8.10" {
+		t.Errorf("StaticIP = %q, want released 10.0.8.10", got)
+	}
+}
+
+// fakeSecretStore records secrets set for each deployment.
+type fakeSecretStore struct {
+	mu      sync.Mutex
+	secrets map[string]string // "deployment/name" -> value
+	fail    bool
+}
+
+func (f *fakeSecretStore) SetSecret(deploymentName, name, value string) error {
+	if f.fail {
+		return fmt.Errorf("credhub unavailable")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.secrets == nil {
+		f.secrets = make(map[string]string)
+	}
+	f.secrets[deploymentName+"/"+name] = value
+	return nil
+}
+
+func TestManifest_ConfigServerReferences(t *testing.T) {
+	params := bosh.ManifestParams{
+		ID: "inst-cs", DeploymentName: "openclaw-agent-inst-cs",
+		GatewayToken: "gw-secret", NodeSeed: "seed-secret",
+		LLMProvider: "anthropic", LLMAPIKey: "sk-ant-secret",
+		SSOEnabled: true, SSOClientID: "openclaw-inst-cs", SSOClientSecret: "sso-secret", SSOCookieSecret: "cookie-secret",
+		Network: "default", AZs: []string{"z1"}, VMType: "small", DiskType: "10GB",
+		UseConfigServer: true,
+	}
+	manifest, err := bosh.RenderAgentManifest(params)
+	if err != nil {
+		t.Fatalf("RenderAgentManifest: %v", err)
+	}
+	assertManifestContains(t, string(manifest),
+		`token: "((openclaw_gateway_token))"`,
+		`api_key: "((openclaw_llm_api_key))"`,
+		`seed: "((openclaw_node_seed))"`,
+		`client_secret: "((openclaw_sso_client_secret))"`,
+		`cookie_secret: "((openclaw_sso_cookie_secret))"`,
+		"\nvariables:\n  - name: openclaw_gateway_token\n    type: password\n",
+		"  - name: openclaw_sso_cookie_secret\n    type: password\n",
+	)
+	for _, secret := range []string{"gw-secret", "seed-secret", "sk-ant-secret", "sso-secret", "cookie-secret"} {
+		if strings.Contains(string(manifest), secret) {
+			t.Errorf("manifest should not inline %q", secret)
+		}
+	}
+
+	// Disabled: literal values and no variables block
+	params.UseConfigServer = false
+	manifest, _ = bosh.RenderAgentManifest(params)
+	assertManifestContains(t, string(manifest), `token: "gw-secret"`)
+	if strings.Contains(string(manifest), "variables:") || strings.Contains(string(manifest), "((") {
+		t.Errorf("manifest should not reference config-server variables when disabled:\n%s", manifest)
+	}
+}
+
+func TestProvision_StoresSecretsInConfigServer(t *testing.T) {
+	var manifests, deletes []string
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{manifests: &manifests, deletes: &deletes})
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		UseConfigServer: true,
+	}, director)
+	store := &fakeSecretStore{}
+	b.SetSecretStore(store)
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+
+	if rr := provisionInstance(t, r, "inst-cs", "openclaw-developer-plan"); rr.Code != http.StatusAccepted {
+		t.Fatalf("Provision failed: %d", rr.Code)
+	}
+	inst := b.instances["inst-cs"]
+	if got := store.secrets["openclaw-agent-inst-cs/openclaw_gateway_token"]; got != inst.GatewayToken {
+		t.Errorf("stored gateway token = %q, want the instance token", got)
+	}
+	if got := store.secrets["openclaw-agent-inst-cs/openclaw_node_seed"]; got != inst.NodeSeed {
+		t.Errorf("stored node seed = %q, want the instance seed", got)
+	}
+	if len(manifests) != 1 || strings.Contains(manifests[0], inst.GatewayToken) {
+		t.Error("deployed manifest should reference, not inline, the gateway token")
+	}
+
+	// A config server failure fails the provision before anything is deployed
+	store.fail = true
+	if rr := provisionInstance(t, r, "inst-cs-fail", "openclaw-developer-plan"); rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d when the config server is down", rr.Code, http.StatusInternalServerError)
+	}
+	if len(manifests) != 1 {
+		t.Errorf("got %d deploys, want 1", len(manifests))
+	}
+}
+
+func TestBuildManifestParams_ConfigServerNeedsSecretStore(t *testing.T) {
+	b := New(BrokerConfig{UseConfigServer: true}, nil)
+	if b.buildManifestParams(&Instance{ID: "x"}).UseConfigServer {
+		t.Error("UseConfigServer should stay off until a SecretStore is set")
+	}
+}
+
+func TestProvision_BrowserEnabledFromPlanFeatures(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	cfg := BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		Plans: []Plan{
+			{
+				ID: "browser-plan", Name: "browser-enabled",
+				VMType: "medium", DiskType: "20GB",
+				Features: map[string]bool{"browser": true},
+			},
+		},
+	}
+	b := New(cfg, director)
+
+	// Build manifest params and check browser is enabled
+	instance := &Instance{
+		ID: "inst-browser", PlanID: "browser-plan", PlanName: "browser-enabled",
+		VMType: "medium", DiskType: "20GB", AppsDomain: "apps.example.com",
+	}
+	params := b.buildManifestParams(instance)
+	if !params.BrowserEnabled {
+		t.Error("BrowserEnabled should be true for plan with browser feature")
+	}
+
+	// Also test plan without browser feature
+	cfg2 := BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		Plans: []Plan{
+			{ID: "no-browser-plan", Name: "basic", VMType: "small", DiskType: "10GB"},
+		},
+	}
+	b2 := New(cfg2, director)
+	instance2 := &Instance{
+		ID: "inst-no-browser", PlanID: "no-browser-plan", PlanName: "basic",
+		VMType: "small", DiskType: "10GB", AppsDomain: "apps.example.com",
+	}
+	params2 := b2.buildManifestParams(instance2)
+	if params2.BrowserEnabled {
+		t.Error("BrowserEnabled should be false for plan without browser feature")
+	}
+}
+
+func TestProvision_DefaultPlansEnableAdvertisedBrowser(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-dev", "openclaw-developer-plan")
+	provisionInstance(t, router, "inst-dev-plus", "openclaw-developer-plus-plan")
+	provisionInstance(t, router, "inst-team", "openclaw-team-plan")
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for id, want := range map[string]bool{"inst-dev": false, "inst-dev-plus": true, "inst-team": true} {
+		if got := b.buildManifestParams(b.instances[id]).BrowserEnabled; got != want {
+			t.Errorf("%s: BrowserEnabled = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestProvision_ChannelsFromPlanFeatures(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.config.Plans = defaultPlans()
+	b.config.Plans[2].Features = map[string]bool{"browser": true, "slack": true, "teams": true}
+
+	body, _ := json.Marshal(ProvisionRequest{
+		ServiceID: "openclaw-service", PlanID: "openclaw-team-plan",
+		OrganizationGUID: "org-123", SpaceGUID: "space-456",
+		Parameters: map[string]interface{}{
+			"owner":             "team@example.com",
+			"slack_bot_token":   "xoxb-team",
+			"teams_webhook_url": "https://example.webhook.office.com/hook",
+			"discord_bot_token": "discord-unused",
+		},
+	})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v2/service_instances/inst-team?accepts_incomplete=true", bytes.NewReader(body)))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Provision failed: %d %s", rr.Code, rr.Body.String())
+	}
+	provisionInstance(t, router, "inst-dev", "openclaw-developer-plan")
+
+	b.mu.RLock()
+	team, dev := b.instances["inst-team"], b.instances["inst-dev"]
+	b.mu.RUnlock()
+	if _, ok := team.ChannelCredentials["discord"]; ok {
+		t.Error("discord credential should be dropped when the plan doesn't enable discord")
+	}
+
+	manifest, err := bosh.RenderAgentManifest(b.buildManifestParams(team))
+	if err != nil {
+		t.Fatalf("RenderAgentManifest: %v", err)
+	}
+	assertManifestContains(t, string(manifest),
+		"            channels:\n              slack:\n                enabled: true\n                bot_token: \"xoxb-team\"\n"+
+			"              teams:\n                enabled: true\n                webhook_url: \"https://example.webhook.office.com/hook\"\n")
+	if strings.Contains(string(manifest), "discord") {
+		t.Errorf("team manifest should not render discord:\n%s", manifest)
+	}
+
+	manifest, err = bosh.RenderAgentManifest(b.buildManifestParams(dev))
+	if err != nil {
+		t.Fatalf("RenderAgentManifest: %v", err)
+	}
+	if strings.Contains(string(manifest), "channels:") {
+		t.Errorf("developer manifest should not render channels:\n%s", manifest)
+	}
+}
+
+func TestProvision_SchemaRejectsControlCharsInChannelCredential(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	rr := provisionWithParams(t, router, "inst-schema-cred", map[string]interface{}{
+		"slack_bot_token": "xoxb\"\n                injected: \"true",
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestManifest_ChannelCredentialCannotInjectProperties(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.config.Plans = defaultPlans()
+	b.config.Plans[2].Features = map[string]bool{"slack": true}
+	provisionInstance(t, router, "inst-cred", "openclaw-team-plan")
+
+	b.mu.Lock()
+	inst := b.instances["inst-cred"]
+	inst.ChannelCredentials = map[string]string{"slack": "xoxb\"\n                injected: \"true"}
+	b.mu.Unlock()
+
+	manifest, err := bosh.RenderAgentManifest(b.buildManifestParams(inst))
+	if err != nil {
+		t.Fatalf("RenderAgentManifest: %v", err)
+	}
+	if strings.Contains(string(manifest), "\n                injected:") {
+		t.Errorf("credential injected a manifest property:\n%s", manifest)
+	}
+	assertManifestContains(t, string(manifest), `bot_token: "xoxb\"                injected: \"true"`)
+}
+
+// --- sanitizeHostname tests ---
+
+func TestSanitizeHostname_BasicEmail(t *testing.T) {
+	result := sanitizeHostname("dev@example.com")
+	if result != "dev" {
+		t.Errorf("sanitizeHostname(%q) = %q, want %q", "dev@example.com", result, "dev")
+	}
+}
+
+func TestSanitizeHostname_DotsReplacedWithHyphens(t *testing.T) {
+	result := sanitizeHostname("first.last")
+	if result != "first-last" {
+		t.Errorf("sanitizeHostname(%q) = %q, want %q", "first.last", result, "first-last")
+	}
+}
+
+func TestSanitizeHostname_UnderscoresReplacedWithHyphens(t *testing.T) {
+	result := sanitizeHostname("first_last")
+	if result != "first-last" {
+		t.Errorf("sanitizeHostname(%q) = %q, want %q", "first_last", result, "first-last")
+	}
+}
+
+func TestSanitizeHostname_UppercaseToLowercase(t *testing.T) {
+	result := sanitizeHostname("DevUser")
+	if result != "devuser" {
+		t.Errorf("sanitizeHostname(%q) = %q, want %q", "DevUser", result, "devuser")
+	}
+}
+
+func TestSanitizeHostname_EmailWithDotsAndUnderscores(t *testing.T) {
+	result := sanitizeHostname("first.last_name@company.io")
+	if result != "first-last-name" {
+		t.Errorf("sanitizeHostname(%q) = %q, want %q", "first.last_name@company.io", result, "first-last-name")
+	}
+}
+
+func TestSanitizeHostname_PlainString(t *testing.T) {
+	result := sanitizeHostname("simple")
+	if result != "simple" {
+		t.Errorf("sanitizeHostname(%q) = %q, want %q", "simple", result, "simple")
+	}
+}
+
+func TestSanitizeHostname_EmptyString(t *testing.T) {
+	result := sanitizeHostname("")
+	if result != "" {
+		t.Errorf("sanitizeHostname(%q) = %q, want %q", "", result, "")
+	}
+}
+
+// --- findPlan tests ---
+
+func TestFindPlan_DeveloperPlan(t *testing.T) {
+	b, fakeBOSH, _ := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	plan := b.findPlan("openclaw-developer-plan")
+	if plan == nil {
+		t.Fatal("findPlan returned nil for developer plan")
+	}
+	if plan.Name != "developer" {
+		t.Errorf("plan.Name = %q, want %q", plan.Name, "developer")
+	}
+	if plan.VMType != "small" {
+		t.Errorf("plan.VMType = %q, want %q", plan.VMType, "small")
+	}
+}
+
+func TestFindPlan_DeveloperPlusPlan(t *testing.T) {
+	b, fakeBOSH, _ := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	plan := b.findPlan("openclaw-developer-plus-plan")
+	if plan == nil {
+		t.Fatal("findPlan returned nil for developer-plus plan")
+	}
+	if plan.Name != "developer-plus" {
+		t.Errorf("plan.Name = %q, want %q", plan.Name, "developer-plus")
+	}
+}
+
+func TestFindPlan_TeamPlan(t *testing.T) {
+	b, fakeBOSH, _ := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	plan := b.findPlan("openclaw-team-plan")
+	if plan == nil {
+		t.Fatal("findPlan returned nil for team plan")
+	}
+	if plan.Name != "team" {
+		t.Errorf("plan.Name = %q, want %q", plan.Name, "team")
+	}
+}
+
+func TestFindPlan_UnknownPlan(t *testing.T) {
+	b, fakeBOSH, _ := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	plan := b.findPlan("unknown-plan")
+	if plan != nil {
+		t.Errorf("findPlan returned non-nil for unknown plan: %+v", plan)
+	}
+}
+
+func TestFindPlan_UsesConfigPlans(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	cfg := BrokerConfig{
+		Plans: []Plan{
+			{ID: "custom-plan", Name: "custom", VMType: "micro", DiskType: "1GB"},
+		},
+	}
+	b := New(cfg, director)
+
+	plan := b.findPlan("custom-plan")
+	if plan == nil {
+		t.Fatal("findPlan returned nil for custom config plan")
+	}
+	if plan.Name != "custom" {
+		t.Errorf("plan.Name = %q, want %q", plan.Name, "custom")
+	}
+
+	// Default plans should not be found when config plans are set
+	defaultPlan := b.findPlan("openclaw-developer-plan")
+	if defaultPlan != nil {
+		t.Error("findPlan should not return default plan when config plans are set")
+	}
+}
+
+// --- normalizePlans tests ---
+
+func TestNormalizePlans_GeneratesIDFromName(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	cfg := BrokerConfig{
+		Plans: []Plan{
+			{Name: "dedicated-agent", PlanDescription: "A dedicated agent", VMType: "small", DiskType: "10240"},
+		},
+	}
+	b := New(cfg, director)
+
+	plan := b.findPlan("openclaw-dedicated-agent-plan")
+	if plan == nil {
+		t.Fatal("findPlan returned nil for auto-generated plan ID")
+	}
+	if plan.ID != "openclaw-dedicated-agent-plan" {
+		t.Errorf("plan.ID = %q, want %q", plan.ID, "openclaw-dedicated-agent-plan")
+	}
+	if plan.Description != "A dedicated agent" {
+		t.Errorf("plan.Description = %q, want %q", plan.Description, "A dedicated agent")
+	}
+}
+
+func TestNormalizePlans_FallbackDescription(t *testing.T) {
+	plans := []Plan{
+		{Name: "test-plan"},
+	}
+	normalizePlans(plans)
+	if plans[0].Description != "OpenClaw test-plan plan" {
+		t.Errorf("Description = %q, want %q", plans[0].Description, "OpenClaw test-plan plan")
+	}
+}
+
+func TestNormalizePlans_PreservesExistingIDAndDescription(t *testing.T) {
+	plans := []Plan{
+		{Name: "custom", ID: "my-custom-id", Description: "My description"},
+	}
+	normalizePlans(plans)
+	if plans[0].ID != "my-custom-id" {
+		t.Errorf("ID = %q, want %q (should not be overwritten)", plans[0].ID, "my-custom-id")
+	}
+	if plans[0].Description != "My description" {
+		t.Errorf("Description = %q, want %q (should not be overwritten)", plans[0].Description, "My description")
+	}
+}
+
+func TestCheckUniquePlans(t *testing.T) {
+	unique := []Plan{{Name: "developer"}, {Name: "team"}, {Name: "custom", ID: "my-custom-id"}}
+	if errs := CheckUniquePlans(unique); len(errs) != 0 {
+		t.Errorf("CheckUniquePlans(unique) = %v, want none", errs)
+	}
+	if unique[0].ID != "" {
+		t.Error("CheckUniquePlans should not normalize the caller's plans")
+	}
+
+	// Two "team" plans normalize to one ID; "other" reuses an explicit ID
+	duplicates := []Plan{
+		{Name: "team"},
+		{Name: "team", PlanDescription: "Second team"},
+		{Name: "developer", ID: "shared-id"},
+		{Name: "other", ID: "shared-id"},
+	}
+	errs := CheckUniquePlans(duplicates)
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), `plan "team"`) || !strings.Contains(errs[1].Error(), `plan "other"`) {
+		t.Errorf("CheckUniquePlans(duplicates) = %v, want the second team and other", errs)
+	}
+}
+
+func TestNew_DropsDuplicatePlans(t *testing.T) {
+	b := New(BrokerConfig{Plans: []Plan{
+		{Name: "team", VMType: "large"},
+		{Name: "team", VMType: "small"},
+		{Name: "developer"},
+	}}, nil)
+
+	var names []string
+	for _, p := range b.buildServicePlans() {
+		names = append(names, p.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"team", "developer"}) {
+		t.Errorf("catalog plans = %v, want each plan once", names)
+	}
+	if plan := b.findPlan("openclaw-team-plan"); plan == nil || plan.VMType != "large" {
+		t.Errorf("findPlan(team) = %+v, want the first team plan", plan)
+	}
+}
+
+// --- New() constructor tests ---
+
+func TestNew_ReturnsNonNil(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	b := New(BrokerConfig{}, director)
+	if b == nil {
+		t.Fatal("New() returned nil")
+	}
+}
+
+func TestNew_InitializesInstancesMap(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	b := New(BrokerConfig{}, director)
+	if b.instances == nil {
+		t.Error("instances map is nil")
+	}
+	if len(b.instances) != 0 {
+		t.Errorf("instances map length = %d, want 0", len(b.instances))
+	}
+}
+
+// --- State persistence tests ---
+
+func TestStatePersistence_SaveAndLoad(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	stateDir := t.TempDir()
+	cfg := BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		StateDir:        stateDir,
+	}
+
+	// Create broker and provision an instance
+	b1 := New(cfg, director)
+	b1.mu.Lock()
+	b1.instances["persist-001"] = &Instance{
+		ID:             "persist-001",
+		PlanID:         "openclaw-developer-plan",
+		PlanName:       "developer",
+		Owner:          "testuser",
+		DeploymentName: "openclaw-agent-persist-001",
+		GatewayToken:   "tok-abc",
+		NodeSeed:       "seed-xyz",
+		RouteHostname:  "oc-testuser-persist-001",
+		AppsDomain:     "apps.example.com",
+		VMType:         "small",
+		DiskType:       "10GB",
+		State:          "ready",
+		BoshTaskID:     42,
+		SSOEnabled:     true,
+	}
+	b1.mu.Unlock()
+	b1.saveState()
+
+	// Create a new broker that loads state from disk
+	b2 := New(cfg, director)
+
+	b2.mu.RLock()
+	inst, exists := b2.instances["persist-001"]
+	b2.mu.RUnlock()
+
+	if !exists {
+		t.Fatal("Instance should exist after loading state from disk")
+	}
+	if inst.Owner != "testuser" {
+		t.Errorf("Owner = %q, want %q", inst.Owner, "testuser")
+	}
+	if inst.GatewayToken != "tok-abc" {
+		t.Errorf("GatewayToken = %q, want %q", inst.GatewayToken, "tok-abc")
+	}
+	if inst.State != "ready" {
+		t.Errorf("State = %q, want %q", inst.State, "ready")
+	}
+	if inst.SSOEnabled != true {
+		t.Error("SSOEnabled should be true")
+	}
+	if inst.BoshTaskID != 42 {
+		t.Errorf("BoshTaskID = %d, want 42", inst.BoshTaskID)
+	}
+}
+
+func TestStatePersistence_EmptyStateDir(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	// No StateDir set — persistence is disabled, should work fine
+	cfg := BrokerConfig{}
+	b := New(cfg, director)
+	if len(b.instances) != 0 {
+		t.Errorf("instances should be empty, got %d", len(b.instances))
+	}
+	// saveState should be a no-op
+	b.saveState()
+}
+
+func TestStatePersistence_MissingFileOnLoad(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	// StateDir exists but no state files yet — fresh start
+	cfg := BrokerConfig{StateDir: t.TempDir()}
+	b := New(cfg, director)
 	if len(b.instances) != 0 {
 		t.Errorf("instances should be empty on fresh start, got %d", len(b.instances))
 	}
 }
 
-func TestStatePersistence_ProvisionSavesState(t *testing.T) {
-	fakeBOSH := newFakeBOSHDirector("done", false)
+func TestStatePersistence_ProvisionSavesState(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	stateDir := t.TempDir()
+	cfg := BrokerConfig{
+		MinOpenClawVersion: "2026.1.29",
+		OpenClawVersion:    "2026.2.21-2",
+		AZs:                []string{"z1"},
+		AppsDomain:         "apps.example.com",
+		StateDir:           stateDir,
+	}
+	b := New(cfg, director)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+
+	rr := provisionInstance(t, r, "inst-persist", "openclaw-developer-plan")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Provision failed: %d, body: %s", rr.Code, rr.Body.String())
+	}
+
+	// Create a new broker and verify state was loaded
+	b2 := New(cfg, director)
+	b2.mu.RLock()
+	_, exists := b2.instances["inst-persist"]
+	b2.mu.RUnlock()
+	if !exists {
+		t.Fatal("Instance should be persisted after provision")
+	}
+}
+
+func TestStatePersistence_LastOperationTransitionSurvivesRestart(t *testing.T) {
+	for taskState, wantState := range map[string]string{"done": "ready", "error": "failed"} {
+		t.Run(taskState, func(t *testing.T) {
+			fakeBOSH := newFakeBOSHDirector(taskState, false)
+			defer fakeBOSH.Close()
+			director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+			cfg := BrokerConfig{
+				OpenClawVersion: "2026.2.21-2",
+				AZs:             []string{"z1"},
+				AppsDomain:      "apps.example.com",
+				StateDir:        t.TempDir(),
+			}
+			b := New(cfg, director)
+			r := mux.NewRouter()
+			r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+			r.HandleFunc("/v2/service_instances/{instance_id}/last_operation", b.LastOperation).Methods("GET")
+
+			if rr := provisionInstance(t, r, "inst-lo-persist", "openclaw-developer-plan"); rr.Code != http.StatusAccepted {
+				t.Fatalf("Provision failed: %d", rr.Code)
+			}
+			req := httptest.NewRequest("GET", "/v2/service_instances/inst-lo-persist/last_operation", nil)
+			r.ServeHTTP(httptest.NewRecorder(), req)
+
+			// A broker restarted from the same StateDir sees the terminal state
+			b2 := New(cfg, director)
+			inst, exists := b2.instances["inst-lo-persist"]
+			if !exists {
+				t.Fatal("instance should be persisted")
+			}
+			if inst.State != wantState {
+				t.Errorf("State after restart = %q, want %q", inst.State, wantState)
+			}
+		})
+	}
+}
+
+func TestShutdown_WaitsForInFlightProvision(t *testing.T) {
+	// Director that holds the deploy until released
+	deployStarted := make(chan struct{})
+	releaseDeploy := make(chan struct{})
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/deployments" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		close(deployStarted)
+		<-releaseDeploy
+		w.Header().Set("Location", server.URL+"/tasks/42")
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer server.Close()
+	director := bosh.NewClient(server.URL, "admin", "admin", "", "")
+
+	cfg := BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		StateDir:        t.TempDir(),
+	}
+	b := New(cfg, director)
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+
+	provisioned := make(chan int)
+	go func() {
+		provisioned <- provisionInstance(t, r, "inst-drain", "openclaw-developer-plan").Code
+	}()
+	<-deployStarted
+
+	shutdownErr := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- b.Shutdown(ctx)
+	}()
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before the deploy finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(releaseDeploy)
+	if code := <-provisioned; code != http.StatusAccepted {
+		t.Fatalf("Provision failed: %d", code)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	b2 := New(cfg, director)
+	inst, exists := b2.instances["inst-drain"]
+	if !exists {
+		t.Fatal("instance should be persisted")
+	}
+	if inst.BoshTaskID != 42 {
+		t.Errorf("BoshTaskID after restart = %d, want 42", inst.BoshTaskID)
+	}
+}
+
+func TestShutdown_BoundedByContext(t *testing.T) {
+	b := New(BrokerConfig{}, nil)
+	done := b.beginBOSHWrite()
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown error = %v, want deadline exceeded", err)
+	}
+}
+
+func TestStatePersistence_LoadsPerInstanceFiles(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	stateDir := t.TempDir()
+	instancesDir := filepath.Join(stateDir, "instances")
+	if err := os.MkdirAll(instancesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"file-a", "file-b"} {
+		data, _ := json.Marshal(&Instance{ID: id, State: "ready", Owner: id + "-owner"})
+		if err := os.WriteFile(filepath.Join(instancesDir, id+".json"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := New(BrokerConfig{StateDir: stateDir}, director)
+	if len(b.instances) != 2 {
+		t.Fatalf("Loaded %d instances, want 2", len(b.instances))
+	}
+	if b.instances["file-b"].Owner != "file-b-owner" {
+		t.Errorf("Owner = %q, want %q", b.instances["file-b"].Owner, "file-b-owner")
+	}
+}
+
+func TestStatePersistence_MigratesLegacyFile(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	stateDir := t.TempDir()
+	legacy := map[string]*Instance{
+		"legacy-001": {ID: "legacy-001", State: "ready", GatewayToken: "tok-legacy"},
+	}
+	data, _ := json.Marshal(legacy)
+	if err := os.WriteFile(filepath.Join(stateDir, "instances.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := New(BrokerConfig{StateDir: stateDir}, director)
+	inst, exists := b.instances["legacy-001"]
+	if !exists {
+		t.Fatal("Legacy instance should be imported")
+	}
+	if inst.GatewayToken != "tok-legacy" {
+		t.Errorf("GatewayToken = %q, want %q", inst.GatewayToken, "tok-legacy")
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "instances", "legacy-001.json")); err != nil {
+		t.Errorf("Legacy instance should be written as a per-instance file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "instances.json")); !os.IsNotExist(err) {
+		t.Error("Legacy instances.json should be renamed after migration")
+	}
+
+	// A second startup loads from the per-instance file only
+	b2 := New(BrokerConfig{StateDir: stateDir}, director)
+	if _, exists := b2.instances["legacy-001"]; !exists {
+		t.Error("Migrated instance should load from per-instance file")
+	}
+}
+
+func TestStatePersistence_DeprovisionRemovesFile(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	stateDir := t.TempDir()
+	cfg := BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		StateDir:        stateDir,
+	}
+	b := New(cfg, director)
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Deprovision).Methods("DELETE")
+	r.HandleFunc("/v2/service_instances/{instance_id}/last_operation", b.LastOperation).Methods("GET")
+
+	if rr := provisionInstance(t, r, "inst-gone", "openclaw-developer-plan"); rr.Code != http.StatusAccepted {
+		t.Fatalf("Provision failed: %d", rr.Code)
+	}
+	stateFile := filepath.Join(stateDir, "instances", "inst-gone.json")
+	if _, err := os.Stat(stateFile); err != nil {
+		t.Fatalf("State file should exist after provision: %v", err)
+	}
+
+	req := httptest.NewRequest("DELETE", "/v2/service_instances/inst-gone?accepts_incomplete=true", nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest("GET", "/v2/service_instances/inst-gone/last_operation", nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Error("State file should be removed once deprovisioning completes")
+	}
+}
+
+func TestUpdate_OrphanRecovery_FallbackPlan(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	// Update with empty plan ID — should fall back to first available plan
+	body := UpdateRequest{
+		ServiceID: "openclaw-service",
+		PlanID:    "",
+	}
+	bodyBytes, _ := json.Marshal(body)
+	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-orphan-noplan?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Update orphan fallback plan status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+
+	b.mu.RLock()
+	inst := b.instances["inst-orphan-noplan"]
+	b.mu.RUnlock()
+
+	if inst.PlanName != "developer" {
+		t.Errorf("PlanName = %q, want %q (first default plan)", inst.PlanName, "developer")
+	}
+}
+
+// --- Integration-style test: full lifecycle ---
+
+func TestFullLifecycle_ProvisionBindDeprovision(t *testing.T) {
+	// Set up a BOSH server that transitions states
+	taskState := "processing"
+	boshServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/deployments":
+			w.Header().Set("Location", "/tasks/42")
+			w.WriteHeader(http.StatusFound)
+		case r.Method == "DELETE" && len(r.URL.Path) > len("/deployments/"):
+			w.Header().Set("Location", "/tasks/99")
+			w.WriteHeader(http.StatusFound)
+		case r.Method == "GET" && len(r.URL.Path) > len("/tasks/"):
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"state": taskState})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer boshServer.Close()
+
+	director := bosh.NewClient(boshServer.URL, "admin", "admin", "", "")
+	cfg := BrokerConfig{
+		MinOpenClawVersion: "2026.1.29",
+		SandboxMode:        "strict",
+		OpenClawVersion:    "2026.2.21-2",
+		AZs:                []string{"z1"},
+		AppsDomain:         "apps.example.com",
+	}
+	b := New(cfg, director)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", b.Deprovision).Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Bind).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Unbind).Methods("DELETE")
+	router.HandleFunc("/v2/service_instances/{instance_id}/last_operation", b.LastOperation).Methods("GET")
+
+	instanceID := "lifecycle-001"
+
+	// Step 1: Provision
+	rr := provisionInstance(t, router, instanceID, "openclaw-developer-plan")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Provision failed: %d", rr.Code)
+	}
+
+	// Step 2: LastOperation while provisioning (task processing)
+	req := httptest.NewRequest("GET", fmt.Sprintf("/v2/service_instances/%s/last_operation", instanceID), nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var loResp LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &loResp)
+	if loResp.State != "in progress" {
+		t.Errorf("Step 2: state = %q, want %q", loResp.State, "in progress")
+	}
+
+	// Step 3: BOSH task completes
+	taskState = "done"
+	req = httptest.NewRequest("GET", fmt.Sprintf("/v2/service_instances/%s/last_operation", instanceID), nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	json.Unmarshal(rr.Body.Bytes(), &loResp)
+	if loResp.State != "succeeded" {
+		t.Errorf("Step 3: state = %q, want %q", loResp.State, "succeeded")
+	}
+
+	// Step 4: Bind
+	bindBody := BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"}
+	bodyBytes, _ := json.Marshal(bindBody)
+	req = httptest.NewRequest("PUT", fmt.Sprintf("/v2/service_instances/%s/service_bindings/bind-001", instanceID), bytes.NewReader(bodyBytes))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Step 4: Bind failed: %d, body: %s", rr.Code, rr.Body.String())
+	}
+
+	// Step 5: Unbind
+	req = httptest.NewRequest("DELETE", fmt.Sprintf("/v2/service_instances/%s/service_bindings/bind-001", instanceID), nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Step 5: Unbind status = %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	// Step 6: Deprovision
+	taskState = "processing" // reset for deprovision
+	req = httptest.NewRequest("DELETE", fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true&service_id=openclaw-service&plan_id=openclaw-developer-plan", instanceID), nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Step 6: Deprovision failed: %d", rr.Code)
+	}
+
+	// Step 7: LastOperation during deprovisioning
+	req = httptest.NewRequest("GET", fmt.Sprintf("/v2/service_instances/%s/last_operation", instanceID), nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	json.Unmarshal(rr.Body.Bytes(), &loResp)
+	if loResp.State != "in progress" {
+		t.Errorf("Step 7: state = %q, want %q", loResp.State, "in progress")
+	}
+
+	// Step 8: Deprovision task completes
+	taskState = "done"
+	req = httptest.NewRequest("GET", fmt.Sprintf("/v2/service_instances/%s/last_operation", instanceID), nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	json.Unmarshal(rr.Body.Bytes(), &loResp)
+	if loResp.State != "succeeded" {
+		t.Errorf("Step 8: state = %q, want %q", loResp.State, "succeeded")
+	}
+
+	// Verify instance is deleted
+	b.mu.RLock()
+	_, exists := b.instances[instanceID]
+	b.mu.RUnlock()
+	if exists {
+		t.Error("Instance should be deleted after deprovisioning completes")
+	}
+}
+
+func TestBuildManifestParams_SSODisabledWithoutPerInstanceCreds(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	// SSOEnabled=true on instance but no per-instance credentials — SSO should be effectively disabled
+	cfg := BrokerConfig{
+		SSOEnabled: true,
+		AZs:        []string{"z1"},
+		AppsDomain: "apps.example.com",
+	}
+	b := New(cfg, director)
+
+	instance := &Instance{
+		ID:             "sso-test-001",
+		PlanID:         "openclaw-developer-plan",
+		PlanName:       "developer",
+		DeploymentName: "openclaw-agent-sso-test-001",
+		SSOEnabled:     true,
+		// No SSOClientID — UAA client was not created
+		VMType:  "small",
+		DiskType: "10GB",
+	}
+
+	params := b.buildManifestParams(instance)
+	if params.SSOEnabled {
+		t.Error("SSOEnabled should be false when instance has no SSOClientID")
+	}
+}
+
+func TestBuildManifestParams_SSOEnabledWithPerInstanceCreds(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	// SSOEnabled=true and per-instance credentials are set — SSO should be enabled
+	cfg := BrokerConfig{
+		SSOEnabled:       true,
+		SSOOIDCIssuerURL: "https://login.sys.example.com",
+		AZs:              []string{"z1"},
+		AppsDomain:       "apps.example.com",
+	}
+	b := New(cfg, director)
+
+	instance := &Instance{
+		ID:              "sso-test-002",
+		PlanID:          "openclaw-developer-plan",
+		PlanName:        "developer",
+		DeploymentName:  "openclaw-agent-sso-test-002",
+		RouteHostname:   "oc-dev-sso-test-002",
+		AppsDomain:      "apps.example.com",
+		SSOEnabled:      true,
+		SSOClientID:     "openclaw-sso-test-002",
+		SSOClientSecret: "auto-generated-secret",
+		SSOCookieSecret: "auto-cookie-secret",
+		VMType:          "small",
+		DiskType:        "10GB",
+	}
+
+	params := b.buildManifestParams(instance)
+	if !params.SSOEnabled {
+		t.Error("SSOEnabled should be true when instance has per-instance credentials")
+	}
+	if params.SSOClientID != "openclaw-sso-test-002" {
+		t.Errorf("SSOClientID = %q, want %q", params.SSOClientID, "openclaw-sso-test-002")
+	}
+
+	// Verify the manifest renders with SSO proxy and redirect_url
+	manifest, err := bosh.RenderAgentManifest(params)
+	if err != nil {
+		t.Fatalf("RenderAgentManifest failed: %v", err)
+	}
+	manifestStr := string(manifest)
+	if !strings.Contains(manifestStr, "openclaw-sso-proxy") {
+		t.Error("Manifest should contain openclaw-sso-proxy job when SSO is enabled")
+	}
+	expectedRedirect := "redirect_url: \"https://oc-dev-sso-test-002.apps.example.com/oauth2/callback\""
+	if !strings.Contains(manifestStr, expectedRedirect) {
+		t.Errorf("Manifest should contain redirect_url, got:\n%s", manifestStr)
+	}
+	expectedIssuer := "oidc_issuer_url: \"https://login.sys.example.com\""
+	if !strings.Contains(manifestStr, expectedIssuer) {
+		t.Errorf("Manifest should contain OIDC issuer URL, got:\n%s", manifestStr)
+	}
+}
+
+func TestRenderAgentManifest_DefaultUpdateBlock(t *testing.T) {
+	manifest, err := bosh.RenderAgentManifest(bosh.ManifestParams{
+		DeploymentName: "openclaw-agent-update-default",
+		AZs:            []string{"z1"},
+	})
+	if err != nil {
+		t.Fatalf("RenderAgentManifest failed: %v", err)
+	}
+	manifestStr := string(manifest)
+	for _, want := range []string{
+		"canaries: 1\n",
+		"max_in_flight: 1\n",
+		"canary_watch_time: 30000-120000\n",
+		"update_watch_time: 30000-120000\n",
+	} {
+		if !strings.Contains(manifestStr, want) {
+			t.Errorf("Manifest should contain default %q, got:\n%s", want, manifestStr)
+		}
+	}
+}
+
+func TestBuildManifestParams_PlanUpdateOverride(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	cfg := BrokerConfig{
+		AZs:        []string{"z1"},
+		AppsDomain: "apps.example.com",
+		Plans: []Plan{
+			{
+				ID: "fast-plan", Name: "fast", VMType: "small", DiskType: "10GB",
+				Update: bosh.UpdateConfig{Canaries: 2, MaxInFlight: 5, CanaryWatchTime: "5000-60000"},
+			},
+		},
+	}
+	b := New(cfg, director)
+
+	instance := &Instance{
+		ID: "inst-fast", PlanID: "fast-plan", PlanName: "fast",
+		DeploymentName: "openclaw-agent-inst-fast", VMType: "small", DiskType: "10GB",
+	}
+	params := b.buildManifestParams(instance)
+	if params.Update.Canaries != 2 || params.Update.MaxInFlight != 5 {
+		t.Errorf("Update = %+v, want canaries=2 max_in_flight=5", params.Update)
+	}
+
+	manifest, err := bosh.RenderAgentManifest(params)
+	if err != nil {
+		t.Fatalf("RenderAgentManifest failed: %v", err)
+	}
+	manifestStr := string(manifest)
+	for _, want := range []string{
+		"canaries: 2\n",
+		"max_in_flight: 5\n",
+		"canary_watch_time: 5000-60000\n",
+		// Unset fields keep their defaults
+		"update_watch_time: 30000-120000\n",
+	} {
+		if !strings.Contains(manifestStr, want) {
+			t.Errorf("Manifest should contain %q, got:\n%s", want, manifestStr)
+		}
+	}
+}
+
+// --- Provision parameter schema tests ---
+
+func provisionWithParams(t *testing.T, router *mux.Router, instanceID string, params map[string]interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	bodyBytes, _ := json.Marshal(ProvisionRequest{
+		ServiceID:        "openclaw-service",
+		PlanID:           "openclaw-developer-plan",
+		OrganizationGUID: "org-123",
+		SpaceGUID:        "space-456",
+		Parameters:       params,
+	})
+	req := httptest.NewRequest("PUT", "/v2/service_instances/"+instanceID+"?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestProvision_SchemaAcceptsValidParameters(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	rr := provisionWithParams(t, router, "inst-schema-ok", map[string]interface{}{
+		"owner":            "dev@example.com",
+		"openclaw_version": "2026.3.1",
+	})
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+	if v := b.instances["inst-schema-ok"].OpenClawVersion; v != "2026.3.1" {
+		t.Errorf("OpenClawVersion = %q, want %q", v, "2026.3.1")
+	}
+}
+
+func TestProvision_SchemaRejectsUnknownField(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	rr := provisionWithParams(t, router, "inst-schema-typo", map[string]interface{}{
+		"openclaw_verison": "2026.3.1",
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(rr.Body.String(), "openclaw_verison") {
+		t.Errorf("Error should name the unknown field, got: %s", rr.Body.String())
+	}
+}
+
+func TestProvision_SchemaRejectsMalformedVersion(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	rr := provisionWithParams(t, router, "inst-schema-ver", map[string]interface{}{
+		"openclaw_version": "latest\"\ninjected: true",
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestProvision_RequestedVersionStillGated(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	rr := provisionWithParams(t, router, "inst-schema-old", map[string]interface{}{
+		"openclaw_version": "2025.1.1",
+	})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestCatalog_PlansPublishCreateSchema(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	req := httptest.NewRequest("GET", "/v2/catalog", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var catalog CatalogResponse
+	json.Unmarshal(rr.Body.Bytes(), &catalog)
+	for _, p := range catalog.Services[0].Plans {
+		if p.Schemas == nil || p.Schemas.ServiceInstance.Create == nil {
+			t.Fatalf("Plan %s missing schemas.service_instance.create", p.ID)
+		}
+		props := p.Schemas.ServiceInstance.Create.Parameters.Properties
+		if props["owner"] == nil || props["openclaw_version"] == nil {
+			t.Errorf("Plan %s schema missing owner/openclaw_version properties", p.ID)
+		}
+	}
+}
+
+// --- maintenance_info tests ---
+
+func updateWithMaintenanceInfo(t *testing.T, router *mux.Router, instanceID, version string) *httptest.ResponseRecorder {
+	t.Helper()
+	bodyBytes, _ := json.Marshal(UpdateRequest{
+		ServiceID:       "openclaw-service",
+		MaintenanceInfo: &MaintenanceInfo{Version: version},
+	})
+	req := httptest.NewRequest("PATCH", "/v2/service_instances/"+instanceID+"?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCatalog_PlansHaveMaintenanceInfo(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	req := httptest.NewRequest("GET", "/v2/catalog", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var catalog CatalogResponse
+	json.Unmarshal(rr.Body.Bytes(), &catalog)
+	for _, p := range catalog.Services[0].Plans {
+		if p.MaintenanceInfo == nil || p.MaintenanceInfo.Version != "2026.2.21-2" {
+			t.Errorf("Plan %s maintenance_info = %+v, want version 2026.2.21-2", p.ID, p.MaintenanceInfo)
+		}
+	}
+}
+
+func TestUpdate_MaintenanceInfoUpgradesOutdatedInstance(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-mi", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-mi"].State = "ready"
+	b.instances["inst-mi"].OpenClawVersion = "2026.1.29"
+	b.instances["inst-mi"].BoshTaskID = 0
+	b.mu.Unlock()
+
+	rr := updateWithMaintenanceInfo(t, router, "inst-mi", "2026.2.21-2")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+
+	b.mu.RLock()
+	inst := b.instances["inst-mi"]
+	b.mu.RUnlock()
+	if inst.OpenClawVersion != "2026.2.21-2" {
+		t.Errorf("OpenClawVersion = %q, want %q", inst.OpenClawVersion, "2026.2.21-2")
+	}
+	if inst.BoshTaskID != 42 {
+		t.Errorf("BoshTaskID = %d, want 42 (redeploy expected)", inst.BoshTaskID)
+	}
+}
+
+func TestUpdate_MaintenanceInfoCurrentVersionIsNoop(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-mi-cur", "openclaw-developer-plan")
+	b.mu.Lock()
+	b.instances["inst-mi-cur"].State = "ready"
+	b.instances["inst-mi-cur"].BoshTaskID = 0
+	b.mu.Unlock()
+
+	rr := updateWithMaintenanceInfo(t, router, "inst-mi-cur", "2026.2.21-2")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if b.instances["inst-mi-cur"].BoshTaskID != 0 {
+		t.Error("Instance already at the requested version should not be redeployed")
+	}
+}
+
+func TestUpdate_MaintenanceInfoConflict(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-mi-bad", "openclaw-developer-plan")
+
+	rr := updateWithMaintenanceInfo(t, router, "inst-mi-bad", "2099.1.1")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if !strings.Contains(rr.Body.String(), "MaintenanceInfoConflict") {
+		t.Errorf("Body should contain MaintenanceInfoConflict, got: %s", rr.Body.String())
+	}
+}
+
+// --- Reconciliation tests ---
+
+func TestListDeployments_ParsesDirectorResponse(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{deployments: []string{"cf", "openclaw-agent-abc"}})
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	deployments, err := director.ListDeployments()
+	if err != nil {
+		t.Fatalf("ListDeployments failed: %v", err)
+	}
+	if len(deployments) != 2 {
+		t.Fatalf("Got %d deployments, want 2", len(deployments))
+	}
+	if deployments[1].Name != "openclaw-agent-abc" || deployments[1].Releases[0].Name != "openclaw" {
+		t.Errorf("Unexpected deployment: %+v", deployments[1])
+	}
+}
+
+func TestReconcileDeployments_RecoversOrphans(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{
+		deployments: []string{"cf", "openclaw-agent-known", "openclaw-agent-orphan", "other-openclaw-agent-x"},
+		instanceIDs: map[string]string{"openclaw-agent-known": "known", "openclaw-agent-orphan": "orphan", "other-openclaw-agent-x": "x"},
+	})
 	defer fakeBOSH.Close()
 	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
 
 	stateDir := t.TempDir()
-	cfg := BrokerConfig{
-		MinOpenClawVersion: "2026.1.29",
-		OpenClawVersion:    "2026.2.21-2",
-		AZs:                []string{"z1"},
-		AppsDomain:         "apps.example.com",
-		StateDir:           stateDir,
+	b := New(BrokerConfig{AppsDomain: "apps.example.com", StateDir: stateDir}, director)
+	b.instances["known"] = &Instance{ID: "known", DeploymentName: "openclaw-agent-known", State: "provisioning"}
+
+	recovered, err := b.ReconcileDeployments()
+	if err != nil {
+		t.Fatalf("ReconcileDeployments failed: %v", err)
 	}
-	b := New(cfg, director)
+	if len(recovered) != 1 || recovered[0] != "orphan" {
+		t.Fatalf("recovered = %v, want [orphan]", recovered)
+	}
+
+	inst := b.instances["orphan"]
+	if inst.DeploymentName != "openclaw-agent-orphan" || inst.State != "ready" {
+		t.Errorf("Recovered instance = %+v, want deployment openclaw-agent-orphan in state ready", inst)
+	}
+	if b.instances["known"].State != "provisioning" {
+		t.Error("Existing instances should not be touched by reconciliation")
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "instances", "orphan.json")); err != nil {
+		t.Errorf("Recovered instance should be persisted: %v", err)
+	}
+}
+
+func TestReconcileDeployments_DirectorError(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	b := New(BrokerConfig{}, director)
+	if _, err := b.ReconcileDeployments(); err == nil {
+		t.Error("ReconcileDeployments should return an error when the Director listing fails")
+	}
+}
+
+// --- Deployment prefix tests ---
+
+func TestDeploymentPrefix_UsedForAllDeploymentCalls(t *testing.T) {
+	var manifests, deletes []string
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{manifests: &manifests, deletes: &deletes})
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
 
+	b := New(BrokerConfig{
+		OpenClawVersion:  "2026.2.21-2",
+		AZs:              []string{"z1"},
+		AppsDomain:       "apps.example.com",
+		DeploymentPrefix: "fdn2-openclaw",
+	}, director)
 	r := mux.NewRouter()
 	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Deprovision).Methods("DELETE")
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Update).Methods("PATCH")
 
-	rr := provisionInstance(t, r, "inst-persist", "openclaw-developer-plan")
+	if rr := provisionInstance(t, r, "inst-pfx", "openclaw-developer-plan"); rr.Code != http.StatusAccepted {
+		t.Fatalf("Provision failed: %d", rr.Code)
+	}
+	if b.instances["inst-pfx"].DeploymentName != "fdn2-openclaw-inst-pfx" {
+		t.Errorf("DeploymentName = %q, want fdn2-openclaw-inst-pfx", b.instances["inst-pfx"].DeploymentName)
+	}
+
+	// Orphan recovery in Update redeploys under the same prefix
+	bodyBytes, _ := json.Marshal(UpdateRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"})
+	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-pfx-orphan?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(manifests) != 2 {
+		t.Fatalf("got %d deploys, want 2", len(manifests))
+	}
+	for i, want := range []string{"name: fdn2-openclaw-inst-pfx\n", "name: fdn2-openclaw-inst-pfx-orphan\n"} {
+		if !strings.Contains(manifests[i], want) {
+			t.Errorf("manifest %d missing %q", i, strings.TrimSpace(want))
+		}
+	}
+
+	// Deprovision of a known and an unknown (orphaned) instance
+	for _, id := range []string{"inst-pfx", "inst-pfx-gone"} {
+		req := httptest.NewRequest("DELETE", "/v2/service_instances/"+id+"?accepts_incomplete=true", nil)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	wantDeletes := []string{"/deployments/fdn2-openclaw-inst-pfx", "/deployments/fdn2-openclaw-inst-pfx-gone"}
+	if strings.Join(deletes, ",") != strings.Join(wantDeletes, ",") {
+		t.Errorf("deletes = %v, want %v", deletes, wantDeletes)
+	}
+}
+
+func TestDeploymentPrefix_DefaultsToOpenClawAgent(t *testing.T) {
+	b := New(BrokerConfig{}, nil)
+	if got := b.deploymentName("abc"); got != "openclaw-agent-abc" {
+		t.Errorf("deploymentName = %q, want openclaw-agent-abc", got)
+	}
+}
+
+func TestReconcileDeployments_UsesDeploymentPrefix(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{
+		deployments: []string{"openclaw-agent-other-fdn", "fdn2-openclaw-mine"},
+		instanceIDs: map[string]string{"openclaw-agent-other-fdn": "other-fdn", "fdn2-openclaw-mine": "mine"},
+	})
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	b := New(BrokerConfig{DeploymentPrefix: "fdn2-openclaw"}, director)
+	recovered, err := b.ReconcileDeployments()
+	if err != nil {
+		t.Fatalf("ReconcileDeployments failed: %v", err)
+	}
+	if len(recovered) != 1 || recovered[0] != "mine" {
+		t.Errorf("recovered = %v, want [mine]", recovered)
+	}
+}
+
+func TestReconcileDeployments_IgnoresLongerPrefixes(t *testing.T) {
+	// "openclaw-agent-prod-abc" belongs to a foundation prefixed
+	// "openclaw-agent-prod", but its name alone also fits "openclaw-agent"
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{
+		deployments: []string{"openclaw-agent-prod-abc", "openclaw-agent-def", "openclaw-agent-unmarked"},
+		instanceIDs: map[string]string{"openclaw-agent-prod-abc": "abc", "openclaw-agent-def": "def"},
+	})
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+
+	b := New(BrokerConfig{}, director)
+	recovered, err := b.ReconcileDeployments()
+	if err != nil {
+		t.Fatalf("ReconcileDeployments failed: %v", err)
+	}
+	if len(recovered) != 1 || recovered[0] != "def" {
+		t.Errorf("recovered = %v, want only [def]", recovered)
+	}
+}
+
+// --- Task failure output tests ---
+
+func lastOperationAfterFailedDeploy(t *testing.T, fakeBOSH *httptest.Server) LastOperationResponse {
+	t.Helper()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	b := New(BrokerConfig{OpenClawVersion: "2026.2.21-2", AZs: []string{"z1"}, AppsDomain: "apps.example.com"}, director)
+	r := mux.NewRouter()
+	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+	r.HandleFunc("/v2/service_instances/{instance_id}/last_operation", b.LastOperation).Methods("GET")
+
+	provisionInstance(t, r, "inst-fail-out", "openclaw-developer-plan")
+	req := httptest.NewRequest("GET", "/v2/service_instances/inst-fail-out/last_operation", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	var resp LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	return resp
+}
+
+func TestLastOperation_FailedIncludesTaskResult(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{taskState: "error", taskOutput: map[string]string{"result": "Error: VM type 'small' not found in cloud config\n"}})
+	defer fakeBOSH.Close()
+
+	resp := lastOperationAfterFailedDeploy(t, fakeBOSH)
+	if resp.State != "failed" {
+		t.Fatalf("State = %q, want %q", resp.State, "failed")
+	}
+	if !strings.Contains(resp.Description, "VM type 'small' not found") {
+		t.Errorf("Description = %q, want it to contain the task error", resp.Description)
+	}
+}
+
+func TestLastOperation_FailedFallsBackToEventError(t *testing.T) {
+	events := `{"time":1,"stage":"Preparing deployment","state":"started"}` + "\n" +
+		`{"time":2,"error":{"code":190014,"message":"Instance group 'agent' references unknown network 'missing'"}}` + "\n"
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{taskState: "error", taskOutput: map[string]string{"event": events}})
+	defer fakeBOSH.Close()
+
+	resp := lastOperationAfterFailedDeploy(t, fakeBOSH)
+	if !strings.Contains(resp.Description, "unknown network 'missing'") {
+		t.Errorf("Description = %q, want it to contain the event error message", resp.Description)
+	}
+}
+
+func TestLastOperation_FailedOutputIsTruncated(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirectorWith(fakeDirector{taskState: "error", taskOutput: map[string]string{"result": strings.Repeat("x", 10000)}})
+	defer fakeBOSH.Close()
+
+	resp := lastOperationAfterFailedDeploy(t, fakeBOSH)
+	if len(resp.Description) > maxFailureReasonLen+100 {
+		t.Errorf("Description length = %d, want it capped near %d", len(resp.Description), maxFailureReasonLen)
+	}
+}
+
+func TestProvision_PinnedPlanVersion(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.config.Plans = []Plan{
+		{ID: "stable-plan", Name: "stable", VMType: "small", OpenClawVersion: "2026.2.17"},
+		{ID: "beta-plan", Name: "beta", VMType: "small"},
+	}
+
+	if rr := provisionInstance(t, router, "inst-stable", "stable-plan"); rr.Code != http.StatusAccepted {
+		t.Fatalf("stable provision = %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := provisionInstance(t, router, "inst-beta", "beta-plan"); rr.Code != http.StatusAccepted {
+		t.Fatalf("beta provision = %d: %s", rr.Code, rr.Body.String())
+	}
+	b.mu.RLock()
+	stable, beta := b.instances["inst-stable"].OpenClawVersion, b.instances["inst-beta"].OpenClawVersion
+	b.mu.RUnlock()
+	if stable != "2026.2.17" {
+		t.Errorf("pinned plan version = %q, want 2026.2.17", stable)
+	}
+	if beta != "2026.2.21-2" {
+		t.Errorf("unpinned plan version = %q, want the broker version 2026.2.21-2", beta)
+	}
+
+	// Catalog advertises each plan's own version
+	for _, p := range b.buildServicePlans() {
+		want := map[string]string{"stable-plan": "2026.2.17", "beta-plan": "2026.2.21-2"}[p.ID]
+		if p.MaintenanceInfo == nil || p.MaintenanceInfo.Version != want {
+			t.Errorf("plan %s maintenance_info = %+v, want version %s", p.ID, p.MaintenanceInfo, want)
+		}
+	}
+}
+
+func TestProvision_PinnedPlanVersionStillGated(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.config.Plans = []Plan{{ID: "stale-plan", Name: "stale", VMType: "small", OpenClawVersion: "2026.1.1"}}
+
+	rr := provisionInstance(t, router, "inst-stale", "stale-plan")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want 422 for a pin below min_openclaw_version. Body: %s", rr.Code, rr.Body.String())
+	}
+	b.mu.RLock()
+	_, exists := b.instances["inst-stale"]
+	b.mu.RUnlock()
+	if exists {
+		t.Error("rejected instance should not be recorded")
+	}
+}
+
+func TestProvision_TagsAndLabels(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.config.StateDir = t.TempDir()
+
+	body, _ := json.Marshal(ProvisionRequest{
+		ServiceID:        "openclaw-service",
+		PlanID:           "openclaw-developer-plan",
+		OrganizationGUID: "org-123",
+		SpaceGUID:        "space-456",
+		Parameters: map[string]interface{}{
+			"owner":  "dev@example.com",
+			"tags":   []string{"team-agents", "prod", "prod"},
+			"labels": map[string]string{"cost_center": "cc-42", "note": "say \"hi\"\nthere"},
+		},
+	})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v2/service_instances/inst-tagged?accepts_incomplete=true", bytes.NewReader(body)))
 	if rr.Code != http.StatusAccepted {
-		t.Fatalf("Provision failed: %d, body: %s", rr.Code, rr.Body.String())
+		t.Fatalf("provision = %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Persisted across a restart
+	reloaded := New(BrokerConfig{StateDir: b.config.StateDir, AppsDomain: "apps.example.com", AZs: []string{"z1"}}, nil)
+	inst := reloaded.instances["inst-tagged"]
+	if inst == nil {
+		t.Fatal("instance not reloaded from state")
+	}
+	if !reflect.DeepEqual(inst.Tags, []string{"team-agents", "prod"}) {
+		t.Errorf("Tags = %v, want deduplicated tags", inst.Tags)
+	}
+	if inst.Labels["cost_center"] != "cc-42" {
+		t.Errorf("Labels = %v", inst.Labels)
 	}
 
-	// Create a new broker and verify state was loaded
-	b2 := New(cfg, director)
-	b2.mu.RLock()
-	_, exists := b2.instances["inst-persist"]
-	b2.mu.RUnlock()
-	if !exists {
-		t.Fatal("Instance should be persisted after provision")
-	}
+	manifest, err := bosh.RenderAgentManifest(reloaded.buildManifestParams(inst))
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	assertManifestContains(t, string(manifest),
+		"\ntags:\n",
+		`"cost_center": "cc-42"`,
+		`"note": "say \"hi\"there"`,
+		`"prod": ""`,
+		`"team-agents": ""`,
+	)
 }
 
-func TestUpdate_OrphanRecovery_FallbackPlan(t *testing.T) {
+func TestProvision_AgentConfig(t *testing.T) {
 	b, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
 
-	// Update with empty plan ID — should fall back to first available plan
-	body := UpdateRequest{
-		ServiceID: "openclaw-service",
-		PlanID:    "",
-	}
-	bodyBytes, _ := json.Marshal(body)
-	req := httptest.NewRequest("PATCH", "/v2/service_instances/inst-orphan-noplan?accepts_incomplete=true", bytes.NewReader(bodyBytes))
+	body, _ := json.Marshal(ProvisionRequest{
+		ServiceID:        "openclaw-service",
+		PlanID:           "openclaw-developer-plan",
+		OrganizationGUID: "org-123",
+		SpaceGUID:        "space-456",
+		Parameters: map[string]interface{}{
+			"agent_config": map[string]string{
+				"system_prompt": "You are \"Ops Bot\".\nBe brief.",
+				"timezone":      "Europe/Berlin",
+			},
+		},
+	})
 	rr := httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
-
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v2/service_instances/inst-agentcfg?accepts_incomplete=true", bytes.NewReader(body)))
 	if rr.Code != http.StatusAccepted {
-		t.Fatalf("Update orphan fallback plan status = %d, want %d. Body: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+		t.Fatalf("provision = %d: %s", rr.Code, rr.Body.String())
 	}
 
 	b.mu.RLock()
-	inst := b.instances["inst-orphan-noplan"]
+	params := b.buildManifestParams(b.instances["inst-agentcfg"])
 	b.mu.RUnlock()
-
-	if inst.PlanName != "developer" {
-		t.Errorf("PlanName = %q, want %q (first default plan)", inst.PlanName, "developer")
+	manifest, err := bosh.RenderAgentManifest(params)
+	if err != nil {
+		t.Fatalf("render: %v", err)
 	}
+	assertManifestContains(t, string(manifest),
+		"            agent:\n              custom:\n",
+		`                system_prompt: "You are \"Ops Bot\".\nBe brief."`,
+		`                timezone: "Europe/Berlin"`,
+	)
 }
 
-// --- Integration-style test: full lifecycle ---
+func TestProvision_AgentConfigRejectsUnknownKey(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
 
-func TestFullLifecycle_ProvisionBindDeprovision(t *testing.T) {
-	// Set up a BOSH server that transitions states
-	taskState := "processing"
-	boshServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch {
-		case r.Method == "POST" && r.URL.Path == "/deployments":
-			w.Header().Set("Location", "/tasks/42")
-			w.WriteHeader(http.StatusFound)
-		case r.Method == "DELETE" && len(r.URL.Path) > len("/deployments/"):
-			w.Header().Set("Location", "/tasks/99")
-			w.WriteHeader(http.StatusFound)
-		case r.Method == "GET" && len(r.URL.Path) > len("/tasks/"):
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"state": taskState})
-		default:
-			w.WriteHeader(http.StatusNotFound)
+	for name, params := range map[string]map[string]interface{}{
+		"unknown key":    {"agent_config": map[string]string{"vm_type": "huge"}},
+		"value too long": {"agent_config": map[string]string{"language": strings.Repeat("x", 36)}},
+		"not an object":  {"agent_config": "system_prompt"},
+	} {
+		body, _ := json.Marshal(ProvisionRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan", Parameters: params})
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v2/service_instances/inst-badcfg?accepts_incomplete=true", bytes.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400. Body: %s", name, rr.Code, rr.Body.String())
 		}
-	}))
-	defer boshServer.Close()
-
-	director := bosh.NewClient(boshServer.URL, "admin", "admin", "", "")
-	cfg := BrokerConfig{
-		MinOpenClawVersion: "2026.1.29",
-		SandboxMode:        "strict",
-		OpenClawVersion:    "2026.2.21-2",
-		AZs:                []string{"z1"},
-		AppsDomain:         "apps.example.com",
 	}
-	b := New(cfg, director)
-
-	router := mux.NewRouter()
-	router.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
-	router.HandleFunc("/v2/service_instances/{instance_id}", b.Deprovision).Methods("DELETE")
-	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Bind).Methods("PUT")
-	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Unbind).Methods("DELETE")
-	router.HandleFunc("/v2/service_instances/{instance_id}/last_operation", b.LastOperation).Methods("GET")
+}
 
-	instanceID := "lifecycle-001"
+func TestProvision_RejectsInvalidTags(t *testing.T) {
+	_, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
 
-	// Step 1: Provision
-	rr := provisionInstance(t, router, instanceID, "openclaw-developer-plan")
-	if rr.Code != http.StatusAccepted {
-		t.Fatalf("Provision failed: %d", rr.Code)
+	for name, params := range map[string]map[string]interface{}{
+		"tag with space":   {"tags": []string{"cost center"}},
+		"tags not array":   {"tags": "prod"},
+		"label not string": {"labels": map[string]interface{}{"tier": 1}},
+		"bad label key":    {"labels": map[string]string{"-tier": "gold"}},
+	} {
+		body, _ := json.Marshal(ProvisionRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan", Parameters: params})
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v2/service_instances/inst-badtag?accepts_incomplete=true", bytes.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400. Body: %s", name, rr.Code, rr.Body.String())
+		}
 	}
+}
 
-	// Step 2: LastOperation while provisioning (task processing)
-	req := httptest.NewRequest("GET", fmt.Sprintf("/v2/service_instances/%s/last_operation", instanceID), nil)
-	rr = httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
-	var loResp LastOperationResponse
-	json.Unmarshal(rr.Body.Bytes(), &loResp)
-	if loResp.State != "in progress" {
-		t.Errorf("Step 2: state = %q, want %q", loResp.State, "in progress")
+func TestProvision_AZPin(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.config.AZs = []string{"z1", "z2", "z3"}
+
+	provision := func(id string, params map[string]interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(ProvisionRequest{
+			ServiceID:        "openclaw-service",
+			PlanID:           "openclaw-developer-plan",
+			OrganizationGUID: "org-123",
+			SpaceGUID:        "space-456",
+			Parameters:       params,
+		})
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v2/service_instances/"+id+"?accepts_incomplete=true", bytes.NewReader(body)))
+		return rr
+	}
+	manifestFor := func(id string) string {
+		t.Helper()
+		b.mu.RLock()
+		params := b.buildManifestParams(b.instances[id])
+		b.mu.RUnlock()
+		manifest, err := bosh.RenderAgentManifest(params)
+		if err != nil {
+			t.Fatalf("render: %v", err)
+		}
+		return string(manifest)
 	}
 
-	// Step 3: BOSH task completes
-	taskState = "done"
-	req = httptest.NewRequest("GET", fmt.Sprintf("/v2/service_instances/%s/last_operation", instanceID), nil)
-	rr = httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
-	json.Unmarshal(rr.Body.Bytes(), &loResp)
-	if loResp.State != "succeeded" {
-		t.Errorf("Step 3: state = %q, want %q", loResp.State, "succeeded")
+	if rr := provision("inst-pinned", map[string]interface{}{"az": "z2"}); rr.Code != http.StatusAccepted {
+		t.Fatalf("pinned provision = %d: %s", rr.Code, rr.Body.String())
 	}
-
-	// Step 4: Bind
-	bindBody := BindRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"}
-	bodyBytes, _ := json.Marshal(bindBody)
-	req = httptest.NewRequest("PUT", fmt.Sprintf("/v2/service_instances/%s/service_bindings/bind-001", instanceID), bytes.NewReader(bodyBytes))
-	rr = httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
-	if rr.Code != http.StatusCreated {
-		t.Fatalf("Step 4: Bind failed: %d, body: %s", rr.Code, rr.Body.String())
+	if az := b.instances["inst-pinned"].AZ; az != "z2" {
+		t.Errorf("AZ = %q, want z2", az)
 	}
+	assertManifestContains(t, manifestFor("inst-pinned"), "    azs: [z2]\n")
 
-	// Step 5: Unbind
-	req = httptest.NewRequest("DELETE", fmt.Sprintf("/v2/service_instances/%s/service_bindings/bind-001", instanceID), nil)
-	rr = httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
-	if rr.Code != http.StatusOK {
-		t.Errorf("Step 5: Unbind status = %d, want %d", rr.Code, http.StatusOK)
+	if rr := provision("inst-spread", nil); rr.Code != http.StatusAccepted {
+		t.Fatalf("default provision = %d: %s", rr.Code, rr.Body.String())
 	}
+	assertManifestContains(t, manifestFor("inst-spread"), "    azs: [z1, z2, z3]\n")
 
-	// Step 6: Deprovision
-	taskState = "processing" // reset for deprovision
-	req = httptest.NewRequest("DELETE", fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true&service_id=openclaw-service&plan_id=openclaw-developer-plan", instanceID), nil)
-	rr = httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
-	if rr.Code != http.StatusAccepted {
-		t.Fatalf("Step 6: Deprovision failed: %d", rr.Code)
+	rr := provision("inst-badaz", map[string]interface{}{"az": "z9"})
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "InvalidParameters") {
+		t.Fatalf("unknown AZ = %d: %s, want 400 InvalidParameters", rr.Code, rr.Body.String())
+	}
+	if _, exists := b.instances["inst-badaz"]; exists {
+		t.Error("rejected instance should not be recorded")
 	}
+}
 
-	// Step 7: LastOperation during deprovisioning
-	req = httptest.NewRequest("GET", fmt.Sprintf("/v2/service_instances/%s/last_operation", instanceID), nil)
-	rr = httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
-	json.Unmarshal(rr.Body.Bytes(), &loResp)
-	if loResp.State != "in progress" {
-		t.Errorf("Step 7: state = %q, want %q", loResp.State, "in progress")
+func TestManifest_PlanStemcellOverride(t *testing.T) {
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		StemcellOS:      "ubuntu-jammy",
+		StemcellVersion: "1.500",
+		Plans: []Plan{
+			{ID: "dev-plan", Name: "developer", VMType: "small"},
+			{ID: "browser-plan", Name: "browser", VMType: "gpu", Features: map[string]bool{"browser": true},
+				StemcellOS: "ubuntu-jammy-gpu", StemcellVersion: "1.501"},
+			{ID: "pinned-plan", Name: "pinned", VMType: "small", StemcellVersion: "1.400"},
+		},
+	}, nil)
+	render := func(planID string) string {
+		t.Helper()
+		manifest, err := bosh.RenderAgentManifest(b.buildManifestParams(&Instance{
+			ID: "inst-" + planID, PlanID: planID, DeploymentName: "openclaw-agent-" + planID,
+			VMType: "small", DiskType: "10GB", AppsDomain: "apps.example.com",
+		}))
+		if err != nil {
+			t.Fatalf("render %s: %v", planID, err)
+		}
+		return string(manifest)
+	}
+
+	assertManifestContains(t, render("dev-plan"),
+		"    stemcell: default\n",
+		"  - alias: default\n    os: ubuntu-jammy\n    version: \"1.500\"")
+	browser := render("browser-plan")
+	assertManifestContains(t, browser,
+		"    stemcell: ubuntu-jammy-gpu\n",
+		"  - alias: ubuntu-jammy-gpu\n    os: ubuntu-jammy-gpu\n    version: \"1.501\"")
+	if strings.Contains(browser, "alias: default") {
+		t.Errorf("browser plan should not reference the default stemcell:\n%s", browser)
+	}
+	assertManifestContains(t, render("pinned-plan"),
+		"    stemcell: ubuntu-jammy\n",
+		"  - alias: ubuntu-jammy\n    os: ubuntu-jammy\n    version: \"1.400\"")
+}
+
+func TestManifest_NATSTLSAndRouteRegistrationInterval(t *testing.T) {
+	render := func(cfg BrokerConfig) string {
+		t.Helper()
+		cfg.OpenClawVersion, cfg.AZs, cfg.AppsDomain = "2026.2.21-2", []string{"z1"}, "apps.example.com"
+		b := New(cfg, nil)
+		manifest, err := bosh.RenderAgentManifest(b.buildManifestParams(&Instance{
+			ID: "inst-nats", PlanID: "openclaw-developer-plan", DeploymentName: "openclaw-agent-inst-nats",
+			VMType: "small", DiskType: "10GB", AppsDomain: "apps.example.com",
+		}))
+		if err != nil {
+			t.Fatalf("RenderAgentManifest: %v", err)
+		}
+		return string(manifest)
+	}
+
+	tlsOn := render(BrokerConfig{NATSTLSEnabled: true, NATSTLSClientCert: "CERT", NATSTLSCACert: "CA"})
+	assertManifestContains(t, tlsOn,
+		"nats-tls:\n            from: nats-tls",
+		"tls:\n              enabled: true",
+		"client_cert: |\n                CERT",
+		"registration_interval: 20s")
+
+	tlsOff := render(BrokerConfig{NATSTLSClientCert: "CERT", NATSTLSCACert: "CA", RouteRegistrationInterval: "45s"})
+	assertManifestContains(t, tlsOff,
+		"nats:\n            from: nats\n",
+		"tls:\n              enabled: false",
+		"registration_interval: 45s")
+	for _, unwanted := range []string{"nats-tls", "client_cert", "ca_cert"} {
+		if strings.Contains(tlsOff, unwanted) {
+			t.Errorf("TLS-disabled manifest should not contain %q", unwanted)
+		}
 	}
 
-	// Step 8: Deprovision task completes
-	taskState = "done"
-	req = httptest.NewRequest("GET", fmt.Sprintf("/v2/service_instances/%s/last_operation", instanceID), nil)
-	rr = httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
-	json.Unmarshal(rr.Body.Bytes(), &loResp)
-	if loResp.State != "succeeded" {
-		t.Errorf("Step 8: state = %q, want %q", loResp.State, "succeeded")
+	// Params built outside the broker keep the previous TLS-on default
+	manifest, err := bosh.RenderAgentManifest(bosh.ManifestParams{
+		DeploymentName: "d", ID: "x", AZs: []string{"z1"}, Network: "default", VMType: "small", DiskType: "10GB",
+	})
+	if err != nil {
+		t.Fatalf("RenderAgentManifest: %v", err)
 	}
+	assertManifestContains(t, string(manifest), "enabled: true", "registration_interval: 20s")
 
-	// Verify instance is deleted
-	b.mu.RLock()
-	_, exists := b.instances[instanceID]
-	b.mu.RUnlock()
-	if exists {
-		t.Error("Instance should be deleted after deprovisioning completes")
+	if _, err := bosh.RenderAgentManifest(bosh.ManifestParams{RouteRegistrationInterval: "often"}); err == nil {
+		t.Error("expected an invalid registration interval to be rejected")
 	}
 }
 
-func TestBuildManifestParams_SSODisabledWithoutPerInstanceCreds(t *testing.T) {
-	fakeBOSH := newFakeBOSHDirector("done", false)
-	defer fakeBOSH.Close()
-	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
-
-	// SSOEnabled=true on instance but no per-instance credentials — SSO should be effectively disabled
-	cfg := BrokerConfig{
-		SSOEnabled: true,
-		AZs:        []string{"z1"},
-		AppsDomain: "apps.example.com",
+func TestManifest_PlanAgentLimits(t *testing.T) {
+	b := New(BrokerConfig{
+		OpenClawVersion: "2026.2.21-2",
+		AZs:             []string{"z1"},
+		AppsDomain:      "apps.example.com",
+		Plans: []Plan{
+			{ID: "unlimited-plan", Name: "unlimited", VMType: "small"},
+			{ID: "capped-plan", Name: "capped", VMType: "small", MaxConcurrentTasks: 2, MaxToolCallsPerMinute: 30},
+			{ID: "tasks-plan", Name: "tasks", VMType: "small", MaxConcurrentTasks: 4},
+		},
+	}, nil)
+	render := func(planID string) string {
+		t.Helper()
+		manifest, err := bosh.RenderAgentManifest(b.buildManifestParams(&Instance{
+			ID: "inst-" + planID, PlanID: planID, DeploymentName: "openclaw-agent-" + planID,
+			VMType: "small", DiskType: "10GB", AppsDomain: "apps.example.com",
+		}))
+		if err != nil {
+			t.Fatalf("render %s: %v", planID, err)
+		}
+		return string(manifest)
 	}
-	b := New(cfg, director)
 
-	instance := &Instance{
-		ID:             "sso-test-001",
-		PlanID:         "openclaw-developer-plan",
-		PlanName:       "developer",
-		DeploymentName: "openclaw-agent-sso-test-001",
-		SSOEnabled:     true,
-		// No SSOClientID — UAA client was not created
-		VMType:  "small",
-		DiskType: "10GB",
+	assertManifestContains(t, render("capped-plan"),
+		"            limits:\n              max_concurrent_tasks: 2\n              max_tool_calls_per_minute: 30\n")
+	tasksOnly := render("tasks-plan")
+	assertManifestContains(t, tasksOnly, "            limits:\n              max_concurrent_tasks: 4\n")
+	if strings.Contains(tasksOnly, "max_tool_calls_per_minute") {
+		t.Error("a zero tool call limit should not be rendered")
 	}
-
-	params := b.buildManifestParams(instance)
-	if params.SSOEnabled {
-		t.Error("SSOEnabled should be false when instance has no SSOClientID")
+	if unlimited := render("unlimited-plan"); strings.Contains(unlimited, "limits:") {
+		t.Errorf("plan without limits should not render a limits block:\n%s", unlimited)
 	}
 }
 
-func TestBuildManifestParams_SSOEnabledWithPerInstanceCreds(t *testing.T) {
-	fakeBOSH := newFakeBOSHDirector("done", false)
+func TestPlanDeprecation(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
 	defer fakeBOSH.Close()
-	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	b.config.Plans = defaultPlans()
+	provisionInstance(t, router, "inst-existing", "openclaw-developer-plan")
+	provisionInstance(t, router, "inst-team", "openclaw-team-plan")
 
-	// SSOEnabled=true and per-instance credentials are set — SSO should be enabled
-	cfg := BrokerConfig{
-		SSOEnabled:       true,
-		SSOOIDCIssuerURL: "https://login.sys.example.com",
-		AZs:              []string{"z1"},
-		AppsDomain:       "apps.example.com",
-	}
-	b := New(cfg, director)
+	b.config.Plans[0].Deprecated = true
+	b.config.Plans[0].DeprecationMessage = "Use developer-plus instead"
 
-	instance := &Instance{
-		ID:              "sso-test-002",
-		PlanID:          "openclaw-developer-plan",
-		PlanName:        "developer",
-		DeploymentName:  "openclaw-agent-sso-test-002",
-		RouteHostname:   "oc-dev-sso-test-002",
-		AppsDomain:      "apps.example.com",
-		SSOEnabled:      true,
-		SSOClientID:     "openclaw-sso-test-002",
-		SSOClientSecret: "auto-generated-secret",
-		SSOCookieSecret: "auto-cookie-secret",
-		VMType:          "small",
-		DiskType:        "10GB",
-	}
+	t.Run("catalog marks the plan", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/catalog", nil))
+		var catalog CatalogResponse
+		if err := json.NewDecoder(rr.Body).Decode(&catalog); err != nil {
+			t.Fatal(err)
+		}
+		plans := catalog.Services[0].Plans
+		if len(plans) != 3 {
+			t.Fatalf("catalog lists %d plans, want the deprecated plan still listed", len(plans))
+		}
+		if plans[0].Metadata["deprecated"] != true || plans[0].Metadata["deprecationMessage"] != "Use developer-plus instead" {
+			t.Errorf("deprecated plan metadata = %v", plans[0].Metadata)
+		}
+		if !strings.HasPrefix(plans[0].Description, "[Deprecated] ") {
+			t.Errorf("description = %q, want a deprecation marker", plans[0].Description)
+		}
+		if _, ok := plans[1].Metadata["deprecated"]; ok {
+			t.Error("active plan should not be marked deprecated")
+		}
+	})
 
-	params := b.buildManifestParams(instance)
-	if !params.SSOEnabled {
-		t.Error("SSOEnabled should be true when instance has per-instance credentials")
-	}
-	if params.SSOClientID != "openclaw-sso-test-002" {
-		t.Errorf("SSOClientID = %q, want %q", params.SSOClientID, "openclaw-sso-test-002")
-	}
+	t.Run("provision is rejected", func(t *testing.T) {
+		rr := provisionInstance(t, router, "inst-new", "openclaw-developer-plan")
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("status = %d, want 422", rr.Code)
+		}
+		var resp map[string]string
+		json.NewDecoder(rr.Body).Decode(&resp)
+		if resp["error"] != "PlanDeprecated" || resp["description"] != "Use developer-plus instead" {
+			t.Errorf("response = %v", resp)
+		}
+	})
 
-	// Verify the manifest renders with SSO proxy and redirect_url
-	manifest, err := bosh.RenderAgentManifest(params)
-	if err != nil {
-		t.Fatalf("RenderAgentManifest failed: %v", err)
-	}
-	manifestStr := string(manifest)
-	if !strings.Contains(manifestStr, "openclaw-sso-proxy") {
-		t.Error("Manifest should contain openclaw-sso-proxy job when SSO is enabled")
-	}
-	expectedRedirect := "redirect_url: \"https://oc-dev-sso-test-002.apps.example.com/oauth2/callback\""
-	if !strings.Contains(manifestStr, expectedRedirect) {
-		t.Errorf("Manifest should contain redirect_url, got:\n%s", manifestStr)
-	}
-	expectedIssuer := "oidc_issuer_url: \"https://login.sys.example.com\""
-	if !strings.Contains(manifestStr, expectedIssuer) {
-		t.Errorf("Manifest should contain OIDC issuer URL, got:\n%s", manifestStr)
-	}
+	t.Run("moving onto the plan is rejected", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PATCH", "/v2/service_instances/inst-team?accepts_incomplete=true",
+			strings.NewReader(`{"service_id":"openclaw-service","plan_id":"openclaw-developer-plan"}`)))
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("plan change status = %d, want 422", rr.Code)
+		}
+	})
+
+	t.Run("existing instances can update and deprovision", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PATCH", "/v2/service_instances/inst-existing?accepts_incomplete=true",
+			strings.NewReader(`{"service_id":"openclaw-service","plan_id":"openclaw-developer-plan","parameters":{"sandbox_mode":"strict"}}`)))
+		if rr.Code != http.StatusAccepted && rr.Code != http.StatusOK {
+			t.Errorf("update status = %d: %s", rr.Code, rr.Body.String())
+		}
+
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/v2/service_instances/inst-existing?accepts_incomplete=true&service_id=openclaw-service&plan_id=openclaw-developer-plan", nil))
+		if rr.Code != http.StatusAccepted {
+			t.Errorf("deprovision status = %d: %s", rr.Code, rr.Body.String())
+		}
+	})
 }
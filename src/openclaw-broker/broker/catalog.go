@@ -1,8 +1,14 @@
 package broker
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
 )
 
 type CatalogResponse struct {
@@ -28,12 +34,141 @@ type ServicePlan struct {
 	Description string                 `json:"description"`
 	Free        bool                   `json:"free"`
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Schemas     *PlanSchemas           `json:"schemas,omitempty"`
+
+	MaintenanceInfo *MaintenanceInfo `json:"maintenance_info,omitempty"`
+}
+
+// MaintenanceInfo advertises the OpenClaw version a plan currently deploys.
+// Platforms compare it with the instance's version to offer upgrades.
+type MaintenanceInfo struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// maintenanceInfo returns the catalog maintenance_info for the OpenClaw
+// version plan deploys, or nil when no version is configured.
+func (b *Broker) maintenanceInfo(plan *Plan) *MaintenanceInfo {
+	version := b.planVersion(plan)
+	if version == "" {
+		return nil
+	}
+	return &MaintenanceInfo{
+		Version:     version,
+		Description: fmt.Sprintf("OpenClaw %s", version),
+	}
+}
+
+// offersVersion reports whether version is deployed by any plan.
+func (b *Broker) offersVersion(version string) bool {
+	if version == b.config.OpenClawVersion {
+		return true
+	}
+	plans := b.config.Plans
+	if len(plans) == 0 {
+		plans = defaultPlans()
+	}
+	for i := range plans {
+		if plans[i].OpenClawVersion == version {
+			return true
+		}
+	}
+	return false
 }
 
 func (b *Broker) Catalog(w http.ResponseWriter, r *http.Request) {
+	body, etag, err := b.catalogBody(r)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Catalog failed", "description": err.Error()})
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// catalogBody returns the serialized catalog for r and its ETag.
+func (b *Broker) catalogBody(r *http.Request) ([]byte, string, error) {
+	if !b.config.CatalogQuotas {
+		return b.cachedCatalog()
+	}
+	// Quota metadata is per caller and changes with every provision, so a
+	// catalog carrying it is never cached
 	plans := b.buildServicePlans()
+	b.addQuotaMetadata(plans, b.originatingIdentity(r.Context(), r))
+	body, err := marshalCatalog(b.catalogResponse(plans))
+	if err != nil {
+		return nil, "", err
+	}
+	return body, catalogETag(body), nil
+}
+
+// catalogCache holds the serialized catalog and its ETag. The catalog is
+// derived from config alone, so it is built on first use and again only
+// after invalidateCatalog.
+type catalogCache struct {
+	mu   sync.Mutex
+	body []byte
+	etag string
+}
+
+// cachedCatalog returns the serialized catalog and its ETag, building them
+// if config changed since the last call.
+func (b *Broker) cachedCatalog() ([]byte, string, error) {
+	b.catalogCache.mu.Lock()
+	defer b.catalogCache.mu.Unlock()
+	if b.catalogCache.body == nil {
+		body, err := marshalCatalog(b.catalogResponse(b.buildServicePlans()))
+		if err != nil {
+			return nil, "", err
+		}
+		b.catalogCache.body, b.catalogCache.etag = body, catalogETag(body)
+	}
+	return b.catalogCache.body, b.catalogCache.etag, nil
+}
+
+// invalidateCatalog drops the cached catalog; call it whenever config the
+// catalog is built from changes.
+func (b *Broker) invalidateCatalog() {
+	b.catalogCache.mu.Lock()
+	defer b.catalogCache.mu.Unlock()
+	b.catalogCache.body, b.catalogCache.etag = nil, ""
+}
+
+func marshalCatalog(catalog CatalogResponse) ([]byte, error) {
+	body, err := json.Marshal(catalog)
+	if err != nil {
+		return nil, err
+	}
+	return append(body, '\n'), nil
+}
+
+// catalogETag returns a strong ETag for a serialized catalog.
+func catalogETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header value names etag. Weak
+// validators match too, as RFC 9110 requires for If-None-Match.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
 
-	catalog := CatalogResponse{
+// catalogResponse wraps plans in the broker's single service offering.
+func (b *Broker) catalogResponse(plans []ServicePlan) CatalogResponse {
+	return CatalogResponse{
 		Services: []Service{
 			{
 				ID:                   "openclaw-service",
@@ -55,9 +190,6 @@ func (b *Broker) Catalog(w http.ResponseWriter, r *http.Request) {
 			},
 		},
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(catalog)
 }
 
 func (b *Broker) buildServicePlans() []ServicePlan {
@@ -67,15 +199,155 @@ func (b *Broker) buildServicePlans() []ServicePlan {
 	}
 
 	plans := make([]ServicePlan, 0, len(configPlans))
-	for _, p := range configPlans {
+	for i, p := range configPlans {
 		sp := ServicePlan{
 			ID:          p.ID,
 			Name:        p.Name,
-			Description: p.Description,
+			Description: planDescription(p),
 			Free:        false,
-			Metadata:    p.Metadata,
+			Metadata:    planMetadata(p, i),
+			Schemas: &PlanSchemas{
+				ServiceInstance: ServiceInstanceSchemas{
+					Create: &InputParametersSchema{Parameters: provisionParametersSchema()},
+				},
+			},
+			MaintenanceInfo: b.maintenanceInfo(&p),
 		}
 		plans = append(plans, sp)
 	}
+	// Plans with an explicit displayOrder can tie with positional ones, so
+	// break ties by name to keep the catalog byte-stable
+	sort.SliceStable(plans, func(i, j int) bool {
+		oi, oj := displayOrder(plans[i].Metadata), displayOrder(plans[j].Metadata)
+		if oi != oj {
+			return oi < oj
+		}
+		return plans[i].Name < plans[j].Name
+	})
 	return plans
 }
+
+// displayOrder reads metadata.displayOrder, which is an int from the
+// defaults and YAML config but a float64 from JSON config.
+func displayOrder(metadata map[string]interface{}) float64 {
+	switch v := metadata["displayOrder"].(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// planMetadata returns the catalog metadata for the plan at position i. The
+// plan's own metadata (displayName, bullets, and OSB "costs" entries of
+// {"amount": {"usd": 99.0}, "unit": "MONTHLY"}) passes through unchanged;
+// displayOrder defaults to the plan's position so marketplaces list plans in
+// configured order, and the catalog is sorted by it. Returns a copy so the plan config is never mutated.
+func planMetadata(p Plan, i int) map[string]interface{} {
+	metadata := make(map[string]interface{}, len(p.Metadata)+1)
+	for k, v := range p.Metadata {
+		metadata[k] = v
+	}
+	if _, ok := metadata["displayOrder"]; !ok {
+		metadata["displayOrder"] = i + 1
+	}
+	if p.Deprecated {
+		metadata["deprecated"] = true
+		metadata["deprecationMessage"] = planDeprecationMessage(&p)
+	}
+	return metadata
+}
+
+// PlanQuota is the remaining capacity reported in a plan's metadata.quota
+// when BrokerConfig.CatalogQuotas is set.
+type PlanQuota struct {
+	UsedInstances int `json:"used_instances"`
+	MaxInstances  int `json:"max_instances,omitempty"`
+	// RemainingInstances is how many more instances of this plan fit under
+	// the instance and memory limits; absent when neither is set.
+	RemainingInstances *int `json:"remaining_instances,omitempty"`
+	Full               bool `json:"full"`
+	// Orgs reports the per-org limit for the orgs the requesting user has
+	// instances in, keyed by org GUID.
+	Orgs map[string]OrgQuota `json:"orgs,omitempty"`
+}
+
+// OrgQuota is one org's usage against BrokerConfig.MaxInstancesPerOrg.
+type OrgQuota struct {
+	UsedInstances      int `json:"used_instances"`
+	MaxInstances       int `json:"max_instances"`
+	RemainingInstances int `json:"remaining_instances"`
+}
+
+// addQuotaMetadata sets metadata.quota on each plan from live instance
+// counts. user, if known, scopes the per-org figures to that user's orgs.
+func (b *Broker) addQuotaMetadata(plans []ServicePlan, user *OriginatingIdentity) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	used := b.countInstances()
+	freeMemory := b.config.MaxTotalMemoryMB - b.totalMemoryMB()
+	var orgs map[string]OrgQuota
+	if user != nil && user.UserID != "" && b.config.MaxInstancesPerOrg > 0 {
+		orgs = make(map[string]OrgQuota)
+		for _, inst := range b.instances {
+			if !active(inst) || inst.OrgGUID == "" || inst.CreatedBy == nil || inst.CreatedBy.UserID != user.UserID {
+				continue
+			}
+			orgUsed := b.countInstancesByOrg(inst.OrgGUID)
+			orgs[inst.OrgGUID] = OrgQuota{
+				UsedInstances:      orgUsed,
+				MaxInstances:       b.config.MaxInstancesPerOrg,
+				RemainingInstances: max(0, b.config.MaxInstancesPerOrg-orgUsed),
+			}
+		}
+	}
+
+	for i := range plans {
+		quota := PlanQuota{UsedInstances: used, MaxInstances: b.config.MaxInstances, Orgs: orgs}
+		remaining := -1
+		if b.config.MaxInstances > 0 {
+			remaining = max(0, b.config.MaxInstances-used)
+		}
+		if plan := b.findPlan(plans[i].ID); b.config.MaxTotalMemoryMB > 0 && plan != nil && plan.Memory > 0 {
+			if fit := max(0, freeMemory/plan.Memory); remaining < 0 || fit < remaining {
+				remaining = fit
+			}
+		}
+		if remaining >= 0 {
+			quota.RemainingInstances = &remaining
+			quota.Full = remaining == 0
+		}
+		plans[i].Metadata["quota"] = quota
+	}
+}
+
+// planDescription flags deprecated plans so marketplace listings show it.
+func planDescription(p Plan) string {
+	if p.Deprecated {
+		return "[Deprecated] " + p.Description
+	}
+	return p.Description
+}
+
+// planDeprecationMessage explains why plan can't be provisioned.
+func planDeprecationMessage(plan *Plan) string {
+	if plan.DeprecationMessage != "" {
+		return plan.DeprecationMessage
+	}
+	return fmt.Sprintf("Plan %s is deprecated and no longer accepts new instances", plan.Name)
+}
+
+// allowsUpdateTo reports whether instances on plan may move to target.
+func (plan *Plan) allowsUpdateTo(target *Plan) bool {
+	if len(plan.AllowedUpdates) == 0 {
+		return true
+	}
+	for _, allowed := range plan.AllowedUpdates {
+		if allowed == target.Name || allowed == target.ID {
+			return true
+		}
+	}
+	return false
+}
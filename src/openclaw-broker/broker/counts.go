@@ -0,0 +1,100 @@
+package broker
+
+// instanceCounts tallies active (non-deprovisioning) instances so quota
+// checks don't rescan every instance on each provision. It is kept in step
+// with b.instances by putInstance, removeInstance and setInstanceState.
+type instanceCounts struct {
+	total   int
+	byOrg   map[string]int
+	bySpace map[string]int
+}
+
+// active reports whether inst counts against quotas.
+func active(inst *Instance) bool {
+	return inst.State != "deprovisioning"
+}
+
+// add adjusts the counts for inst by delta, dropping keys that reach zero.
+func (c *instanceCounts) add(inst *Instance, delta int) {
+	if c.byOrg == nil {
+		c.byOrg = make(map[string]int)
+	}
+	if c.bySpace == nil {
+		c.bySpace = make(map[string]int)
+	}
+	c.total += delta
+	if c.byOrg[inst.OrgGUID] += delta; c.byOrg[inst.OrgGUID] == 0 {
+		delete(c.byOrg, inst.OrgGUID)
+	}
+	if c.bySpace[inst.SpaceGUID] += delta; c.bySpace[inst.SpaceGUID] == 0 {
+		delete(c.bySpace, inst.SpaceGUID)
+	}
+}
+
+// scanInstanceCounts counts instances from scratch. loadState uses it to
+// seed the counters and tests use it to cross-check them.
+func scanInstanceCounts(instances map[string]*Instance) instanceCounts {
+	c := instanceCounts{byOrg: make(map[string]int), bySpace: make(map[string]int)}
+	for _, inst := range instances {
+		if active(inst) {
+			c.add(inst, 1)
+		}
+	}
+	return c
+}
+
+// putInstance stores inst, replacing any instance with the same ID.
+// Must be called with b.mu held.
+func (b *Broker) putInstance(inst *Instance) {
+	b.removeInstance(inst.ID)
+	b.instances[inst.ID] = inst
+	if active(inst) {
+		b.counts.add(inst, 1)
+	}
+}
+
+// removeInstance forgets the instance with the given ID, if any.
+// Must be called with b.mu held.
+func (b *Broker) removeInstance(id string) {
+	inst, ok := b.instances[id]
+	if !ok {
+		return
+	}
+	if active(inst) {
+		b.counts.add(inst, -1)
+	}
+	delete(b.instances, id)
+}
+
+// setInstanceState changes the state of a stored instance, moving it in or
+// out of the counts when it enters or leaves deprovisioning.
+// Must be called with b.mu held.
+func (b *Broker) setInstanceState(inst *Instance, state string) {
+	wasActive := active(inst)
+	inst.State = state
+	if isActive := active(inst); isActive != wasActive {
+		if isActive {
+			b.counts.add(inst, 1)
+		} else {
+			b.counts.add(inst, -1)
+		}
+	}
+}
+
+// countInstances returns the total number of active (non-deprovisioning) instances.
+// Must be called with b.mu held.
+func (b *Broker) countInstances() int {
+	return b.counts.total
+}
+
+// countInstancesByOrg returns the number of active instances for a given org.
+// Must be called with b.mu held.
+func (b *Broker) countInstancesByOrg(orgGUID string) int {
+	return b.counts.byOrg[orgGUID]
+}
+
+// countInstancesBySpace returns the number of active instances for a given space.
+// Must be called with b.mu held.
+func (b *Broker) countInstancesBySpace(spaceGUID string) int {
+	return b.counts.bySpace[spaceGUID]
+}
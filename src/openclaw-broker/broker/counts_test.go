@@ -0,0 +1,85 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"net/http/httptest"
+	"testing"
+)
+
+// assertCountsConsistent cross-checks the incremental counters against a
+// full scan of the instances.
+func assertCountsConsistent(t *testing.T, b *Broker, step string) {
+	t.Helper()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	want := scanInstanceCounts(b.instances)
+	if b.counts.total != want.total || !maps.Equal(b.counts.byOrg, want.byOrg) || !maps.Equal(b.counts.bySpace, want.bySpace) {
+		t.Errorf("after %s: counts = %+v, scan = %+v", step, b.counts, want)
+	}
+}
+
+func TestInstanceCounts_StayConsistent(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	lastOp := func(id string) {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/service_instances/"+id+"/last_operation", nil))
+	}
+	deprovision := func(id string) {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/v2/service_instances/"+id+"?accepts_incomplete=true&service_id=openclaw-service&plan_id=openclaw-developer-plan", nil))
+	}
+
+	provisionInSpace(t, router, "inst-a", "org-1", "space-a")
+	provisionInSpace(t, router, "inst-b", "org-1", "space-b")
+	provisionInSpace(t, router, "inst-c", "org-2", "space-c")
+	lastOp("inst-a")
+	assertCountsConsistent(t, b, "provision")
+	if b.countInstances() != 3 || b.countInstancesByOrg("org-1") != 2 || b.countInstancesBySpace("space-c") != 1 {
+		t.Errorf("counts = %+v, want 3 instances with 2 in org-1", b.counts)
+	}
+
+	deprovision("inst-a")
+	assertCountsConsistent(t, b, "deprovision")
+	if b.countInstancesByOrg("org-1") != 1 {
+		t.Errorf("org-1 count = %d, want a deprovisioning instance excluded", b.countInstancesByOrg("org-1"))
+	}
+	lastOp("inst-a")
+	assertCountsConsistent(t, b, "deprovision completed")
+
+	// Orphan recovery: an update and a deprovision for instances the broker
+	// has never seen
+	body, _ := json.Marshal(UpdateRequest{ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan"})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PATCH", "/v2/service_instances/inst-orphan?accepts_incomplete=true", bytes.NewReader(body)))
+	assertCountsConsistent(t, b, "update orphan recovery")
+	deprovision("inst-orphan-gone")
+	assertCountsConsistent(t, b, "deprovision orphan recovery")
+	lastOp("inst-orphan-gone")
+	assertCountsConsistent(t, b, "orphan deprovision completed")
+
+	// Provisioning over the same ID replaces rather than double-counts
+	b.mu.Lock()
+	b.putInstance(&Instance{ID: "inst-b", OrgGUID: "org-1", SpaceGUID: "space-b", State: "ready"})
+	b.mu.Unlock()
+	assertCountsConsistent(t, b, "replace")
+	if b.countInstances() != 3 {
+		t.Errorf("total = %d, want inst-b, inst-c and inst-orphan", b.countInstances())
+	}
+}
+
+func TestInstanceCounts_RebuiltOnLoad(t *testing.T) {
+	cfg := BrokerConfig{StateDir: t.TempDir(), AppsDomain: "apps.example.com"}
+	b := New(cfg, nil)
+	b.mu.Lock()
+	b.putInstance(&Instance{ID: "inst-1", OrgGUID: "org-1", SpaceGUID: "space-1", State: "ready"})
+	b.putInstance(&Instance{ID: "inst-2", OrgGUID: "org-1", SpaceGUID: "space-2", State: "deprovisioning"})
+	b.mu.Unlock()
+	b.saveInstance("inst-1")
+	b.saveInstance("inst-2")
+
+	reloaded := New(cfg, nil)
+	assertCountsConsistent(t, reloaded, "load")
+	if reloaded.countInstances() != 1 || reloaded.countInstancesByOrg("org-1") != 1 || reloaded.countInstancesBySpace("space-2") != 0 {
+		t.Errorf("counts = %+v, want only the active instance", reloaded.counts)
+	}
+}
@@ -0,0 +1,88 @@
+package broker
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// DefaultDashboardURLTemplate is the agent's own route.
+const DefaultDashboardURLTemplate = "https://{{.RouteHostname}}.{{.AppsDomain}}"
+
+// DashboardURLFields are the instance fields a dashboard URL template can use.
+type DashboardURLFields struct {
+	ID            string
+	RouteHostname string
+	AppsDomain    string
+	Owner         string
+	PlanName      string
+	OrgGUID       string
+	SpaceGUID     string
+}
+
+// ParseDashboardURLTemplate parses and trial-renders a dashboard URL template,
+// rejecting ones that reference unknown fields or don't produce an absolute
+// http(s) URL. An empty text parses DefaultDashboardURLTemplate.
+func ParseDashboardURLTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultDashboardURLTemplate
+	}
+	tmpl, err := template.New("dashboard_url").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	sample := DashboardURLFields{
+		ID: "instance-id", RouteHostname: "openclaw-owner-abc123", AppsDomain: "apps.example.com",
+		Owner: "owner", PlanName: "developer", OrgGUID: "org-guid", SpaceGUID: "space-guid",
+	}
+	rendered, err := renderDashboardURL(tmpl, sample)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(rendered)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("template must render an absolute http(s) URL, got %q", rendered)
+	}
+	return tmpl, nil
+}
+
+func renderDashboardURL(tmpl *template.Template, fields DashboardURLFields) (string, error) {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, fields); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// dashboardURL returns the instance's dashboard URL from the configured
+// template, falling back to its route if the template fails to render. Must
+// be called with b.mu held.
+func (b *Broker) dashboardURL(instance *Instance) string {
+	fields := DashboardURLFields{
+		ID:            instance.ID,
+		RouteHostname: instance.RouteHostname,
+		AppsDomain:    instance.AppsDomain,
+		Owner:         instance.Owner,
+		PlanName:      instance.PlanName,
+		OrgGUID:       instance.OrgGUID,
+		SpaceGUID:     instance.SpaceGUID,
+	}
+	if b.dashboardTmpl != nil {
+		rendered, err := renderDashboardURL(b.dashboardTmpl, fields)
+		if err == nil {
+			return rendered
+		}
+		b.logger.Warn("dashboard URL template failed, using the agent route", "instance_id", instance.ID, "error", err)
+	}
+	return fmt.Sprintf("https://%s.%s", instance.RouteHostname, instance.AppsDomain)
+}
+
+// withToken appends the gateway token to a dashboard URL as a query parameter.
+func withToken(dashboardURL, token string) string {
+	sep := "?"
+	if strings.Contains(dashboardURL, "?") {
+		sep = "&"
+	}
+	return dashboardURL + sep + "token=" + token
+}
@@ -1,10 +1,11 @@
 package broker
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/uaa"
@@ -17,18 +18,21 @@ type DeprovisionResponse struct {
 func (b *Broker) Deprovision(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	instanceID := vars["instance_id"]
+	ctx := r.Context()
 
 	// OSB API: async operations require accepts_incomplete=true
-	if r.URL.Query().Get("accepts_incomplete") != "true" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error":       "AsyncRequired",
-			"description": "This service plan requires client support for asynchronous service operations.",
-		})
+	if !requireAsync(w, r) {
 		return
 	}
 
+	// Wait out any Update still submitting its deploy, so the delete is
+	// issued after it and wins
+	unlock := b.ops.lock(instanceID)
+	defer unlock()
+
+	done := b.beginBOSHWrite()
+	defer done()
+
 	b.mu.Lock()
 
 	instance, exists := b.instances[instanceID]
@@ -36,33 +40,39 @@ func (b *Broker) Deprovision(w http.ResponseWriter, r *http.Request) {
 		// Instance not in broker memory (e.g., broker restarted after tile redeploy).
 		// Attempt to delete the BOSH deployment using the known naming convention
 		// rather than returning 410 Gone and orphaning the deployment.
-		deploymentName := fmt.Sprintf("openclaw-agent-%s", instanceID)
+		deploymentName := b.deploymentName(instanceID)
 		instance = &Instance{
 			ID:             instanceID,
 			DeploymentName: deploymentName,
 			State:          "deprovisioning",
 		}
-		b.instances[instanceID] = instance
+		b.putInstance(instance)
 		b.mu.Unlock()
 
 		// Delete per-instance UAA OAuth2 client (best-effort — don't block deprovision on failure)
-		b.deleteUAAClient(instanceID)
+		b.deleteUAAClient(ctx, instanceID)
 
-		taskID, err := b.director.DeleteDeployment(deploymentName)
+		taskID, err := b.deleteDeployment(ctx, instanceID, deploymentName)
 		if err != nil {
-			log.Printf("BOSH delete for orphaned deployment %s failed: %v", deploymentName, err)
+			b.logger.WarnContext(ctx, "BOSH delete for orphaned deployment failed", "operation", "deprovision",
+				"instance_id", instanceID, "deployment", deploymentName, "error", err)
 			b.mu.Lock()
-			delete(b.instances, instanceID)
+			b.removeInstance(instanceID)
 			b.mu.Unlock()
 			// Return 410 Gone so CF can clean up its side even if BOSH deployment is already gone
 			writeJSON(w, http.StatusGone, map[string]string{})
 			return
 		}
 
+		user := b.originatingIdentity(ctx, r)
 		b.mu.Lock()
 		instance.BoshTaskID = taskID
+		instance.LastModifiedBy = user
 		b.mu.Unlock()
-		b.saveState()
+		b.saveInstance(instanceID)
+		b.logger.InfoContext(ctx, "BOSH delete started for orphaned deployment", "operation", "deprovision",
+			"instance_id", instanceID, "bosh_task_id", taskID)
+		b.audit(ctx, "deprovision", instanceID, "", user)
 
 		writeJSON(w, http.StatusAccepted, DeprovisionResponse{
 			Operation: fmt.Sprintf("deprovision-%s", instanceID),
@@ -79,30 +89,48 @@ func (b *Broker) Deprovision(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Mark as deprovisioning and capture deployment name before releasing lock
+	// Mark as deprovisioning and capture deployment name before releasing lock.
+	// A deploy still in flight is cancelled first so the delete doesn't race it;
+	// CancelledTaskID guards against cancelling the same task twice on retry.
 	previousState := instance.State
-	instance.State = "deprovisioning"
+	b.setInstanceState(instance, "deprovisioning")
 	deploymentName := instance.DeploymentName
+	cancelTaskID := 0
+	if previousState == "provisioning" && instance.BoshTaskID != 0 && instance.CancelledTaskID != instance.BoshTaskID {
+		cancelTaskID = instance.BoshTaskID
+		instance.CancelledTaskID = cancelTaskID
+	}
 	b.mu.Unlock()
 
+	if cancelTaskID != 0 {
+		b.cancelInFlightTask(ctx, instanceID, cancelTaskID)
+	}
+
 	// Delete per-instance UAA OAuth2 client (best-effort — don't block deprovision on failure)
-	b.deleteUAAClient(instanceID)
+	b.deleteUAAClient(ctx, instanceID)
 
-	taskID, err := b.director.DeleteDeployment(deploymentName)
+	taskID, err := b.deleteDeployment(ctx, instanceID, deploymentName)
 	if err != nil {
-		log.Printf("BOSH delete failed for %s: %v", instanceID, err)
+		b.logger.ErrorContext(ctx, "BOSH delete failed", "operation", "deprovision", "instance_id", instanceID, "error", err)
 		// Restore previous state on failure
 		b.mu.Lock()
-		instance.State = previousState
+		b.setInstanceState(instance, previousState)
 		b.mu.Unlock()
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Deprovision failed"})
+		osbError(w, http.StatusInternalServerError, "DeprovisionFailed", "The BOSH Director rejected the deployment delete")
 		return
 	}
 
+	user := b.originatingIdentity(ctx, r)
 	b.mu.Lock()
 	instance.BoshTaskID = taskID
+	instance.LastError = ""
+	if user != nil {
+		instance.LastModifiedBy = user
+	}
 	b.mu.Unlock()
-	b.saveState()
+	b.saveInstance(instanceID)
+	b.logger.InfoContext(ctx, "BOSH delete started", "operation", "deprovision", "instance_id", instanceID, "bosh_task_id", taskID)
+	b.audit(ctx, "deprovision", instanceID, "", user)
 
 	resp := DeprovisionResponse{
 		Operation: fmt.Sprintf("deprovision-%s", instanceID),
@@ -113,16 +141,43 @@ func (b *Broker) Deprovision(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// cancelWaitTimeout bounds how long Deprovision waits for a cancelled deploy
+// to stop before submitting the delete.
+const cancelWaitTimeout = 30 * time.Second
+
+// cancelInFlightTask cancels a still-running provision deploy and waits briefly
+// for it to stop. Best-effort: the delete is submitted regardless, since the
+// Director will queue it behind the deployment lock.
+func (b *Broker) cancelInFlightTask(ctx context.Context, instanceID string, taskID int) {
+	if err := b.director.CancelTask(taskID); err != nil {
+		b.logger.WarnContext(ctx, "failed to cancel in-flight task", "operation", "deprovision",
+			"instance_id", instanceID, "bosh_task_id", taskID, "error", err)
+		return
+	}
+	b.logger.InfoContext(ctx, "cancelled in-flight provision task", "operation", "deprovision",
+		"instance_id", instanceID, "bosh_task_id", taskID)
+	if _, err := b.waitForTask(ctx, taskID, cancelWaitTimeout); err != nil {
+		b.logger.WarnContext(ctx, "task still running after cancel", "operation", "deprovision",
+			"instance_id", instanceID, "bosh_task_id", taskID, "error", err)
+	}
+}
+
 // deleteUAAClient removes the per-instance UAA OAuth2 client.
 // Best-effort: logs errors but does not fail the deprovision.
-func (b *Broker) deleteUAAClient(instanceID string) {
+func (b *Broker) deleteUAAClient(ctx context.Context, instanceID string) {
+	b.deleteSSOClient(ctx, instanceID, uaa.ClientIDForInstance(instanceID))
+}
+
+// deleteSSOClient removes the given UAA OAuth2 client. A client that is
+// already gone counts as deleted. Best-effort: logs errors.
+func (b *Broker) deleteSSOClient(ctx context.Context, instanceID, clientID string) {
 	if b.uaaClient == nil {
 		return
 	}
-	clientID := uaa.ClientIDForInstance(instanceID)
-	if err := b.uaaClient.DeleteClient(clientID); err != nil {
-		log.Printf("Failed to delete UAA client %s for instance %s: %v (will be orphaned in UAA)", clientID, instanceID, err)
+	if err := b.traceUAA(ctx, "uaa.delete_client", instanceID, clientID, func() error { return b.uaaClient.DeleteClient(clientID) }); err != nil {
+		b.logger.WarnContext(ctx, "failed to delete UAA client, it will be orphaned in UAA", "operation", "deprovision",
+			"instance_id", instanceID, "client_id", clientID, "error", err)
 	} else {
-		log.Printf("Deleted UAA OAuth2 client %s for instance %s", clientID, instanceID)
+		b.logger.InfoContext(ctx, "deleted UAA OAuth2 client", "operation", "deprovision", "instance_id", instanceID, "client_id", clientID)
 	}
 }
@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// maxImportBytes bounds an import body; a full export of a large foundation
+// is well under this.
+const maxImportBytes = 64 << 20
+
+// AdminExport returns every instance record, secrets included, keyed by ID,
+// for moving instances to another foundation's broker with AdminImport.
+func (b *Broker) AdminExport(w http.ResponseWriter, r *http.Request) {
+	b.mu.RLock()
+	data, err := json.Marshal(b.instances)
+	count := len(b.instances)
+	b.mu.RUnlock()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Export failed", "description": err.Error()})
+		return
+	}
+
+	// The export carries every instance's secrets, so record who pulled it
+	b.logger.InfoContext(r.Context(), "exported instance state", "operation", "export", "count", count)
+	b.audit(r.Context(), "export", "", "", nil)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// ImportResult is the AdminImport response.
+type ImportResult struct {
+	Imported    []string `json:"imported"`
+	Overwritten []string `json:"overwritten"`
+}
+
+// AdminImport merges an AdminExport body into broker state and persists it.
+// The import is all-or-nothing: if any ID already exists it is refused with
+// 409 unless ?overwrite=true, in which case the imported record replaces it.
+func (b *Broker) AdminImport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	overwrite, _ := strconv.ParseBool(r.URL.Query().Get("overwrite"))
+
+	var imported map[string]*Instance
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportBytes)).Decode(&imported); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Bad request", "description": err.Error()})
+		return
+	}
+	ids := make([]string, 0, len(imported))
+	for id, inst := range imported {
+		if inst == nil || !validInstanceID.MatchString(id) || (inst.ID != "" && inst.ID != id) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error":       "Bad request",
+				"description": fmt.Sprintf("Invalid instance record %q", id),
+			})
+			return
+		}
+		inst.ID = id
+		failInterruptedBindings(inst)
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	b.mu.Lock()
+	var existing []string
+	for _, id := range ids {
+		if _, ok := b.instances[id]; ok {
+			existing = append(existing, id)
+		}
+	}
+	if len(existing) > 0 && !overwrite {
+		b.mu.Unlock()
+		writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"error":       "InstancesExist",
+			"description": "Some instances already exist; retry with ?overwrite=true to replace them",
+			"existing":    existing,
+		})
+		return
+	}
+	for _, id := range ids {
+		b.putInstance(imported[id])
+	}
+	b.mu.Unlock()
+
+	for _, id := range ids {
+		b.saveInstance(id)
+		b.audit(ctx, "import", id, "", nil)
+	}
+	if existing == nil {
+		existing = []string{}
+	}
+	b.logger.InfoContext(ctx, "imported instance state", "operation", "import", "count", len(ids), "overwritten", len(existing))
+	writeJSON(w, http.StatusOK, ImportResult{Imported: ids, Overwritten: existing})
+}
@@ -0,0 +1,23 @@
+package broker
+
+// LLMCredentials returns the GenAI endpoint, API key and model rendered into
+// new agent manifests.
+func (b *Broker) LLMCredentials() (endpoint, apiKey, model string) {
+	b.llmMu.RLock()
+	defer b.llmMu.RUnlock()
+	return b.config.LLMEndpoint, b.config.LLMAPIKey, b.config.LLMModel
+}
+
+// SetLLMCredentials replaces the GenAI credentials after a marketplace
+// service key rotation. Instances pick them up on their next deploy. Reports
+// whether anything changed.
+func (b *Broker) SetLLMCredentials(endpoint, apiKey, model string) bool {
+	b.llmMu.Lock()
+	defer b.llmMu.Unlock()
+	if b.config.LLMEndpoint == endpoint && b.config.LLMAPIKey == apiKey && b.config.LLMModel == model {
+		return false
+	}
+	b.config.LLMEndpoint, b.config.LLMAPIKey, b.config.LLMModel = endpoint, apiKey, model
+	b.invalidateCatalog()
+	return true
+}
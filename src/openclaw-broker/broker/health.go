@@ -0,0 +1,62 @@
+package broker
+
+import (
+	"net/http"
+	"os"
+	"time"
+)
+
+// readinessProbeTimeout bounds the Director reachability check so a hung
+// Director can't stall the readiness endpoint.
+const readinessProbeTimeout = 5 * time.Second
+
+// Healthz is an unauthenticated liveness probe. It returns 200 as long as
+// the process is serving HTTP.
+func (b *Broker) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readyz is an unauthenticated readiness probe. It returns 200 only when the
+// BOSH Director is reachable with a valid token and the state directory is
+// writable; otherwise 503 with the per-component status.
+func (b *Broker) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+
+	if err := b.director.Ping(readinessProbeTimeout); err != nil {
+		checks["bosh_director"] = err.Error()
+		ready = false
+	} else {
+		checks["bosh_director"] = "ok"
+	}
+
+	if err := b.checkStateDirWritable(); err != nil {
+		checks["state_dir"] = err.Error()
+		ready = false
+	} else {
+		checks["state_dir"] = "ok"
+	}
+
+	status := http.StatusOK
+	resp := map[string]interface{}{"status": "ready", "checks": checks}
+	if !ready {
+		status = http.StatusServiceUnavailable
+		resp["status"] = "not ready"
+	}
+	writeJSON(w, status, resp)
+}
+
+// checkStateDirWritable verifies the broker can create files in StateDir.
+// Persistence is optional, so an unset StateDir is considered healthy.
+func (b *Broker) checkStateDirWritable() error {
+	if b.config.StateDir == "" {
+		return nil
+	}
+	f, err := os.CreateTemp(b.config.StateDir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/bosh"
+)
+
+type readyzResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func TestHealthz_ReturnsOK(t *testing.T) {
+	b, fakeBOSH, _ := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+
+	rr := httptest.NewRecorder()
+	b.Healthz(rr, httptest.NewRequest("GET", "/healthz", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Healthz status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want %q", ct, "application/json")
+	}
+}
+
+func TestReadyz_Ready(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	b := New(BrokerConfig{StateDir: t.TempDir()}, director)
+
+	rr := httptest.NewRecorder()
+	b.Readyz(rr, httptest.NewRequest("GET", "/readyz", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Readyz status = %d, want %d. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var resp readyzResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.Checks["bosh_director"] != "ok" || resp.Checks["state_dir"] != "ok" {
+		t.Errorf("Checks = %v, want all ok", resp.Checks)
+	}
+}
+
+func TestReadyz_DirectorUnreachable(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	fakeBOSH.Close() // Director goes away before the probe
+	b := New(BrokerConfig{StateDir: t.TempDir()}, director)
+
+	rr := httptest.NewRecorder()
+	b.Readyz(rr, httptest.NewRequest("GET", "/readyz", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Readyz status = %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	var resp readyzResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.Checks["bosh_director"] == "ok" {
+		t.Error("bosh_director check should report failure")
+	}
+	if resp.Checks["state_dir"] != "ok" {
+		t.Errorf("state_dir check = %q, want ok", resp.Checks["state_dir"])
+	}
+}
+
+func TestReadyz_StateDirNotWritable(t *testing.T) {
+	fakeBOSH := newFakeBOSHDirector("done", false)
+	defer fakeBOSH.Close()
+	director := bosh.NewClient(fakeBOSH.URL, "admin", "admin", "", "")
+	b := New(BrokerConfig{StateDir: filepath.Join(t.TempDir(), "missing")}, director)
+
+	rr := httptest.NewRecorder()
+	b.Readyz(rr, httptest.NewRequest("GET", "/readyz", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Readyz status = %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	var resp readyzResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.Status != "not ready" {
+		t.Errorf("Status = %q, want %q", resp.Status, "not ready")
+	}
+	if resp.Checks["state_dir"] == "ok" {
+		t.Error("state_dir check should report failure")
+	}
+}
+
+func TestServeVersion_DefaultBuildInfo(t *testing.T) {
+	b := New(BrokerConfig{OpenClawVersion: "2026.2.21-2"}, nil)
+
+	rr := httptest.NewRecorder()
+	b.ServeVersion(rr, httptest.NewRequest("GET", "/version", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("ServeVersion status = %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	var info map[string]interface{}
+	if err := json.NewDecoder(rr.Body).Decode(&info); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := map[string]interface{}{
+		"version":          "dev",
+		"commit":           "unknown",
+		"build_date":       "unknown",
+		"openclaw_version": "2026.2.21-2",
+		"plan_count":       float64(len(defaultPlans())),
+	}
+	for key, value := range want {
+		if info[key] != value {
+			t.Errorf("%s = %v, want %v", key, info[key], value)
+		}
+	}
+}
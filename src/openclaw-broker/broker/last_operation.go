@@ -1,9 +1,12 @@
 package broker
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -16,16 +19,41 @@ type LastOperationResponse struct {
 func (b *Broker) LastOperation(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	instanceID := vars["instance_id"]
+	ctx := r.Context()
 
-	// Read instance state and task ID under lock, then release before
-	// making BOSH HTTP calls to avoid blocking other operations.
 	b.mu.RLock()
 	instance, exists := b.instances[instanceID]
+	b.mu.RUnlock()
 	if !exists {
-		b.mu.RUnlock()
-		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Instance not found"})
+		// OSB: 410 Gone tells the platform a deprovision it is polling has
+		// finished, e.g. because the task watcher already removed the instance
+		if strings.HasPrefix(r.URL.Query().Get("operation"), "deprovision") {
+			writeJSON(w, http.StatusGone, map[string]string{})
+			return
+		}
+		osbError(w, http.StatusNotFound, "InstanceNotFound", fmt.Sprintf("Instance %s does not exist", instanceID))
 		return
 	}
+
+	// With the task watcher running, state is kept current in the background
+	var resp LastOperationResponse
+	if b.watching.Load() {
+		resp = b.cachedOperation(instance)
+	} else {
+		resp = b.advanceOperation(ctx, instance)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// advanceOperation polls BOSH for an instance's in-flight operation and
+// records any state change, returning the operation's status.
+func (b *Broker) advanceOperation(ctx context.Context, instance *Instance) LastOperationResponse {
+	// Read instance state and task ID under lock, then release before
+	// making BOSH HTTP calls to avoid blocking other operations.
+	b.mu.RLock()
+	instanceID := instance.ID
 	state := instance.State
 	taskID := instance.BoshTaskID
 	b.mu.RUnlock()
@@ -38,23 +66,39 @@ func (b *Broker) LastOperation(w http.ResponseWriter, r *http.Request) {
 			resp = LastOperationResponse{State: "in progress", Description: "Waiting for deployment task..."}
 			break
 		}
-		taskState, err := b.director.TaskStatus(taskID)
+		taskState, err := b.taskStatus(ctx, instanceID, taskID)
 		if err != nil {
-			log.Printf("TaskStatus error for %s (task %d): %v", instanceID, taskID, err)
+			b.logger.WarnContext(ctx, "BOSH task status check failed", "operation", "provision",
+				"instance_id", instanceID, "bosh_task_id", taskID, "error", err)
 		}
 		switch taskState {
 		case "done":
-			b.mu.Lock()
-			instance.State = "ready"
-			b.mu.Unlock()
-			b.saveState()
+			// BOSH is done before route_registrar has published the route;
+			// hold the instance back until the route is served.
+			if !b.routeReady(ctx, instanceID, instance) {
+				b.mu.Lock()
+				instance.State = stateDeployingRoute
+				instance.RouteWaitSince = time.Now().UTC()
+				b.mu.Unlock()
+				b.saveInstance(instanceID)
+				b.logger.InfoContext(ctx, "deploy done, waiting for route registration", "operation", "provision",
+					"instance_id", instanceID, "bosh_task_id", taskID)
+				resp = LastOperationResponse{State: "in progress", Description: "Waiting for route registration..."}
+				break
+			}
+			b.markReady(ctx, instanceID, instance)
 			resp = LastOperationResponse{State: "succeeded", Description: "Agent ready"}
 		case "error", "cancelled":
+			resp = LastOperationResponse{State: "failed", Description: b.describeTaskFailure(ctx, "BOSH deployment failed", taskID)}
 			b.mu.Lock()
 			instance.State = "failed"
+			instance.LastError = resp.Description
+			planName := instance.PlanName
 			b.mu.Unlock()
-			b.saveState()
-			resp = LastOperationResponse{State: "failed", Description: "BOSH deployment failed"}
+			b.saveInstance(instanceID)
+			b.logger.ErrorContext(ctx, "provision failed", "operation", "provision", "instance_id", instanceID,
+				"bosh_task_id", taskID, "task_state", taskState, "description", resp.Description)
+			b.notify(ctx, EventProvisionFailed, instanceID, planName, "failed")
 		default:
 			resp = LastOperationResponse{State: "in progress", Description: "Deploying agent VM..."}
 		}
@@ -63,30 +107,223 @@ func (b *Broker) LastOperation(w http.ResponseWriter, r *http.Request) {
 			resp = LastOperationResponse{State: "in progress", Description: "Waiting for delete task..."}
 			break
 		}
-		taskState, err := b.director.TaskStatus(taskID)
+		taskState, err := b.taskStatus(ctx, instanceID, taskID)
 		if err != nil {
-			log.Printf("TaskStatus error for %s (task %d): %v", instanceID, taskID, err)
+			b.logger.WarnContext(ctx, "BOSH task status check failed", "operation", "deprovision",
+				"instance_id", instanceID, "bosh_task_id", taskID, "error", err)
 		}
 		switch taskState {
 		case "done":
 			b.mu.Lock()
-			delete(b.instances, instanceID)
+			ssoClientID, planName := instance.SSOClientID, instance.PlanName
+			b.removeInstance(instanceID)
 			b.mu.Unlock()
-			b.saveState()
+			b.saveInstance(instanceID)
+			b.logger.InfoContext(ctx, "instance deprovisioned", "operation", "deprovision", "instance_id", instanceID, "bosh_task_id", taskID)
+			b.notify(ctx, EventDeprovisionSucceeded, instanceID, planName, "deprovisioned")
+			// Deprovision already tried this, but UAA may have been unreachable
+			// then; once the instance is gone nothing else would clean it up.
+			if ssoClientID != "" {
+				b.deleteSSOClient(ctx, instanceID, ssoClientID)
+			}
 			resp = LastOperationResponse{State: "succeeded", Description: "Agent deprovisioned"}
 		case "error", "cancelled":
-			resp = LastOperationResponse{State: "failed", Description: "Deprovision failed"}
+			resp = LastOperationResponse{State: "failed", Description: b.describeTaskFailure(ctx, "Deprovision failed", taskID)}
+			b.mu.Lock()
+			instance.LastError = resp.Description
+			planName := instance.PlanName
+			b.mu.Unlock()
+			b.saveInstance(instanceID)
+			b.logger.ErrorContext(ctx, "deprovision failed", "operation", "deprovision", "instance_id", instanceID,
+				"bosh_task_id", taskID, "task_state", taskState, "description", resp.Description)
+			b.notify(ctx, EventDeprovisionFailed, instanceID, planName, "deprovisioning")
 		default:
 			resp = LastOperationResponse{State: "in progress", Description: "Deprovisioning agent VM..."}
 		}
-	case "ready":
+	case stateDeployingRoute:
+		b.mu.RLock()
+		waited := time.Since(instance.RouteWaitSince)
+		b.mu.RUnlock()
+		ready := b.routeReady(ctx, instanceID, instance)
+		if !ready && waited < b.routeReadyTimeout() {
+			resp = LastOperationResponse{State: "in progress", Description: "Waiting for route registration..."}
+			break
+		}
+		if !ready {
+			b.logger.WarnContext(ctx, "route still not served, marking instance ready anyway", "operation", "provision",
+				"instance_id", instanceID, "waited", waited.Round(time.Second).String())
+		}
+		b.markReady(ctx, instanceID, instance)
 		resp = LastOperationResponse{State: "succeeded", Description: "Agent ready"}
+	default:
+		resp = b.cachedOperation(instance)
+	}
+	return resp
+}
+
+// cachedOperation reports an instance's operation status from broker state
+// alone, without asking BOSH.
+func (b *Broker) cachedOperation(instance *Instance) LastOperationResponse {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	switch instance.State {
+	case "provisioning":
+		if instance.BoshTaskID == 0 {
+			return LastOperationResponse{State: "in progress", Description: "Waiting for deployment task..."}
+		}
+		return LastOperationResponse{State: "in progress", Description: "Deploying agent VM..."}
+	case stateDeployingRoute:
+		return LastOperationResponse{State: "in progress", Description: "Waiting for route registration..."}
+	case "deprovisioning":
+		// A failed delete task is recorded in LastError until the next attempt
+		if instance.LastError != "" {
+			return LastOperationResponse{State: "failed", Description: instance.LastError}
+		}
+		if instance.BoshTaskID == 0 {
+			return LastOperationResponse{State: "in progress", Description: "Waiting for delete task..."}
+		}
+		return LastOperationResponse{State: "in progress", Description: "Deprovisioning agent VM..."}
+	case "ready":
+		return LastOperationResponse{State: "succeeded", Description: "Agent ready"}
 	case "failed":
-		resp = LastOperationResponse{State: "failed", Description: "Deployment failed"}
+		return LastOperationResponse{State: "failed", Description: "Deployment failed"}
 	default:
-		resp = LastOperationResponse{State: "in progress", Description: "Processing..."}
+		return LastOperationResponse{State: "in progress", Description: "Processing..."}
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+// settleOperation advances an instance's in-flight deploy before a handler
+// checks its state. Nothing polls last_operation for the deploy a bind or
+// unbind submits, so without the task watcher the instance would otherwise
+// stay in progress. A no-op while the task watcher runs.
+func (b *Broker) settleOperation(ctx context.Context, instanceID string) {
+	if b.watching.Load() {
+		return
+	}
+	b.mu.RLock()
+	instance, exists := b.instances[instanceID]
+	inFlight := exists && (instance.State == "provisioning" || instance.State == stateDeployingRoute)
+	b.mu.RUnlock()
+	if inFlight {
+		b.advanceOperation(ctx, instance)
+	}
+}
+
+// stateDeployingRoute is the instance state between the BOSH deploy finishing
+// and its route being served by the gorouter.
+const stateDeployingRoute = "deploying-route"
+
+// routeProbeTimeout bounds a single route probe so LastOperation stays fast.
+const routeProbeTimeout = 3 * time.Second
+
+// RouteProbe reports whether url is served, returning an error if not yet.
+type RouteProbe func(ctx context.Context, url string) error
+
+// SetRouteProbe replaces the route readiness probe, e.g. in tests.
+func (b *Broker) SetRouteProbe(probe RouteProbe) {
+	b.routeProbe = probe
+}
+
+// routeReadyTimeout is how long an instance may wait in deploying-route.
+func (b *Broker) routeReadyTimeout() time.Duration {
+	return time.Duration(b.config.RouteReadyTimeout) * time.Second
+}
+
+// probeRoute sends a HEAD to url. The gorouter answers routes it doesn't know
+// with an X-Cf-Routererror header; any other response means the route is live.
+func probeRoute(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, routeProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if routerErr := resp.Header.Get("X-Cf-Routererror"); routerErr != "" {
+		return fmt.Errorf("gorouter returned %d: %s", resp.StatusCode, routerErr)
+	}
+	return nil
+}
+
+// routeReady reports whether the instance's route is served. Always true when
+// route probing is disabled.
+func (b *Broker) routeReady(ctx context.Context, instanceID string, instance *Instance) bool {
+	if b.config.RouteReadyTimeout <= 0 || b.routeProbe == nil {
+		return true
+	}
+	b.mu.RLock()
+	url := fmt.Sprintf("https://%s.%s", instance.RouteHostname, instance.AppsDomain)
+	b.mu.RUnlock()
+	if err := b.routeProbe(ctx, url); err != nil {
+		b.logger.DebugContext(ctx, "route not served yet", "instance_id", instanceID, "url", url, "error", err)
+		return false
+	}
+	return true
+}
+
+// markReady records a finished provision or update.
+func (b *Broker) markReady(ctx context.Context, instanceID string, instance *Instance) {
+	b.mu.Lock()
+	instance.State = "ready"
+	instance.LastError = ""
+	instance.RouteWaitSince = time.Time{}
+	taskID, planName := instance.BoshTaskID, instance.PlanName
+	b.mu.Unlock()
+	b.saveInstance(instanceID)
+	b.logger.InfoContext(ctx, "instance ready", "operation", "provision", "instance_id", instanceID, "bosh_task_id", taskID)
+	b.notify(ctx, EventProvisionSucceeded, instanceID, planName, "ready")
+}
+
+// maxFailureReasonLen caps how much BOSH task output is surfaced to the platform.
+const maxFailureReasonLen = 500
+
+// describeTaskFailure appends the reason a BOSH task failed to summary, so
+// users see why without running `bosh task`. The reason comes from the task's
+// result output, falling back to the last error event. Best-effort: if neither
+// can be fetched the summary is returned unchanged.
+func (b *Broker) describeTaskFailure(ctx context.Context, summary string, taskID int) string {
+	reason := ""
+	if out, err := b.director.TaskResult(taskID); err != nil {
+		b.logger.WarnContext(ctx, "failed to fetch BOSH task result output", "bosh_task_id", taskID, "error", err)
+	} else {
+		reason = strings.TrimSpace(out)
+	}
+	if reason == "" {
+		if out, err := b.director.TaskOutput(taskID, "event"); err != nil {
+			b.logger.WarnContext(ctx, "failed to fetch BOSH task event output", "bosh_task_id", taskID, "error", err)
+		} else {
+			reason = lastEventError(out)
+		}
+	}
+	if reason == "" {
+		return summary
+	}
+	reason = strings.Join(strings.Fields(reason), " ")
+	if len(reason) > maxFailureReasonLen {
+		reason = reason[:maxFailureReasonLen] + "..."
+	}
+	return fmt.Sprintf("%s: %s", summary, reason)
+}
+
+// lastEventError returns the message of the last error in NDJSON task event output.
+func lastEventError(events string) string {
+	msg := ""
+	for _, line := range strings.Split(events, "\n") {
+		var event struct {
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			continue
+		}
+		if event.Error != nil && event.Error.Message != "" {
+			msg = event.Error.Message
+		}
+	}
+	return msg
 }
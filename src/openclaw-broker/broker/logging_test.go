@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIDMiddleware_GeneratesID(t *testing.T) {
+	var seen string
+	h := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/catalog", nil))
+
+	if seen == "" {
+		t.Fatal("request ID should be set on the request context")
+	}
+	if got := rr.Header().Get("X-Request-ID"); got != seen {
+		t.Errorf("X-Request-ID = %q, want %q", got, seen)
+	}
+}
+
+func TestRequestIDMiddleware_ReusesValidIncomingID(t *testing.T) {
+	var seen string
+	h := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/v2/catalog", nil)
+	req.Header.Set("X-Request-ID", "cc-1234")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if seen != "cc-1234" {
+		t.Errorf("request ID = %q, want caller-supplied %q", seen, "cc-1234")
+	}
+
+	req = httptest.NewRequest("GET", "/v2/catalog", nil)
+	req.Header.Set("X-Request-ID", "bad id\nforged=1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if seen == "bad id\nforged=1" {
+		t.Error("malformed incoming request ID should be replaced")
+	}
+}
+
+func TestNewLogger_JSONIncludesRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger("json", &buf)
+
+	h := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.InfoContext(r.Context(), "provisioning", "operation", "provision", "instance_id", "inst-1", "bosh_task_id", 42)
+	}))
+	req := httptest.NewRequest("PUT", "/v2/service_instances/inst-1", nil)
+	req.Header.Set("X-Request-ID", "req-abc")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log line is not JSON: %v (%s)", err, buf.String())
+	}
+	want := map[string]interface{}{
+		"msg": "provisioning", "operation": "provision", "instance_id": "inst-1",
+		"bosh_task_id": float64(42), "request_id": "req-abc",
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("%s = %v, want %v", k, entry[k], v)
+		}
+	}
+}
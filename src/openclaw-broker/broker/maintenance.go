@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// maintenanceFile is the StateDir file holding the maintenance mode flag.
+const maintenanceFile = "maintenance.json"
+
+// defaultMaintenanceMessage is returned to provision requests when maintenance
+// mode was enabled without a message.
+const defaultMaintenanceMessage = "The broker is in maintenance mode and is not accepting new service instances"
+
+// Maintenance is the broker's maintenance mode. While Enabled, Provision
+// returns 503 with Message; deprovision, update, bind and last_operation are
+// unaffected.
+type Maintenance struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+}
+
+// maintenanceMode returns the current maintenance mode.
+func (b *Broker) maintenanceMode() Maintenance {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.maintenance
+}
+
+// AdminGetMaintenance handles GET /admin/maintenance.
+func (b *Broker) AdminGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, b.maintenanceMode())
+}
+
+// AdminSetMaintenance handles POST /admin/maintenance, enabling or disabling
+// maintenance mode. The new mode is persisted so it survives a restart.
+func (b *Broker) AdminSetMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req Maintenance
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Bad request", "description": "Malformed request body: " + err.Error()})
+		return
+	}
+	if !req.Enabled {
+		req.Message = ""
+	} else if req.Message == "" {
+		req.Message = defaultMaintenanceMessage
+	}
+	ctx := r.Context()
+
+	b.mu.Lock()
+	previous := b.maintenance
+	b.maintenance = req
+	err := b.saveMaintenance()
+	if err != nil {
+		b.maintenance = previous
+	}
+	b.mu.Unlock()
+	if err != nil {
+		b.logger.ErrorContext(ctx, "failed to persist maintenance mode", "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to persist maintenance mode", "description": err.Error()})
+		return
+	}
+
+	operation := "maintenance-off"
+	if req.Enabled {
+		operation = "maintenance-on"
+	}
+	b.logger.InfoContext(ctx, "maintenance mode changed", "enabled", req.Enabled, "message", req.Message)
+	b.audit(ctx, operation, "", "", nil)
+	writeJSON(w, http.StatusOK, req)
+}
+
+// saveMaintenance writes the maintenance mode to StateDir. Caller holds b.mu.
+func (b *Broker) saveMaintenance() error {
+	if b.config.StateDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(b.maintenance)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(b.config.StateDir, maintenanceFile), data)
+}
+
+// loadMaintenance restores the maintenance mode saved by a previous run.
+func (b *Broker) loadMaintenance() {
+	if b.config.StateDir == "" {
+		return
+	}
+	path := filepath.Join(b.config.StateDir, maintenanceFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &b.maintenance)
+	}
+	if err != nil {
+		b.logger.Error("failed to load maintenance mode", "path", path, "error", err)
+		return
+	}
+	if b.maintenance.Enabled {
+		b.logger.Warn("broker is in maintenance mode; new provisions are rejected", "message", b.maintenance.Message)
+	}
+}
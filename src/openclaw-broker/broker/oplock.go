@@ -0,0 +1,43 @@
+package broker
+
+import "sync"
+
+// instanceLocks serializes lifecycle operations on a single instance. b.mu
+// can't be held across BOSH calls, so without this an Update and a
+// Deprovision could interleave between reading and writing instance state.
+// The zero value is ready to use.
+type instanceLocks struct {
+	mu    sync.Mutex
+	locks map[string]*instanceLock
+}
+
+type instanceLock struct {
+	mu   sync.Mutex
+	refs int // holders plus waiters; the entry is dropped at zero
+}
+
+// lock blocks until the caller holds the instance's operation lock and
+// returns the func that releases it.
+func (l *instanceLocks) lock(instanceID string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*instanceLock)
+	}
+	il := l.locks[instanceID]
+	if il == nil {
+		il = &instanceLock{}
+		l.locks[instanceID] = il
+	}
+	il.refs++
+	l.mu.Unlock()
+
+	il.mu.Lock()
+	return func() {
+		il.mu.Unlock()
+		l.mu.Lock()
+		if il.refs--; il.refs == 0 {
+			delete(l.locks, instanceID)
+		}
+		l.mu.Unlock()
+	}
+}
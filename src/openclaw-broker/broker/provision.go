@@ -1,12 +1,19 @@
 package broker
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/bosh"
@@ -33,97 +40,179 @@ type ProvisionResponse struct {
 func (b *Broker) Provision(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	instanceID := vars["instance_id"]
+	ctx := r.Context()
 
 	// Validate instance ID to prevent YAML injection via crafted IDs
 	if !validInstanceID.MatchString(instanceID) {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid instance_id format"})
+		osbError(w, http.StatusBadRequest, "BadRequest", "Invalid instance_id format")
 		return
 	}
 
-	// OSB API: async operations require accepts_incomplete=true
-	if r.URL.Query().Get("accepts_incomplete") != "true" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error":       "AsyncRequired",
-			"description": "This service plan requires client support for asynchronous service operations.",
-		})
+	// In maintenance mode only new instances are turned away; existing ones
+	// can still be updated, bound and deleted.
+	if m := b.maintenanceMode(); m.Enabled {
+		osbError(w, http.StatusServiceUnavailable, "MaintenanceMode", m.Message)
+		return
+	}
+
+	// OSB API: async operations require accepts_incomplete=true, unless the
+	// operator has enabled synchronous provisioning for clients that can't poll.
+	async := true
+	if b.config.SyncProvision {
+		var ok bool
+		if async, ok = acceptsIncomplete(w, r); !ok {
+			return
+		}
+	} else if !requireAsync(w, r) {
 		return
 	}
 
 	var req ProvisionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Bad request"})
+		osbError(w, http.StatusBadRequest, "BadRequest", "Malformed request body: "+err.Error())
 		return
 	}
+	user := b.originatingIdentity(ctx, r)
+
+	// Reject unknown or malformed parameters before taking the lock
+	if err := validateAgainstSchema(provisionParametersSchema(), req.Parameters); err != nil {
+		osbError(w, http.StatusBadRequest, "InvalidParameters", err.Error())
+		return
+	}
+
+	// Store one canonical owner so the same user isn't recorded several ways
+	var owner string
+	if o, ok := req.Parameters["owner"].(string); ok {
+		normalized, err := normalizeOwner(o)
+		if err != nil {
+			osbError(w, http.StatusBadRequest, "InvalidParameters", err.Error())
+			return
+		}
+		owner = normalized
+	}
+
+	// An SSO instance is useless to an owner UAA won't let log in
+	if b.config.SSOEnabled && b.config.SSOAllowedEmailDomains != "" {
+		if err := checkOwnerEmailDomain(owner, b.config.SSOAllowedEmailDomains); err != nil {
+			b.logger.WarnContext(ctx, "owner email domain rejected", "operation", "provision", "instance_id", instanceID,
+				"owner", owner, "error", err)
+			osbError(w, http.StatusUnprocessableEntity, "OwnerEmailDomainNotAllowed", err.Error())
+			return
+		}
+	}
+	if owner == "" {
+		owner = "user"
+	}
 
 	b.mu.Lock()
 
 	// Check if already exists
 	if _, exists := b.instances[instanceID]; exists {
 		b.mu.Unlock()
-		writeJSON(w, http.StatusConflict, map[string]string{"error": "Instance already exists"})
+		osbError(w, http.StatusConflict, "InstanceAlreadyExists", fmt.Sprintf("Instance %s already exists", instanceID))
 		return
 	}
 
 	// Enforce quota limits
 	if b.config.MaxInstances > 0 && b.countInstances() >= b.config.MaxInstances {
-		log.Printf("Quota exceeded: %d/%d total instances", b.countInstances(), b.config.MaxInstances)
+		b.logger.WarnContext(ctx, "quota exceeded", "operation", "provision", "instance_id", instanceID,
+			"instances", b.countInstances(), "max_instances", b.config.MaxInstances)
 		b.mu.Unlock()
-		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
-			"error":       "Quota exceeded",
-			"description": fmt.Sprintf("Maximum total instances (%d) reached", b.config.MaxInstances),
-		})
+		osbError(w, http.StatusUnprocessableEntity, "QuotaExceeded", fmt.Sprintf("Maximum total instances (%d) reached", b.config.MaxInstances))
 		return
 	}
 	if b.config.MaxInstancesPerOrg > 0 && b.countInstancesByOrg(req.OrganizationGUID) >= b.config.MaxInstancesPerOrg {
-		log.Printf("Quota exceeded: org %s has %d/%d instances", req.OrganizationGUID, b.countInstancesByOrg(req.OrganizationGUID), b.config.MaxInstancesPerOrg)
+		b.logger.WarnContext(ctx, "org quota exceeded", "operation", "provision", "instance_id", instanceID,
+			"org_guid", req.OrganizationGUID, "instances", b.countInstancesByOrg(req.OrganizationGUID), "max_instances", b.config.MaxInstancesPerOrg)
 		b.mu.Unlock()
-		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
-			"error":       "Quota exceeded",
-			"description": fmt.Sprintf("Maximum instances per org (%d) reached", b.config.MaxInstancesPerOrg),
-		})
+		osbError(w, http.StatusUnprocessableEntity, "QuotaExceeded", fmt.Sprintf("Maximum instances per org (%d) reached", b.config.MaxInstancesPerOrg))
+		return
+	}
+	if b.config.MaxInstancesPerSpace > 0 && b.countInstancesBySpace(req.SpaceGUID) >= b.config.MaxInstancesPerSpace {
+		b.logger.WarnContext(ctx, "space quota exceeded", "operation", "provision", "instance_id", instanceID,
+			"space_guid", req.SpaceGUID, "instances", b.countInstancesBySpace(req.SpaceGUID), "max_instances", b.config.MaxInstancesPerSpace)
+		b.mu.Unlock()
+		osbError(w, http.StatusUnprocessableEntity, "QuotaExceeded", fmt.Sprintf("Maximum instances per space (%d) reached", b.config.MaxInstancesPerSpace))
+		return
+	}
+
+	// Find plan
+	plan := b.findPlan(req.PlanID)
+	if plan == nil {
+		b.mu.Unlock()
+		osbError(w, http.StatusBadRequest, "UnknownPlan", fmt.Sprintf("Plan %q is not in the catalog", req.PlanID))
+		return
+	}
+	if plan.Deprecated {
+		b.logger.WarnContext(ctx, "plan deprecated", "operation", "provision", "instance_id", instanceID, "plan", plan.Name)
+		b.mu.Unlock()
+		osbError(w, http.StatusUnprocessableEntity, "PlanDeprecated", planDeprecationMessage(plan))
 		return
 	}
 
 	// Enforce minimum OpenClaw version (CVE-2026-25253)
-	openclawVersion := b.config.OpenClawVersion
-	if b.config.MinOpenClawVersion != "" {
+	// A caller-requested or plan-pinned version is always gated, falling back
+	// to MinSafeVersion.
+	openclawVersion := b.planVersion(plan)
+	versionRequested := plan.OpenClawVersion != ""
+	if v, ok := req.Parameters["openclaw_version"].(string); ok && v != "" {
+		openclawVersion = v
+		versionRequested = true
+	}
+	if b.config.MinOpenClawVersion != "" || versionRequested {
 		if err := security.ValidateVersion(openclawVersion, b.config.MinOpenClawVersion); err != nil {
-			log.Printf("Version gate rejected %s for %s: %v", openclawVersion, instanceID, err)
+			b.logger.WarnContext(ctx, "version gate rejected", "operation", "provision", "instance_id", instanceID,
+				"openclaw_version", openclawVersion, "error", err)
 			b.mu.Unlock()
-			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
-				"error":       "Version below minimum safe version",
-				"description": err.Error(),
-			})
+			osbError(w, http.StatusUnprocessableEntity, "VersionBelowMinimum", err.Error())
 			return
 		}
 	}
 
-	// Find plan
-	plan := b.findPlan(req.PlanID)
-	if plan == nil {
+	if b.memoryQuotaExceeded(plan.Memory) {
+		b.logger.WarnContext(ctx, "memory quota exceeded", "operation", "provision", "instance_id", instanceID,
+			"plan", plan.Name, "memory_mb", plan.Memory, "total_memory_mb", b.totalMemoryMB(), "max_total_memory_mb", b.config.MaxTotalMemoryMB)
+		b.mu.Unlock()
+		osbError(w, http.StatusUnprocessableEntity, "QuotaExceeded", fmt.Sprintf("Plan %s needs %d MB but only %d of %d MB total memory remains", plan.Name, plan.Memory, b.config.MaxTotalMemoryMB-b.totalMemoryMB(), b.config.MaxTotalMemoryMB))
+		return
+	}
+
+	// An AZ pin must be one the plan deploys to. With no AZs configured at all
+	// the misconfiguration check below reports the real problem.
+	az, _ := req.Parameters["az"].(string)
+	if allowed := b.planAZs(plan); az != "" && len(allowed) > 0 && !slices.Contains(allowed, az) {
 		b.mu.Unlock()
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Unknown plan"})
+		osbError(w, http.StatusBadRequest, "InvalidParameters",
+			fmt.Sprintf("AZ %q is not available for plan %s; allowed AZs: %s", az, plan.Name, strings.Join(allowed, ", ")))
 		return
 	}
 
+	var staticIP string
+	if len(plan.StaticIPs) > 0 {
+		ip, ok := b.nextStaticIP(plan)
+		if !ok {
+			b.logger.WarnContext(ctx, "static IP pool exhausted", "operation", "provision", "instance_id", instanceID,
+				"plan", plan.Name, "pool_size", len(plan.StaticIPs))
+			b.mu.Unlock()
+			osbError(w, http.StatusUnprocessableEntity, "StaticIPPoolExhausted", fmt.Sprintf("All %d static IPs for plan %s are in use", len(plan.StaticIPs), plan.Name))
+			return
+		}
+		staticIP = ip
+	}
+
 	// Generate credentials
 	gatewayToken := security.GenerateGatewayToken()
 	nodeSeed := security.GenerateNodeSeed()
 
-	// Derive route hostname
-	owner := "user"
-	if o, ok := req.Parameters["owner"]; ok {
-		owner = fmt.Sprintf("%v", o)
-	}
+	// Derive route hostname; the instance ID suffix keeps owners whose local
+	// parts collide (dev@x.com, dev@y.com) on distinct routes
 	sanitizedOwner := sanitizeHostname(owner)
 	if sanitizedOwner == "" {
 		sanitizedOwner = "agent"
 	}
 	routeHostname := uniqueRouteHostname(sanitizedOwner, instanceID)
 
-	deploymentName := fmt.Sprintf("openclaw-agent-%s", instanceID)
+	deploymentName := b.deploymentName(instanceID)
 
 	instance := &Instance{
 		ID:               instanceID,
@@ -142,88 +231,112 @@ func (b *Broker) Provision(w http.ResponseWriter, r *http.Request) {
 		State:            "provisioning",
 		SSOEnabled:       b.config.SSOEnabled,
 		OpenClawVersion:  openclawVersion,
+		StaticIP:         staticIP,
+		AZ:               az,
+		ChannelCredentials: channelCredentials(plan, req.Parameters),
+		Tags:             instanceTags(req.Parameters),
+		Labels:           instanceLabels(req.Parameters),
+		AgentConfig:      stringMapParam(req.Parameters, "agent_config"),
+		CreatedBy:        user,
+		LastModifiedBy:   user,
+		CreatedAt:        b.now().UTC(),
 	}
 
 	// Validate required infrastructure config — per-plan AZs take precedence over global
-	if len(plan.AZs) == 0 && len(b.config.AZs) == 0 {
+	if len(b.planAZs(plan)) == 0 {
 		b.mu.Unlock()
-		log.Printf("No AZs configured for plan %s or globally", plan.Name)
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Broker misconfiguration: no availability zones configured"})
+		b.logger.ErrorContext(ctx, "no AZs configured for plan or globally", "operation", "provision", "instance_id", instanceID, "plan", plan.Name)
+		osbError(w, http.StatusInternalServerError, "BrokerMisconfigured", fmt.Sprintf("No availability zones are configured for plan %s; contact the operator", plan.Name))
 		return
 	}
 	if b.config.AppsDomain == "" {
 		b.mu.Unlock()
-		log.Printf("No apps domain configured")
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Broker misconfiguration: no apps domain configured"})
+		b.logger.ErrorContext(ctx, "no apps domain configured", "operation", "provision", "instance_id", instanceID)
+		osbError(w, http.StatusInternalServerError, "BrokerMisconfigured", "No apps domain is configured for agent routes; contact the operator")
 		return
 	}
 
 	// Reserve the instance slot before releasing the lock for the BOSH call.
 	// This prevents duplicate provisions for the same instance ID.
-	b.instances[instanceID] = instance
+	b.putInstance(instance)
 	b.mu.Unlock()
+	done := b.beginBOSHWrite()
+	defer done()
 
 	// Create per-instance UAA OAuth2 client for SSO (before BOSH deploy so credentials are available for manifest)
-	if instance.SSOEnabled && b.uaaClient != nil {
+	if instance.SSOEnabled && b.config.SSOExternalClientManagement {
+		ssoClientID := uaa.ClientIDForInstance(instanceID)
+		ssoClientSecret, err := b.externalSSOClientSecret(ssoClientID)
+		if err != nil {
+			b.logger.WarnContext(ctx, "externally managed UAA client secret unavailable, SSO will be disabled", "operation", "provision",
+				"instance_id", instanceID, "client_id", ssoClientID, "error", err)
+			instance.SSOEnabled = false
+		} else {
+			b.logger.InfoContext(ctx, "using externally managed UAA OAuth2 client", "operation", "provision", "instance_id", instanceID, "client_id", ssoClientID)
+			instance.SSOClientID = ssoClientID
+			instance.SSOClientSecret = ssoClientSecret
+			instance.SSOCookieSecret = uaa.GenerateCookieSecret()
+		}
+	} else if instance.SSOEnabled && b.uaaClient != nil {
 		ssoClientID := uaa.ClientIDForInstance(instanceID)
 		ssoClientSecret := uaa.GenerateClientSecret()
 		ssoCookieSecret := uaa.GenerateCookieSecret()
-		redirectURI := fmt.Sprintf("https://%s.%s/oauth2/callback", routeHostname, b.config.AppsDomain)
-
-		err := b.uaaClient.CreateClient(uaa.OAuthClient{
-			ClientID:             ssoClientID,
-			ClientSecret:         ssoClientSecret,
-			AuthorizedGrantTypes: []string{"authorization_code"},
-			RedirectURI:          []string{redirectURI},
-			Scope:                []string{"openid"},
-			Authorities:          []string{"uaa.resource"},
-			Name:                 fmt.Sprintf("OpenClaw Agent %s", instanceID),
+		err := b.traceUAA(ctx, "uaa.create_client", instanceID, ssoClientID, func() error {
+			return b.uaaClient.CreateClient(ssoOAuthClient(instanceID, ssoClientID, ssoClientSecret, routeHostname, b.config.AppsDomain))
 		})
 		if err != nil {
-			log.Printf("UAA client creation failed for %s: %v — SSO will be disabled", instanceID, err)
+			b.logger.WarnContext(ctx, "UAA client creation failed, SSO will be disabled", "operation", "provision", "instance_id", instanceID, "error", err)
 			instance.SSOEnabled = false
 		} else {
-			log.Printf("Created UAA OAuth2 client %s for instance %s", ssoClientID, instanceID)
+			b.logger.InfoContext(ctx, "created UAA OAuth2 client", "operation", "provision", "instance_id", instanceID, "client_id", ssoClientID)
 			instance.SSOClientID = ssoClientID
 			instance.SSOClientSecret = ssoClientSecret
 			instance.SSOCookieSecret = ssoCookieSecret
 		}
 	} else if instance.SSOEnabled && b.uaaClient == nil {
-		log.Printf("SSO disabled for %s: UAA admin credentials not configured in tile", instanceID)
+		b.logger.WarnContext(ctx, "SSO disabled: UAA admin credentials not configured in tile", "operation", "provision", "instance_id", instanceID)
 		instance.SSOEnabled = false
 	}
 
 	// Build manifest params and deploy via BOSH (outside lock to avoid blocking)
 	params := b.buildManifestParams(instance)
-	log.Printf("Provisioning %s: plan=%s vm=%s sso=%v route=%s.%s",
-		instanceID, instance.PlanName, instance.VMType, params.SSOEnabled,
-		instance.RouteHostname, instance.AppsDomain)
-	manifest, err := bosh.RenderAgentManifest(params)
+	b.logger.InfoContext(ctx, "provisioning", "operation", "provision", "instance_id", instanceID,
+		"plan", instance.PlanName, "vm_type", instance.VMType, "sso", params.SSOEnabled,
+		"route", instance.RouteHostname+"."+instance.AppsDomain)
+	manifest, err := b.renderManifest(params)
 	if err != nil {
-		log.Printf("Manifest render failed for %s: %v", instanceID, err)
-		b.mu.Lock()
-		delete(b.instances, instanceID)
-		b.mu.Unlock()
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to render deployment manifest"})
+		b.logger.ErrorContext(ctx, "manifest render failed", "operation", "provision", "instance_id", instanceID, "error", err)
+		b.abandonProvision(ctx, instance)
+		osbError(w, http.StatusInternalServerError, "ManifestRenderFailed", "Failed to render deployment manifest")
 		return
 	}
-	taskID, err := b.director.Deploy(manifest)
+	taskID, err := b.deploy(ctx, instanceID, manifest)
 	if err != nil {
-		log.Printf("BOSH deploy failed for %s: %v", instanceID, err)
-		b.mu.Lock()
-		delete(b.instances, instanceID)
-		b.mu.Unlock()
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Deployment failed"})
+		b.logger.ErrorContext(ctx, "BOSH deploy failed", "operation", "provision", "instance_id", instanceID, "error", err)
+		b.abandonProvision(ctx, instance)
+		osbError(w, http.StatusInternalServerError, "DeploymentFailed", "The BOSH Director rejected the deployment")
 		return
 	}
 
 	b.mu.Lock()
 	instance.BoshTaskID = taskID
 	b.mu.Unlock()
-	b.saveState()
+	b.saveInstance(instanceID)
+	b.logger.InfoContext(ctx, "BOSH deploy started", "operation", "provision", "instance_id", instanceID, "bosh_task_id", taskID)
+	b.audit(ctx, "provision", instanceID, "", user)
+
+	done()
+
+	if !async {
+		b.finishSyncProvision(ctx, w, instance, taskID)
+		return
+	}
 
+	b.mu.RLock()
+	dashboardURL := b.dashboardURL(instance)
+	b.mu.RUnlock()
 	resp := ProvisionResponse{
-		DashboardURL: fmt.Sprintf("https://%s.%s", routeHostname, b.config.AppsDomain),
+		DashboardURL: dashboardURL,
 		Operation:    fmt.Sprintf("provision-%s", instanceID),
 	}
 
@@ -232,6 +345,129 @@ func (b *Broker) Provision(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// ssoOAuthClient describes the UAA OAuth2 client registration for an
+// instance's SSO login, redirecting back to the agent's route.
+func ssoOAuthClient(instanceID, clientID, clientSecret, routeHostname, appsDomain string) uaa.OAuthClient {
+	return uaa.OAuthClient{
+		ClientID:             clientID,
+		ClientSecret:         clientSecret,
+		AuthorizedGrantTypes: []string{"authorization_code"},
+		RedirectURI:          []string{fmt.Sprintf("https://%s.%s/oauth2/callback", routeHostname, appsDomain)},
+		Scope:                []string{"openid"},
+		Authorities:          []string{"uaa.resource"},
+		Name:                 fmt.Sprintf("OpenClaw Agent %s", instanceID),
+	}
+}
+
+// abandonProvision releases the slot reserved for an instance whose deploy was
+// never submitted, deleting its UAA client if one was already created so it
+// isn't orphaned in UAA.
+func (b *Broker) abandonProvision(ctx context.Context, instance *Instance) {
+	b.mu.Lock()
+	b.removeInstance(instance.ID)
+	b.mu.Unlock()
+
+	if instance.SSOClientID == "" || b.uaaClient == nil {
+		return
+	}
+	if err := b.traceUAA(ctx, "uaa.delete_client", instance.ID, instance.SSOClientID, func() error { return b.uaaClient.DeleteClient(instance.SSOClientID) }); err != nil {
+		b.logger.WarnContext(ctx, "failed to delete UAA client after failed provision, it will be orphaned in UAA", "operation", "provision",
+			"instance_id", instance.ID, "client_id", instance.SSOClientID, "error", err)
+		return
+	}
+	b.logger.InfoContext(ctx, "deleted UAA OAuth2 client after failed provision", "operation", "provision",
+		"instance_id", instance.ID, "client_id", instance.SSOClientID)
+}
+
+// externalSSOClientSecret reads the secret of an externally managed UAA
+// client from BrokerConfig.SSOExternalClientSecretsDir.
+func (b *Broker) externalSSOClientSecret(clientID string) (string, error) {
+	if b.config.SSOExternalClientSecretsDir == "" {
+		return "", errors.New("no client secrets directory configured")
+	}
+	data, err := os.ReadFile(filepath.Join(b.config.SSOExternalClientSecretsDir, clientID))
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("client secret file for %s is empty", clientID)
+	}
+	return secret, nil
+}
+
+// finishSyncProvision blocks until the provision finishes and writes the
+// final OSB response: 201 with the dashboard URL on success, 500 otherwise.
+// Progress is tracked exactly as LastOperation would, so the route gate and
+// webhooks apply to synchronous provisions too. On timeout, or if the client
+// goes away, the instance stays in "provisioning" so LastOperation and
+// Deprovision can still track the running task.
+func (b *Broker) finishSyncProvision(ctx context.Context, w http.ResponseWriter, instance *Instance, taskID int) {
+	instanceID := instance.ID
+	deadline := time.Now().Add(b.syncTimeout)
+	for {
+		var resp LastOperationResponse
+		if b.watching.Load() {
+			resp = b.cachedOperation(instance)
+		} else {
+			resp = b.advanceOperation(ctx, instance)
+		}
+		switch resp.State {
+		case "succeeded":
+			b.mu.RLock()
+			dashboardURL := b.dashboardURL(instance)
+			b.mu.RUnlock()
+			writeJSON(w, http.StatusCreated, ProvisionResponse{DashboardURL: dashboardURL})
+			return
+		case "failed":
+			b.logger.ErrorContext(ctx, "synchronous provision failed", "operation", "provision", "instance_id", instanceID,
+				"bosh_task_id", taskID, "description", resp.Description)
+			osbError(w, http.StatusInternalServerError, "DeploymentFailed", resp.Description)
+			return
+		}
+
+		if !time.Now().Before(deadline) {
+			err := fmt.Errorf("provision did not finish within %s", b.syncTimeout)
+			b.logger.ErrorContext(ctx, "synchronous provision timed out", "operation", "provision", "instance_id", instanceID,
+				"bosh_task_id", taskID, "error", err)
+			osbError(w, http.StatusInternalServerError, "DeploymentTimedOut", err.Error())
+			return
+		}
+		select {
+		case <-ctx.Done():
+			b.logger.WarnContext(ctx, "synchronous provision abandoned", "operation", "provision", "instance_id", instanceID,
+				"bosh_task_id", taskID, "error", ctx.Err())
+			osbError(w, http.StatusInternalServerError, "DeploymentTimedOut", ctx.Err().Error())
+			return
+		case <-time.After(b.taskPollInterval):
+		}
+	}
+}
+
+// waitForTask polls a BOSH task until it reaches a terminal state
+// (done, error, cancelled), the timeout elapses or ctx is done.
+func (b *Broker) waitForTask(ctx context.Context, taskID int, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := b.director.TaskStatus(taskID)
+		if err != nil {
+			b.logger.WarnContext(ctx, "BOSH task status check failed", "bosh_task_id", taskID, "error", err)
+		}
+		switch state {
+		case "done", "error", "cancelled":
+			return state, nil
+		}
+		if !time.Now().Before(deadline) {
+			return state, fmt.Errorf("BOSH task %d did not finish within %s", taskID, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return state, ctx.Err()
+		case <-time.After(b.taskPollInterval):
+		}
+	}
+}
+
 func (b *Broker) buildManifestParams(instance *Instance) bosh.ManifestParams {
 	network := b.config.Network
 	if network == "" {
@@ -247,12 +483,34 @@ func (b *Broker) buildManifestParams(instance *Instance) bosh.ManifestParams {
 	}
 	azs := b.config.AZs
 	plan := b.findPlan(instance.PlanID)
-	if plan != nil && len(plan.AZs) > 0 {
-		azs = plan.AZs
+	// A plan may need its own stemcell (e.g. GPU drivers for browser
+	// automation). It gets an alias named after its OS so its manifests never
+	// collide with the broker-wide "default" stemcell.
+	stemcellAlias := "default"
+	if plan != nil && (plan.StemcellOS != "" || plan.StemcellVersion != "") {
+		if plan.StemcellOS != "" && plan.StemcellOS != stemcellOS {
+			stemcellOS = plan.StemcellOS
+			stemcellVersion = "latest"
+		}
+		if plan.StemcellVersion != "" {
+			stemcellVersion = plan.StemcellVersion
+		}
+		stemcellAlias = stemcellOS
 	}
+	if plan != nil {
+		azs = b.planAZs(plan)
+	}
+	if instance.AZ != "" {
+		azs = []string{instance.AZ}
+	}
+	// main rejects unknown modes at startup; anything else that slips through
+	// renders strict rather than reaching the agent
 	sandboxMode := b.config.SandboxMode
-	if sandboxMode == "" {
-		sandboxMode = "strict"
+	if !security.ValidSandboxMode(sandboxMode) {
+		if sandboxMode != "" {
+			b.logger.Warn("Unknown sandbox mode, using strict", "sandbox_mode", sandboxMode)
+		}
+		sandboxMode = security.SandboxStrict
 	}
 	cfDeploymentName := b.config.CFDeploymentName
 	if cfDeploymentName == "" {
@@ -271,31 +529,90 @@ func (b *Broker) buildManifestParams(instance *Instance) bosh.ManifestParams {
 		routingReleaseVersion = "latest"
 	}
 
-	// Determine browser automation from plan features
+	// A plan may place agents on several networks; otherwise the broker-wide
+	// network is used on its own.
+	var networks []bosh.NetworkConfig
+	if plan != nil && len(plan.Networks) > 0 {
+		networks = plan.Networks
+	}
+	// A reserved static IP pins the agent's address on its first network.
+	// Copied so the plan's network config is never mutated.
+	if instance.StaticIP != "" {
+		if len(networks) == 0 {
+			networks = []bosh.NetworkConfig{{Name: network}}
+		} else {
+			networks = append([]bosh.NetworkConfig(nil), networks...)
+		}
+		networks[0].StaticIPs = []string{instance.StaticIP}
+	}
+
+	// VM extensions (load balancers, security groups) come from the plan.
+	// Copied so manifest sanitization never mutates the plan config.
+	var vmExtensions []string
+	if plan != nil && len(plan.VMExtensions) > 0 {
+		vmExtensions = append([]string(nil), plan.VMExtensions...)
+	}
+
+	// Determine browser automation and messaging channels from plan features
 	browserEnabled := false
 	if plan != nil && plan.Features["browser"] {
 		browserEnabled = true
 	}
+	channels := enabledChannels(plan)
+
+	// Agent-side limits for cost control; negative values mean unlimited
+	var maxTasks, maxToolCalls int
+	if plan != nil {
+		maxTasks, maxToolCalls = max(plan.MaxConcurrentTasks, 0), max(plan.MaxToolCallsPerMinute, 0)
+	}
+
+	// Per-plan BOSH update block; zero values fall back to manifest defaults
+	var update bosh.UpdateConfig
+	if plan != nil {
+		update = plan.Update
+	}
+
+	// Generation parameters: plan values override the broker-wide defaults
+	temperature, maxTokens, topP := b.config.LLMTemperature, b.config.LLMMaxTokens, b.config.LLMTopP
+	llmEndpoint, llmAPIKey, llmModel := b.LLMCredentials()
+	natsTLS := b.config.NATSTLSEnabled
+	if plan != nil {
+		if plan.LLMTemperature != nil {
+			temperature = plan.LLMTemperature
+		}
+		if plan.LLMMaxTokens != 0 {
+			maxTokens = plan.LLMMaxTokens
+		}
+		if plan.LLMTopP != nil {
+			topP = plan.LLMTopP
+		}
+	}
+	temperature = clampFloat(temperature, 0, maxLLMTemperature)
+	topP = clampFloat(topP, 0, 1)
+	if maxTokens < 0 {
+		maxTokens = 0
+	} else if maxTokens > maxLLMMaxTokens {
+		maxTokens = maxLLMMaxTokens
+	}
 
 	// SSO requires per-instance OAuth2 credentials created during provision.
 	// If the instance has no SSOClientID, SSO was either not requested or UAA client creation failed.
 	ssoEnabled := instance.SSOEnabled && instance.SSOClientID != ""
 	if instance.SSOEnabled && !ssoEnabled {
-		log.Printf("SSO disabled for %s: no OAuth2 client credentials available", instance.ID)
-	}
-
-	// Parse blocked commands: tile may send newline-separated or comma-separated
-	var blockedCmds []string
-	if b.config.BlockedCommands != "" {
-		// Replace newlines with commas so we can split uniformly
-		normalized := strings.ReplaceAll(b.config.BlockedCommands, "\n", ",")
-		normalized = strings.ReplaceAll(normalized, "\r", "")
-		for _, cmd := range strings.Split(normalized, ",") {
-			cmd = strings.TrimSpace(cmd)
-			if cmd != "" {
-				blockedCmds = append(blockedCmds, cmd)
-			}
-		}
+		b.logger.Warn("SSO disabled: no OAuth2 client credentials available", "instance_id", instance.ID)
+	}
+
+	// Allowlist mode renders only the operator's allowed commands; otherwise the
+	// sandbox mode's baseline is merged with the operator's blocked commands.
+	commandPolicy := b.config.CommandPolicyMode
+	if commandPolicy == "" {
+		commandPolicy = CommandPolicyBlocklist
+	}
+	var blockedCmds, allowedCmds []string
+	if commandPolicy == CommandPolicyAllowlist {
+		allowedCmds = parseCommandList(b.config.AllowedCommands)
+	} else {
+		blockedCmds = uniqueCommands(append(security.DefaultBlockedCommands(sandboxMode), parseCommandList(b.config.BlockedCommands)...))
 	}
 
 	return bosh.ManifestParams{
@@ -304,17 +621,22 @@ func (b *Broker) buildManifestParams(instance *Instance) bosh.ManifestParams {
 		Owner:                  instance.Owner,
 		PlanName:               instance.PlanName,
 		GatewayToken:           instance.GatewayToken,
+		BindingTokens:          bindingTokens(instance),
 		NodeSeed:               instance.NodeSeed,
 		RouteHostname:          instance.RouteHostname,
 		VMType:                 instance.VMType,
+		VMResources:            b.vmResources(instance),
+		VMExtensions:           vmExtensions,
 		DiskType:               instance.DiskType,
 		SSOEnabled:             ssoEnabled,
 		OpenClawVersion:        instance.OpenClawVersion,
 		SandboxMode:            sandboxMode,
 		Network:                network,
+		Networks:               networks,
 		AZs:                    azs,
 		StemcellOS:             stemcellOS,
 		StemcellVersion:        stemcellVersion,
+		StemcellAlias:          stemcellAlias,
 		CFDeploymentName:       cfDeploymentName,
 		OpenClawReleaseVersion: openclawReleaseVersion,
 		BPMReleaseVersion:      bpmReleaseVersion,
@@ -327,17 +649,220 @@ func (b *Broker) buildManifestParams(instance *Instance) bosh.ManifestParams {
 		SSOAllowedEmailDomains: b.config.SSOAllowedEmailDomains,
 		SSOSessionTimeoutHours: b.config.SSOSessionTimeoutHours,
 		LLMProvider:            b.config.LLMProvider,
-		LLMEndpoint:            b.config.LLMEndpoint,
-		LLMAPIKey:              b.config.LLMAPIKey,
-		LLMModel:               b.config.LLMModel,
+		LLMEndpoint:            llmEndpoint,
+		LLMAPIKey:              llmAPIKey,
+		LLMModel:               llmModel,
 		LLMPreferredModel:      b.config.LLMPreferredModel,
 		LLMAPIEndpoint:         b.config.LLMAPIEndpoint,
+		LLMExtraParams:         b.config.LLMExtraParams,
+		LLMTemperature:         temperature,
+		LLMMaxTokens:           maxTokens,
+		LLMTopP:                topP,
 		BrowserEnabled:         browserEnabled,
+		MaxConcurrentTasks:     maxTasks,
+		MaxToolCallsPerMinute:  maxToolCalls,
+		ChannelsEnabled:        channels,
+		ChannelCredentials:     instance.ChannelCredentials,
+		CommandPolicy:          commandPolicy,
 		BlockedCommands:        blockedCmds,
+		AllowedCommands:        allowedCmds,
 		NATSTLSClientCert:      b.config.NATSTLSClientCert,
 		NATSTLSClientKey:       b.config.NATSTLSClientKey,
 		NATSTLSCACert:          b.config.NATSTLSCACert,
+		NATSTLSEnabled:         &natsTLS,
+		RouteRegistrationInterval: b.config.RouteRegistrationInterval,
+		Update:                 update,
+		TemplatePath:           b.config.ManifestTemplatePath,
+		UseConfigServer:        b.config.UseConfigServer && b.secrets != nil,
+		GatewayPort:            b.config.GatewayPort,
+		WebchatPort:            b.config.WebchatPort,
+		WebchatSSOPort:         b.config.WebchatSSOPort,
+		Tags:                   manifestTags(instance),
+		AgentCustom:            instance.AgentConfig,
+	}
+}
+
+// vmResources sizes the instance's VM from its plan's cpu and memory when
+// BrokerConfig.UseVMResources is set. Plans missing either keep their vm_type.
+func (b *Broker) vmResources(instance *Instance) *bosh.VMResources {
+	if !b.config.UseVMResources {
+		return nil
+	}
+	plan := b.findPlan(instance.PlanID)
+	if plan == nil || plan.CPU <= 0 || plan.Memory <= 0 {
+		return nil
+	}
+	return &bosh.VMResources{CPU: plan.CPU, RAM: plan.Memory, EphemeralDiskSize: plan.EphemeralDiskMB}
+}
+
+// planAZs returns the AZs instances of plan deploy to: the plan's own AZs,
+// or the broker-wide ones when it has none.
+func (b *Broker) planAZs(plan *Plan) []string {
+	if len(plan.AZs) > 0 {
+		return plan.AZs
+	}
+	return b.config.AZs
+}
+
+// enabledChannels returns the messaging channels the plan's features turn on,
+// or nil when there are none.
+func enabledChannels(plan *Plan) map[string]bool {
+	if plan == nil {
+		return nil
+	}
+	var channels map[string]bool
+	for name := range bosh.MessagingChannels {
+		if plan.Features[name] {
+			if channels == nil {
+				channels = map[string]bool{}
+			}
+			channels[name] = true
+		}
+	}
+	return channels
+}
+
+// channelCredentials picks the credentials of the plan's enabled channels out
+// of the provision parameters, where each is named "<channel>_<credential>"
+// (e.g. slack_bot_token). Credentials for channels the plan doesn't enable
+// are dropped.
+func channelCredentials(plan *Plan, params map[string]interface{}) map[string]string {
+	var creds map[string]string
+	for name := range enabledChannels(plan) {
+		if v, ok := params[name+"_"+bosh.MessagingChannels[name]].(string); ok && v != "" {
+			if creds == nil {
+				creds = map[string]string{}
+			}
+			creds[name] = v
+		}
+	}
+	return creds
+}
+
+// instanceTags returns the schema-validated "tags" parameter, deduplicated.
+func instanceTags(params map[string]interface{}) []string {
+	raw, _ := params["tags"].([]interface{})
+	var tags []string
+	seen := map[string]bool{}
+	for _, v := range raw {
+		if tag, ok := v.(string); ok && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// instanceLabels returns the schema-validated "labels" parameter.
+func instanceLabels(params map[string]interface{}) map[string]string {
+	return stringMapParam(params, "labels")
+}
+
+// stringMapParam returns the schema-validated object parameter name as a
+// string map, or nil when it is absent or empty.
+func stringMapParam(params map[string]interface{}, name string) map[string]string {
+	raw, _ := params[name].(map[string]interface{})
+	var values map[string]string
+	for k, v := range raw {
+		if value, ok := v.(string); ok {
+			if values == nil {
+				values = map[string]string{}
+			}
+			values[k] = value
+		}
+	}
+	return values
+}
+
+// manifestTags returns the BOSH deployment tags for an instance: each tag as
+// a key with an empty value, and each label as key/value. A label wins over a
+// tag of the same name. Must be called with b.mu held.
+func manifestTags(instance *Instance) map[string]string {
+	if len(instance.Tags) == 0 && len(instance.Labels) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(instance.Tags)+len(instance.Labels))
+	for _, tag := range instance.Tags {
+		tags[tag] = ""
+	}
+	for k, v := range instance.Labels {
+		tags[k] = v
+	}
+	return tags
+}
+
+// Upper bounds for LLM generation parameters. Temperature follows the
+// OpenAI range (0-2); max tokens is capped well above any current context window.
+const (
+	maxLLMTemperature = 2.0
+	maxLLMMaxTokens   = 1000000
+)
+
+// clampFloat bounds an optional value to [lo, hi], returning a new pointer so
+// the configured value is never mutated. nil stays nil (unset).
+func clampFloat(v *float64, lo, hi float64) *float64 {
+	if v == nil {
+		return nil
 	}
+	c := *v
+	if c < lo {
+		c = lo
+	} else if c > hi {
+		c = hi
+	}
+	return &c
+}
+
+// maxOwnerLength is the longest owner accepted, the SMTP limit on an address.
+const maxOwnerLength = 254
+
+// normalizeOwner returns the stored form of an owner: trimmed and lowercased,
+// since email addresses are compared case-insensitively everywhere the broker
+// uses them. Control characters and over-long values are rejected. The route
+// hostname is derived from this separately by sanitizeHostname.
+func normalizeOwner(owner string) (string, error) {
+	owner = strings.TrimSpace(owner)
+	if len(owner) > maxOwnerLength {
+		return "", fmt.Errorf("owner must be at most %d characters, got %d", maxOwnerLength, len(owner))
+	}
+	for _, r := range owner {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return "", fmt.Errorf("owner %q must not contain control characters", owner)
+		}
+	}
+	return strings.ToLower(owner), nil
+}
+
+// checkOwnerEmailDomain verifies owner is an email address whose domain is in
+// the comma-separated allowlist. Domains match case-insensitively; a leading
+// "@" in an allowlist entry is ignored.
+func checkOwnerEmailDomain(owner, allowedDomains string) error {
+	local, domain, ok := strings.Cut(strings.TrimSpace(owner), "@")
+	if !ok || local == "" || domain == "" || strings.Contains(domain, "@") {
+		return fmt.Errorf("owner %q must be an email address when SSO email domains are restricted (allowed: %s)", owner, allowedDomains)
+	}
+	for _, allowed := range strings.Split(allowedDomains, ",") {
+		allowed = strings.TrimPrefix(strings.TrimSpace(allowed), "@")
+		if allowed != "" && strings.EqualFold(domain, allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("owner email domain %q is not in the allowed SSO email domains (%s)", domain, allowedDomains)
+}
+
+// renderManifest renders an agent manifest. When it references config-server
+// variables, their values are stored first so the Director can resolve them.
+func (b *Broker) renderManifest(params bosh.ManifestParams) ([]byte, error) {
+	manifest, err := bosh.RenderAgentManifest(params)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range params.ConfigServerVariables() {
+		if err := b.secrets.SetSecret(params.DeploymentName, v.Name, v.Value); err != nil {
+			return nil, fmt.Errorf("storing %s in config server: %w", v.Name, err)
+		}
+	}
+	return manifest, nil
 }
 
 // uniqueRouteHostname generates a per-instance DNS-safe hostname: oc-{owner}-{id}.
@@ -376,3 +901,34 @@ func sanitizeHostname(s string) string {
 	s = strings.Trim(s, "-")
 	return s
 }
+
+// Command policy modes for BrokerConfig.CommandPolicyMode.
+const (
+	CommandPolicyBlocklist = "blocklist"
+	CommandPolicyAllowlist = "allowlist"
+)
+
+// parseCommandList splits an operator-supplied command list. The tile may
+// send newline-separated or comma-separated values.
+func parseCommandList(s string) []string {
+	// Replace newlines with commas so we can split uniformly
+	normalized := strings.ReplaceAll(s, "\n", ",")
+	normalized = strings.ReplaceAll(normalized, "\r", "")
+	return uniqueCommands(strings.Split(normalized, ","))
+}
+
+// uniqueCommands trims each command and drops empties and repeats, keeping
+// first-seen order.
+func uniqueCommands(cmds []string) []string {
+	var out []string
+	seen := make(map[string]bool, len(cmds))
+	for _, cmd := range cmds {
+		cmd = strings.TrimSpace(cmd)
+		if cmd == "" || seen[cmd] {
+			continue
+		}
+		seen[cmd] = true
+		out = append(out, cmd)
+	}
+	return out
+}
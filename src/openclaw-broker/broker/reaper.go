@@ -0,0 +1,176 @@
+package broker
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultTTLExemptLabel is the instance label that keeps an instance from
+// being reaped when BrokerConfig.InstanceTTLExemptLabel is unset. Any value
+// other than "false" exempts it.
+const DefaultTTLExemptLabel = "ttl-exempt"
+
+// defaultReaperInterval is how often the TTL reaper looks for expired instances.
+const defaultReaperInterval = 15 * time.Minute
+
+// StartReaper deprovisions instances older than BrokerConfig.InstanceTTLHours
+// in the background until the returned func is called. A no-op when no TTL
+// is configured.
+func (b *Broker) StartReaper() (stop func()) {
+	if b.config.InstanceTTLHours <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(b.reaperInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.reapExpiredInstances(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// ttlExempt reports whether inst carries the exemption label.
+func (b *Broker) ttlExempt(inst *Instance) bool {
+	label := b.config.InstanceTTLExemptLabel
+	if label == "" {
+		label = DefaultTTLExemptLabel
+	}
+	v, ok := inst.Labels[label]
+	return ok && v != "false"
+}
+
+// reapExpiredInstances finishes deletes started on earlier runs, then starts
+// deleting ready or failed instances older than the TTL. Returns the IDs of
+// newly reaped instances.
+func (b *Broker) reapExpiredInstances(ctx context.Context) []string {
+	b.finishReaps(ctx)
+	if b.config.InstanceTTLHours <= 0 {
+		return nil
+	}
+
+	ttl := time.Duration(b.config.InstanceTTLHours) * time.Hour
+	now := b.now()
+	b.mu.RLock()
+	var expired []*Instance
+	for _, inst := range b.instances {
+		if inst.CreatedAt.IsZero() || now.Sub(inst.CreatedAt) < ttl || b.ttlExempt(inst) {
+			continue
+		}
+		if inst.State == "ready" || inst.State == "failed" {
+			expired = append(expired, inst)
+		}
+	}
+	b.mu.RUnlock()
+
+	var reaped []string
+	for _, inst := range expired {
+		if b.reapInstance(ctx, inst, now) {
+			reaped = append(reaped, inst.ID)
+		}
+	}
+	return reaped
+}
+
+// reapInstance starts deleting an expired instance the way Deprovision would,
+// announcing it first so owners can be told why their agent disappeared.
+func (b *Broker) reapInstance(ctx context.Context, inst *Instance, now time.Time) bool {
+	unlock := b.ops.lock(inst.ID)
+	defer unlock()
+	done := b.beginBOSHWrite()
+	defer done()
+
+	b.mu.Lock()
+	current, exists := b.instances[inst.ID]
+	if !exists || current != inst || (inst.State != "ready" && inst.State != "failed") {
+		b.mu.Unlock()
+		return false
+	}
+	instanceID, planName, deploymentName, previousState := inst.ID, inst.PlanName, inst.DeploymentName, inst.State
+	age := now.Sub(inst.CreatedAt)
+	b.setInstanceState(inst, "deprovisioning")
+	b.mu.Unlock()
+
+	b.logger.WarnContext(ctx, "instance exceeded TTL, deprovisioning", "operation", "reap", "instance_id", instanceID,
+		"age", age.Round(time.Minute).String(), "ttl_hours", b.config.InstanceTTLHours)
+	b.notify(ctx, EventInstanceExpired, instanceID, planName, previousState)
+
+	b.deleteUAAClient(ctx, instanceID)
+	taskID, err := b.deleteDeployment(ctx, instanceID, deploymentName)
+	if err != nil {
+		b.logger.ErrorContext(ctx, "BOSH delete failed", "operation", "reap", "instance_id", instanceID, "error", err)
+		b.mu.Lock()
+		b.setInstanceState(inst, previousState)
+		b.mu.Unlock()
+		return false
+	}
+
+	b.mu.Lock()
+	inst.BoshTaskID = taskID
+	inst.LastError = ""
+	inst.ReapedAt = now.UTC()
+	b.mu.Unlock()
+	b.saveInstance(instanceID)
+	b.logger.InfoContext(ctx, "BOSH delete started", "operation", "reap", "instance_id", instanceID, "bosh_task_id", taskID)
+	b.audit(ctx, "reap", instanceID, "", nil)
+	return true
+}
+
+// finishReaps removes reaped instances whose delete task has finished. The
+// platform never polls last_operation for these, so nothing else would. A
+// failed delete marks the instance failed and the next run retries it.
+func (b *Broker) finishReaps(ctx context.Context) {
+	type pending struct {
+		inst   *Instance
+		taskID int
+	}
+	b.mu.RLock()
+	var reaping []pending
+	for _, inst := range b.instances {
+		if inst.State == "deprovisioning" && !inst.ReapedAt.IsZero() && inst.BoshTaskID != 0 {
+			reaping = append(reaping, pending{inst, inst.BoshTaskID})
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, p := range reaping {
+		instanceID := p.inst.ID
+		state, err := b.taskStatus(ctx, instanceID, p.taskID)
+		if err != nil {
+			b.logger.WarnContext(ctx, "BOSH task status check failed", "operation", "reap",
+				"instance_id", instanceID, "bosh_task_id", p.taskID, "error", err)
+			continue
+		}
+		switch state {
+		case "done":
+			b.mu.Lock()
+			planName := p.inst.PlanName
+			b.removeInstance(instanceID)
+			b.mu.Unlock()
+			b.saveInstance(instanceID)
+			b.logger.InfoContext(ctx, "instance deprovisioned", "operation", "reap", "instance_id", instanceID, "bosh_task_id", p.taskID)
+			b.notify(ctx, EventDeprovisionSucceeded, instanceID, planName, "deprovisioned")
+		case "error", "cancelled":
+			b.mu.Lock()
+			planName := p.inst.PlanName
+			b.setInstanceState(p.inst, "failed")
+			p.inst.LastError = "TTL reaper delete task " + state
+			p.inst.ReapedAt = time.Time{}
+			b.mu.Unlock()
+			b.saveInstance(instanceID)
+			b.logger.ErrorContext(ctx, "BOSH delete failed", "operation", "reap", "instance_id", instanceID, "bosh_task_id", p.taskID, "task_state", state)
+			b.notify(ctx, EventDeprovisionFailed, instanceID, planName, "failed")
+		}
+	}
+}
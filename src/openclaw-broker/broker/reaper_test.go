@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable clock for the TTL reaper.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestReaper_DeprovisionsExpiredInstances(t *testing.T) {
+	receiver, events := newWebhookReceiver(t, "", 0)
+	defer receiver.Close()
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)}
+	b.now = clock.Now
+	b.reaperInterval = 10 * time.Millisecond
+	b.config.InstanceTTLHours = 24
+	b.config.WebhookURL = receiver.URL
+
+	provisionInstance(t, router, "inst-old", "openclaw-developer-plan")
+	body, _ := json.Marshal(ProvisionRequest{
+		ServiceID: "openclaw-service", PlanID: "openclaw-developer-plan",
+		OrganizationGUID: "org-123", SpaceGUID: "space-456",
+		Parameters: map[string]interface{}{"owner": "dev@example.com", "labels": map[string]interface{}{"ttl-exempt": "true"}},
+	})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v2/service_instances/inst-exempt?accepts_incomplete=true", bytes.NewReader(body)))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Provision failed: %d %s", rr.Code, rr.Body.String())
+	}
+	clock.Advance(23 * time.Hour)
+	provisionInstance(t, router, "inst-young", "openclaw-developer-plan")
+	for _, id := range []string{"inst-old", "inst-exempt", "inst-young"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/service_instances/"+id+"/last_operation", nil))
+		waitForEvent(t, events) // provision.succeeded
+	}
+
+	clock.Advance(2 * time.Hour)
+	stop := b.StartReaper()
+	defer stop()
+
+	event := waitForEvent(t, events)
+	if event.Event != EventInstanceExpired || event.InstanceID != "inst-old" || event.State != "ready" {
+		t.Errorf("event = %+v, want instance.expired for inst-old", event)
+	}
+	event = waitForEvent(t, events)
+	if event.Event != EventDeprovisionSucceeded || event.InstanceID != "inst-old" {
+		t.Errorf("event = %+v, want deprovision.succeeded for inst-old", event)
+	}
+	stop()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if _, ok := b.instances["inst-old"]; ok {
+		t.Error("expired instance should be removed once its delete task is done")
+	}
+	for _, id := range []string{"inst-exempt", "inst-young"} {
+		if inst, ok := b.instances[id]; !ok || inst.State != "ready" {
+			t.Errorf("%s should be untouched, got %+v", id, inst)
+		}
+	}
+}
+
+func TestReaper_DisabledWithoutTTL(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	clock := &fakeClock{now: time.Now()}
+	b.now = clock.Now
+	provisionInstance(t, router, "inst-1", "openclaw-developer-plan")
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/service_instances/inst-1/last_operation", nil))
+
+	clock.Advance(10000 * time.Hour)
+	b.StartReaper()()
+	if reaped := b.reapExpiredInstances(t.Context()); len(reaped) != 0 {
+		t.Errorf("reaped %v with no TTL configured", reaped)
+	}
+}
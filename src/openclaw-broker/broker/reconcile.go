@@ -0,0 +1,194 @@
+package broker
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/bosh"
+)
+
+// ReconcileDeployments rebuilds minimal instance records for agent deployments
+// that exist in BOSH but not in broker state (e.g., after the state directory
+// was lost). Recovered instances are marked ready so they can be bound,
+// updated, and deprovisioned. Returns the IDs of the recovered instances.
+func (b *Broker) ReconcileDeployments() ([]string, error) {
+	deployments, err := b.director.ListDeployments()
+	if err != nil {
+		return nil, err
+	}
+	return b.adoptDeployments(b.orphanedDeployments(deployments)), nil
+}
+
+// orphanedDeployments returns the IDs of agent deployments with no broker
+// record, sorted. A matching name alone isn't proof of ownership: another
+// foundation's prefix may extend this one, so "openclaw-agent-prod-abc" would
+// pass for instance "prod-abc" under "openclaw-agent". Only deployments whose
+// manifest records the instance ID the name implies are counted.
+func (b *Broker) orphanedDeployments(deployments []bosh.Deployment) []string {
+	prefix := b.deploymentName("")
+	var candidates []string
+	b.mu.RLock()
+	for _, d := range deployments {
+		if !strings.HasPrefix(d.Name, prefix) {
+			continue
+		}
+		instanceID := strings.TrimPrefix(d.Name, prefix)
+		if !validInstanceID.MatchString(instanceID) {
+			continue
+		}
+		if _, exists := b.instances[instanceID]; exists {
+			continue
+		}
+		candidates = append(candidates, instanceID)
+	}
+	b.mu.RUnlock()
+
+	var orphaned []string
+	for _, instanceID := range candidates {
+		deploymentName := b.deploymentName(instanceID)
+		manifest, err := b.director.GetDeploymentManifest(deploymentName)
+		if err != nil {
+			b.logger.Warn("skipping unverifiable deployment", "operation", "reconcile",
+				"deployment", deploymentName, "error", err)
+			continue
+		}
+		if recorded := bosh.ManifestInstanceID(manifest); recorded != instanceID {
+			b.logger.Info("skipping deployment owned by another broker", "operation", "reconcile",
+				"deployment", deploymentName, "manifest_instance_id", recorded)
+			continue
+		}
+		orphaned = append(orphaned, instanceID)
+	}
+	sort.Strings(orphaned)
+	return orphaned
+}
+
+// adoptDeployments records the agent deployments for instanceIDs as ready
+// instances, skipping any that gained a record meanwhile. Returns the IDs
+// adopted.
+func (b *Broker) adoptDeployments(instanceIDs []string) []string {
+	var recovered []string
+	b.mu.Lock()
+	for _, instanceID := range instanceIDs {
+		if _, exists := b.instances[instanceID]; exists {
+			continue
+		}
+		b.putInstance(&Instance{
+			ID:             instanceID,
+			DeploymentName: b.deploymentName(instanceID),
+			AppsDomain:     b.config.AppsDomain,
+			State:          "ready",
+		})
+		recovered = append(recovered, instanceID)
+	}
+	b.mu.Unlock()
+
+	for _, id := range recovered {
+		b.logger.Info("reconciled orphaned deployment into broker state", "operation", "reconcile",
+			"instance_id", id, "deployment", b.deploymentName(id))
+		b.saveInstance(id)
+	}
+	return recovered
+}
+
+// ReconcileReport is the drift AdminReconcile found and what it did about it.
+type ReconcileReport struct {
+	DryRun       bool     `json:"dry_run"`
+	Missing      []string `json:"missing"`  // instances whose BOSH deployment is gone
+	Orphaned     []string `json:"orphaned"` // agent deployments with no broker record
+	MarkedFailed []string `json:"marked_failed"`
+	Removed      []string `json:"removed"`
+	Adopted      []string `json:"adopted"`
+}
+
+// ReconcileRequest is the AdminReconcile body.
+type ReconcileRequest struct {
+	Adopt         bool `json:"adopt,omitempty"`
+	RemoveMissing bool `json:"remove_missing,omitempty"`
+	DryRun        bool `json:"dry_run,omitempty"`
+}
+
+// AdminReconcile diffs broker state against the Director's deployments.
+// Instances whose deployment is gone are marked failed, or dropped with
+// remove_missing=true; orphaned agent deployments are adopted as recovered
+// instances with adopt=true. Instances mid-deploy or mid-delete are skipped
+// since their deployment legitimately comes and goes. With dry_run the drift
+// is reported and nothing changes.
+func (b *Broker) AdminReconcile(w http.ResponseWriter, r *http.Request) {
+	var req ReconcileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Bad request"})
+		return
+	}
+	ctx := r.Context()
+
+	deployments, err := b.director.ListDeployments()
+	if err != nil {
+		b.logger.ErrorContext(ctx, "listing deployments failed", "operation", "reconcile", "error", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "Failed to list BOSH deployments", "description": err.Error()})
+		return
+	}
+	deployed := make(map[string]bool, len(deployments))
+	for _, d := range deployments {
+		deployed[d.Name] = true
+	}
+
+	report := ReconcileReport{
+		DryRun:       req.DryRun,
+		Missing:      []string{},
+		Orphaned:     b.orphanedDeployments(deployments),
+		MarkedFailed: []string{},
+		Removed:      []string{},
+		Adopted:      []string{},
+	}
+	if report.Orphaned == nil {
+		report.Orphaned = []string{}
+	}
+
+	b.mu.Lock()
+	var ssoClients []string
+	for id, inst := range b.instances {
+		if inst.State == "provisioning" || inst.State == "deprovisioning" || deployed[inst.DeploymentName] {
+			continue
+		}
+		report.Missing = append(report.Missing, id)
+		if req.DryRun {
+			continue
+		}
+		if req.RemoveMissing {
+			if inst.SSOClientID != "" {
+				ssoClients = append(ssoClients, id, inst.SSOClientID)
+			}
+			b.removeInstance(id)
+			report.Removed = append(report.Removed, id)
+		} else if inst.State != "failed" {
+			b.setInstanceState(inst, "failed")
+			inst.LastError = "BOSH deployment " + inst.DeploymentName + " not found"
+			report.MarkedFailed = append(report.MarkedFailed, id)
+		}
+	}
+	b.mu.Unlock()
+	sort.Strings(report.Missing)
+	sort.Strings(report.MarkedFailed)
+	sort.Strings(report.Removed)
+
+	for _, id := range append(report.MarkedFailed, report.Removed...) {
+		b.saveInstance(id)
+	}
+	for i := 0; i < len(ssoClients); i += 2 {
+		b.deleteSSOClient(ctx, ssoClients[i], ssoClients[i+1])
+	}
+	if req.Adopt && !req.DryRun {
+		if adopted := b.adoptDeployments(report.Orphaned); adopted != nil {
+			report.Adopted = adopted
+		}
+	}
+
+	b.logger.InfoContext(ctx, "reconciled broker state against BOSH", "operation", "reconcile", "dry_run", req.DryRun,
+		"missing", len(report.Missing), "orphaned", len(report.Orphaned), "marked_failed", len(report.MarkedFailed),
+		"removed", len(report.Removed), "adopted", len(report.Adopted))
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,228 @@
+package broker
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/bosh"
+)
+
+// JSONSchema is the subset of JSON Schema (draft-04) the broker publishes in
+// the catalog and enforces on request parameters. Only the keywords below are
+// understood; anything richer must be added here before it is advertised.
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	PatternProperties    map[string]*JSONSchema `json:"patternProperties,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	MaxItems             int                    `json:"maxItems,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	MaxLength            int                    `json:"maxLength,omitempty"`
+}
+
+// PlanSchemas is the OSB "schemas" object on a catalog plan.
+type PlanSchemas struct {
+	ServiceInstance ServiceInstanceSchemas `json:"service_instance"`
+}
+
+type ServiceInstanceSchemas struct {
+	Create *InputParametersSchema `json:"create,omitempty"`
+}
+
+type InputParametersSchema struct {
+	Parameters *JSONSchema `json:"parameters"`
+}
+
+// versionPattern matches OpenClaw calendar versions: YYYY.M.D with an optional -N build suffix.
+const versionPattern = `^[0-9]{4}\.[0-9]{1,2}\.[0-9]{1,2}(-[0-9]+)?$`
+
+// tagPattern restricts instance tags and label keys to names every IaaS
+// accepts as a tag key.
+const tagPattern = `^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`
+
+// maxInstanceTags bounds the tags and labels an instance carries; IaaS
+// providers cap tags per resource (AWS at 50, shared with BOSH's own).
+const maxInstanceTags = 20
+
+// credentialPattern rejects control characters in channel credentials, which
+// are rendered into the agent manifest.
+const credentialPattern = `^[^\x00-\x1f\x7f]*$`
+
+// maxCredentialLength comfortably fits bot tokens and Teams webhook URLs.
+const maxCredentialLength = 1024
+
+// emailPattern is a deliberately loose check for the "email" format.
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// provisionParametersSchema describes the parameters Provision understands.
+// Unknown keys are rejected so typos don't silently fall back to defaults.
+func provisionParametersSchema() *JSONSchema {
+	noExtra := false
+	return &JSONSchema{
+		Schema:               "http://json-schema.org/draft-04/schema#",
+		Type:                 "object",
+		AdditionalProperties: &noExtra,
+		Properties: map[string]*JSONSchema{
+			"owner": {
+				Type:        "string",
+				Format:      "email",
+				Description: "Email address of the agent owner; used to derive the route hostname",
+			},
+			"openclaw_version": {
+				Type:        "string",
+				Pattern:     versionPattern,
+				Description: "OpenClaw version to deploy (YYYY.M.D), defaults to the broker's configured version",
+			},
+			"slack_bot_token": {
+				Type:        "string",
+				MaxLength:   maxCredentialLength,
+				Pattern:     credentialPattern,
+				Description: "Slack bot token, used when the plan enables the slack channel",
+			},
+			"teams_webhook_url": {
+				Type:        "string",
+				MaxLength:   maxCredentialLength,
+				Pattern:     credentialPattern,
+				Description: "Microsoft Teams incoming webhook URL, used when the plan enables the teams channel",
+			},
+			"discord_bot_token": {
+				Type:        "string",
+				MaxLength:   maxCredentialLength,
+				Pattern:     credentialPattern,
+				Description: "Discord bot token, used when the plan enables the discord channel",
+			},
+			"tags": {
+				Type:        "array",
+				Items:       &JSONSchema{Type: "string", Pattern: tagPattern},
+				MaxItems:    maxInstanceTags,
+				Description: "Tags for reporting (e.g. team name); each is also applied to the agent VM as an IaaS tag",
+			},
+			"labels": {
+				Type:                 "object",
+				PatternProperties:    map[string]*JSONSchema{tagPattern: {Type: "string", MaxLength: 255}},
+				AdditionalProperties: &noExtra,
+				Description:          "Key/value labels for reporting (e.g. cost_center); applied to the agent VM as IaaS tags",
+			},
+			"agent_config": agentConfigSchema(),
+			"az": {
+				Type:        "string",
+				Description: "Availability zone to pin the agent VM to; must be one of the plan's AZs. Defaults to spreading over all of them",
+			},
+		},
+	}
+}
+
+// agentConfigSchema allows only the agent settings in bosh.AgentCustomKeys, so
+// agent_config can't inject arbitrary structure into the manifest.
+func agentConfigSchema() *JSONSchema {
+	noExtra := false
+	props := make(map[string]*JSONSchema, len(bosh.AgentCustomKeys))
+	for key, maxLength := range bosh.AgentCustomKeys {
+		props[key] = &JSONSchema{Type: "string", MaxLength: maxLength}
+	}
+	return &JSONSchema{
+		Type:                 "object",
+		Properties:           props,
+		AdditionalProperties: &noExtra,
+		Description:          "Agent settings (e.g. system_prompt) rendered into the agent's custom configuration",
+	}
+}
+
+// validateAgainstSchema checks value against schema and returns the first
+// violation found, with a JSON-path style location for the error message.
+func validateAgainstSchema(schema *JSONSchema, value interface{}) error {
+	return validateSchemaAt(schema, value, "parameters")
+}
+
+func validateSchemaAt(schema *JSONSchema, value interface{}, path string) error {
+	if schema == nil {
+		return nil
+	}
+	switch schema.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			if value == nil {
+				return nil
+			}
+			return fmt.Errorf("%s must be an object", path)
+		}
+		// Sort keys so the reported violation is deterministic
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			prop, known := schema.Properties[k]
+			if !known {
+				prop, known = matchPatternProperty(schema.PatternProperties, k)
+			}
+			if !known {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					return fmt.Errorf("%s.%s is not a recognized parameter", path, k)
+				}
+				continue
+			}
+			if err := validateSchemaAt(prop, obj[k], path+"."+k); err != nil {
+				return err
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", path)
+		}
+		if schema.MaxItems > 0 && len(items) > schema.MaxItems {
+			return fmt.Errorf("%s has %d items, at most %d allowed", path, len(items), schema.MaxItems)
+		}
+		for i, item := range items {
+			if err := validateSchemaAt(schema.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", path)
+		}
+		if schema.MaxLength > 0 && utf8.RuneCountInString(str) > schema.MaxLength {
+			return fmt.Errorf("%s is longer than %d characters", path, schema.MaxLength)
+		}
+		if schema.Format == "email" && !emailPattern.MatchString(str) {
+			return fmt.Errorf("%s must be an email address, got %q", path, str)
+		}
+		if schema.Pattern != "" {
+			re, err := regexp.Compile(schema.Pattern)
+			if err != nil {
+				return fmt.Errorf("%s has an invalid schema pattern: %w", path, err)
+			}
+			if !re.MatchString(str) {
+				return fmt.Errorf("%s value %q does not match pattern %s", path, str, schema.Pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// matchPatternProperty returns the schema of the first pattern (in sorted
+// order, for determinism) that matches key.
+func matchPatternProperty(patterns map[string]*JSONSchema, key string) (*JSONSchema, bool) {
+	keys := make([]string, 0, len(patterns))
+	for p := range patterns {
+		keys = append(keys, p)
+	}
+	sort.Strings(keys)
+	for _, p := range keys {
+		if re, err := regexp.Compile(p); err == nil && re.MatchString(key) {
+			return patterns[p], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/tracing"
+)
+
+// osbOperations names the server span for each OSB route; other routes are
+// named "<METHOD> <path template>".
+var osbOperations = map[string]string{
+	"GET /v2/catalog":                                                          "catalog",
+	"PUT /v2/service_instances/{instance_id}":                                  "provision",
+	"PATCH /v2/service_instances/{instance_id}":                                "update",
+	"DELETE /v2/service_instances/{instance_id}":                               "deprovision",
+	"GET /v2/service_instances/{instance_id}/last_operation":                   "last_operation",
+	"PUT /v2/service_instances/{instance_id}/service_bindings/{binding_id}":    "bind",
+	"DELETE /v2/service_instances/{instance_id}/service_bindings/{binding_id}": "unbind",
+}
+
+// SetTracer replaces the tracer configured from BrokerConfig.OTLPEndpoint.
+func (b *Broker) SetTracer(t *tracing.Tracer) {
+	b.tracer = t
+}
+
+// TracingMiddleware opens a server span per request, continuing any trace
+// the caller passed in a traceparent header. Handlers add child spans for
+// the BOSH and UAA calls they make through the request context.
+func (b *Broker) TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.tracer.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := r.Method + " " + r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				name = r.Method + " " + tmpl
+			}
+		}
+		if op, ok := osbOperations[name]; ok {
+			name = op
+		}
+		attrs := []tracing.Attr{tracing.String("operation", name), tracing.String("http.method", r.Method)}
+		vars := mux.Vars(r)
+		if id := vars["instance_id"]; id != "" {
+			attrs = append(attrs, tracing.String("instance_id", id))
+		}
+		if id := vars["binding_id"]; id != "" {
+			attrs = append(attrs, tracing.String("binding_id", id))
+		}
+		ctx, span := b.tracer.Start(tracing.Extract(r.Context(), r.Header), name, attrs...)
+		span.SetKind(tracing.KindServer)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		result := "success"
+		if rec.status >= 400 {
+			result = "error"
+		}
+		span.SetAttributes(tracing.Int("http.status_code", rec.status), tracing.String("result", result))
+		if rec.status >= 500 {
+			span.SetError(http.StatusText(rec.status))
+		}
+		span.End()
+	})
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// deploy submits manifest to the Director inside a bosh.deploy span.
+func (b *Broker) deploy(ctx context.Context, instanceID string, manifest []byte) (int, error) {
+	_, span := b.tracer.Start(ctx, "bosh.deploy", tracing.String("instance_id", instanceID))
+	span.SetKind(tracing.KindClient)
+	taskID, err := b.director.Deploy(manifest)
+	span.SetAttributes(tracing.Int("bosh_task_id", taskID))
+	span.Finish(err)
+	return taskID, err
+}
+
+// deleteDeployment deletes an agent deployment inside a bosh.delete_deployment span.
+func (b *Broker) deleteDeployment(ctx context.Context, instanceID, deploymentName string) (int, error) {
+	_, span := b.tracer.Start(ctx, "bosh.delete_deployment", tracing.String("instance_id", instanceID))
+	span.SetKind(tracing.KindClient)
+	taskID, err := b.director.DeleteDeployment(deploymentName)
+	span.SetAttributes(tracing.Int("bosh_task_id", taskID))
+	span.Finish(err)
+	return taskID, err
+}
+
+// recreate recreates an agent deployment's VMs inside a bosh.recreate span.
+func (b *Broker) recreate(ctx context.Context, instanceID, deploymentName string) (int, error) {
+	_, span := b.tracer.Start(ctx, "bosh.recreate", tracing.String("instance_id", instanceID))
+	span.SetKind(tracing.KindClient)
+	taskID, err := b.director.Recreate(deploymentName)
+	span.SetAttributes(tracing.Int("bosh_task_id", taskID))
+	span.Finish(err)
+	return taskID, err
+}
+
+// taskStatus polls a BOSH task inside a bosh.task_status span.
+func (b *Broker) taskStatus(ctx context.Context, instanceID string, taskID int) (string, error) {
+	_, span := b.tracer.Start(ctx, "bosh.task_status", tracing.String("instance_id", instanceID), tracing.Int("bosh_task_id", taskID))
+	span.SetKind(tracing.KindClient)
+	state, err := b.director.TaskStatus(taskID)
+	span.SetAttributes(tracing.String("task_state", state))
+	span.Finish(err)
+	return state, err
+}
+
+// traceUAA runs a UAA client call inside a span named name.
+func (b *Broker) traceUAA(ctx context.Context, name, instanceID, clientID string, call func() error) error {
+	_, span := b.tracer.Start(ctx, name, tracing.String("instance_id", instanceID), tracing.String("client_id", clientID))
+	span.SetKind(tracing.KindClient)
+	err := call()
+	span.Finish(err)
+	return err
+}
@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/tracing"
+)
+
+func TestTracing_ProvisionSpanTree(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	recorder := &tracing.Recorder{}
+	b.SetTracer(tracing.NewTracer(recorder))
+	router.Use(b.TracingMiddleware)
+
+	const callerTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	body, _ := json.Marshal(ProvisionRequest{
+		ServiceID:        "openclaw-service",
+		PlanID:           "openclaw-developer-plan",
+		OrganizationGUID: "org-123",
+		SpaceGUID:        "space-456",
+		Parameters:       map[string]interface{}{"owner": "dev@example.com"},
+	})
+	req := httptest.NewRequest("PUT", "/v2/service_instances/inst-traced?accepts_incomplete=true", bytes.NewReader(body))
+	req.Header.Set("traceparent", "00-"+callerTrace+"-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != 202 {
+		t.Fatalf("provision = %d: %s", rr.Code, rr.Body.String())
+	}
+
+	spans := recorder.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want bosh.deploy and provision: %+v", len(spans), spans)
+	}
+	deploy, root := spans[0], spans[1]
+	if root.Name != "provision" || root.Kind != tracing.KindServer {
+		t.Errorf("root span = %q (kind %d), want server span provision", root.Name, root.Kind)
+	}
+	if root.TraceID != callerTrace || root.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("root span trace %s parent %s, want the caller's traceparent continued", root.TraceID, root.ParentSpanID)
+	}
+	if root.Attr("instance_id") != "inst-traced" || root.Attr("http.status_code") != 202 || root.Attr("result") != "success" {
+		t.Errorf("root attributes = %+v", root.Attributes)
+	}
+
+	if deploy.Name != "bosh.deploy" || deploy.TraceID != callerTrace || deploy.ParentSpanID != root.SpanID {
+		t.Errorf("child span = %+v, want bosh.deploy under the provision span", deploy)
+	}
+	b.mu.RLock()
+	taskID := b.instances["inst-traced"].BoshTaskID
+	b.mu.RUnlock()
+	if deploy.Attr("bosh_task_id") != taskID || deploy.Attr("instance_id") != "inst-traced" || deploy.Attr("result") != "success" {
+		t.Errorf("deploy attributes = %+v, want bosh_task_id %d", deploy.Attributes, taskID)
+	}
+}
+
+func TestTracing_NoopWithoutEndpoint(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	if b.tracer.Enabled() {
+		t.Fatal("tracer should be a no-op without an OTLP endpoint")
+	}
+	router.Use(b.TracingMiddleware)
+	if rr := provisionInstance(t, router, "inst-untraced", "openclaw-developer-plan"); rr.Code != 202 {
+		t.Fatalf("provision = %d: %s", rr.Code, rr.Body.String())
+	}
+}
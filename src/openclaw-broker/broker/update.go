@@ -1,10 +1,14 @@
 package broker
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/bosh"
@@ -12,40 +16,55 @@ import (
 )
 
 type UpdateRequest struct {
-	ServiceID  string                 `json:"service_id"`
-	PlanID     string                 `json:"plan_id,omitempty"`
-	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	ServiceID       string                 `json:"service_id"`
+	PlanID          string                 `json:"plan_id,omitempty"`
+	Parameters      map[string]interface{} `json:"parameters,omitempty"`
+	MaintenanceInfo *MaintenanceInfo       `json:"maintenance_info,omitempty"`
 }
 
 func (b *Broker) Update(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	instanceID := vars["instance_id"]
+	ctx := r.Context()
 
 	// OSB API: async operations require accepts_incomplete=true
-	if r.URL.Query().Get("accepts_incomplete") != "true" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error":       "AsyncRequired",
-			"description": "This service plan requires client support for asynchronous service operations.",
-		})
+	if !requireAsync(w, r) {
 		return
 	}
 
 	var req UpdateRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Bad request"})
+		osbError(w, http.StatusBadRequest, "BadRequest", "Malformed request body: "+err.Error())
 		return
 	}
 
+	// maintenance_info requests an upgrade to a specific version; the broker
+	// can only deploy the version it currently advertises in the catalog.
+	if req.MaintenanceInfo != nil && !b.offersVersion(req.MaintenanceInfo.Version) {
+		osbError(w, http.StatusUnprocessableEntity, errMaintenanceInfoConflict,
+			fmt.Sprintf("maintenance_info.version %q is not offered; the current version is %q", req.MaintenanceInfo.Version, b.config.OpenClawVersion))
+		return
+	}
+
+	unlock := b.ops.lock(instanceID)
+	defer unlock()
+	done := b.beginBOSHWrite()
+	defer done()
+
 	b.mu.Lock()
 
+	routeChanged := false
 	instance, exists := b.instances[instanceID]
+	if exists && instance.State == "deprovisioning" {
+		b.mu.Unlock()
+		osbError(w, http.StatusUnprocessableEntity, errConcurrency, fmt.Sprintf("Instance %s is being deprovisioned", instanceID))
+		return
+	}
 	if !exists {
 		// Instance not in broker memory (e.g., broker restarted after tile redeploy).
 		// Create a recovery record and redeploy with current broker config.
-		log.Printf("Update orphan recovery for instance %s", instanceID)
-		deploymentName := fmt.Sprintf("openclaw-agent-%s", instanceID)
+		b.logger.InfoContext(ctx, "update orphan recovery", "operation", "update", "instance_id", instanceID)
+		deploymentName := b.deploymentName(instanceID)
 
 		plan := b.findPlan(req.PlanID)
 		if plan == nil {
@@ -60,7 +79,7 @@ func (b *Broker) Update(w http.ResponseWriter, r *http.Request) {
 		}
 		if plan == nil {
 			b.mu.Unlock()
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Unknown plan"})
+			osbError(w, http.StatusBadRequest, "UnknownPlan", "No plans are configured")
 			return
 		}
 
@@ -78,48 +97,165 @@ func (b *Broker) Update(w http.ResponseWriter, r *http.Request) {
 			DiskType:         plan.DiskType,
 			State:            "provisioning",
 			SSOEnabled:       b.config.SSOEnabled,
-			OpenClawVersion:  b.config.OpenClawVersion,
+			OpenClawVersion:  b.planVersion(plan),
 		}
-		b.instances[instanceID] = instance
+		b.putInstance(instance)
 	} else {
-		// If the plan is changing, validate the new plan and update instance fields
+		// A maintenance_info-only request for the version the instance already
+		// runs is a no-op; anything else falls through to a redeploy.
 		planChanged := req.PlanID != "" && req.PlanID != instance.PlanID
+		if req.MaintenanceInfo != nil {
+			// Each plan offers only the version it deploys
+			targetPlanID := instance.PlanID
+			if planChanged {
+				targetPlanID = req.PlanID
+			}
+			if offered := b.planVersion(b.findPlan(targetPlanID)); req.MaintenanceInfo.Version != offered {
+				b.mu.Unlock()
+				osbError(w, http.StatusUnprocessableEntity, errMaintenanceInfoConflict,
+					fmt.Sprintf("maintenance_info.version %q is not offered for this plan; it deploys %q", req.MaintenanceInfo.Version, offered))
+				return
+			}
+			if req.MaintenanceInfo.Version == instance.OpenClawVersion && !planChanged && len(req.Parameters) == 0 {
+				b.mu.Unlock()
+				writeJSON(w, http.StatusOK, map[string]string{})
+				return
+			}
+			b.logger.InfoContext(ctx, "upgrading via maintenance_info", "operation", "update", "instance_id", instanceID,
+				"from_version", instance.OpenClawVersion, "to_version", req.MaintenanceInfo.Version)
+		}
+
+		// If the plan is changing, validate the new plan and update instance fields
 		if planChanged {
 			plan := b.findPlan(req.PlanID)
 			if plan == nil {
 				b.mu.Unlock()
-				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Unknown plan"})
+				osbError(w, http.StatusBadRequest, "UnknownPlan", fmt.Sprintf("Plan %q is not in the catalog", req.PlanID))
+				return
+			}
+			current := b.findPlan(instance.PlanID)
+			if current != nil && !current.allowsUpdateTo(plan) {
+				b.mu.Unlock()
+				osbError(w, http.StatusUnprocessableEntity, "PlanChangeNotAllowed",
+					fmt.Sprintf("Plan %s cannot be changed to %s; allowed plans: %s", current.Name, plan.Name, strings.Join(current.AllowedUpdates, ", ")))
+				return
+			}
+			// Instances already on a deprecated plan keep it; none may move onto it
+			if plan.Deprecated {
+				b.mu.Unlock()
+				osbError(w, http.StatusUnprocessableEntity, "PlanDeprecated", planDeprecationMessage(plan))
+				return
+			}
+			// Only the growth in memory counts against the aggregate cap
+			delta := plan.Memory
+			if current != nil {
+				delta -= current.Memory
+			}
+			if b.memoryQuotaExceeded(delta) {
+				b.logger.WarnContext(ctx, "memory quota exceeded", "operation", "update", "instance_id", instanceID,
+					"plan", plan.Name, "memory_delta_mb", delta, "total_memory_mb", b.totalMemoryMB(), "max_total_memory_mb", b.config.MaxTotalMemoryMB)
+				b.mu.Unlock()
+				osbError(w, http.StatusUnprocessableEntity, "QuotaExceeded", fmt.Sprintf("Changing to plan %s needs %d MB more but only %d of %d MB total memory remains", plan.Name, delta, b.config.MaxTotalMemoryMB-b.totalMemoryMB(), b.config.MaxTotalMemoryMB))
 				return
 			}
 			instance.PlanID = req.PlanID
 			instance.PlanName = plan.Name
 			instance.VMType = plan.VMType
 			instance.DiskType = plan.DiskType
+			if plan.OpenClawVersion != "" {
+				instance.OpenClawVersion = plan.OpenClawVersion
+			}
+		}
+
+		// Follow an apps domain migration so the route moves with it
+		if b.config.AppsDomain != "" && instance.AppsDomain != b.config.AppsDomain {
+			b.logger.InfoContext(ctx, "apps domain changed", "operation", "update", "instance_id", instanceID,
+				"from_domain", instance.AppsDomain, "to_domain", b.config.AppsDomain)
+			instance.AppsDomain = b.config.AppsDomain
+			routeChanged = true
 		}
 	}
 
-	// Always redeploy — this ensures instances pick up new release versions
-	// after a tile update (e.g., gateway code fixes, security patches).
+	// Redeploy whenever the rendered manifest differs from what BOSH has, so
+	// instances pick up new release versions after a tile update (e.g.,
+	// gateway code fixes, security patches).
 	params := b.buildManifestParams(instance)
+	wasReady := exists && instance.State == "ready"
+	ssoClientID := instance.SSOClientID
+	routeHostname, appsDomain := instance.RouteHostname, instance.AppsDomain
 	b.mu.Unlock()
 
-	manifest, err := bosh.RenderAgentManifest(params)
+	// A stale redirect_uri breaks SSO login on the new route
+	if routeChanged && ssoClientID != "" && b.uaaClient != nil {
+		if err := b.traceUAA(ctx, "uaa.update_client", instanceID, ssoClientID, func() error {
+			return b.uaaClient.UpdateClient(ssoOAuthClient(instanceID, ssoClientID, "", routeHostname, appsDomain))
+		}); err != nil {
+			b.logger.WarnContext(ctx, "failed to update UAA client redirect URI, SSO login may fail", "operation", "update",
+				"instance_id", instanceID, "client_id", ssoClientID, "error", err)
+		} else {
+			b.logger.InfoContext(ctx, "updated UAA client redirect URI", "operation", "update",
+				"instance_id", instanceID, "client_id", ssoClientID)
+		}
+	}
+	if req.MaintenanceInfo != nil {
+		params.OpenClawVersion = req.MaintenanceInfo.Version
+	}
+
+	manifest, err := b.renderManifest(params)
 	if err != nil {
-		log.Printf("Manifest render failed for update %s: %v", instanceID, err)
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to render deployment manifest"})
+		b.logger.ErrorContext(ctx, "manifest render failed", "operation", "update", "instance_id", instanceID, "error", err)
+		osbError(w, http.StatusInternalServerError, "ManifestRenderFailed", "Failed to render deployment manifest")
 		return
 	}
-	taskID, err := b.director.Deploy(manifest)
+
+	user := b.originatingIdentity(ctx, r)
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	if wasReady && !force && b.manifestUnchanged(ctx, params.DeploymentName, manifest) {
+		b.logger.InfoContext(ctx, "manifest unchanged, skipping redeploy", "operation", "update", "instance_id", instanceID)
+		if user != nil {
+			b.mu.Lock()
+			instance.LastModifiedBy = user
+			b.mu.Unlock()
+		}
+		b.saveInstance(instanceID)
+		b.audit(ctx, "update", instanceID, "", user)
+		writeJSON(w, http.StatusOK, map[string]string{})
+		return
+	}
+
+	taskID, err := b.deploy(ctx, instanceID, manifest)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Update deployment failed"})
+		b.logger.ErrorContext(ctx, "BOSH deploy failed", "operation", "update", "instance_id", instanceID, "error", err)
+		osbError(w, http.StatusInternalServerError, "DeploymentFailed", "The BOSH Director rejected the deployment")
 		return
 	}
 
 	b.mu.Lock()
 	instance.State = "provisioning"
 	instance.BoshTaskID = taskID
+	instance.OpenClawVersion = params.OpenClawVersion
+	if user != nil {
+		instance.LastModifiedBy = user
+	}
 	b.mu.Unlock()
-	b.saveState()
+	b.saveInstance(instanceID)
+	b.logger.InfoContext(ctx, "BOSH deploy started", "operation", "update", "instance_id", instanceID, "bosh_task_id", taskID)
+	b.audit(ctx, "update", instanceID, "", user)
 
 	writeJSON(w, http.StatusAccepted, map[string]string{"operation": "update-" + instanceID})
 }
+
+// manifestUnchanged reports whether the Director already runs exactly this
+// manifest. Any failure to fetch the deployed manifest counts as changed, so
+// the caller falls back to redeploying.
+func (b *Broker) manifestUnchanged(ctx context.Context, deploymentName string, manifest []byte) bool {
+	deployed, err := b.director.GetDeploymentManifest(deploymentName)
+	if err != nil {
+		if !errors.Is(err, bosh.ErrDeploymentNotFound) {
+			b.logger.WarnContext(ctx, "could not fetch deployed manifest, redeploying", "operation", "update",
+				"deployment", deploymentName, "error", err)
+		}
+		return false
+	}
+	return sha256.Sum256(deployed) == sha256.Sum256(manifest)
+}
@@ -0,0 +1,37 @@
+package broker
+
+import "net/http"
+
+// Build information, set at link time by the package build:
+//
+//	go build -ldflags "-X .../broker.Version=1.2.3 -X .../broker.Commit=abc123 -X .../broker.BuildDate=2026-01-02T15:04:05Z"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// VersionInfo identifies the running broker build and what it deploys.
+type VersionInfo struct {
+	Version         string `json:"version"`
+	Commit          string `json:"commit"`
+	BuildDate       string `json:"build_date"`
+	OpenClawVersion string `json:"openclaw_version"`
+	PlanCount       int    `json:"plan_count"`
+}
+
+// ServeVersion is an unauthenticated endpoint reporting the broker build, so
+// support can tell exactly what is deployed.
+func (b *Broker) ServeVersion(w http.ResponseWriter, r *http.Request) {
+	plans := b.config.Plans
+	if len(plans) == 0 {
+		plans = defaultPlans()
+	}
+	writeJSON(w, http.StatusOK, VersionInfo{
+		Version:         Version,
+		Commit:          Commit,
+		BuildDate:       BuildDate,
+		OpenClawVersion: b.config.OpenClawVersion,
+		PlanCount:       len(plans),
+	})
+}
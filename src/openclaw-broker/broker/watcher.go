@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// StartTaskWatcher polls the BOSH tasks of in-flight provisions, updates and
+// deprovisions in the background until the returned func is called, so
+// instances converge even when the platform stops polling last_operation.
+// While it runs, LastOperation answers from broker state. A no-op when
+// BrokerConfig.TaskWatchInterval is not set.
+func (b *Broker) StartTaskWatcher() (stop func()) {
+	if b.watchInterval <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	b.watching.Store(true)
+	go func() {
+		defer close(done)
+		timer := time.NewTimer(jittered(b.watchInterval))
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				b.watchTasks(ctx)
+				timer.Reset(jittered(b.watchInterval))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		b.watching.Store(false)
+	}
+}
+
+// jittered spreads d uniformly over [d/2, 3d/2) so several brokers sharing a
+// Director don't poll it in lockstep.
+func jittered(d time.Duration) time.Duration {
+	return d/2 + rand.N(d)
+}
+
+// watchTasks advances every instance with an operation in flight. Reaped
+// instances are left to the TTL reaper, and a failed delete waits for the
+// platform to retry the deprovision.
+func (b *Broker) watchTasks(ctx context.Context) {
+	b.mu.RLock()
+	var inflight []*Instance
+	for _, inst := range b.instances {
+		switch inst.State {
+		case "provisioning", stateDeployingRoute:
+			inflight = append(inflight, inst)
+		case "deprovisioning":
+			if inst.ReapedAt.IsZero() && inst.LastError == "" {
+				inflight = append(inflight, inst)
+			}
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, inst := range inflight {
+		if ctx.Err() != nil {
+			return
+		}
+		b.watchInstance(ctx, inst)
+	}
+}
+
+// watchInstance advances one instance under its operation lock, skipping it
+// if a handler replaced or removed it since the snapshot.
+func (b *Broker) watchInstance(ctx context.Context, inst *Instance) {
+	unlock := b.ops.lock(inst.ID)
+	defer unlock()
+	b.mu.RLock()
+	current := b.instances[inst.ID]
+	b.mu.RUnlock()
+	if current != inst {
+		return
+	}
+	b.advanceOperation(ctx, inst)
+}
@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitForState polls until the instance reaches want, or is removed when want is "".
+func waitForState(t *testing.T, b *Broker, instanceID, want string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b.mu.RLock()
+		state := ""
+		if inst, ok := b.instances[instanceID]; ok {
+			state = inst.State
+		}
+		b.mu.RUnlock()
+		if state == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s state = %q, want %q", instanceID, state, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTaskWatcher_ConvergesWithoutLastOperation(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.watchInterval = 10 * time.Millisecond
+	stop := b.StartTaskWatcher()
+	defer stop()
+
+	provisionInstance(t, router, "inst-watched", "openclaw-developer-plan")
+	waitForState(t, b, "inst-watched", "ready")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/v2/service_instances/inst-watched?accepts_incomplete=true", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Deprovision status = %d, want 202. Body: %s", rr.Code, rr.Body.String())
+	}
+	waitForState(t, b, "inst-watched", "")
+
+	// The platform polling after the watcher removed the instance learns the
+	// deprovision finished
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/service_instances/inst-watched/last_operation?operation=deprovision-inst-watched", nil))
+	if rr.Code != http.StatusGone {
+		t.Errorf("last_operation after removal = %d, want 410", rr.Code)
+	}
+}
+
+func TestTaskWatcher_LastOperationReadsCachedState(t *testing.T) {
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.watchInterval = time.Hour
+	stop := b.StartTaskWatcher()
+	defer stop()
+
+	provisionInstance(t, router, "inst-cached", "openclaw-developer-plan")
+
+	// The task is done, but until the watcher runs LastOperation reports what
+	// broker state says
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/service_instances/inst-cached/last_operation", nil))
+	var resp LastOperationResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.State != "in progress" {
+		t.Errorf("state = %q, want in progress from cached state", resp.State)
+	}
+
+	b.watchTasks(t.Context())
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/service_instances/inst-cached/last_operation", nil))
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.State != "succeeded" {
+		t.Errorf("state after a watcher run = %q, want succeeded", resp.State)
+	}
+
+	stop()
+	if b.watching.Load() {
+		t.Error("LastOperation should poll BOSH again once the watcher stops")
+	}
+}
+
+func TestTaskWatcher_DisabledWithoutInterval(t *testing.T) {
+	b, fakeBOSH, _ := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.StartTaskWatcher()()
+	if b.watching.Load() {
+		t.Error("watcher should not start without an interval")
+	}
+}
+
+func TestJittered(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jittered(time.Second); d < 500*time.Millisecond || d >= 1500*time.Millisecond {
+			t.Fatalf("jittered(1s) = %s, want within [500ms, 1.5s)", d)
+		}
+	}
+}
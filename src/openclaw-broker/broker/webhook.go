@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Lifecycle events sent to the webhook. Provision events also cover update
+// redeploys, which LastOperation observes through the same state.
+const (
+	EventProvisionSucceeded   = "provision.succeeded"
+	EventProvisionFailed      = "provision.failed"
+	EventDeprovisionSucceeded = "deprovision.succeeded"
+	EventDeprovisionFailed    = "deprovision.failed"
+	EventUpgradeSucceeded     = "upgrade.succeeded"
+	EventUpgradeFailed        = "upgrade.failed"
+	EventInstanceExpired      = "instance.expired" // sent before the TTL reaper deletes an instance
+)
+
+// webhookSignatureHeader carries "sha256=<hex HMAC-SHA256 of the body>" when
+// a webhook secret is configured.
+const webhookSignatureHeader = "X-OpenClaw-Signature"
+
+// Delivery bounds: each attempt gets webhookTimeout, and a failed delivery is
+// retried up to webhookAttempts in total.
+const (
+	webhookTimeout  = 5 * time.Second
+	webhookAttempts = 3
+)
+
+// WebhookEvent is the JSON body POSTed to the webhook URL.
+type WebhookEvent struct {
+	Event      string    `json:"event"`
+	InstanceID string    `json:"instance_id"`
+	Plan       string    `json:"plan"`
+	State      string    `json:"state"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// signWebhook returns the signature header value for body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify sends a lifecycle event to the configured webhook in the background.
+// Best-effort: failures are logged and never affect the operation.
+func (b *Broker) notify(ctx context.Context, event, instanceID, plan, state string) {
+	if b.config.WebhookURL == "" {
+		return
+	}
+	body, err := json.Marshal(WebhookEvent{
+		Event:      event,
+		InstanceID: instanceID,
+		Plan:       plan,
+		State:      state,
+		Timestamp:  time.Now().UTC(),
+	})
+	if err != nil {
+		b.logger.ErrorContext(ctx, "failed to marshal webhook event", "event", event, "instance_id", instanceID, "error", err)
+		return
+	}
+	// Detach from the request so delivery outlives it, keeping its log attributes
+	go b.deliverWebhook(context.WithoutCancel(ctx), event, instanceID, body)
+}
+
+// deliverWebhook POSTs body, retrying failed attempts after webhookRetryDelay.
+func (b *Broker) deliverWebhook(ctx context.Context, event, instanceID string, body []byte) {
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if err = b.postWebhook(ctx, body); err == nil {
+			return
+		}
+		if attempt < webhookAttempts {
+			time.Sleep(b.webhookRetryDelay)
+		}
+	}
+	b.logger.WarnContext(ctx, "webhook delivery failed", "event", event, "instance_id", instanceID,
+		"attempts", webhookAttempts, "error", err)
+}
+
+func (b *Broker) postWebhook(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", b.config.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.config.WebhookSecret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(b.config.WebhookSecret, body))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
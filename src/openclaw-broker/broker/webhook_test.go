@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newWebhookReceiver verifies each delivery's signature against secret (or
+// that it is unsigned without one) and forwards the decoded event. The first
+// `fail` deliveries are answered 500.
+func newWebhookReceiver(t *testing.T, secret string, fail int32) (*httptest.Server, <-chan WebhookEvent) {
+	events := make(chan WebhookEvent, 10)
+	var deliveries atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := ""
+		if secret != "" {
+			want = signWebhook(secret, body)
+		}
+		if got := r.Header.Get(webhookSignatureHeader); got != want {
+			t.Errorf("signature = %q, want %q", got, want)
+		}
+		if deliveries.Add(1) <= fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("webhook body is not an event: %v", err)
+		}
+		events <- event
+	}))
+	return srv, events
+}
+
+func waitForEvent(t *testing.T, events <-chan WebhookEvent) WebhookEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook event delivered")
+		return WebhookEvent{}
+	}
+}
+
+func TestWebhook_ProvisionSucceeded(t *testing.T) {
+	receiver, events := newWebhookReceiver(t, "hook-secret", 0)
+	defer receiver.Close()
+	b, fakeBOSH, router := newTestBroker("done", false)
+	defer fakeBOSH.Close()
+	b.config.WebhookURL = receiver.URL
+	b.config.WebhookSecret = "hook-secret"
+
+	provisionInstance(t, router, "inst-hook", "openclaw-developer-plan")
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/service_instances/inst-hook/last_operation", nil))
+
+	event := waitForEvent(t, events)
+	if event.Event != EventProvisionSucceeded || event.InstanceID != "inst-hook" || event.Plan != "developer" || event.State != "ready" {
+		t.Errorf("event = %+v, want provision.succeeded for inst-hook", event)
+	}
+	if event.Timestamp.IsZero() {
+		t.Error("event should carry a timestamp")
+	}
+
+	// Polling a ready instance again is not a new transition
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/service_instances/inst-hook/last_operation", nil))
+	select {
+	case extra := <-events:
+		t.Errorf("unexpected second event %+v", extra)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhook_RetriesFailedDelivery(t *testing.T) {
+	receiver, events := newWebhookReceiver(t, "", 2)
+	defer receiver.Close()
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("error", false)
+	defer fakeBOSH.Close()
+	b.config.WebhookURL = receiver.URL
+	b.webhookRetryDelay = 10 * time.Millisecond
+
+	provisionInstance(t, router, "inst-hook-retry", "openclaw-developer-plan")
+	b.upgrades.track("inst-hook-retry", 42, "2026.2.17")
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin/upgrade/status", nil))
+
+	event := waitForEvent(t, events)
+	if event.Event != EventUpgradeFailed || event.State != "failed" {
+		t.Errorf("event = %+v, want upgrade.failed after two failed deliveries", event)
+	}
+}
+
+func TestWebhook_NoUpgradeEventAfterDeprovision(t *testing.T) {
+	receiver, events := newWebhookReceiver(t, "", 0)
+	defer receiver.Close()
+	b, fakeBOSH, router := newTestBrokerWithAdminRoutes("done", false)
+	defer fakeBOSH.Close()
+
+	provisionInstance(t, router, "inst-gone", "openclaw-developer-plan")
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/service_instances/inst-gone/last_operation", nil))
+	b.config.WebhookURL = receiver.URL
+
+	// Recreate tasks are tracked with upgrades; deprovisioning the instance
+	// afterwards must not let the status poll flip it back to ready
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/instances/inst-gone/recreate", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("recreate status = %d, want 202. Body: %s", rr.Code, rr.Body.String())
+	}
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/v2/service_instances/inst-gone?accepts_incomplete=true", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin/upgrade/status", nil))
+
+	b.mu.RLock()
+	state := b.instances["inst-gone"].State
+	b.mu.RUnlock()
+	if state != "deprovisioning" {
+		t.Errorf("state = %q, want deprovisioning", state)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -2,4 +2,7 @@ module github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker
 
 go 1.24
 
-require github.com/gorilla/mux v1.8.1
+require (
+	github.com/gorilla/mux v1.8.1
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -1,24 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/broker"
 	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/bosh"
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/security"
+	"gopkg.in/yaml.v3"
 )
 
+// stateDir is the broker's persistent disk: instance state, the audit log
+// and the cached GenAI chat model.
+const stateDir = "/var/vcap/store/openclaw-broker"
+
 func main() {
 	configPath := flag.String("config", "/var/vcap/jobs/openclaw-broker/config/config.json", "Path to broker config")
 	flag.Parse()
@@ -28,15 +38,19 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	// Validate auth credentials are non-empty to prevent bypass
-	if cfg.Auth.Username == "" || cfg.Auth.Password == "" {
-		log.Fatalf("Broker auth credentials must not be empty (username=%q)", cfg.Auth.Username)
+	// Route the stdlib logger through slog so startup messages share the
+	// configured format with the broker's structured handler logs.
+	slog.SetDefault(broker.NewLogger(cfg.LogFormat, os.Stderr))
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid broker config:\n%v", err)
 	}
 
 	// Load GenAI credentials from marketplace service key (if tanzu_genai provider)
+	configuredModel := cfg.GenAI.Model
 	if cfg.GenAI.Provider == "tanzu_genai" {
 		configDir := filepath.Dir(*configPath)
-		endpoint, apiKey, model, err := loadGenAICredentials(configDir)
+		endpoint, apiKey, model, err := loadGenAICredentials(configDir, stateDir, cfg.GenAI.PreferredModel, true)
 		if err != nil {
 			log.Fatalf("Failed to load GenAI marketplace credentials: %v", err)
 		}
@@ -48,7 +62,14 @@ func main() {
 		log.Printf("GenAI: loaded marketplace credentials, endpoint=%s model=%s", endpoint, cfg.GenAI.Model)
 	}
 
-	director := bosh.NewClient(cfg.BOSH.DirectorURL, cfg.BOSH.ClientID, cfg.BOSH.ClientSecret, cfg.BOSH.CACert, cfg.BOSH.UaaURL)
+	// Validate has already rejected a bad outbound_tls block
+	tlsMinVersion, tlsCipherSuites, _ := cfg.outboundTLS()
+	director := bosh.NewClient(cfg.BOSH.DirectorURL, cfg.BOSH.ClientID, cfg.BOSH.ClientSecret, cfg.BOSH.CACert, cfg.BOSH.UaaURL, bosh.ClientOptions{
+		Timeout:           time.Duration(cfg.BOSH.TimeoutSeconds) * time.Second,
+		TaskStatusTimeout: time.Duration(cfg.BOSH.TaskStatusTimeoutSeconds) * time.Second,
+		TLSMinVersion:     tlsMinVersion,
+		TLSCipherSuites:   tlsCipherSuites,
+	})
 
 	// Use on_demand plans if available, fall back to top-level plans
 	plans := cfg.OnDemand.Plans
@@ -62,7 +83,9 @@ func main() {
 		OpenClawVersion:        cfg.AgentDefaults.OpenClawVersion,
 		Plans:                  plans,
 		AppsDomain:             cfg.CF.AppsDomain,
+		DashboardURLTemplate:   cfg.CF.DashboardURLTemplate,
 		Network:                cfg.OnDemand.Network,
+		DeploymentPrefix:       cfg.OnDemand.DeploymentPrefix,
 		AZs:                    cfg.OnDemand.AZs,
 		StemcellOS:             cfg.OnDemand.StemcellOS,
 		StemcellVersion:        cfg.OnDemand.StemcellVersion,
@@ -74,64 +97,131 @@ func main() {
 		SSOOIDCIssuerURL:        cfg.Security.SSOOIDCIssuerURL,
 		SSOAllowedEmailDomains:  cfg.Security.SSOAllowedEmailDomains,
 		SSOSessionTimeoutHours:  cfg.Security.SSOSessionTimeoutHours,
+		SSOExternalClientManagement: cfg.Security.SSOExternalClientManagement,
+		SSOExternalClientSecretsDir: cfg.Security.SSOExternalClientSecretsDir,
 		CFUaaURL:                cfg.CFUAA.URL,
 		CFUaaAdminClientID:      cfg.CFUAA.AdminClientID,
 		CFUaaAdminClientSecret:  cfg.CFUAA.AdminClientSecret,
+		CFUaaCACert:             cfg.CFUAA.CACert,
+		OutboundTLSMinVersion:   tlsMinVersion,
+		OutboundTLSCipherSuites: tlsCipherSuites,
 		MaxInstances:           cfg.Limits.MaxInstances,
 		MaxInstancesPerOrg:     cfg.Limits.MaxInstancesPerOrg,
+		MaxInstancesPerSpace:   cfg.Limits.MaxInstancesPerSpace,
+		MaxTotalMemoryMB:       cfg.Limits.MaxTotalMemoryMB,
+		CatalogQuotas:          cfg.Limits.ExposeInCatalog,
 		LLMProvider:            cfg.GenAI.Provider,
 		LLMEndpoint:            cfg.GenAI.Endpoint,
 		LLMAPIKey:              cfg.GenAI.APIKey,
 		LLMModel:               cfg.GenAI.Model,
 		LLMPreferredModel:      cfg.GenAI.PreferredModel,
 		LLMAPIEndpoint:         cfg.GenAI.APIEndpoint,
+		LLMExtraParams:         cfg.GenAI.ExtraParams,
+		LLMTemperature:         cfg.GenAI.Temperature,
+		LLMMaxTokens:           cfg.GenAI.MaxTokens,
+		LLMTopP:                cfg.GenAI.TopP,
 		GenAIOfferingName:      cfg.GenAI.OfferingName,
 		GenAIPlanName:          cfg.GenAI.PlanName,
 		BlockedCommands:        cfg.Security.BlockedCommands,
+		CommandPolicyMode:      cfg.Security.CommandPolicyMode,
+		AllowedCommands:        cfg.Security.AllowedCommands,
 		NATSTLSEnabled:         cfg.NATS.TLS.Enabled,
 		NATSTLSClientCert:      cfg.NATS.TLS.ClientCert,
 		NATSTLSClientKey:       cfg.NATS.TLS.ClientKey,
 		NATSTLSCACert:          cfg.NATS.TLS.CACert,
-		StateDir:               "/var/vcap/store/openclaw-broker",
+		StateDir:               stateDir,
+		SyncProvision:          cfg.OnDemand.SyncProvision,
+		SyncProvisionTimeout:   cfg.OnDemand.SyncProvisionTimeout,
+		RouteReadyTimeout:      cfg.OnDemand.RouteReadyTimeout,
+		ManifestTemplatePath:   cfg.AgentDefaults.ManifestTemplatePath,
+		GatewayPort:            cfg.AgentDefaults.GatewayPort,
+		WebchatPort:            cfg.AgentDefaults.WebchatPort,
+		WebchatSSOPort:         cfg.AgentDefaults.WebchatSSOPort,
+		RouteRegistrationInterval: cfg.AgentDefaults.RouteRegistrationInterval,
+		LogFormat:              cfg.LogFormat,
+		WebhookURL:             cfg.Webhook.URL,
+		WebhookSecret:          cfg.Webhook.Secret,
+		InstanceTTLHours:       cfg.OnDemand.InstanceTTLHours,
+		InstanceTTLExemptLabel: cfg.OnDemand.InstanceTTLExemptLabel,
+		TaskWatchInterval:      cfg.OnDemand.TaskWatchInterval,
+		UseVMResources:         cfg.OnDemand.UseVMResources,
+		OTLPEndpoint:           cfg.Tracing.OTLPEndpoint,
 	}
 	b := broker.New(brokerCfg, director)
 
+	// Recover agent deployments that BOSH knows about but broker state doesn't
+	if recovered, err := b.ReconcileDeployments(); err != nil {
+		log.Printf("WARNING: startup reconciliation against BOSH failed: %v", err)
+	} else if len(recovered) > 0 {
+		log.Printf("Startup reconciliation recovered %d instances: %v", len(recovered), recovered)
+	}
+
 	log.Printf("Broker config: AZs=%v Network=%q StemcellOS=%q CFDeployment=%q SSOEnabled=%v",
 		brokerCfg.AZs, brokerCfg.Network, brokerCfg.StemcellOS, brokerCfg.CFDeploymentName, brokerCfg.SSOEnabled)
-	log.Printf("Broker config: Plans=%d MaxInstances=%d MaxPerOrg=%d MinVersion=%q",
-		len(brokerCfg.Plans), brokerCfg.MaxInstances, brokerCfg.MaxInstancesPerOrg, brokerCfg.MinOpenClawVersion)
+	log.Printf("Broker config: Plans=%d MaxInstances=%d MaxPerOrg=%d MaxPerSpace=%d MinVersion=%q",
+		len(brokerCfg.Plans), brokerCfg.MaxInstances, brokerCfg.MaxInstancesPerOrg, brokerCfg.MaxInstancesPerSpace, brokerCfg.MinOpenClawVersion)
 	uaaConfigured := brokerCfg.CFUaaURL != "" && brokerCfg.CFUaaAdminClientSecret != ""
-	log.Printf("Broker SSO: enabled=%v uaa_configured=%v issuer=%q uaa_url=%q",
-		brokerCfg.SSOEnabled, uaaConfigured, brokerCfg.SSOOIDCIssuerURL, brokerCfg.CFUaaURL)
-	if brokerCfg.SSOEnabled && !uaaConfigured {
-		log.Printf("WARNING: SSO is enabled but CF UAA admin credentials are not configured — SSO will be disabled for all instances")
-	}
+	log.Printf("Broker SSO: enabled=%v uaa_configured=%v external_clients=%v issuer=%q uaa_url=%q",
+		brokerCfg.SSOEnabled, uaaConfigured, brokerCfg.SSOExternalClientManagement, brokerCfg.SSOOIDCIssuerURL, brokerCfg.CFUaaURL)
 
 	r := mux.NewRouter()
-	r.Use(basicAuthMiddleware(cfg.Auth.Username, cfg.Auth.Password))
-
-	r.HandleFunc("/v2/catalog", b.Catalog).Methods("GET")
-	r.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
-	r.HandleFunc("/v2/service_instances/{instance_id}", b.Deprovision).Methods("DELETE")
-	r.HandleFunc("/v2/service_instances/{instance_id}", b.Update).Methods("PATCH")
-	r.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Bind).Methods("PUT")
-	r.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Unbind).Methods("DELETE")
-	r.HandleFunc("/v2/service_instances/{instance_id}/last_operation", b.LastOperation).Methods("GET")
-
-	r.HandleFunc("/admin/instances", b.AdminListInstances).Methods("GET")
-	r.HandleFunc("/admin/upgrade", b.AdminUpgrade).Methods("POST")
-	r.HandleFunc("/admin/upgrade/status", b.AdminUpgradeStatus).Methods("GET")
+	r.Use(broker.RequestIDMiddleware)
+	r.Use(b.TracingMiddleware)
+
+	// Health probes are registered on the root router before the authenticated
+	// subrouter so monit and load balancers can reach them without credentials.
+	r.HandleFunc("/healthz", b.Healthz).Methods("GET")
+	r.HandleFunc("/readyz", b.Readyz).Methods("GET")
+	r.HandleFunc("/version", b.ServeVersion).Methods("GET")
+
+	// Admin routes get their own credentials so the CF-registered broker
+	// credentials can't trigger upgrades. Registered before the catch-all
+	// OSB subrouter so /admin requests match here first.
+	adminUser, adminPass := cfg.AdminAuth.Username, cfg.AdminAuth.Password
+	if adminUser == "" || adminPass == "" {
+		adminUser, adminPass = cfg.Auth.Username, cfg.Auth.Password
+	} else {
+		log.Printf("Admin API uses separate credentials (username=%q)", adminUser)
+	}
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(broker.BasicAuthMiddleware(adminUser, adminPass))
+	b.RegisterAdminRoutes(admin)
+
+	api := r.PathPrefix("/").Subrouter()
+	api.Use(broker.BasicAuthMiddleware(cfg.Auth.Username, cfg.Auth.Password))
+
+	api.HandleFunc("/v2/catalog", b.Catalog).Methods("GET")
+	api.HandleFunc("/v2/service_instances/{instance_id}", b.Provision).Methods("PUT")
+	api.HandleFunc("/v2/service_instances/{instance_id}", b.Deprovision).Methods("DELETE")
+	api.HandleFunc("/v2/service_instances/{instance_id}", b.Update).Methods("PATCH")
+	api.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Bind).Methods("PUT")
+	api.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.Unbind).Methods("DELETE")
+	api.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.GetBinding).Methods("GET")
+	api.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}/last_operation", b.BindingLastOperation).Methods("GET")
+	api.HandleFunc("/v2/service_instances/{instance_id}/last_operation", b.LastOperation).Methods("GET")
 
 	addr := fmt.Sprintf(":%d", cfg.Port)
-	srv := &http.Server{
-		Addr:         addr,
-		Handler:      r,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
+	// Marketplace service keys can rotate; re-read them so new instances
+	// don't get a revoked API key.
+	if cfg.GenAI.Provider == "tanzu_genai" && cfg.GenAI.CredentialsRefreshSeconds > 0 {
+		reloader := startGenAIReloader(b, time.Duration(cfg.GenAI.CredentialsRefreshSeconds)*time.Second,
+			filepath.Dir(*configPath), stateDir, cfg.GenAI.PreferredModel, configuredModel)
+		defer reloader.Stop()
+	}
+
+	stopReaper := b.StartReaper()
+	if cfg.OnDemand.InstanceTTLHours > 0 {
+		log.Printf("Instances older than %dh are deprovisioned automatically", cfg.OnDemand.InstanceTTLHours)
+	}
+	stopWatcher := b.StartTaskWatcher()
+	if cfg.OnDemand.TaskWatchInterval > 0 {
+		log.Printf("Watching in-flight BOSH tasks every ~%ds", cfg.OnDemand.TaskWatchInterval)
 	}
 
+	srv := newServer(addr, r, cfg)
+
 	go func() {
-		log.Printf("OpenClaw broker starting on port %d", cfg.Port)
+		log.Printf("OpenClaw broker %s (commit %s, built %s) starting on port %d", broker.Version, broker.Commit, broker.BuildDate, cfg.Port)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server error: %v", err)
 		}
@@ -145,87 +235,155 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Shutdown error: %v", err)
+		log.Printf("Shutdown error: %v", err)
 	}
+
+	stopReaper()
+	stopWatcher()
+
+	// Handlers cut off above may still be mid-deploy; give them a bounded
+	// window to record their BOSH task IDs before state is flushed.
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer drainCancel()
+	if err := b.Shutdown(drainCtx); err != nil {
+		log.Printf("Shutdown error: %v", err)
+	}
+	director.Close()
 	log.Println("Broker stopped")
 }
 
 type Config struct {
-	Port int `json:"port"`
+	Port      int    `json:"port" yaml:"port"`
+	LogFormat string `json:"log_format" yaml:"log_format"`
 	Auth struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-	} `json:"auth"`
+		Username string `json:"username" yaml:"username"`
+		Password string `json:"password" yaml:"password"`
+	} `json:"auth" yaml:"auth"`
+	AdminAuth struct {
+		Username string `json:"username" yaml:"username"`
+		Password string `json:"password" yaml:"password"`
+	} `json:"admin_auth" yaml:"admin_auth"`
+	Webhook struct {
+		URL    string `json:"url" yaml:"url"`
+		Secret string `json:"secret" yaml:"secret"`
+	} `json:"webhook" yaml:"webhook"`
+	Tracing struct {
+		OTLPEndpoint string `json:"otlp_endpoint" yaml:"otlp_endpoint"`
+	} `json:"tracing" yaml:"tracing"`
+	// HTTP server limits; 0 uses the defaults in newServer
+	Server struct {
+		ReadTimeoutSeconds       int `json:"read_timeout_seconds" yaml:"read_timeout_seconds"`
+		ReadHeaderTimeoutSeconds int `json:"read_header_timeout_seconds" yaml:"read_header_timeout_seconds"`
+		WriteTimeoutSeconds      int `json:"write_timeout_seconds" yaml:"write_timeout_seconds"`
+		IdleTimeoutSeconds       int `json:"idle_timeout_seconds" yaml:"idle_timeout_seconds"`
+		MaxHeaderBytes           int `json:"max_header_bytes" yaml:"max_header_bytes"`
+	} `json:"server" yaml:"server"`
 	BOSH struct {
-		DirectorURL  string `json:"director_url"`
-		UaaURL       string `json:"uaa_url"`
-		ClientID     string `json:"client_id"`
-		ClientSecret string `json:"client_secret"`
-		CACert       string `json:"ca_cert"`
-	} `json:"bosh"`
+		DirectorURL  string `json:"director_url" yaml:"director_url"`
+		UaaURL       string `json:"uaa_url" yaml:"uaa_url"`
+		ClientID     string `json:"client_id" yaml:"client_id"`
+		ClientSecret string `json:"client_secret" yaml:"client_secret"`
+		CACert       string `json:"ca_cert" yaml:"ca_cert"`
+		// Request timeouts; 0 uses the client defaults
+		TimeoutSeconds           int `json:"timeout_seconds" yaml:"timeout_seconds"`
+		TaskStatusTimeoutSeconds int `json:"task_status_timeout_seconds" yaml:"task_status_timeout_seconds"`
+	} `json:"bosh" yaml:"bosh"`
 	AgentDefaults struct {
-		OpenClawVersion string `json:"openclaw_version"`
-		Stemcell        string `json:"stemcell"`
-		Network         string `json:"network"`
-		AZ              string `json:"az"`
-	} `json:"agent_defaults"`
+		OpenClawVersion      string `json:"openclaw_version" yaml:"openclaw_version"`
+		Stemcell             string `json:"stemcell" yaml:"stemcell"`
+		Network              string `json:"network" yaml:"network"`
+		AZ                   string `json:"az" yaml:"az"`
+		ManifestTemplatePath string `json:"manifest_template_path" yaml:"manifest_template_path"`
+		GatewayPort          int    `json:"gateway_port" yaml:"gateway_port"`
+		WebchatPort          int    `json:"webchat_port" yaml:"webchat_port"`
+		WebchatSSOPort       int    `json:"webchat_sso_port" yaml:"webchat_sso_port"`
+		RouteRegistrationInterval string `json:"route_registration_interval" yaml:"route_registration_interval"`
+	} `json:"agent_defaults" yaml:"agent_defaults"`
 	Security struct {
-		MinOpenClawVersion     string `json:"min_openclaw_version"`
-		SandboxMode            string `json:"sandbox_mode"`
-		BlockedCommands        string `json:"blocked_commands"`
-		SSOEnabled             bool   `json:"sso_enabled"`
-		SSOOIDCIssuerURL       string `json:"sso_oidc_issuer_url"`
-		SSOAllowedEmailDomains string `json:"sso_allowed_email_domains"`
-		SSOSessionTimeoutHours int    `json:"sso_session_timeout_hours"`
-	} `json:"security"`
+		MinOpenClawVersion     string `json:"min_openclaw_version" yaml:"min_openclaw_version"`
+		SandboxMode            string `json:"sandbox_mode" yaml:"sandbox_mode"`
+		BlockedCommands        string `json:"blocked_commands" yaml:"blocked_commands"`
+		CommandPolicyMode      string `json:"command_policy_mode" yaml:"command_policy_mode"`
+		AllowedCommands        string `json:"allowed_commands" yaml:"allowed_commands"`
+		SSOEnabled             bool   `json:"sso_enabled" yaml:"sso_enabled"`
+		SSOOIDCIssuerURL       string `json:"sso_oidc_issuer_url" yaml:"sso_oidc_issuer_url"`
+		SSOAllowedEmailDomains string `json:"sso_allowed_email_domains" yaml:"sso_allowed_email_domains"`
+		SSOSessionTimeoutHours int    `json:"sso_session_timeout_hours" yaml:"sso_session_timeout_hours"`
+		SSOExternalClientManagement bool   `json:"sso_external_client_management" yaml:"sso_external_client_management"`
+		SSOExternalClientSecretsDir string `json:"sso_external_client_secrets_dir" yaml:"sso_external_client_secrets_dir"`
+	} `json:"security" yaml:"security"`
 	CFUAA struct {
-		URL               string `json:"url"`
-		AdminClientID     string `json:"admin_client_id"`
-		AdminClientSecret string `json:"admin_client_secret"`
-	} `json:"cf_uaa"`
+		URL               string `json:"url" yaml:"url"`
+		AdminClientID     string `json:"admin_client_id" yaml:"admin_client_id"`
+		AdminClientSecret string `json:"admin_client_secret" yaml:"admin_client_secret"`
+		CACert            string `json:"ca_cert" yaml:"ca_cert"`
+	} `json:"cf_uaa" yaml:"cf_uaa"`
+	// OutboundTLS applies to the broker's BOSH Director and UAA clients
+	OutboundTLS struct {
+		MinVersion   string   `json:"min_version" yaml:"min_version"`     // "1.2" (default) or "1.3"
+		CipherSuites []string `json:"cipher_suites" yaml:"cipher_suites"` // Go names of TLS 1.2 suites; empty uses Go's defaults
+	} `json:"outbound_tls" yaml:"outbound_tls"`
 	GenAI struct {
-		Provider     string `json:"provider"`
-		Endpoint     string `json:"endpoint"`
-		APIKey       string `json:"api_key"`
-		Model          string `json:"model"`
-		PreferredModel string `json:"preferred_model"`
-		APIEndpoint    string `json:"api_endpoint"`
-		OfferingName string `json:"offering_name"`
-		PlanName     string `json:"plan_name"`
-	} `json:"genai"`
+		Provider     string `json:"provider" yaml:"provider"`
+		Endpoint     string `json:"endpoint" yaml:"endpoint"`
+		APIKey       string `json:"api_key" yaml:"api_key"`
+		Model          string `json:"model" yaml:"model"`
+		PreferredModel string `json:"preferred_model" yaml:"preferred_model"`
+		APIEndpoint    string `json:"api_endpoint" yaml:"api_endpoint"`
+		ExtraParams    map[string]string `json:"extra_params" yaml:"extra_params"`
+		Temperature    *float64 `json:"temperature" yaml:"temperature"`
+		MaxTokens      int      `json:"max_tokens" yaml:"max_tokens"`
+		TopP           *float64 `json:"top_p" yaml:"top_p"`
+		OfferingName string `json:"offering_name" yaml:"offering_name"`
+		PlanName     string `json:"plan_name" yaml:"plan_name"`
+		CredentialsRefreshSeconds int `json:"credentials_refresh_seconds" yaml:"credentials_refresh_seconds"`
+	} `json:"genai" yaml:"genai"`
 	NATS struct {
 		TLS struct {
-			Enabled    bool   `json:"enabled"`
-			ClientCert string `json:"client_cert"`
-			ClientKey  string `json:"client_key"`
-			CACert     string `json:"ca_cert"`
-		} `json:"tls"`
-	} `json:"nats"`
+			Enabled    bool   `json:"enabled" yaml:"enabled"`
+			ClientCert string `json:"client_cert" yaml:"client_cert"`
+			ClientKey  string `json:"client_key" yaml:"client_key"`
+			CACert     string `json:"ca_cert" yaml:"ca_cert"`
+		} `json:"tls" yaml:"tls"`
+	} `json:"nats" yaml:"nats"`
 	OnDemand struct {
-		ServiceName            string        `json:"service_name"`
-		Plans                  []broker.Plan `json:"plans"`
-		StemcellOS             string        `json:"stemcell_os"`
-		StemcellVersion        string        `json:"stemcell_version"`
-		Network                string        `json:"network"`
-		AZs                    []string      `json:"azs"`
-		OpenClawReleaseVersion string        `json:"openclaw_release_version"`
-		BPMReleaseVersion      string        `json:"bpm_release_version"`
-		RoutingReleaseVersion  string        `json:"routing_release_version"`
-	} `json:"on_demand"`
+		ServiceName            string        `json:"service_name" yaml:"service_name"`
+		Plans                  []broker.Plan `json:"plans" yaml:"plans"`
+		StemcellOS             string        `json:"stemcell_os" yaml:"stemcell_os"`
+		StemcellVersion        string        `json:"stemcell_version" yaml:"stemcell_version"`
+		Network                string        `json:"network" yaml:"network"`
+		DeploymentPrefix       string        `json:"deployment_prefix" yaml:"deployment_prefix"`
+		AZs                    []string      `json:"azs" yaml:"azs"`
+		OpenClawReleaseVersion string        `json:"openclaw_release_version" yaml:"openclaw_release_version"`
+		BPMReleaseVersion      string        `json:"bpm_release_version" yaml:"bpm_release_version"`
+		RoutingReleaseVersion  string        `json:"routing_release_version" yaml:"routing_release_version"`
+		SyncProvision          bool          `json:"sync_provision" yaml:"sync_provision"`
+		SyncProvisionTimeout   int           `json:"sync_provision_timeout_seconds" yaml:"sync_provision_timeout_seconds"`
+		RouteReadyTimeout      int           `json:"route_ready_timeout_seconds" yaml:"route_ready_timeout_seconds"`
+		InstanceTTLHours       int           `json:"instance_ttl_hours" yaml:"instance_ttl_hours"`
+		InstanceTTLExemptLabel string        `json:"instance_ttl_exempt_label" yaml:"instance_ttl_exempt_label"`
+		TaskWatchInterval      int           `json:"task_watch_interval_seconds" yaml:"task_watch_interval_seconds"`
+		UseVMResources         bool          `json:"use_vm_resources" yaml:"use_vm_resources"`
+	} `json:"on_demand" yaml:"on_demand"`
 	CF struct {
-		SystemDomain      string `json:"system_domain"`
-		AppsDomain        string `json:"apps_domain"`
-		DeploymentName    string `json:"deployment_name"`
-		APIURL            string `json:"api_url"`
-		AdminUsername     string `json:"admin_username"`
-		AdminPassword     string `json:"admin_password"`
-		SkipSSLValidation bool   `json:"skip_ssl_validation"`
-	} `json:"cf"`
-	Plans  []broker.Plan `json:"plans"`
+		SystemDomain      string `json:"system_domain" yaml:"system_domain"`
+		AppsDomain        string `json:"apps_domain" yaml:"apps_domain"`
+		// Go template over broker.DashboardURLFields; empty uses the agent route
+		DashboardURLTemplate string `json:"dashboard_url_template" yaml:"dashboard_url_template"`
+		DeploymentName    string `json:"deployment_name" yaml:"deployment_name"`
+		APIURL            string `json:"api_url" yaml:"api_url"`
+		AdminUsername     string `json:"admin_username" yaml:"admin_username"`
+		AdminPassword     string `json:"admin_password" yaml:"admin_password"`
+		SkipSSLValidation bool   `json:"skip_ssl_validation" yaml:"skip_ssl_validation"`
+	} `json:"cf" yaml:"cf"`
+	Plans  []broker.Plan `json:"plans" yaml:"plans"`
 	Limits struct {
-		MaxInstances       int `json:"max_instances"`
-		MaxInstancesPerOrg int `json:"max_instances_per_org"`
-	} `json:"limits"`
+		MaxInstances         int `json:"max_instances" yaml:"max_instances"`
+		MaxInstancesPerOrg   int `json:"max_instances_per_org" yaml:"max_instances_per_org"`
+		MaxInstancesPerSpace int `json:"max_instances_per_space" yaml:"max_instances_per_space"`
+		MaxTotalMemoryMB     int `json:"max_total_memory_mb" yaml:"max_total_memory_mb"`
+		ExposeInCatalog      bool `json:"expose_in_catalog" yaml:"expose_in_catalog"`
+	} `json:"limits" yaml:"limits"`
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -234,7 +392,11 @@ func loadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 	var cfg Config
-	if err := json.Unmarshal(data, &cfg); err != nil {
+	if isYAMLConfig(path, data) {
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
 	if cfg.Port == 0 {
@@ -243,6 +405,192 @@ func loadConfig(path string) (*Config, error) {
 	return &cfg, nil
 }
 
+// HTTP server defaults. ReadHeaderTimeout is what stops slowloris-style
+// clients from holding connections open by trickling headers.
+const (
+	defaultReadTimeout       = 30 * time.Second
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	defaultMaxHeaderBytes    = 64 << 10
+)
+
+// newServer returns the broker's HTTP server with cfg's timeouts and header
+// limit applied over the defaults.
+func newServer(addr string, handler http.Handler, cfg *Config) *http.Server {
+	seconds := func(n int, def time.Duration) time.Duration {
+		if n > 0 {
+			return time.Duration(n) * time.Second
+		}
+		return def
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       seconds(cfg.Server.ReadTimeoutSeconds, defaultReadTimeout),
+		ReadHeaderTimeout: seconds(cfg.Server.ReadHeaderTimeoutSeconds, defaultReadHeaderTimeout),
+		WriteTimeout:      seconds(cfg.Server.WriteTimeoutSeconds, defaultWriteTimeout),
+		IdleTimeout:       seconds(cfg.Server.IdleTimeoutSeconds, defaultIdleTimeout),
+		MaxHeaderBytes:    defaultMaxHeaderBytes,
+	}
+	if cfg.Server.MaxHeaderBytes > 0 {
+		srv.MaxHeaderBytes = cfg.Server.MaxHeaderBytes
+	}
+	// Synchronous provisions hold the response open until the BOSH task
+	// finishes, so the write deadline must outlast the provision timeout.
+	if cfg.OnDemand.SyncProvision {
+		syncTimeout := seconds(cfg.OnDemand.SyncProvisionTimeout, 10*time.Minute)
+		srv.WriteTimeout = max(srv.WriteTimeout, syncTimeout+30*time.Second)
+	}
+	return srv
+}
+
+// Validate checks the settings the broker cannot serve requests without and
+// returns one error listing every problem, so a bad deploy fails at startup
+// instead of as per-provision 500s.
+func (c *Config) Validate() error {
+	var errs []error
+	// Empty auth would let any caller through BasicAuthMiddleware
+	if c.Auth.Username == "" || c.Auth.Password == "" {
+		errs = append(errs, errors.New("auth.username and auth.password must not be empty"))
+	}
+	if c.BOSH.DirectorURL == "" {
+		errs = append(errs, errors.New("bosh.director_url is required"))
+	}
+	if c.BOSH.UaaURL == "" {
+		errs = append(errs, errors.New("bosh.uaa_url is required"))
+	}
+	if c.BOSH.TimeoutSeconds < 0 || c.BOSH.TaskStatusTimeoutSeconds < 0 {
+		errs = append(errs, errors.New("bosh.timeout_seconds and bosh.task_status_timeout_seconds must not be negative"))
+	}
+	if c.Server.ReadTimeoutSeconds < 0 || c.Server.ReadHeaderTimeoutSeconds < 0 || c.Server.WriteTimeoutSeconds < 0 ||
+		c.Server.IdleTimeoutSeconds < 0 || c.Server.MaxHeaderBytes < 0 {
+		errs = append(errs, errors.New("server timeouts and max_header_bytes must not be negative"))
+	}
+	if c.OnDemand.TaskWatchInterval < 0 {
+		errs = append(errs, errors.New("on_demand.task_watch_interval_seconds must not be negative"))
+	}
+	if c.CF.AppsDomain == "" {
+		errs = append(errs, errors.New("cf.apps_domain is required"))
+	}
+	if _, err := broker.ParseDashboardURLTemplate(c.CF.DashboardURLTemplate); err != nil {
+		errs = append(errs, fmt.Errorf("cf.dashboard_url_template is invalid: %w", err))
+	}
+	// Per-plan AZs take precedence, so global AZs are only needed for plans without their own
+	if len(c.OnDemand.AZs) == 0 {
+		plans := c.OnDemand.Plans
+		if len(plans) == 0 {
+			plans = c.Plans
+		}
+		if len(plans) == 0 {
+			errs = append(errs, errors.New("on_demand.azs must list at least one availability zone"))
+		}
+		for _, p := range plans {
+			if len(p.AZs) == 0 {
+				errs = append(errs, fmt.Errorf("on_demand.azs is empty and plan %q sets no azs", p.Name))
+			}
+		}
+	}
+	// vm_resources needs both sizes, or the CPI can't pick an instance type
+	if c.OnDemand.UseVMResources {
+		for _, plans := range [][]broker.Plan{c.OnDemand.Plans, c.Plans} {
+			for _, p := range plans {
+				if p.CPU <= 0 || p.Memory <= 0 {
+					errs = append(errs, fmt.Errorf("on_demand.use_vm_resources is set but plan %q has no cpu or memory", p.Name))
+				}
+			}
+		}
+	}
+	for _, plans := range [][]broker.Plan{c.OnDemand.Plans, c.Plans} {
+		errs = append(errs, broker.CheckUniquePlans(plans)...)
+	}
+	// Plan transitions must name plans that exist, or the rule can never match
+	for _, plans := range [][]broker.Plan{c.OnDemand.Plans, c.Plans} {
+		known := make(map[string]bool)
+		for _, p := range plans {
+			known[p.Name] = true
+			known[p.ID] = true
+		}
+		for _, p := range plans {
+			for _, target := range p.AllowedUpdates {
+				if !known[target] {
+					errs = append(errs, fmt.Errorf("plan %q allowed_updates names unknown plan %q", p.Name, target))
+				}
+			}
+		}
+	}
+	if iv := c.AgentDefaults.RouteRegistrationInterval; iv != "" {
+		if d, err := time.ParseDuration(iv); err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("agent_defaults.route_registration_interval must be a positive duration such as \"20s\", got %q", iv))
+		}
+	}
+	if mode := c.Security.SandboxMode; mode != "" && !security.ValidSandboxMode(mode) {
+		errs = append(errs, fmt.Errorf("security.sandbox_mode must be one of %s, got %q",
+			strings.Join(security.SandboxModes, ", "), mode))
+	}
+	switch c.Security.CommandPolicyMode {
+	case "", broker.CommandPolicyBlocklist, broker.CommandPolicyAllowlist:
+	default:
+		errs = append(errs, fmt.Errorf("security.command_policy_mode must be %q or %q, got %q",
+			broker.CommandPolicyBlocklist, broker.CommandPolicyAllowlist, c.Security.CommandPolicyMode))
+	}
+	if c.Security.SSOExternalClientManagement {
+		if c.Security.SSOEnabled && c.Security.SSOExternalClientSecretsDir == "" {
+			errs = append(errs, errors.New("security.sso_external_client_management requires security.sso_external_client_secrets_dir"))
+		}
+	} else if c.Security.SSOEnabled && (c.CFUAA.URL == "" || c.CFUAA.AdminClientSecret == "") {
+		errs = append(errs, errors.New("security.sso_enabled requires cf_uaa.url and cf_uaa.admin_client_secret"))
+	}
+	if _, _, err := c.outboundTLS(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// outboundTLS resolves the outbound_tls block to a minimum TLS version and
+// cipher suite IDs. Only Go's secure suites are accepted; a zero version
+// leaves the clients' TLS 1.2 default in place.
+func (c *Config) outboundTLS() (uint16, []uint16, error) {
+	var minVersion uint16
+	switch c.OutboundTLS.MinVersion {
+	case "":
+	case "1.2":
+		minVersion = tls.VersionTLS12
+	case "1.3":
+		minVersion = tls.VersionTLS13
+	default:
+		return 0, nil, fmt.Errorf("outbound_tls.min_version must be \"1.2\" or \"1.3\", got %q", c.OutboundTLS.MinVersion)
+	}
+	if len(c.OutboundTLS.CipherSuites) == 0 {
+		return minVersion, nil, nil
+	}
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	suites := make([]uint16, 0, len(c.OutboundTLS.CipherSuites))
+	for _, name := range c.OutboundTLS.CipherSuites {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return 0, nil, fmt.Errorf("outbound_tls.cipher_suites: %q is not a supported secure cipher suite", name)
+		}
+		suites = append(suites, id)
+	}
+	return minVersion, suites, nil
+}
+
+// isYAMLConfig reports whether a config file should be parsed as YAML: a
+// .yml/.yaml extension or a leading "---" document marker. Anything else is JSON.
+func isYAMLConfig(path string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		return true
+	case ".json":
+		return false
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("---"))
+}
+
 // GenAI service key credential structures
 type GenAIEndpoint struct {
 	APIBase   string `json:"api_base"`
@@ -304,7 +652,72 @@ func discoverChatModel(configURL, apiKey string) (string, error) {
 	return "", fmt.Errorf("no model with CHAT capability found")
 }
 
-func loadGenAICredentials(configDir string) (endpoint, apiKey, model string, err error) {
+// Chat-model discovery retries with exponential backoff (2s, 4s, 8s) so a
+// briefly unavailable GenAI tile doesn't leave every instance without a model.
+var (
+	discoveryAttempts = 4
+	discoveryBackoff  = 2 * time.Second
+)
+
+// modelCacheFile, under the state directory, remembers the last discovered
+// chat model so restarts skip discovery.
+const modelCacheFile = "genai-model.json"
+
+type modelCache struct {
+	ConfigURL string `json:"config_url"`
+	Model     string `json:"model"`
+}
+
+// resolveChatModel returns the chat model advertised at configURL. With
+// useCache, a model cached for the same config URL is used without contacting
+// GenAI; otherwise discovery is retried with backoff and the result cached. If
+// discovery fails, preferredModel (when set) is used instead. Returns "" when
+// nothing works.
+func resolveChatModel(configURL, apiKey, cacheDir, preferredModel string, useCache bool) string {
+	cachePath := filepath.Join(cacheDir, modelCacheFile)
+	if data, err := os.ReadFile(cachePath); useCache && err == nil {
+		var cached modelCache
+		if json.Unmarshal(data, &cached) == nil && cached.ConfigURL == configURL && cached.Model != "" {
+			log.Printf("GenAI: using cached chat model: %s", cached.Model)
+			return cached.Model
+		}
+	}
+
+	backoff := discoveryBackoff
+	var err error
+	for attempt := 1; attempt <= discoveryAttempts; attempt++ {
+		var model string
+		if model, err = discoverChatModel(configURL, apiKey); err == nil {
+			log.Printf("GenAI: discovered chat model: %s", model)
+			if data, merr := json.Marshal(modelCache{ConfigURL: configURL, Model: model}); merr == nil {
+				if werr := writeModelCache(cachePath, data); werr != nil {
+					log.Printf("WARNING: failed to cache chat model: %v", werr)
+				}
+			}
+			return model
+		}
+		if attempt < discoveryAttempts {
+			log.Printf("GenAI: chat model discovery attempt %d/%d failed, retrying in %s: %v", attempt, discoveryAttempts, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	if preferredModel != "" {
+		log.Printf("WARNING: failed to discover chat model, falling back to preferred model %s: %v", preferredModel, err)
+		return preferredModel
+	}
+	log.Printf("WARNING: failed to discover chat model: %v", err)
+	return ""
+}
+
+func writeModelCache(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func loadGenAICredentials(configDir, cacheDir, preferredModel string, useCache bool) (endpoint, apiKey, model string, err error) {
 	credsPath := filepath.Join(configDir, "genai-credentials.json")
 	data, err := os.ReadFile(credsPath)
 	if err != nil {
@@ -340,28 +753,73 @@ func loadGenAICredentials(configDir string) (endpoint, apiKey, model string, err
 
 	// Multi-model endpoints don't have model_name — discover the chat model from config URL
 	if model == "" && creds.Endpoint != nil && creds.Endpoint.ConfigURL != "" {
-		discovered, err := discoverChatModel(creds.Endpoint.ConfigURL, apiKey)
-		if err != nil {
-			log.Printf("WARNING: failed to discover chat model: %v", err)
-		} else {
-			model = discovered
-			log.Printf("GenAI: discovered chat model: %s", model)
-		}
+		model = resolveChatModel(creds.Endpoint.ConfigURL, apiKey, cacheDir, preferredModel, useCache)
 	}
 
 	return endpoint, apiKey, model, nil
 }
 
-func basicAuthMiddleware(username, password string) mux.MiddlewareFunc {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			u, p, ok := r.BasicAuth()
-			if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(username)) != 1 || subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
-				w.Header().Set("WWW-Authenticate", `Basic realm="OpenClaw Broker"`)
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+// genAIReloader periodically re-reads genai-credentials.json and re-runs
+// chat-model discovery so a rotated service key reaches new instances without
+// a broker redeploy.
+type genAIReloader struct {
+	broker          *broker.Broker
+	configDir       string
+	cacheDir        string
+	preferredModel  string
+	configuredModel string // operator-set model; takes precedence over discovery
+	stop            chan struct{}
+	done            chan struct{}
+}
+
+func startGenAIReloader(b *broker.Broker, interval time.Duration, configDir, cacheDir, preferredModel, configuredModel string) *genAIReloader {
+	r := &genAIReloader{
+		broker:          b,
+		configDir:       configDir,
+		cacheDir:        cacheDir,
+		preferredModel:  preferredModel,
+		configuredModel: configuredModel,
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.reload()
+			case <-r.stop:
 				return
 			}
-			next.ServeHTTP(w, r)
-		})
+		}
+	}()
+	return r
+}
+
+// reload applies the current service key. A missing or unreadable file
+// keeps the credentials already in use, as does a failed model discovery.
+func (r *genAIReloader) reload() {
+	endpoint, apiKey, model, err := loadGenAICredentials(r.configDir, r.cacheDir, r.preferredModel, false)
+	if err != nil {
+		log.Printf("WARNING: GenAI credential reload failed, keeping current credentials: %v", err)
+		return
+	}
+	_, _, currentModel := r.broker.LLMCredentials()
+	switch {
+	case r.configuredModel != "":
+		model = r.configuredModel
+	case model == "":
+		model = currentModel
 	}
+	if r.broker.SetLLMCredentials(endpoint, apiKey, model) {
+		log.Printf("GenAI: marketplace credentials changed, endpoint=%s model=%s", endpoint, model)
+	}
+}
+
+// Stop ends the reload loop and waits for an in-progress reload to finish.
+func (r *genAIReloader) Stop() {
+	close(r.stop)
+	<-r.done
 }
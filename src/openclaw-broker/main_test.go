@@ -0,0 +1,338 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nkuhn-vmw/bosh-openclaw/src/openclaw-broker/broker"
+)
+
+const testJSONConfig = `{
+  "port": 9090,
+  "auth": {"username": "broker", "password": "secret"},
+  "bosh": {
+    "director_url": "https://10.0.0.6:25555",
+    "uaa_url": "https://10.0.0.6:8443",
+    "client_id": "ops",
+    "client_secret": "ops-secret",
+    "ca_cert": "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+  },
+  "security": {"sso_enabled": true, "sso_session_timeout_hours": 8},
+  "cf_uaa": {"url": "https://uaa.sys.example.com", "admin_client_secret": "uaa-secret"},
+  "genai": {"provider": "anthropic", "temperature": 0.5, "extra_params": {"reasoning": "high"}},
+  "on_demand": {
+    "azs": ["z1", "z2"],
+    "plans": [{
+      "name": "developer",
+      "id": "openclaw-developer-plan",
+      "vm_type": "small",
+      "memory": 2048,
+      "features": {"browser": true},
+      "networks": [{"name": "agents", "static_ips": ["10.0.1.10"]}],
+      "update": {"canaries": 2}
+    }]
+  },
+  "cf": {"apps_domain": "apps.example.com"},
+  "limits": {"max_instances": 50}
+}`
+
+const testYAMLConfig = `---
+port: 9090
+auth:
+  username: broker
+  password: secret
+bosh:
+  director_url: https://10.0.0.6:25555
+  uaa_url: https://10.0.0.6:8443
+  client_id: ops
+  client_secret: ops-secret
+  ca_cert: |
+    -----BEGIN CERTIFICATE-----
+    MIIB
+    -----END CERTIFICATE-----
+security:
+  sso_enabled: true
+  sso_session_timeout_hours: 8
+cf_uaa:
+  url: https://uaa.sys.example.com
+  admin_client_secret: uaa-secret
+genai:
+  provider: anthropic
+  temperature: 0.5
+  extra_params:
+    reasoning: high
+on_demand:
+  azs: [z1, z2]
+  plans:
+    - name: developer
+      id: openclaw-developer-plan
+      vm_type: small
+      memory: 2048
+      features:
+        browser: true
+      networks:
+        - name: agents
+          static_ips: [10.0.1.10]
+      update:
+        canaries: 2
+cf:
+  apps_domain: apps.example.com
+limits:
+  max_instances: 50
+`
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig_YAMLMatchesJSON(t *testing.T) {
+	fromJSON, err := loadConfig(writeConfig(t, "config.json", testJSONConfig))
+	if err != nil {
+		t.Fatalf("loading JSON config: %v", err)
+	}
+	for _, name := range []string{"config.yml", "config.yaml", "config"} {
+		fromYAML, err := loadConfig(writeConfig(t, name, testYAMLConfig))
+		if err != nil {
+			t.Fatalf("loading %s: %v", name, err)
+		}
+		if !reflect.DeepEqual(fromJSON, fromYAML) {
+			t.Errorf("%s parsed differently from JSON:\n json: %+v\n yaml: %+v", name, fromJSON, fromYAML)
+		}
+	}
+	if fromJSON.OnDemand.Plans[0].VMType != "small" || fromJSON.BOSH.ClientID != "ops" {
+		t.Errorf("unexpected parsed config: %+v", fromJSON)
+	}
+}
+
+func TestLoadConfig_JSONExtensionIsNotYAML(t *testing.T) {
+	if _, err := loadConfig(writeConfig(t, "config.json", testYAMLConfig)); err == nil {
+		t.Error("YAML content in a .json file should fail to parse")
+	}
+}
+
+func TestConfigValidate_Valid(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "config.json", testJSONConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+	for _, mode := range []string{"", "strict", "moderate", "loose"} {
+		cfg.Security.SandboxMode = mode
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Validate() with sandbox_mode %q = %v, want nil", mode, err)
+		}
+	}
+}
+
+func TestConfigValidate_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   []string
+	}{
+		{"missing auth", func(c *Config) { c.Auth.Password = "" }, []string{"auth.username and auth.password"}},
+		{"missing apps domain", func(c *Config) { c.CF.AppsDomain = "" }, []string{"cf.apps_domain"}},
+		{"no AZs anywhere", func(c *Config) { c.OnDemand.AZs = nil }, []string{`plan "developer" sets no azs`}},
+		{"no AZs and no plans", func(c *Config) { c.OnDemand.AZs, c.OnDemand.Plans = nil, nil }, []string{"on_demand.azs must list"}},
+		{"external SSO clients without a secrets dir", func(c *Config) { c.Security.SSOExternalClientManagement = true }, []string{"security.sso_external_client_secrets_dir"}},
+		{"SSO without UAA", func(c *Config) { c.CFUAA.URL = "" }, []string{"security.sso_enabled requires"}},
+		{"negative BOSH timeout", func(c *Config) { c.BOSH.TimeoutSeconds = -1 }, []string{"bosh.timeout_seconds"}},
+		{"duplicate plan name", func(c *Config) { c.OnDemand.Plans = append(c.OnDemand.Plans, c.OnDemand.Plans[0]) }, []string{`plan "developer" (id "openclaw-developer-plan") duplicates`}},
+		{"allowed update to unknown plan", func(c *Config) { c.OnDemand.Plans[0].AllowedUpdates = []string{"enterprise"} }, []string{`allowed_updates names unknown plan "enterprise"`}},
+		{"negative server timeout", func(c *Config) { c.Server.ReadHeaderTimeoutSeconds = -1 }, []string{"server timeouts"}},
+		{"vm_resources plan without cpu", func(c *Config) { c.OnDemand.UseVMResources = true }, []string{`use_vm_resources is set but plan "developer"`}},
+		{"negative task watch interval", func(c *Config) { c.OnDemand.TaskWatchInterval = -1 }, []string{"on_demand.task_watch_interval_seconds"}},
+		{"unknown sandbox mode", func(c *Config) { c.Security.SandboxMode = "strct" }, []string{`security.sandbox_mode must be one of strict, moderate, loose, got "strct"`}},
+		{"unknown command policy", func(c *Config) { c.Security.CommandPolicyMode = "denylist" }, []string{"security.command_policy_mode"}},
+		{"dashboard template with unknown field", func(c *Config) { c.CF.DashboardURLTemplate = "https://{{.Hostname}}" }, []string{"cf.dashboard_url_template"}},
+		{"dashboard template without scheme", func(c *Config) { c.CF.DashboardURLTemplate = "{{.RouteHostname}}.example.com" }, []string{"absolute http(s) URL"}},
+		{"unsupported outbound TLS version", func(c *Config) { c.OutboundTLS.MinVersion = "1.1" }, []string{"outbound_tls.min_version"}},
+		{"insecure outbound cipher suite", func(c *Config) { c.OutboundTLS.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"} }, []string{"outbound_tls.cipher_suites"}},
+		{"bad route registration interval", func(c *Config) { c.AgentDefaults.RouteRegistrationInterval = "20" }, []string{"agent_defaults.route_registration_interval"}},
+		{"several problems", func(c *Config) {
+			c.BOSH.DirectorURL = ""
+			c.BOSH.UaaURL = ""
+			c.CF.AppsDomain = ""
+		}, []string{"bosh.director_url", "bosh.uaa_url", "cf.apps_domain"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(writeConfig(t, "config.json", testJSONConfig))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.modify(cfg)
+
+			err = cfg.Validate()
+			if err == nil {
+				t.Fatal("Validate() = nil, want error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q should mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	cfg := &Config{}
+	srv := newServer(":8080", http.NotFoundHandler(), cfg)
+	if srv.ReadHeaderTimeout != defaultReadHeaderTimeout || srv.IdleTimeout != defaultIdleTimeout || srv.MaxHeaderBytes != defaultMaxHeaderBytes {
+		t.Errorf("defaults not applied: read header %s, idle %s, max header bytes %d", srv.ReadHeaderTimeout, srv.IdleTimeout, srv.MaxHeaderBytes)
+	}
+
+	cfg.Server.ReadTimeoutSeconds = 10
+	cfg.Server.ReadHeaderTimeoutSeconds = 2
+	cfg.Server.WriteTimeoutSeconds = 45
+	cfg.Server.IdleTimeoutSeconds = 60
+	cfg.Server.MaxHeaderBytes = 8192
+	srv = newServer(":8080", http.NotFoundHandler(), cfg)
+	if srv.ReadTimeout != 10*time.Second || srv.ReadHeaderTimeout != 2*time.Second || srv.WriteTimeout != 45*time.Second ||
+		srv.IdleTimeout != time.Minute || srv.MaxHeaderBytes != 8192 {
+		t.Errorf("server = read %s, read header %s, write %s, idle %s, max header bytes %d; want the configured values",
+			srv.ReadTimeout, srv.ReadHeaderTimeout, srv.WriteTimeout, srv.IdleTimeout, srv.MaxHeaderBytes)
+	}
+
+	// A synchronous provision must be able to finish writing its response
+	cfg.OnDemand.SyncProvision = true
+	cfg.OnDemand.SyncProvisionTimeout = 300
+	if srv := newServer(":8080", http.NotFoundHandler(), cfg); srv.WriteTimeout != 330*time.Second {
+		t.Errorf("WriteTimeout with sync provision = %s, want 5m30s", srv.WriteTimeout)
+	}
+}
+
+func TestConfigValidate_PerPlanAZsSuffice(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "config.json", testJSONConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.CFUAA.URL = "https://uaa.sys.example.com"
+	cfg.CFUAA.AdminClientSecret = "uaa-secret"
+	cfg.OnDemand.AZs = nil
+	cfg.OnDemand.Plans[0].AZs = []string{"z3"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil when every plan has AZs", err)
+	}
+}
+
+// newGenAIConfigServer advertises a CHAT model after failing the first `fail` requests.
+func newGenAIConfigServer(fail int32, requests *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"advertisedModels": [{"name": "embed", "capabilities": ["EMBEDDING"]}, {"name": "gpt-oss", "capabilities": ["CHAT"]}]}`))
+	}))
+}
+
+func fastDiscovery(t *testing.T, attempts int) {
+	oldAttempts, oldBackoff := discoveryAttempts, discoveryBackoff
+	discoveryAttempts, discoveryBackoff = attempts, time.Millisecond
+	t.Cleanup(func() { discoveryAttempts, discoveryBackoff = oldAttempts, oldBackoff })
+}
+
+func TestResolveChatModel_RetriesThenCaches(t *testing.T) {
+	fastDiscovery(t, 4)
+	var requests atomic.Int32
+	srv := newGenAIConfigServer(2, &requests)
+	defer srv.Close()
+	cacheDir := t.TempDir()
+
+	if model := resolveChatModel(srv.URL, "key", cacheDir, "", true); model != "gpt-oss" {
+		t.Fatalf("model = %q, want gpt-oss after retries", model)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("requests = %d, want 3 (two failures, then success)", got)
+	}
+
+	// A restart uses the cached model without contacting GenAI
+	if model := resolveChatModel(srv.URL, "key", cacheDir, "", true); model != "gpt-oss" {
+		t.Errorf("cached model = %q, want gpt-oss", model)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("requests = %d after restart, want the cache to be used", got)
+	}
+
+	// A different config URL doesn't reuse another endpoint's model
+	other := newGenAIConfigServer(0, &requests)
+	defer other.Close()
+	resolveChatModel(other.URL, "key", cacheDir, "", true)
+	if got := requests.Load(); got != 4 {
+		t.Errorf("requests = %d, want discovery for a new config URL", got)
+	}
+}
+
+func TestResolveChatModel_FallsBackToPreferredModel(t *testing.T) {
+	fastDiscovery(t, 3)
+	var requests atomic.Int32
+	srv := newGenAIConfigServer(100, &requests)
+	defer srv.Close()
+
+	if model := resolveChatModel(srv.URL, "key", t.TempDir(), "preferred-llm", true); model != "preferred-llm" {
+		t.Errorf("model = %q, want the preferred model", model)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("requests = %d, want %d bounded attempts", got, 3)
+	}
+	if model := resolveChatModel(srv.URL, "key", t.TempDir(), "", true); model != "" {
+		t.Errorf("model = %q, want none without a preferred model", model)
+	}
+}
+
+func TestGenAIReloader_PicksUpRotatedKey(t *testing.T) {
+	configDir := t.TempDir()
+	writeCreds := func(apiKey string) {
+		t.Helper()
+		creds := `{"credentials": {"api_base": "https://genai.example.com/v1", "api_key": "` + apiKey + `", "model_name": "gpt-oss"}}`
+		if err := os.WriteFile(filepath.Join(configDir, "genai-credentials.json"), []byte(creds), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCreds("old-key")
+
+	b := broker.New(broker.BrokerConfig{LLMEndpoint: "https://genai.example.com/v1", LLMAPIKey: "old-key", LLMModel: "gpt-oss"}, nil)
+	reloader := startGenAIReloader(b, 10*time.Millisecond, configDir, t.TempDir(), "", "")
+	defer reloader.Stop()
+
+	writeCreds("rotated-key")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, apiKey, model := b.LLMCredentials()
+		if apiKey == "rotated-key" {
+			if model != "gpt-oss" {
+				t.Errorf("model = %q, want gpt-oss", model)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("api key = %q, want the rotated key after a reload tick", apiKey)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// A broken file keeps the last good credentials
+	if err := os.WriteFile(filepath.Join(configDir, "genai-credentials.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, apiKey, _ := b.LLMCredentials(); apiKey != "rotated-key" {
+		t.Errorf("api key = %q after an unreadable reload, want rotated-key kept", apiKey)
+	}
+}
@@ -2,7 +2,9 @@ package security
 
 import (
 	"fmt"
+	"net"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -10,26 +12,56 @@ import (
 const MinSafeVersion = "2026.1.29"
 
 // parseVersion splits a "YYYY.M.D" or "YYYY.M.D-N" version string into integer components.
-// Any hyphen suffix (e.g., "-2" in "2026.2.21-2") is stripped from the day component.
-func parseVersion(v string) (int, int, int, error) {
+// The hyphen suffix (e.g., "-2" in "2026.2.21-2") is the hotfix build number; it is 0 when absent.
+func parseVersion(v string) (int, int, int, int, error) {
 	parts := strings.Split(v, ".")
 	if len(parts) != 3 {
-		return 0, 0, 0, fmt.Errorf("invalid version format %q (expected YYYY.M.D)", v)
+		return 0, 0, 0, 0, fmt.Errorf("invalid version format %q (expected YYYY.M.D)", v)
 	}
 	year, err := strconv.Atoi(parts[0])
 	if err != nil {
-		return 0, 0, 0, fmt.Errorf("invalid year in version %q: %w", v, err)
+		return 0, 0, 0, 0, fmt.Errorf("invalid year in version %q: %w", v, err)
 	}
 	month, err := strconv.Atoi(parts[1])
 	if err != nil {
-		return 0, 0, 0, fmt.Errorf("invalid month in version %q: %w", v, err)
+		return 0, 0, 0, 0, fmt.Errorf("invalid month in version %q: %w", v, err)
 	}
-	dayStr, _, _ := strings.Cut(parts[2], "-")
+	dayStr, buildStr, hasBuild := strings.Cut(parts[2], "-")
 	day, err := strconv.Atoi(dayStr)
 	if err != nil {
-		return 0, 0, 0, fmt.Errorf("invalid day in version %q: %w", v, err)
+		return 0, 0, 0, 0, fmt.Errorf("invalid day in version %q: %w", v, err)
 	}
-	return year, month, day, nil
+	build := 0
+	if hasBuild {
+		build, err = strconv.Atoi(buildStr)
+		if err != nil {
+			return 0, 0, 0, 0, fmt.Errorf("invalid build number in version %q: %w", v, err)
+		}
+	}
+	return year, month, day, build, nil
+}
+
+// CompareVersions compares two "YYYY.M.D[-N]" versions, returning -1, 0 or 1
+// as a is older than, equal to, or newer than b. A version without a build
+// suffix sorts before any hotfix build of the same day.
+func CompareVersions(a, b string) (int, error) {
+	aY, aM, aD, aN, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	bY, bM, bD, bN, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for _, pair := range [][2]int{{aY, bY}, {aM, bM}, {aD, bD}, {aN, bN}} {
+		if pair[0] < pair[1] {
+			return -1, nil
+		}
+		if pair[0] > pair[1] {
+			return 1, nil
+		}
+	}
+	return 0, nil
 }
 
 // ValidateVersion ensures the OpenClaw version meets the given minimum version.
@@ -41,16 +73,15 @@ func ValidateVersion(version, minVersion string) error {
 	if version == "" {
 		return fmt.Errorf("OpenClaw version is required (minimum: %s for CVE-2026-25253)", minVersion)
 	}
-	vY, vM, vD, err := parseVersion(version)
-	if err != nil {
+	if _, _, _, _, err := parseVersion(version); err != nil {
 		return err
 	}
-	mY, mM, mD, err := parseVersion(minVersion)
+	cmp, err := CompareVersions(version, minVersion)
 	if err != nil {
 		return fmt.Errorf("invalid minimum version %q: %w", minVersion, err)
 	}
 
-	if vY < mY || (vY == mY && vM < mM) || (vY == mY && vM == mM && vD < mD) {
+	if cmp < 0 {
 		return fmt.Errorf("OpenClaw version %s is below minimum safe version %s (CVE-2026-25253)", version, minVersion)
 	}
 	return nil
@@ -58,7 +89,14 @@ func ValidateVersion(version, minVersion string) error {
 
 // ValidateWebSocketOrigin checks that a WebSocket connection's Origin header
 // matches the expected hostname, preventing cross-origin token exfiltration.
-func ValidateWebSocketOrigin(origin, expectedHost string) error {
+// expectedHost may carry a port ("host:8443", "[::1]:8443"), in which case the
+// origin's port must match too, defaulting from its scheme when omitted.
+// IPv6 literals are compared by address, so "[::1]" matches "0:0:0:0:0:0:0:1".
+//
+// Matching is exact unless allowSubdomains is set (or expectedHost is written
+// as "*.host"), which also admits direct subdomains such as
+// "feature.host" — but not deeper ones or unrelated hosts.
+func ValidateWebSocketOrigin(origin, expectedHost string, allowSubdomains bool) error {
 	if origin == "" {
 		return fmt.Errorf("WebSocket origin header is required")
 	}
@@ -66,12 +104,98 @@ func ValidateWebSocketOrigin(origin, expectedHost string) error {
 	if err != nil {
 		return fmt.Errorf("invalid origin URL: %w", err)
 	}
-	if !strings.EqualFold(parsed.Hostname(), expectedHost) {
+	if rest, ok := strings.CutPrefix(expectedHost, "*."); ok {
+		expectedHost, allowSubdomains = rest, true
+	}
+	wantHost, wantPort := splitExpectedHost(expectedHost)
+	originHost := parsed.Hostname()
+	if !sameHost(originHost, wantHost) && !(allowSubdomains && isDirectSubdomain(originHost, wantHost)) {
 		return fmt.Errorf("origin %q does not match expected host %q", origin, expectedHost)
 	}
+	if wantPort != "" && originPort(parsed) != wantPort {
+		return fmt.Errorf("origin %q does not match expected port %s", origin, wantPort)
+	}
 	return nil
 }
 
+// splitExpectedHost separates an optional port from expectedHost, accepting
+// bare and bracketed IPv6 literals.
+func splitExpectedHost(expectedHost string) (host, port string) {
+	if h, p, err := net.SplitHostPort(expectedHost); err == nil {
+		return h, p
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(expectedHost, "["), "]"), ""
+}
+
+// sameHost compares hostnames case-insensitively and IP literals by address.
+func sameHost(a, b string) bool {
+	if ipA, ipB := net.ParseIP(a), net.ParseIP(b); ipA != nil || ipB != nil {
+		return ipA != nil && ipB != nil && ipA.Equal(ipB)
+	}
+	return strings.EqualFold(a, b)
+}
+
+// isDirectSubdomain reports whether host is exactly one DNS label below parent.
+// IP literals have no subdomains.
+func isDirectSubdomain(host, parent string) bool {
+	if net.ParseIP(parent) != nil || net.ParseIP(host) != nil {
+		return false
+	}
+	label, ok := strings.CutSuffix(strings.ToLower(host), "."+strings.ToLower(parent))
+	return ok && label != "" && !strings.Contains(label, ".")
+}
+
+// originPort returns the origin's explicit port or its scheme's default.
+func originPort(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "https", "wss":
+		return "443"
+	case "http", "ws":
+		return "80"
+	}
+	return ""
+}
+
+// Sandbox modes, from most to least restrictive. They match the
+// openclaw-agent job's openclaw.security.sandbox_mode values.
+const (
+	SandboxStrict   = "strict"
+	SandboxModerate = "moderate"
+	SandboxLoose    = "loose"
+)
+
+// SandboxModes lists every valid sandbox mode.
+var SandboxModes = []string{SandboxStrict, SandboxModerate, SandboxLoose}
+
+// ValidSandboxMode reports whether mode is one of SandboxModes.
+func ValidSandboxMode(mode string) bool {
+	return slices.Contains(SandboxModes, mode)
+}
+
+// baselineBlockedCommands are catastrophic in every sandbox mode.
+var baselineBlockedCommands = []string{
+	"rm -rf /",
+	"rm -rf /*",
+	":(){ :|:& };:",
+}
+
+// DefaultBlockedCommands returns the blocked-command baseline for a sandbox
+// mode. Stricter modes block more; an unknown mode gets the strict list.
+func DefaultBlockedCommands(sandboxMode string) []string {
+	cmds := append([]string(nil), baselineBlockedCommands...)
+	switch sandboxMode {
+	case SandboxLoose:
+		return cmds
+	case SandboxModerate:
+		return append(cmds, "dd if=/dev/zero", "mkfs")
+	default:
+		return append(cmds, "dd if=/dev/zero", "dd if=/dev/random", "mkfs", "shutdown", "reboot", "chmod -R 777 /")
+	}
+}
+
 // SecurityPolicy represents the runtime security policy for an agent instance.
 type SecurityPolicy struct {
 	WebSocketOriginCheck bool   `json:"websocket_origin_check"`
@@ -104,61 +104,134 @@ func TestValidateVersion_UsesCustomMinVersion(t *testing.T) {
 }
 
 func TestValidateWebSocketOrigin_MatchingHost(t *testing.T) {
-	err := ValidateWebSocketOrigin("https://myapp.example.com", "myapp.example.com")
+	err := ValidateWebSocketOrigin("https://myapp.example.com", "myapp.example.com", false)
 	if err != nil {
 		t.Errorf("ValidateWebSocketOrigin() returned error: %v, want nil", err)
 	}
 }
 
 func TestValidateWebSocketOrigin_MatchingHostCaseInsensitive(t *testing.T) {
-	err := ValidateWebSocketOrigin("https://MyApp.Example.COM", "myapp.example.com")
+	err := ValidateWebSocketOrigin("https://MyApp.Example.COM", "myapp.example.com", false)
 	if err != nil {
 		t.Errorf("ValidateWebSocketOrigin() returned error: %v, want nil", err)
 	}
 }
 
 func TestValidateWebSocketOrigin_MismatchedHost(t *testing.T) {
-	err := ValidateWebSocketOrigin("https://evil.attacker.com", "myapp.example.com")
+	err := ValidateWebSocketOrigin("https://evil.attacker.com", "myapp.example.com", false)
 	if err == nil {
 		t.Error("ValidateWebSocketOrigin() returned nil for mismatched host, want error")
 	}
 }
 
 func TestValidateWebSocketOrigin_EmptyOrigin(t *testing.T) {
-	err := ValidateWebSocketOrigin("", "myapp.example.com")
+	err := ValidateWebSocketOrigin("", "myapp.example.com", false)
 	if err == nil {
 		t.Error("ValidateWebSocketOrigin() returned nil for empty origin, want error")
 	}
 }
 
 func TestValidateWebSocketOrigin_WithPort(t *testing.T) {
-	err := ValidateWebSocketOrigin("https://myapp.example.com:8443", "myapp.example.com")
+	err := ValidateWebSocketOrigin("https://myapp.example.com:8443", "myapp.example.com", false)
 	if err != nil {
 		t.Errorf("ValidateWebSocketOrigin() returned error: %v, want nil", err)
 	}
 }
 
 func TestValidateWebSocketOrigin_HTTPScheme(t *testing.T) {
-	err := ValidateWebSocketOrigin("http://myapp.example.com", "myapp.example.com")
+	err := ValidateWebSocketOrigin("http://myapp.example.com", "myapp.example.com", false)
 	if err != nil {
 		t.Errorf("ValidateWebSocketOrigin() returned error: %v, want nil", err)
 	}
 }
 
 func TestValidateWebSocketOrigin_WSSScheme(t *testing.T) {
-	err := ValidateWebSocketOrigin("wss://myapp.example.com", "myapp.example.com")
+	err := ValidateWebSocketOrigin("wss://myapp.example.com", "myapp.example.com", false)
 	if err != nil {
 		t.Errorf("ValidateWebSocketOrigin() returned error: %v, want nil", err)
 	}
 }
 
 func TestValidateWebSocketOrigin_SubdomainMismatch(t *testing.T) {
-	err := ValidateWebSocketOrigin("https://sub.myapp.example.com", "myapp.example.com")
+	err := ValidateWebSocketOrigin("https://sub.myapp.example.com", "myapp.example.com", false)
 	if err == nil {
 		t.Error("ValidateWebSocketOrigin() should reject subdomain mismatch")
 	}
 }
 
+func TestValidateWebSocketOrigin_ExpectedHostWithPort(t *testing.T) {
+	tests := []struct {
+		origin, expectedHost string
+		wantErr              bool
+	}{
+		{"https://myapp.example.com:8443", "myapp.example.com:8443", false},
+		{"https://myapp.example.com:9443", "myapp.example.com:8443", true},
+		{"https://myapp.example.com", "myapp.example.com:443", false},
+		{"wss://myapp.example.com", "myapp.example.com:443", false},
+		{"http://myapp.example.com", "myapp.example.com:443", true},
+		{"https://sub.myapp.example.com:8443", "myapp.example.com:8443", true},
+	}
+	for _, tt := range tests {
+		err := ValidateWebSocketOrigin(tt.origin, tt.expectedHost, false)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateWebSocketOrigin(%q, %q) error = %v, wantErr %v", tt.origin, tt.expectedHost, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateWebSocketOrigin_IPv6(t *testing.T) {
+	tests := []struct {
+		origin, expectedHost string
+		wantErr              bool
+	}{
+		{"https://[::1]:8443", "[::1]:8443", false},
+		{"https://[::1]:8443", "::1", false},
+		{"https://[::1]:8443", "[::1]", false},
+		{"https://[0:0:0:0:0:0:0:1]", "::1", false},
+		{"https://[2001:db8::1]:8443", "[2001:DB8::1]:8443", false},
+		{"https://[::1]:9443", "[::1]:8443", true},
+		{"https://[::2]:8443", "[::1]:8443", true},
+		{"https://localhost:8443", "[::1]:8443", true},
+	}
+	for _, tt := range tests {
+		err := ValidateWebSocketOrigin(tt.origin, tt.expectedHost, false)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateWebSocketOrigin(%q, %q) error = %v, wantErr %v", tt.origin, tt.expectedHost, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateWebSocketOrigin_AllowSubdomains(t *testing.T) {
+	tests := []struct {
+		origin, expectedHost string
+		wantErr              bool
+	}{
+		{"https://feature.myapp.example.com", "myapp.example.com", false},
+		{"https://Feature.MyApp.Example.com:443", "myapp.example.com:443", false},
+		{"https://myapp.example.com", "myapp.example.com", false},
+		{"https://evil.attacker.com", "myapp.example.com", true},
+		{"https://a.b.myapp.example.com", "myapp.example.com", true},
+		{"https://evilmyapp.example.com", "myapp.example.com", true},
+		{"https://myapp.example.com.attacker.com", "myapp.example.com", true},
+		{"https://feature.myapp.example.com:9443", "myapp.example.com:8443", true},
+	}
+	for _, tt := range tests {
+		err := ValidateWebSocketOrigin(tt.origin, tt.expectedHost, true)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateWebSocketOrigin(%q, %q, true) error = %v, wantErr %v", tt.origin, tt.expectedHost, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateWebSocketOrigin_WildcardExpectedHost(t *testing.T) {
+	if err := ValidateWebSocketOrigin("https://feature.myapp.example.com", "*.myapp.example.com", false); err != nil {
+		t.Errorf("wildcard expected host should admit a direct subdomain: %v", err)
+	}
+	if err := ValidateWebSocketOrigin("https://evil.attacker.com", "*.myapp.example.com", false); err == nil {
+		t.Error("wildcard expected host should still reject unrelated hosts")
+	}
+}
+
 func TestDefaultSecurityPolicy_WebSocketOriginCheck(t *testing.T) {
 	policy := DefaultSecurityPolicy()
 	if !policy.WebSocketOriginCheck {
@@ -192,3 +265,76 @@ func searchSubstring(s, substr string) bool {
 	}
 	return false
 }
+
+func TestCompareVersions_OrdersHotfixBuilds(t *testing.T) {
+	ordered := []string{"2026.2.21", "2026.2.21-2", "2026.2.21-10", "2026.2.22"}
+	for i := 0; i < len(ordered)-1; i++ {
+		older, newer := ordered[i], ordered[i+1]
+		if cmp, err := CompareVersions(newer, older); err != nil || cmp != 1 {
+			t.Errorf("CompareVersions(%q, %q) = %d, %v; want 1, nil", newer, older, cmp, err)
+		}
+		if cmp, err := CompareVersions(older, newer); err != nil || cmp != -1 {
+			t.Errorf("CompareVersions(%q, %q) = %d, %v; want -1, nil", older, newer, cmp, err)
+		}
+	}
+	if cmp, err := CompareVersions("2026.2.21-2", "2026.2.21-2"); err != nil || cmp != 0 {
+		t.Errorf("CompareVersions of equal versions = %d, %v; want 0, nil", cmp, err)
+	}
+}
+
+func TestCompareVersions_RejectsInvalidBuild(t *testing.T) {
+	if _, err := CompareVersions("2026.2.21-rc1", "2026.2.21"); err == nil {
+		t.Error("CompareVersions with non-numeric build returned nil, want error")
+	}
+}
+
+func TestValidateVersion_ComparesBuildSuffix(t *testing.T) {
+	if err := ValidateVersion("2026.2.21-2", "2026.2.21-10"); err == nil {
+		t.Error("ValidateVersion should reject build 2 below minimum build 10")
+	}
+	if err := ValidateVersion("2026.2.21-10", "2026.2.21-2"); err != nil {
+		t.Errorf("ValidateVersion(2026.2.21-10, 2026.2.21-2) returned error: %v", err)
+	}
+	if err := ValidateVersion("2026.2.21-2", "2026.2.21"); err != nil {
+		t.Errorf("ValidateVersion(2026.2.21-2, 2026.2.21) returned error: %v", err)
+	}
+	for _, v := range []string{"2025.12.31-99", "2025.1.1"} {
+		if err := ValidateVersion(v, ""); err == nil {
+			t.Errorf("ValidateVersion(%q) returned nil, want error", v)
+		}
+	}
+}
+
+func TestDefaultBlockedCommands_StricterModesBlockMore(t *testing.T) {
+	loose, moderate, strict := DefaultBlockedCommands("loose"), DefaultBlockedCommands("moderate"), DefaultBlockedCommands("strict")
+	if !(len(loose) < len(moderate) && len(moderate) < len(strict)) {
+		t.Errorf("list sizes loose=%d moderate=%d strict=%d, want strictly increasing", len(loose), len(moderate), len(strict))
+	}
+	for _, cmds := range [][]string{loose, moderate, strict} {
+		if cmds[0] != "rm -rf /" {
+			t.Errorf("baseline missing from %v", cmds)
+		}
+	}
+	if got := DefaultBlockedCommands("unknown"); len(got) != len(strict) {
+		t.Errorf("unknown mode got %d commands, want the strict list", len(got))
+	}
+
+	// Callers may append to the result without affecting later calls
+	_ = append(loose, "curl")
+	if len(DefaultBlockedCommands("loose")) != len(loose) {
+		t.Error("DefaultBlockedCommands result shares state across calls")
+	}
+}
+
+func TestValidSandboxMode(t *testing.T) {
+	for _, mode := range []string{"strict", "moderate", "loose"} {
+		if !ValidSandboxMode(mode) {
+			t.Errorf("ValidSandboxMode(%q) = false, want true", mode)
+		}
+	}
+	for _, mode := range []string{"", "strct", "Strict", "off"} {
+		if ValidSandboxMode(mode) {
+			t.Errorf("ValidSandboxMode(%q) = true, want false", mode)
+		}
+	}
+}
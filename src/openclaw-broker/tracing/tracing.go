@@ -0,0 +1,295 @@
+// Package tracing records request spans for the broker and exports them to
+// an OpenTelemetry collector over OTLP/HTTP. It implements the small subset
+// of OpenTelemetry the broker needs (spans, attributes, W3C trace context)
+// without pulling in the SDK.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanKind mirrors the OTLP span kinds the broker emits.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// Attr is a span attribute. Value is a string, int, or bool.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key, value string) Attr    { return Attr{Key: key, Value: value} }
+func Int(key string, value int) Attr   { return Attr{Key: key, Value: value} }
+func Bool(key string, value bool) Attr { return Attr{Key: key, Value: value} }
+
+// SpanData is a finished span as handed to an Exporter. IDs are lowercase hex.
+type SpanData struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         SpanKind
+	Start        time.Time
+	End          time.Time
+	Attributes   []Attr
+	Failed       bool
+	StatusMsg    string
+}
+
+// Attr returns the value of the named attribute, or nil.
+func (d SpanData) Attr(key string) interface{} {
+	for _, a := range d.Attributes {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+// Exporter receives finished spans. Export is called on the goroutine that
+// ends the span, so implementations must not block.
+type Exporter interface {
+	Export(SpanData)
+	Shutdown(ctx context.Context) error
+}
+
+// Tracer starts spans. A nil *Tracer, or one without an exporter, is a no-op
+// that still propagates incoming trace context.
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer returns a tracer sending finished spans to exporter; a nil
+// exporter yields a no-op tracer.
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// Enabled reports whether spans are recorded.
+func (t *Tracer) Enabled() bool {
+	return t != nil && t.exporter != nil
+}
+
+// Shutdown flushes spans still buffered in the exporter.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if !t.Enabled() {
+		return nil
+	}
+	return t.exporter.Shutdown(ctx)
+}
+
+// spanContext identifies a span for parenting and propagation.
+type spanContext struct {
+	traceID string
+	spanID  string
+	sampled bool
+}
+
+type spanContextKey struct{}
+
+func fromContext(ctx context.Context) (spanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(spanContext)
+	return sc, ok
+}
+
+// TraceID returns the trace ID active in ctx, or "".
+func TraceID(ctx context.Context) string {
+	sc, _ := fromContext(ctx)
+	return sc.traceID
+}
+
+// Start begins a span named name as a child of the span in ctx, or of a remote
+// parent extracted from incoming headers, and returns a context carrying it.
+// The span must be ended with End or Finish.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...Attr) (context.Context, *Span) {
+	if !t.Enabled() {
+		return ctx, nil
+	}
+	parent, ok := fromContext(ctx)
+	traceID := parent.traceID
+	if !ok {
+		traceID = newID(16)
+	}
+	s := &Span{
+		tracer: t,
+		data: SpanData{
+			TraceID:      traceID,
+			SpanID:       newID(8),
+			ParentSpanID: parent.spanID,
+			Name:         name,
+			Kind:         KindInternal,
+			Start:        time.Now(),
+			Attributes:   append([]Attr(nil), attrs...),
+		},
+	}
+	return context.WithValue(ctx, spanContextKey{}, spanContext{traceID: traceID, spanID: s.data.SpanID, sampled: true}), s
+}
+
+// Span is an in-progress span. All methods are safe on a nil *Span, which is
+// what a no-op tracer returns.
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// SetKind overrides the default KindInternal.
+func (s *Span) SetKind(kind SpanKind) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Kind = kind
+	s.mu.Unlock()
+}
+
+// SetAttributes adds attrs to the span, replacing any with the same key.
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range attrs {
+		replaced := false
+		for i := range s.data.Attributes {
+			if s.data.Attributes[i].Key == a.Key {
+				s.data.Attributes[i] = a
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			s.data.Attributes = append(s.data.Attributes, a)
+		}
+	}
+}
+
+// SetError marks the span failed with msg.
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Failed = true
+	s.data.StatusMsg = msg
+	s.mu.Unlock()
+}
+
+// Finish records err, if any, as the span's result and ends it.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.SetAttributes(String("result", "error"))
+		s.SetError(err.Error())
+	} else {
+		s.SetAttributes(String("result", "success"))
+	}
+	s.End()
+}
+
+// End exports the span. Later calls are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	data.Attributes = append([]Attr(nil), s.data.Attributes...)
+	s.mu.Unlock()
+	s.tracer.exporter.Export(data)
+}
+
+// traceparentHeader is the W3C Trace Context header:
+// "00-<32 hex trace id>-<16 hex parent id>-<2 hex flags>".
+const traceparentHeader = "traceparent"
+
+// Extract returns ctx carrying the remote parent from a well-formed incoming
+// traceparent header. Malformed headers are ignored and start a new trace.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	parts := strings.Split(strings.TrimSpace(h.Get(traceparentHeader)), "-")
+	if len(parts) != 4 || parts[0] == "ff" || len(parts[0]) != 2 ||
+		!isHex(parts[1], 32) || !isHex(parts[2], 16) || !isHex(parts[3], 2) {
+		return ctx
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, spanContext{
+		traceID: parts[1],
+		spanID:  parts[2],
+		sampled: parts[3] == "01",
+	})
+}
+
+// Inject writes the span context in ctx as a traceparent header.
+func Inject(ctx context.Context, h http.Header) {
+	sc, ok := fromContext(ctx)
+	if !ok {
+		return
+	}
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	h.Set(traceparentHeader, "00-"+sc.traceID+"-"+sc.spanID+"-"+flags)
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func newID(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Recorder is an in-memory Exporter for tests.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (r *Recorder) Export(s SpanData) {
+	r.mu.Lock()
+	r.spans = append(r.spans, s)
+	r.mu.Unlock()
+}
+
+func (r *Recorder) Shutdown(context.Context) error { return nil }
+
+// Spans returns the finished spans in the order they ended.
+func (r *Recorder) Spans() []SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]SpanData(nil), r.spans...)
+}
@@ -0,0 +1,124 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExtractInject_RoundTrip(t *testing.T) {
+	in := http.Header{}
+	in.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := Extract(context.Background(), in)
+	if got := TraceID(ctx); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("TraceID = %q", got)
+	}
+	out := http.Header{}
+	Inject(ctx, out)
+	if got := out.Get("traceparent"); got != in.Get("traceparent") {
+		t.Errorf("Inject = %q, want %q", got, in.Get("traceparent"))
+	}
+}
+
+func TestExtract_IgnoresMalformed(t *testing.T) {
+	for _, header := range []string{
+		"",
+		"garbage",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		h := http.Header{}
+		h.Set("traceparent", header)
+		if id := TraceID(Extract(context.Background(), h)); id != "" {
+			t.Errorf("Extract(%q) trace = %q, want none", header, id)
+		}
+	}
+}
+
+func TestNoopTracer(t *testing.T) {
+	var nilTracer *Tracer
+	for _, tr := range []*Tracer{nilTracer, NewTracer(nil)} {
+		ctx, span := tr.Start(context.Background(), "op", String("k", "v"))
+		span.SetAttributes(Int("n", 1))
+		span.Finish(errors.New("boom"))
+		if span != nil || TraceID(ctx) != "" {
+			t.Errorf("no-op tracer started a span")
+		}
+		if err := tr.Shutdown(context.Background()); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	}
+}
+
+func TestTracer_ParentsAndErrors(t *testing.T) {
+	rec := &Recorder{}
+	tr := NewTracer(rec)
+	ctx, parent := tr.Start(context.Background(), "parent")
+	_, child := tr.Start(ctx, "child")
+	child.Finish(errors.New("director unreachable"))
+	child.End()
+	parent.End()
+
+	spans := rec.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2 (End after Finish is ignored)", len(spans))
+	}
+	if spans[0].ParentSpanID != spans[1].SpanID || spans[0].TraceID != spans[1].TraceID {
+		t.Errorf("child %+v is not parented to %+v", spans[0], spans[1])
+	}
+	if !spans[0].Failed || spans[0].StatusMsg != "director unreachable" || spans[0].Attr("result") != "error" {
+		t.Errorf("child status = %+v, want error", spans[0])
+	}
+	if spans[1].ParentSpanID != "" {
+		t.Errorf("root span has parent %q", spans[1].ParentSpanID)
+	}
+}
+
+func TestOTLPExporter_PostsBatchOnShutdown(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("export to %s (%s), want JSON to /v1/traces", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer collector.Close()
+
+	tr := NewTracer(NewOTLPExporter(collector.URL+"/", "openclaw-broker"))
+	_, span := tr.Start(context.Background(), "provision", String("instance_id", "inst-1"), Int("bosh_task_id", 42))
+	span.SetKind(KindServer)
+	span.SetError("Internal Server Error")
+	span.End()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tr.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	var req otlpRequest
+	if err := json.Unmarshal(<-bodies, &req); err != nil {
+		t.Fatalf("export body: %v", err)
+	}
+	rs := req.ResourceSpans[0]
+	if v := rs.Resource.Attributes[0]; v.Key != "service.name" || v.Value["stringValue"] != "openclaw-broker" {
+		t.Errorf("resource = %+v", rs.Resource)
+	}
+	got := rs.ScopeSpans[0].Spans[0]
+	if got.Name != "provision" || got.Kind != KindServer || len(got.TraceID) != 32 || len(got.SpanID) != 16 {
+		t.Errorf("span = %+v", got)
+	}
+	if got.Status.Code != 2 || got.Status.Message != "Internal Server Error" {
+		t.Errorf("status = %+v, want error", got.Status)
+	}
+	if got.Attributes[1].Key != "bosh_task_id" || got.Attributes[1].Value["intValue"] != "42" {
+		t.Errorf("attributes = %+v", got.Attributes)
+	}
+}
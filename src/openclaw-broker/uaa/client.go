@@ -4,14 +4,17 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,14 +24,92 @@ type Client struct {
 	adminID    string
 	adminSecret string
 	httpClient *http.Client
+	// retryDelay is the backoff before the first retry of a failed client
+	// create or delete; it doubles on each further attempt.
+	retryDelay time.Duration
+
+	tokenMu     sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// ClientOptions tunes a Client's TLS and connection pooling. Zero values
+// use the defaults.
+type ClientOptions struct {
+	// TLSMinVersion is the oldest TLS version negotiated with UAA. Defaults
+	// to DefaultTLSMinVersion.
+	TLSMinVersion uint16
+	// TLSCipherSuites restricts the TLS 1.2 cipher suites offered; empty uses
+	// Go's defaults. TLS 1.3 suites are not configurable.
+	TLSCipherSuites []uint16
+	// MaxIdleConns and MaxIdleConnsPerHost cap the keep-alive connections
+	// kept open for reuse. Default to DefaultMaxIdleConns and
+	// DefaultMaxIdleConnsPerHost.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout closes keep-alive connections left idle this long.
+	// Defaults to DefaultIdleConnTimeout.
+	IdleConnTimeout time.Duration
+	// DisableHTTP2 keeps the client on HTTP/1.1 even when UAA offers HTTP/2.
+	DisableHTTP2 bool
+}
+
+// DefaultTLSMinVersion keeps clients off TLS 1.0 and 1.1.
+const DefaultTLSMinVersion = tls.VersionTLS12
+
+// Keep-alive defaults. Go's default of two idle connections per host is far
+// too few for bursts of concurrent binds, which all talk to one host.
+const (
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 32
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// newTransport returns a pooled, HTTP/2-capable transport for options.
+func newTransport(tlsConfig *tls.Config, options ClientOptions) *http.Transport {
+	if options.MaxIdleConns <= 0 {
+		options.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if options.MaxIdleConnsPerHost <= 0 {
+		options.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	if options.IdleConnTimeout <= 0 {
+		options.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	return &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConns:        options.MaxIdleConns,
+		MaxIdleConnsPerHost: options.MaxIdleConnsPerHost,
+		IdleConnTimeout:     options.IdleConnTimeout,
+		// A custom TLS config turns off Go's automatic HTTP/2
+		ForceAttemptHTTP2: !options.DisableHTTP2,
+	}
 }
 
 // NewClient creates a UAA client. uaaURL is the UAA base URL (e.g., https://uaa.sys.example.com).
 // adminID and adminSecret are the UAA admin client credentials used to manage OAuth2 clients.
-func NewClient(uaaURL, adminID, adminSecret string, skipSSLValidation bool) *Client {
-	transport := &http.Transport{}
-	if skipSSLValidation {
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+// caCert, if non-empty, is a PEM bundle trusted in place of the system roots
+// (e.g., an internal CA); skipSSLValidation disables verification entirely.
+// At most one ClientOptions may be given.
+func NewClient(uaaURL, adminID, adminSecret, caCert string, skipSSLValidation bool, opts ...ClientOptions) *Client {
+	var options ClientOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	if options.TLSMinVersion == 0 {
+		options.TLSMinVersion = DefaultTLSMinVersion
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: skipSSLValidation,
+		MinVersion:         options.TLSMinVersion,
+		CipherSuites:       options.TLSCipherSuites,
+	}
+	if caCert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(caCert)) {
+			log.Printf("WARNING: failed to parse any CA certificates from provided UAA ca_cert")
+		}
+		tlsConfig.RootCAs = pool
 	}
 	return &Client{
 		uaaURL:      strings.TrimRight(uaaURL, "/"),
@@ -36,8 +117,47 @@ func NewClient(uaaURL, adminID, adminSecret string, skipSSLValidation bool) *Cli
 		adminSecret: adminSecret,
 		httpClient: &http.Client{
 			Timeout:   30 * time.Second,
-			Transport: transport,
+			Transport: newTransport(tlsConfig, options),
 		},
+		retryDelay: defaultRetryDelay,
+	}
+}
+
+// UAA occasionally answers 5xx under load. Client creates and deletes are
+// retried on those and on transport errors, backing off from retryDelay.
+const (
+	maxClientAttempts = 4
+	defaultRetryDelay = 500 * time.Millisecond
+)
+
+// doWithRetry sends the request built by newReq, retrying 5xx responses and
+// transport errors up to maxClientAttempts in total. newReq is called per
+// attempt so the body can be resent. Any other response is returned for the
+// caller to interpret, so 404 and 409 are never retried. Only idempotent
+// requests may be sent this way: a create is keyed by its client ID, so a
+// retry after a create that landed gets a 409.
+func (c *Client) doWithRetry(operation string, newReq func() (*http.Request, error)) (*http.Response, error) {
+	delay := c.retryDelay
+	for attempt := 1; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, fmt.Errorf("building %s request: %w", operation, err)
+		}
+		resp, err := c.httpClient.Do(req)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			err = fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+		}
+		if attempt == maxClientAttempts {
+			return nil, fmt.Errorf("%s failed after %d attempts: %w", operation, attempt, err)
+		}
+		log.Printf("UAA %s failed (attempt %d/%d), retrying in %s: %v", operation, attempt, maxClientAttempts, delay, err)
+		time.Sleep(delay)
+		delay *= 2
 	}
 }
 
@@ -48,8 +168,15 @@ type tokenResponse struct {
 	ExpiresIn   int    `json:"expires_in"`
 }
 
-// getAdminToken obtains an access token via client_credentials grant.
+// getAdminToken obtains an access token via client_credentials grant,
+// reusing the cached token until shortly before it expires.
 func (c *Client) getAdminToken() (string, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	if c.token != "" && time.Now().Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
 	data := url.Values{
 		"grant_type":    {"client_credentials"},
 		"client_id":     {c.adminID},
@@ -78,7 +205,14 @@ func (c *Client) getAdminToken() (string, error) {
 	if err := json.Unmarshal(body, &tok); err != nil {
 		return "", fmt.Errorf("parsing token response: %w", err)
 	}
-	return tok.AccessToken, nil
+	// Cache with a 60s safety margin before expiry.
+	margin := tok.ExpiresIn - 60
+	if margin < 0 {
+		margin = 0
+	}
+	c.token = tok.AccessToken
+	c.tokenExpiry = time.Now().Add(time.Duration(margin) * time.Second)
+	return c.token, nil
 }
 
 // OAuthClient represents a UAA OAuth2 client registration.
@@ -92,7 +226,8 @@ type OAuthClient struct {
 	Name                 string   `json:"name,omitempty"`
 }
 
-// CreateClient registers a new OAuth2 client in UAA.
+// CreateClient registers a new OAuth2 client in UAA. 5xx responses and
+// transport errors are retried; a client that already exists is success.
 func (c *Client) CreateClient(client OAuthClient) error {
 	token, err := c.getAdminToken()
 	if err != nil {
@@ -104,15 +239,16 @@ func (c *Client) CreateClient(client OAuthClient) error {
 		return fmt.Errorf("marshalling client: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", c.uaaURL+"/oauth/clients", bytes.NewReader(payload))
-	if err != nil {
-		return fmt.Errorf("building create request: %w", err)
-	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.doWithRetry("create client", func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", c.uaaURL+"/oauth/clients", bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		return req, nil
+	})
 	if err != nil {
 		return fmt.Errorf("creating OAuth client: %w", err)
 	}
@@ -120,7 +256,8 @@ func (c *Client) CreateClient(client OAuthClient) error {
 
 	body, _ := io.ReadAll(resp.Body)
 	if resp.StatusCode == http.StatusConflict {
-		// Client already exists — idempotent
+		// Client already exists — idempotent, including when an earlier
+		// attempt that errored had in fact created it
 		return nil
 	}
 	if resp.StatusCode != http.StatusCreated {
@@ -129,21 +266,59 @@ func (c *Client) CreateClient(client OAuthClient) error {
 	return nil
 }
 
-// DeleteClient removes an OAuth2 client from UAA.
-func (c *Client) DeleteClient(clientID string) error {
+// UpdateClient replaces an existing OAuth2 client's registration (e.g., its
+// redirect_uri after a route change). The client secret is not changed;
+// ClientSecret is ignored. Applying the same update twice is harmless.
+func (c *Client) UpdateClient(client OAuthClient) error {
 	token, err := c.getAdminToken()
 	if err != nil {
 		return fmt.Errorf("getting admin token: %w", err)
 	}
 
-	req, err := http.NewRequest("DELETE", c.uaaURL+"/oauth/clients/"+url.PathEscape(clientID), nil)
+	client.ClientSecret = ""
+	payload, err := json.Marshal(client)
 	if err != nil {
-		return fmt.Errorf("building delete request: %w", err)
+		return fmt.Errorf("marshalling client: %w", err)
+	}
+
+	req, err := http.NewRequest("PUT", c.uaaURL+"/oauth/clients/"+url.PathEscape(client.ClientID), bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("building update request: %w", err)
 	}
 	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
 	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("updating OAuth client: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("update client failed (status %d): %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// DeleteClient removes an OAuth2 client from UAA. 5xx responses and
+// transport errors are retried; a client that is already gone is success.
+func (c *Client) DeleteClient(clientID string) error {
+	token, err := c.getAdminToken()
+	if err != nil {
+		return fmt.Errorf("getting admin token: %w", err)
+	}
+
+	resp, err := c.doWithRetry("delete client", func() (*http.Request, error) {
+		req, err := http.NewRequest("DELETE", c.uaaURL+"/oauth/clients/"+url.PathEscape(clientID), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", "application/json")
+		return req, nil
+	})
 	if err != nil {
 		return fmt.Errorf("deleting OAuth client: %w", err)
 	}
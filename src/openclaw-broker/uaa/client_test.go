@@ -1,18 +1,32 @@
 package uaa
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // newFakeUAA creates an httptest.Server that simulates the CF UAA API.
 // adminID/adminSecret are the expected admin credentials.
 // existingClients tracks registered client IDs to test idempotency.
-func newFakeUAA(adminID, adminSecret string) (*httptest.Server, map[string]bool) {
+// redirectURIs tracks each registered client's redirect_uri.
+func newFakeUAA(adminID, adminSecret string) (*httptest.Server, map[string]bool, map[string][]string) {
 	existingClients := make(map[string]bool)
+	redirectURIs := make(map[string][]string)
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch {
@@ -54,9 +68,31 @@ func newFakeUAA(adminID, adminSecret string) (*httptest.Server, map[string]bool)
 				return
 			}
 			existingClients[client.ClientID] = true
+			redirectURIs[client.ClientID] = client.RedirectURI
 			w.WriteHeader(http.StatusCreated)
 			json.NewEncoder(w).Encode(client)
 
+		// PUT /oauth/clients/{id} — update client (secret is not changeable here)
+		case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/oauth/clients/"):
+			auth := r.Header.Get("Authorization")
+			if auth != "Bearer fake-admin-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			clientID := strings.TrimPrefix(r.URL.Path, "/oauth/clients/")
+			var client OAuthClient
+			if err := json.NewDecoder(r.Body).Decode(&client); err != nil || client.ClientID != clientID || client.ClientSecret != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !existingClients[clientID] {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			redirectURIs[clientID] = client.RedirectURI
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(client)
+
 		// DELETE /oauth/clients/{id} — delete client
 		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/oauth/clients/"):
 			auth := r.Header.Get("Authorization")
@@ -70,6 +106,7 @@ func newFakeUAA(adminID, adminSecret string) (*httptest.Server, map[string]bool)
 				return
 			}
 			delete(existingClients, clientID)
+			delete(redirectURIs, clientID)
 			w.WriteHeader(http.StatusOK)
 
 		default:
@@ -77,14 +114,14 @@ func newFakeUAA(adminID, adminSecret string) (*httptest.Server, map[string]bool)
 		}
 	}))
 
-	return server, existingClients
+	return server, existingClients, redirectURIs
 }
 
 func TestGetAdminToken_Success(t *testing.T) {
-	server, _ := newFakeUAA("admin", "admin-secret")
+	server, _, _ := newFakeUAA("admin", "admin-secret")
 	defer server.Close()
 
-	client := NewClient(server.URL, "admin", "admin-secret", false)
+	client := NewClient(server.URL, "admin", "admin-secret", "", false)
 	token, err := client.getAdminToken()
 	if err != nil {
 		t.Fatalf("getAdminToken failed: %v", err)
@@ -94,11 +131,134 @@ func TestGetAdminToken_Success(t *testing.T) {
 	}
 }
 
+// newFakeUAATLS serves the fake UAA over TLS and returns its certificate as PEM.
+func newFakeUAATLS(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	plain, _, _ := newFakeUAA("admin", "secret")
+	t.Cleanup(plain.Close)
+	server := httptest.NewTLSServer(plain.Config.Handler)
+	t.Cleanup(server.Close)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	return server, string(certPEM)
+}
+
+// selfSignedCAPEM generates an unrelated CA certificate. httptest TLS servers
+// all share one certificate, so a second server can't stand in for it.
+func selfSignedCAPEM(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Unrelated Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestNewClient_TrustsPinnedCA(t *testing.T) {
+	server, caCert := newFakeUAATLS(t)
+
+	client := NewClient(server.URL, "admin", "secret", caCert, false)
+	if _, err := client.getAdminToken(); err != nil {
+		t.Fatalf("getAdminToken with pinned CA failed: %v", err)
+	}
+}
+
+func TestNewClient_RejectsUnknownCA(t *testing.T) {
+	server, _ := newFakeUAATLS(t)
+	otherCA := selfSignedCAPEM(t)
+
+	client := NewClient(server.URL, "admin", "secret", otherCA, false)
+	if _, err := client.getAdminToken(); err == nil {
+		t.Fatal("getAdminToken should fail when the server cert isn't signed by the pinned CA")
+	}
+
+	// Without a CA bundle only the system roots are trusted
+	client = NewClient(server.URL, "admin", "secret", "", false)
+	if _, err := client.getAdminToken(); err == nil {
+		t.Fatal("getAdminToken should fail against a self-signed server with system roots")
+	}
+}
+
+func TestNewClient_TLSMinVersion(t *testing.T) {
+	if got := NewClient("https://uaa.example.com", "admin", "secret", "", false).httpClient.Transport.(*http.Transport).TLSClientConfig.MinVersion; got != tls.VersionTLS12 {
+		t.Errorf("default MinVersion = %x, want TLS 1.2", got)
+	}
+
+	// A server capped at TLS 1.2 still works by default, on both the pinned
+	// CA and skip-verify paths, but not once TLS 1.3 is required
+	plain, _, _ := newFakeUAA("admin", "secret")
+	defer plain.Close()
+	server := httptest.NewUnstartedServer(plain.Config.Handler)
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+	caCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	if _, err := NewClient(server.URL, "admin", "secret", caCert, false).getAdminToken(); err != nil {
+		t.Errorf("pinned CA over TLS 1.2: %v", err)
+	}
+	if _, err := NewClient(server.URL, "admin", "secret", "", true).getAdminToken(); err != nil {
+		t.Errorf("skip-verify over TLS 1.2: %v", err)
+	}
+	strict := NewClient(server.URL, "admin", "secret", caCert, false, ClientOptions{TLSMinVersion: tls.VersionTLS13})
+	if _, err := strict.getAdminToken(); err == nil {
+		t.Error("a TLS 1.3 minimum should refuse a TLS 1.2 server")
+	}
+
+	suites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	withSuites := NewClient(server.URL, "admin", "secret", caCert, false, ClientOptions{TLSCipherSuites: suites})
+	if got := withSuites.httpClient.Transport.(*http.Transport).TLSClientConfig.CipherSuites; len(got) != 2 {
+		t.Errorf("CipherSuites = %v, want the configured suites", got)
+	}
+	if _, err := withSuites.getAdminToken(); err != nil {
+		t.Errorf("restricted cipher suites: %v", err)
+	}
+}
+
+func TestClient_ReusesConnections(t *testing.T) {
+	plain, _, _ := newFakeUAA("admin", "secret")
+	defer plain.Close()
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(plain.Config.Handler)
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	client := NewClient(server.URL, "admin", "secret", "", false)
+	for i := 0; i < 5; i++ {
+		if err := client.DeleteClient(fmt.Sprintf("openclaw-missing-%d", i)); err != nil {
+			t.Fatalf("DeleteClient: %v", err)
+		}
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("opened %d connections for sequential requests, want 1", got)
+	}
+	if !client.httpClient.Transport.(*http.Transport).ForceAttemptHTTP2 {
+		t.Error("HTTP/2 should be attempted by default")
+	}
+}
+
 func TestGetAdminToken_BadCredentials(t *testing.T) {
-	server, _ := newFakeUAA("admin", "admin-secret")
+	server, _, _ := newFakeUAA("admin", "admin-secret")
 	defer server.Close()
 
-	client := NewClient(server.URL, "admin", "wrong-secret", false)
+	client := NewClient(server.URL, "admin", "wrong-secret", "", false)
 	_, err := client.getAdminToken()
 	if err == nil {
 		t.Fatal("Expected error for bad credentials")
@@ -109,10 +269,10 @@ func TestGetAdminToken_BadCredentials(t *testing.T) {
 }
 
 func TestCreateClient_Success(t *testing.T) {
-	server, existing := newFakeUAA("admin", "secret")
+	server, existing, _ := newFakeUAA("admin", "secret")
 	defer server.Close()
 
-	client := NewClient(server.URL, "admin", "secret", false)
+	client := NewClient(server.URL, "admin", "secret", "", false)
 	err := client.CreateClient(OAuthClient{
 		ClientID:             "openclaw-test-001",
 		ClientSecret:         "test-secret",
@@ -129,10 +289,10 @@ func TestCreateClient_Success(t *testing.T) {
 }
 
 func TestCreateClient_Idempotent(t *testing.T) {
-	server, _ := newFakeUAA("admin", "secret")
+	server, _, _ := newFakeUAA("admin", "secret")
 	defer server.Close()
 
-	client := NewClient(server.URL, "admin", "secret", false)
+	client := NewClient(server.URL, "admin", "secret", "", false)
 	oauthClient := OAuthClient{
 		ClientID:             "openclaw-dup",
 		ClientSecret:         "dup-secret",
@@ -153,10 +313,10 @@ func TestCreateClient_Idempotent(t *testing.T) {
 }
 
 func TestDeleteClient_Success(t *testing.T) {
-	server, existing := newFakeUAA("admin", "secret")
+	server, existing, _ := newFakeUAA("admin", "secret")
 	defer server.Close()
 
-	client := NewClient(server.URL, "admin", "secret", false)
+	client := NewClient(server.URL, "admin", "secret", "", false)
 
 	// Create first
 	existing["openclaw-del-001"] = true
@@ -171,10 +331,10 @@ func TestDeleteClient_Success(t *testing.T) {
 }
 
 func TestDeleteClient_NotFound_Idempotent(t *testing.T) {
-	server, _ := newFakeUAA("admin", "secret")
+	server, _, _ := newFakeUAA("admin", "secret")
 	defer server.Close()
 
-	client := NewClient(server.URL, "admin", "secret", false)
+	client := NewClient(server.URL, "admin", "secret", "", false)
 
 	// Delete non-existent client — should succeed (idempotent)
 	if err := client.DeleteClient("openclaw-nonexistent"); err != nil {
@@ -206,10 +366,10 @@ func TestClientIDForInstance(t *testing.T) {
 }
 
 func TestCreateDeleteLifecycle(t *testing.T) {
-	server, existing := newFakeUAA("admin", "secret")
+	server, existing, _ := newFakeUAA("admin", "secret")
 	defer server.Close()
 
-	client := NewClient(server.URL, "admin", "secret", false)
+	client := NewClient(server.URL, "admin", "secret", "", false)
 
 	instanceID := "lifecycle-test"
 	clientID := ClientIDForInstance(instanceID)
@@ -238,3 +398,132 @@ func TestCreateDeleteLifecycle(t *testing.T) {
 		t.Error("Client should not exist after delete")
 	}
 }
+
+func TestUpdateClient_RotatesRedirectURI(t *testing.T) {
+	server, _, redirects := newFakeUAA("admin", "secret")
+	defer server.Close()
+
+	client := NewClient(server.URL, "admin", "secret", "", false)
+	oauthClient := OAuthClient{
+		ClientID:             "openclaw-rotate",
+		ClientSecret:         "rotate-secret",
+		AuthorizedGrantTypes: []string{"authorization_code"},
+		RedirectURI:          []string{"https://oc-user-rotate.apps.old.example.com/oauth2/callback"},
+		Scope:                []string{"openid"},
+	}
+	if err := client.CreateClient(oauthClient); err != nil {
+		t.Fatalf("CreateClient failed: %v", err)
+	}
+
+	oauthClient.RedirectURI = []string{"https://oc-user-rotate.apps.new.example.com/oauth2/callback"}
+	for i := 0; i < 2; i++ { // repeated updates are harmless
+		if err := client.UpdateClient(oauthClient); err != nil {
+			t.Fatalf("UpdateClient #%d failed: %v", i+1, err)
+		}
+	}
+	if got := redirects["openclaw-rotate"]; len(got) != 1 || got[0] != oauthClient.RedirectURI[0] {
+		t.Errorf("redirect_uri = %v, want %v", got, oauthClient.RedirectURI)
+	}
+}
+
+func TestUpdateClient_NotFound(t *testing.T) {
+	server, _, _ := newFakeUAA("admin", "secret")
+	defer server.Close()
+
+	client := NewClient(server.URL, "admin", "secret", "", false)
+	err := client.UpdateClient(OAuthClient{ClientID: "openclaw-missing"})
+	if err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Errorf("UpdateClient for missing client = %v, want status 404 error", err)
+	}
+}
+
+func TestGetAdminToken_CachesToken(t *testing.T) {
+	plain, _, _ := newFakeUAA("admin", "secret")
+	defer plain.Close()
+	tokenRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth/token" {
+			tokenRequests++
+		}
+		plain.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "admin", "secret", "", false)
+	client.DeleteClient("openclaw-a")
+	client.DeleteClient("openclaw-b")
+	if tokenRequests != 1 {
+		t.Errorf("token requests = %d, want 1 (token should be cached)", tokenRequests)
+	}
+}
+
+// newFlakyUAA wraps the fake UAA so the first failures client requests answer
+// 503. With landed, each failing request still reaches UAA first, as when a
+// proxy times out on a create UAA completed.
+func newFlakyUAA(t *testing.T, failures int, landed bool) (*Client, map[string]bool, *atomic.Int32) {
+	t.Helper()
+	plain, existing, _ := newFakeUAA("admin", "secret")
+	t.Cleanup(plain.Close)
+	var clientRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/oauth/clients") {
+			plain.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		if int(clientRequests.Add(1)) > failures {
+			plain.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		if landed {
+			plain.Config.Handler.ServeHTTP(httptest.NewRecorder(), r)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, "admin", "secret", "", false)
+	client.retryDelay = time.Millisecond
+	return client, existing, &clientRequests
+}
+
+func TestCreateClient_RetriesServerErrors(t *testing.T) {
+	client, existing, requests := newFlakyUAA(t, 2, false)
+	if err := client.CreateClient(OAuthClient{ClientID: "openclaw-flaky"}); err != nil {
+		t.Fatalf("CreateClient should succeed on the third attempt, got: %v", err)
+	}
+	if !existing["openclaw-flaky"] || requests.Load() != 3 {
+		t.Errorf("registered = %v after %d requests, want registered after 3", existing["openclaw-flaky"], requests.Load())
+	}
+}
+
+func TestCreateClient_RetryAfterLandedCreate(t *testing.T) {
+	// The first create lands but reports 503; the retry's 409 is success
+	client, existing, requests := newFlakyUAA(t, 1, true)
+	if err := client.CreateClient(OAuthClient{ClientID: "openclaw-landed"}); err != nil {
+		t.Fatalf("CreateClient should treat the retry's 409 as success, got: %v", err)
+	}
+	if !existing["openclaw-landed"] || requests.Load() != 2 {
+		t.Errorf("registered = %v after %d requests, want registered after 2", existing["openclaw-landed"], requests.Load())
+	}
+}
+
+func TestDeleteClient_RetriesServerErrors(t *testing.T) {
+	client, existing, requests := newFlakyUAA(t, 2, false)
+	existing["openclaw-flaky"] = true
+	if err := client.DeleteClient("openclaw-flaky"); err != nil {
+		t.Fatalf("DeleteClient should succeed on the third attempt, got: %v", err)
+	}
+	if existing["openclaw-flaky"] || requests.Load() != 3 {
+		t.Errorf("registered = %v after %d requests, want deleted after 3", existing["openclaw-flaky"], requests.Load())
+	}
+}
+
+func TestCreateClient_GivesUpAfterMaxAttempts(t *testing.T) {
+	client, existing, requests := newFlakyUAA(t, maxClientAttempts, false)
+	err := client.CreateClient(OAuthClient{ClientID: "openclaw-down"})
+	if err == nil || !strings.Contains(err.Error(), "status 503") {
+		t.Fatalf("CreateClient error = %v, want the last 503", err)
+	}
+	if existing["openclaw-down"] || requests.Load() != maxClientAttempts {
+		t.Errorf("%d requests, want %d", requests.Load(), maxClientAttempts)
+	}
+}